@@ -0,0 +1,144 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikanmekan/koalemos/cmd/ingestor/params"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+	"go.uber.org/zap"
+)
+
+// Store is the store administered through the API.
+type Store interface {
+	DeleteSeries(mint, maxt int64, matchers ...*metrics.Matcher) error
+	CleanTombstones() error
+	Snapshot(dir string, withHead bool) error
+}
+
+// New returns an Admin for s, creating snapshots under snapshotDir.
+func New(l log.Logger, s Store, snapshotDir string) *Admin {
+	return &Admin{
+		logger:      l,
+		store:       s,
+		snapshotDir: snapshotDir,
+	}
+}
+
+// Admin serves the administrative API of the store, which deletes and backs
+// up data.
+type Admin struct {
+	logger      log.Logger
+	store       Store
+	snapshotDir string
+}
+
+func (a *Admin) Register(r *mux.Router) {
+	r.HandleFunc("/api/v1/admin/tsdb/delete_series", a.HandleDeleteSeries).Methods("POST", "PUT")
+	r.HandleFunc("/api/v1/admin/tsdb/clean_tombstones", a.HandleCleanTombstones).Methods("POST", "PUT")
+	r.HandleFunc("/api/v1/admin/tsdb/snapshot", a.HandleSnapshot).Methods("POST", "PUT")
+}
+
+// HandleDeleteSeries deletes the series selected by every match[] parameter,
+// series selectors as queries write them, e.g. match[]=up{job="api"}, within
+// the optional start and end times. Times are given as Unix seconds or RFC
+// 3339. Queries no longer return the deleted samples once the response is sent.
+func (a *Admin) HandleDeleteSeries(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		a.writeError(w, http.StatusBadRequest, fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	mint, err := params.ParseTime(r.FormValue("start"), math.MinInt64)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid start: %w", err))
+		return
+	}
+	maxt, err := params.ParseTime(r.FormValue("end"), math.MaxInt64)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid end: %w", err))
+		return
+	}
+
+	var matcherSets [][]*metrics.Matcher
+	for _, s := range selectors {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid match[] %q: %w", s, err))
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	for _, matchers := range matcherSets {
+		if err := a.store.DeleteSeries(mint, maxt, matchers...); err != nil {
+			a.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCleanTombstones rewrites the persisted blocks with deleted data,
+// removing it from disk.
+func (a *Admin) HandleCleanTombstones(w http.ResponseWriter, r *http.Request) {
+	if err := a.store.CleanTombstones(); err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSnapshot creates a snapshot of the store's data under the snapshot
+// directory, including the samples held in memory unless skip_head is true,
+// and responds with its name, e.g.
+//
+//	{"status": "success", "data": {"name": "20240102T150405Z-1a2b3c4d5e6f7a8b"}}
+func (a *Admin) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
+	skipHead := false
+	if v := r.FormValue("skip_head"); v != "" {
+		var err error
+		if skipHead, err = strconv.ParseBool(v); err != nil {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid skip_head: %w", err))
+			return
+		}
+	}
+
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	name := time.Now().UTC().Format("20060102T150405Z0700") + "-" + hex.EncodeToString(rnd)
+	if err := a.store.Snapshot(filepath.Join(a.snapshotDir, name), !skipHead); err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": map[string]string{"name": name}})
+}
+
+func (a *Admin) writeError(w http.ResponseWriter, code int, err error) {
+	if code >= http.StatusInternalServerError {
+		a.logger.Error("admin request failed", zap.Error(err))
+	} else {
+		a.logger.Warn("invalid admin request", zap.Error(err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"status": "error", "error": err.Error()})
+}
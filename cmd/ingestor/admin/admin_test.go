@@ -0,0 +1,272 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/reader"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deletion is a call of fakeStore.DeleteSeries.
+type deletion struct {
+	mint, maxt int64
+	matchers   []*metrics.Matcher
+}
+
+// fakeStore records the deletions and tombstone cleanups asked of it, failing
+// them with err.
+type fakeStore struct {
+	deletions []deletion
+	cleanups  int
+	err       error
+}
+
+func (s *fakeStore) DeleteSeries(mint, maxt int64, matchers ...*metrics.Matcher) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.deletions = append(s.deletions, deletion{mint: mint, maxt: maxt, matchers: matchers})
+	return nil
+}
+
+func (s *fakeStore) CleanTombstones() error {
+	if s.err != nil {
+		return s.err
+	}
+	s.cleanups++
+	return nil
+}
+
+func (s *fakeStore) Snapshot(dir string, withHead bool) error {
+	return s.err
+}
+
+func Test_HandleDeleteSeries(t *testing.T) {
+	type Test struct {
+		desc              string
+		params            url.Values
+		storeErr          error
+		expectedCode      int
+		expectedDeletions []deletion
+	}
+
+	up := metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, "up")
+	apiJob := metrics.MustNewMatcher(metrics.MatchEqual, "job", "api")
+	dbJob := metrics.MustNewMatcher(metrics.MatchRegexp, "job", "db.*")
+
+	tests := []Test{
+		{
+			desc:         "[POSITIVE] every sample of a series",
+			params:       url.Values{"match[]": {`up{job="api"}`}},
+			expectedCode: http.StatusNoContent,
+			expectedDeletions: []deletion{
+				{mint: math.MinInt64, maxt: math.MaxInt64, matchers: []*metrics.Matcher{up, apiJob}},
+			},
+		},
+		{
+			desc: "[POSITIVE] several selectors within a time range",
+			params: url.Values{
+				"match[]": {`up{job="api"}`, `{job=~"db.*"}`},
+				"start":   {"1700000000.5"},
+				"end":     {"2023-11-14T22:23:20Z"},
+			},
+			expectedCode: http.StatusNoContent,
+			expectedDeletions: []deletion{
+				{mint: 1700000000, maxt: 1700000600, matchers: []*metrics.Matcher{up, apiJob}},
+				{mint: 1700000000, maxt: 1700000600, matchers: []*metrics.Matcher{dbJob}},
+			},
+		},
+		{
+			desc:         "[POSITIVE] selector with escapes and a metric name matcher",
+			params:       url.Values{"match[]": {`{__name__="up",path='C:\\temp\'s'}`}},
+			expectedCode: http.StatusNoContent,
+			expectedDeletions: []deletion{
+				{mint: math.MinInt64, maxt: math.MaxInt64, matchers: []*metrics.Matcher{up, metrics.MustNewMatcher(metrics.MatchEqual, "path", `C:\temp's`)}},
+			},
+		},
+		{
+			desc:         "[NEGATIVE] no match[] parameter",
+			params:       url.Values{"start": {"0"}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "[NEGATIVE] selector matching every series",
+			params:       url.Values{"match[]": {`{job=~".*"}`}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "[NEGATIVE] any invalid selector deletes nothing",
+			params:       url.Values{"match[]": {`up{job="api"}`, `up{job=}`}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "[NEGATIVE] expression other than a series selector",
+			params:       url.Values{"match[]": {`rate(up[5m])`}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "[NEGATIVE] invalid start",
+			params:       url.Values{"match[]": {"up"}, "start": {"yesterday"}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "[NEGATIVE] invalid end",
+			params:       url.Values{"match[]": {"up"}, "end": {"tomorrow"}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "[NEGATIVE] store failure",
+			params:       url.Values{"match[]": {"up"}},
+			storeErr:     errors.New("disk full"),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := &fakeStore{err: tc.storeErr}
+			rec := serveAdmin(s, "", http.MethodPost, "/api/v1/admin/tsdb/delete_series", tc.params)
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			assert.Equal(t, tc.expectedDeletions, s.deletions)
+			if tc.expectedCode != http.StatusNoContent {
+				assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+				assert.Contains(t, rec.Body.String(), `"status":"error"`)
+			}
+		})
+	}
+}
+
+func Test_HandleCleanTombstones(t *testing.T) {
+	s := &fakeStore{}
+	rec := serveAdmin(s, "", http.MethodPut, "/api/v1/admin/tsdb/clean_tombstones", nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, 1, s.cleanups)
+
+	s = &fakeStore{err: errors.New("disk full")}
+	rec = serveAdmin(s, "", http.MethodPost, "/api/v1/admin/tsdb/clean_tombstones", nil)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.JSONEq(t, `{"status": "error", "error": "disk full"}`, rec.Body.String())
+
+	// Data is only deleted by POST and PUT requests.
+	rec = serveAdmin(&fakeStore{}, "", http.MethodGet, "/api/v1/admin/tsdb/clean_tombstones", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+// serveAdmin serves a request with a form of params to the admin API of s,
+// which creates snapshots under snapshotDir.
+func serveAdmin(s Store, snapshotDir, method, path string, params url.Values) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	New(log.NewLogger(), s, snapshotDir).Register(router)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func Test_HandleSnapshot(t *testing.T) {
+	dataDir := t.TempDir()
+	persisted, err := block.Write(dataDir, 0, store.DefaultBlockRange, metrics.NewListSeriesSet([]metrics.Series{
+		&metrics.ListSeries{
+			Def:     metrics.MetricDefinition{Name: "up", Type: "gauge"},
+			Labels:  map[string]string{"job": "api"},
+			Samples: []metrics.Sample{{Time: 100, Value: 1}},
+		},
+	}))
+	require.NoError(t, err)
+	ims, err := store.Open(log.NewLogger(), store.Options{DataDir: dataDir, Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+	addSample(t, ims, store.DefaultBlockRange+100, 2)
+
+	snapshotDir := filepath.Join(dataDir, "snapshots")
+	rec := serveAdmin(ims, snapshotDir, http.MethodPost, "/api/v1/admin/tsdb/snapshot", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	snapshot := filepath.Join(snapshotDir, resp.Data.Name)
+	files := readFiles(t, snapshot)
+
+	// Persisted blocks are hard linked into the snapshot, and the samples
+	// held in memory written out as a block of their own.
+	orig, err := os.Stat(filepath.Join(dataDir, persisted.ULID.String(), "index"))
+	require.NoError(t, err)
+	linked, err := os.Stat(filepath.Join(snapshot, persisted.ULID.String(), "index"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(orig, linked))
+	metas, err := block.List(snapshot)
+	require.NoError(t, err)
+	assert.Len(t, metas, 2)
+
+	// Neither writing nor persisting more data changes the snapshot.
+	addSample(t, ims, store.DefaultBlockRange+200, 3)
+	addSample(t, ims, 3*store.DefaultBlockRange, 4)
+	require.NoError(t, ims.PersistActiveBlock())
+	require.Len(t, ims.Blocks(), 2)
+	assert.Equal(t, files, readFiles(t, snapshot))
+
+	// Snapshots without the samples held in memory only hold the persisted
+	// blocks.
+	rec = serveAdmin(ims, snapshotDir, http.MethodPost, "/api/v1/admin/tsdb/snapshot", url.Values{"skip_head": {"true"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	metas, err = block.List(filepath.Join(snapshotDir, resp.Data.Name))
+	require.NoError(t, err)
+	assert.Len(t, metas, 2)
+
+	rec = serveAdmin(ims, snapshotDir, http.MethodPost, "/api/v1/admin/tsdb/snapshot", url.Values{"skip_head": {"maybe"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serveAdmin(&fakeStore{err: errors.New("disk full")}, snapshotDir, http.MethodPost, "/api/v1/admin/tsdb/snapshot", nil)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.JSONEq(t, `{"status": "error", "error": "disk full"}`, rec.Body.String())
+}
+
+// addSample adds a sample of the series up{job="api"} to ims.
+func addSample(t *testing.T, ims *store.IMSImpl, ts int64, v float64) {
+	t.Helper()
+	mfs, err := reader.NewPrometheusTextReader().Read(strings.NewReader(fmt.Sprintf("up{job=\"api\"} %g %d\n", v, ts*1000)))
+	require.NoError(t, err)
+	require.NoError(t, ims.AddMetricFamiliesTimeGroup(mfs))
+}
+
+// readFiles returns the contents of every file under dir, by path.
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		files[path] = string(b)
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
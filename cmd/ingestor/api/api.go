@@ -0,0 +1,425 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikanmekan/koalemos/cmd/ingestor/params"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+	"go.uber.org/zap"
+)
+
+// defaultQueryTimeout is how long a query may run unless the request gives a
+// shorter timeout.
+const defaultQueryTimeout = 2 * time.Minute
+
+// maxPoints is the most samples a range query may return per series.
+const maxPoints = 11000
+
+// The error types of error responses, and the status codes they are sent
+// with.
+const (
+	errorBadData   = "bad_data"
+	errorExec      = "execution"
+	errorTimeout   = "timeout"
+	errorCanceled  = "canceled"
+	errorInternal  = "internal"
+	statusCanceled = 499
+)
+
+// New returns an API evaluating queries with engine over the series of q.
+func New(l log.Logger, q promql.Queryable, engine *promql.Engine) *API {
+	return &API{
+		logger:    l,
+		queryable: q,
+		engine:    engine,
+	}
+}
+
+// API serves the Prometheus HTTP query API, so that clients of Prometheus,
+// such as Grafana's Prometheus datasource, can query the store. Requests and
+// responses are as Prometheus documents them, see
+// https://prometheus.io/docs/prometheus/latest/querying/api/.
+type API struct {
+	logger    log.Logger
+	queryable promql.Queryable
+	engine    *promql.Engine
+}
+
+func (a *API) Register(r *mux.Router) {
+	r.HandleFunc("/api/v1/query", a.HandleQuery).Methods("GET", "POST")
+	r.HandleFunc("/api/v1/query_range", a.HandleQueryRange).Methods("GET", "POST")
+	r.HandleFunc("/api/v1/series", a.HandleSeries).Methods("GET", "POST")
+	r.HandleFunc("/api/v1/labels", a.HandleLabels).Methods("GET", "POST")
+	r.HandleFunc("/api/v1/label/{name}/values", a.HandleLabelValues).Methods("GET")
+}
+
+// HandleQuery evaluates the query parameter at the time parameter, or now,
+// e.g.
+//
+//	{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {"job": "api"}, "value": [1700000000, "1"]}]}}
+func (a *API) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	ts, err := params.ParseTime(r.FormValue("time"), time.Now().Unix())
+	if err != nil {
+		a.writeError(w, errorBadData, fmt.Errorf("invalid parameter \"time\": %w", err))
+		return
+	}
+	ctx, cancel, err := queryContext(r)
+	if err != nil {
+		a.writeError(w, errorBadData, err)
+		return
+	}
+	defer cancel()
+
+	v, err := a.engine.InstantQuery(ctx, a.queryable, r.FormValue("query"), ts)
+	if err != nil {
+		a.writeError(w, queryErrorType(err), err)
+		return
+	}
+	a.writeData(w, queryData{ResultType: string(v.Type()), Result: encodeValue(v)})
+}
+
+// HandleQueryRange evaluates the query parameter at every step from the start
+// to the end parameter. Downsampled data suited to the step is read unless the
+// optional raw parameter is true, e.g.
+//
+//	{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"job": "api"}, "values": [[1700000000, "1"], [1700000015, "2"]]}]}}
+func (a *API) HandleQueryRange(w http.ResponseWriter, r *http.Request) {
+	start, err := params.ParseTime(r.FormValue("start"), 0)
+	if err != nil || r.FormValue("start") == "" {
+		a.writeError(w, errorBadData, fmt.Errorf("invalid parameter \"start\": %w", requiredErr(err)))
+		return
+	}
+	end, err := params.ParseTime(r.FormValue("end"), 0)
+	if err != nil || r.FormValue("end") == "" {
+		a.writeError(w, errorBadData, fmt.Errorf("invalid parameter \"end\": %w", requiredErr(err)))
+		return
+	}
+	if end < start {
+		a.writeError(w, errorBadData, fmt.Errorf("end timestamp must not be before start time"))
+		return
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		a.writeError(w, errorBadData, fmt.Errorf("invalid parameter \"step\": %w", err))
+		return
+	}
+	if step <= 0 {
+		a.writeError(w, errorBadData, fmt.Errorf("zero or negative query resolution step widths are not accepted. Try a positive integer"))
+		return
+	}
+	if (end-start)/step > maxPoints {
+		a.writeError(w, errorBadData, fmt.Errorf("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)"))
+		return
+	}
+	var opts promql.QueryOptions
+	if v := r.FormValue("raw"); v != "" {
+		if opts.Raw, err = strconv.ParseBool(v); err != nil {
+			a.writeError(w, errorBadData, fmt.Errorf("invalid parameter \"raw\": cannot parse %q to a boolean", v))
+			return
+		}
+	}
+	ctx, cancel, err := queryContext(r)
+	if err != nil {
+		a.writeError(w, errorBadData, err)
+		return
+	}
+	defer cancel()
+
+	m, err := a.engine.RangeQuery(ctx, a.queryable, r.FormValue("query"), start, end, step, opts)
+	if err != nil {
+		a.writeError(w, queryErrorType(err), err)
+		return
+	}
+	a.writeData(w, queryData{ResultType: string(m.Type()), Result: encodeValue(m)})
+}
+
+// HandleSeries lists the labels of the series selected by every match[]
+// parameter with samples between the optional start and end times, e.g.
+//
+//	{"status": "success", "data": [{"__name__": "up", "job": "api"}]}
+func (a *API) HandleSeries(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		a.writeError(w, errorBadData, err)
+		return
+	}
+	if len(r.Form["match[]"]) == 0 {
+		a.writeError(w, errorBadData, fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	series, ok := a.selectSeries(w, r)
+	if !ok {
+		return
+	}
+	data := make([]map[string]string, 0, len(series))
+	for _, ls := range series {
+		data = append(data, ls.Map())
+	}
+	a.writeData(w, data)
+}
+
+// HandleLabels lists the label names of every series, or of those selected
+// by the optional match[] parameters, e.g.
+//
+//	{"status": "success", "data": ["__name__", "job"]}
+func (a *API) HandleLabels(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		a.writeError(w, errorBadData, err)
+		return
+	}
+	if len(r.Form["match[]"]) == 0 {
+		a.writeStrings(w, func(q metrics.Querier) ([]string, error) { return q.LabelNames() })
+		return
+	}
+	series, ok := a.selectSeries(w, r)
+	if !ok {
+		return
+	}
+	a.writeData(w, distinct(series, func(ls promql.Labels) []string {
+		names := make([]string, 0, len(ls))
+		for _, l := range ls {
+			names = append(names, l.Name)
+		}
+		return names
+	}))
+}
+
+// HandleLabelValues lists the values of the named label over every series,
+// or over those selected by the optional match[] parameters, e.g.
+//
+//	{"status": "success", "data": ["api", "db"]}
+func (a *API) HandleLabelValues(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !isLabelName(name) {
+		a.writeError(w, errorBadData, fmt.Errorf("invalid label name: %q", name))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		a.writeError(w, errorBadData, err)
+		return
+	}
+	if len(r.Form["match[]"]) == 0 {
+		a.writeStrings(w, func(q metrics.Querier) ([]string, error) { return q.LabelValues(name) })
+		return
+	}
+	series, ok := a.selectSeries(w, r)
+	if !ok {
+		return
+	}
+	a.writeData(w, distinct(series, func(ls promql.Labels) []string {
+		if v := ls.Get(name); v != "" {
+			return []string{v}
+		}
+		return nil
+	}))
+}
+
+// selectSeries returns the labels of the series selected by the match[]
+// parameters of r with samples between its start and end parameters, sorted.
+// It writes an error response and returns false if they can't be selected.
+func (a *API) selectSeries(w http.ResponseWriter, r *http.Request) ([]promql.Labels, bool) {
+	start, err := params.ParseTime(r.FormValue("start"), math.MinInt64)
+	if err != nil {
+		a.writeError(w, errorBadData, fmt.Errorf("invalid parameter \"start\": %w", err))
+		return nil, false
+	}
+	end, err := params.ParseTime(r.FormValue("end"), math.MaxInt64)
+	if err != nil {
+		a.writeError(w, errorBadData, fmt.Errorf("invalid parameter \"end\": %w", err))
+		return nil, false
+	}
+	var matcherSets [][]*metrics.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			a.writeError(w, errorBadData, err)
+			return nil, false
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	q, err := a.queryable.Querier()
+	if err != nil {
+		a.writeError(w, errorInternal, err)
+		return nil, false
+	}
+	defer q.Close()
+
+	seen := map[string]bool{}
+	var res []promql.Labels
+	for _, matchers := range matcherSets {
+		set := q.Select(start, end, matchers...)
+		for set.Next() {
+			s := set.At()
+			// Series may be selected without a sample in the range.
+			if !s.Iterator().Next() {
+				continue
+			}
+			ls := promql.LabelsFromMap(metrics.LabelsWithName(s))
+			if key := ls.String(); !seen[key] {
+				seen[key] = true
+				res = append(res, ls)
+			}
+		}
+		if err := set.Err(); err != nil {
+			a.writeError(w, errorInternal, err)
+			return nil, false
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Compare(res[j]) < 0 })
+	return res, true
+}
+
+// writeStrings responds with the strings f lists from a querier.
+func (a *API) writeStrings(w http.ResponseWriter, f func(metrics.Querier) ([]string, error)) {
+	q, err := a.queryable.Querier()
+	if err != nil {
+		a.writeError(w, errorInternal, err)
+		return
+	}
+	defer q.Close()
+
+	strs, err := f(q)
+	if err != nil {
+		a.writeError(w, errorInternal, err)
+		return
+	}
+	if strs == nil {
+		strs = []string{}
+	}
+	a.writeData(w, strs)
+}
+
+// distinct returns the sorted, distinct strings f lists from each of series.
+func distinct(series []promql.Labels, f func(promql.Labels) []string) []string {
+	set := map[string]struct{}{}
+	for _, ls := range series {
+		for _, s := range f(ls) {
+			set[s] = struct{}{}
+		}
+	}
+	res := make([]string, 0, len(set))
+	for s := range set {
+		res = append(res, s)
+	}
+	sort.Strings(res)
+	return res
+}
+
+type response struct {
+	Status    string `json:"status"`
+	Data      any    `json:"data,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (a *API) writeData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response{Status: "success", Data: data}); err != nil {
+		a.logger.Warn("failed to write query response", zap.Error(err))
+	}
+}
+
+func (a *API) writeError(w http.ResponseWriter, errorType string, err error) {
+	code := http.StatusBadRequest
+	switch errorType {
+	case errorExec:
+		code = http.StatusUnprocessableEntity
+	case errorTimeout:
+		code = http.StatusServiceUnavailable
+	case errorCanceled:
+		code = statusCanceled
+	case errorInternal:
+		code = http.StatusInternalServerError
+	}
+	if code >= http.StatusInternalServerError {
+		a.logger.Error("query request failed", zap.Error(err))
+	} else {
+		a.logger.Warn("invalid query request", zap.Error(err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// queryErrorType returns the error type of an error evaluating a query.
+func queryErrorType(err error) string {
+	var pe *parser.ParseError
+	switch {
+	case errors.As(err, &pe), errors.Is(err, promql.ErrInvalidQueryRange),
+		errors.Is(err, promql.ErrInvalidExpression), errors.Is(err, promql.ErrUnsupported):
+		return errorBadData
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorTimeout
+	case errors.Is(err, context.Canceled):
+		return errorCanceled
+	case errors.Is(err, promql.ErrDuplicateSeries), errors.Is(err, promql.ErrMatchConflict):
+		return errorExec
+	}
+	return errorInternal
+}
+
+// queryContext returns the context of a query of r, cancelled once its
+// optional timeout parameter, or the default timeout, has passed.
+func queryContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := defaultQueryTimeout
+	if v := r.FormValue("timeout"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid parameter \"timeout\": %w", err)
+		}
+		if t := time.Duration(d) * time.Second; t < timeout {
+			timeout = t
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+func requiredErr(err error) error {
+	if err == nil {
+		return fmt.Errorf("missing value")
+	}
+	return err
+}
+
+// parseDuration parses a duration in seconds given as a number of seconds,
+// possibly fractional, or as queries write durations, e.g. 1m30s. Fractions
+// of a second are truncated.
+func parseDuration(s string) (int64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+		}
+		return int64(f), nil
+	}
+	d, err := parser.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+	}
+	return int64(d / time.Second), nil
+}
+
+// isLabelName reports whether s is a valid label name.
+func isLabelName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics/reader"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// series are the samples served by the API under test, timestamped in
+// milliseconds.
+const series = `
+up{job="api"} 1 100000
+up{job="api"} 2 115000
+up{job="api"} 3 130000
+up{job="db"} 0 100000
+`
+
+func Test_API(t *testing.T) {
+	type Test struct {
+		desc         string
+		path         string
+		params       url.Values
+		expectedCode int
+		expectedBody string
+	}
+
+	tests := []Test{
+		{
+			desc:         "[POSITIVE] instant query of a vector",
+			path:         "/api/v1/query",
+			params:       url.Values{"query": {`up{job="api"}`}, "time": {"130"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {"__name__": "up", "job": "api"}, "value": [130, "3"]}]}}`,
+		},
+		{
+			desc:         "[POSITIVE] instant query of a scalar at an RFC 3339 time",
+			path:         "/api/v1/query",
+			params:       url.Values{"query": {"1 / 0"}, "time": {"1970-01-01T00:01:40Z"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": {"resultType": "scalar", "result": [100, "+Inf"]}}`,
+		},
+		{
+			desc:         "[POSITIVE] instant query of an empty vector",
+			path:         "/api/v1/query",
+			params:       url.Values{"query": {"missing"}, "time": {"130"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": {"resultType": "vector", "result": []}}`,
+		},
+		{
+			desc:         "[NEGATIVE] instant query which does not parse",
+			path:         "/api/v1/query",
+			params:       url.Values{"query": {"up{"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data"}`,
+		},
+		{
+			desc:         "[NEGATIVE] instant query at an invalid time",
+			path:         "/api/v1/query",
+			params:       url.Values{"query": {"up"}, "time": {"yesterday"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "invalid parameter \"time\": cannot parse \"yesterday\" to a valid timestamp"}`,
+		},
+		{
+			desc:         "[NEGATIVE] instant query matching many series to many",
+			path:         "/api/v1/query",
+			params:       url.Values{"query": {"up + on() up"}, "time": {"130"}},
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: `{"status": "error", "errorType": "execution"}`,
+		},
+		{
+			desc:         "[POSITIVE] range query",
+			path:         "/api/v1/query_range",
+			params:       url.Values{"query": {`up{job="api"}`}, "start": {"100"}, "end": {"130"}, "step": {"15s"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"__name__": "up", "job": "api"}, "values": [[100, "1"], [115, "2"], [130, "3"]]}]}}`,
+		},
+		{
+			desc:         "[POSITIVE] range query of raw samples",
+			path:         "/api/v1/query_range",
+			params:       url.Values{"query": {`up{job="api"}`}, "start": {"100"}, "end": {"130"}, "step": {"15s"}, "raw": {"true"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"__name__": "up", "job": "api"}, "values": [[100, "1"], [115, "2"], [130, "3"]]}]}}`,
+		},
+		{
+			desc:         "[NEGATIVE] range query with an invalid raw parameter",
+			path:         "/api/v1/query_range",
+			params:       url.Values{"query": {"up"}, "start": {"100"}, "end": {"130"}, "step": {"15"}, "raw": {"always"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "invalid parameter \"raw\": cannot parse \"always\" to a boolean"}`,
+		},
+		{
+			desc:         "[NEGATIVE] range query without a start",
+			path:         "/api/v1/query_range",
+			params:       url.Values{"query": {"up"}, "end": {"130"}, "step": {"15"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "invalid parameter \"start\": missing value"}`,
+		},
+		{
+			desc:         "[NEGATIVE] range query with a zero step",
+			path:         "/api/v1/query_range",
+			params:       url.Values{"query": {"up"}, "start": {"100"}, "end": {"130"}, "step": {"0"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "zero or negative query resolution step widths are not accepted. Try a positive integer"}`,
+		},
+		{
+			desc:         "[NEGATIVE] range query ending before its start",
+			path:         "/api/v1/query_range",
+			params:       url.Values{"query": {"up"}, "start": {"130"}, "end": {"100"}, "step": {"15"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "end timestamp must not be before start time"}`,
+		},
+		{
+			desc:         "[POSITIVE] series",
+			path:         "/api/v1/series",
+			params:       url.Values{"match[]": {"up"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": [{"__name__": "up", "job": "api"}, {"__name__": "up", "job": "db"}]}`,
+		},
+		{
+			desc:         "[POSITIVE] series with samples in a time range",
+			path:         "/api/v1/series",
+			params:       url.Values{"match[]": {"up"}, "start": {"110"}, "end": {"200"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": [{"__name__": "up", "job": "api"}]}`,
+		},
+		{
+			desc:         "[NEGATIVE] series without a match[] parameter",
+			path:         "/api/v1/series",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "no match[] parameter provided"}`,
+		},
+		{
+			desc:         "[NEGATIVE] series of an invalid selector",
+			path:         "/api/v1/series",
+			params:       url.Values{"match[]": {"up{job"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data"}`,
+		},
+		{
+			desc:         "[POSITIVE] labels",
+			path:         "/api/v1/labels",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": ["__name__", "job"]}`,
+		},
+		{
+			desc:         "[POSITIVE] labels of selected series",
+			path:         "/api/v1/labels",
+			params:       url.Values{"match[]": {"missing"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": []}`,
+		},
+		{
+			desc:         "[NEGATIVE] labels at an invalid time",
+			path:         "/api/v1/labels",
+			params:       url.Values{"match[]": {"up"}, "start": {"yesterday"}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "invalid parameter \"start\": cannot parse \"yesterday\" to a valid timestamp"}`,
+		},
+		{
+			desc:         "[POSITIVE] label values",
+			path:         "/api/v1/label/job/values",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": ["api", "db"]}`,
+		},
+		{
+			desc:         "[POSITIVE] label values of selected series",
+			path:         "/api/v1/label/job/values",
+			params:       url.Values{"match[]": {`up{job="db"}`}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": ["db"]}`,
+		},
+		{
+			desc:         "[POSITIVE] values of a label no series has",
+			path:         "/api/v1/label/env/values",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status": "success", "data": []}`,
+		},
+		{
+			desc:         "[NEGATIVE] values of an invalid label name",
+			path:         "/api/v1/label/0job/values",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status": "error", "errorType": "bad_data", "error": "invalid label name: \"0job\""}`,
+		},
+	}
+
+	router := newTestRouter(t)
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path+"?"+tc.params.Encode(), nil))
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			body := rec.Body.String()
+			if tc.expectedCode != http.StatusOK && !strings.Contains(tc.expectedBody, `"error":`) {
+				// Parse errors are checked by their type alone.
+				resp := map[string]any{}
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+				assert.NotEmpty(t, resp["error"])
+				delete(resp, "error")
+				b, err := json.Marshal(resp)
+				require.NoError(t, err)
+				body = string(b)
+			}
+			assert.JSONEq(t, tc.expectedBody, body)
+		})
+	}
+}
+
+func Test_APIPost(t *testing.T) {
+	router := newTestRouter(t)
+
+	params := url.Values{"query": {`up{job="db"}`}, "time": {"100"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {"__name__": "up", "job": "db"}, "value": [100, "0"]}]}}`, rec.Body.String())
+}
+
+// newTestRouter returns a router serving the API over a store holding series.
+func newTestRouter(t *testing.T) *mux.Router {
+	t.Helper()
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	t.Cleanup(func() { ims.Close() })
+
+	mfs, err := reader.NewPrometheusTextReader().Read(strings.NewReader(series))
+	require.NoError(t, err)
+	require.NoError(t, ims.AddMetricFamiliesTimeGroup(mfs))
+
+	router := mux.NewRouter()
+	New(log.NewLogger(), ims, promql.NewEngine(promql.Options{})).Register(router)
+	return router
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql"
+)
+
+// queryData is the data of a query response.
+type queryData struct {
+	ResultType string `json:"resultType"`
+	Result     any    `json:"result"`
+}
+
+// point is a sample as the API encodes it, a time and a value formatted as a
+// string, e.g. [1700000000, "1.5"], so that NaN and infinities survive JSON.
+type point struct {
+	t int64
+	v string
+}
+
+func (p point) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{p.t, p.v})
+}
+
+// histogramPoint is a native histogram sample as the API encodes it, a time
+// and the histogram's count, sum and non-empty buckets, e.g.
+//
+//	[1700000000, {"count": "3", "sum": "2.5", "buckets": [[0, "0.5", "1", "3"]]}]
+//
+// Each bucket is its boundary rule, lower and upper bounds and count. The
+// boundary rule is 0 for buckets excluding their lower bound, 1 for those
+// excluding their upper bound and 3 for those including both.
+type histogramPoint struct {
+	t int64
+	h *metrics.Histogram
+}
+
+func (p histogramPoint) MarshalJSON() ([]byte, error) {
+	buckets := [][]any{}
+	for _, b := range p.h.Buckets() {
+		if b.Count == 0 {
+			continue
+		}
+		rule := 0
+		switch {
+		case b.LowerInclusive && b.UpperInclusive:
+			rule = 3
+		case b.LowerInclusive:
+			rule = 1
+		}
+		buckets = append(buckets, []any{rule, formatFloat(b.Lower), formatFloat(b.Upper), formatFloat(b.Count)})
+	}
+	return json.Marshal([]any{p.t, map[string]any{
+		"count":   formatFloat(p.h.Count),
+		"sum":     formatFloat(p.h.Sum),
+		"buckets": buckets,
+	}})
+}
+
+// vectorSample holds either a value or, for native histograms, a histogram.
+type vectorSample struct {
+	Metric    map[string]string `json:"metric"`
+	Value     *point            `json:"value,omitempty"`
+	Histogram *histogramPoint   `json:"histogram,omitempty"`
+}
+
+type matrixSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []point           `json:"values"`
+	Histograms []histogramPoint  `json:"histograms,omitempty"`
+}
+
+// encodeValue returns the result of a query as the API encodes it.
+func encodeValue(v promql.Value) any {
+	switch v := v.(type) {
+	case promql.Scalar:
+		return point{t: v.T, v: formatFloat(v.V)}
+	case promql.String:
+		return point{t: v.T, v: v.V}
+	case promql.Vector:
+		res := make([]vectorSample, 0, len(v))
+		for _, s := range v {
+			vs := vectorSample{Metric: s.Metric.Map()}
+			if s.H != nil {
+				vs.Histogram = &histogramPoint{t: s.T, h: s.H}
+			} else {
+				vs.Value = &point{t: s.T, v: formatFloat(s.F)}
+			}
+			res = append(res, vs)
+		}
+		return res
+	case promql.Matrix:
+		res := make([]matrixSeries, 0, len(v))
+		for _, s := range v {
+			ms := matrixSeries{Metric: s.Metric.Map(), Values: []point{}}
+			for _, p := range s.Points {
+				if p.H != nil {
+					ms.Histograms = append(ms.Histograms, histogramPoint{t: p.T, h: p.H})
+				} else {
+					ms.Values = append(ms.Values, point{t: p.T, v: formatFloat(p.F)})
+				}
+			}
+			res = append(res, ms)
+		}
+		return res
+	}
+	return nil
+}
+
+// formatFloat formats a sample value as Prometheus does, e.g. 1.5, +Inf or
+// NaN.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
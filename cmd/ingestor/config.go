@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/metrics/wal"
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"github.com/mikanmekan/koalemos/internal/rules"
+	"github.com/mikanmekan/koalemos/internal/scrape"
+)
+
+const defaultDataDir = "data"
+
+// storeOptions reads the store's configuration from the environment, see
+// example.env.
+func storeOptions() (store.Options, error) {
+	opts := store.Options{
+		DataDir: os.Getenv("KOALEMOS_DATA_DIR"),
+	}
+	if opts.DataDir == "" {
+		opts.DataDir = defaultDataDir
+	}
+
+	if v := os.Getenv("KOALEMOS_WAL_SYNC"); v != "" {
+		policy, err := wal.ParseSyncPolicy(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_WAL_SYNC: %w", err)
+		}
+		opts.WAL.SyncPolicy = policy
+	}
+	if v := os.Getenv("KOALEMOS_WAL_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_WAL_SYNC_INTERVAL: %w", err)
+		}
+		opts.WAL.SyncInterval = d
+	}
+
+	if v := os.Getenv("KOALEMOS_OUT_OF_ORDER_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_OUT_OF_ORDER_WINDOW: %w", err)
+		}
+		opts.OutOfOrderWindow = int64(d / time.Second)
+	}
+
+	if v := os.Getenv("KOALEMOS_CONFLICT_POLICY"); v != "" {
+		policy, err := store.ParseConflictPolicy(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_CONFLICT_POLICY: %w", err)
+		}
+		opts.ConflictPolicy = policy
+	}
+
+	if v := os.Getenv("KOALEMOS_DOWNSAMPLING"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_DOWNSAMPLING: %w", err)
+		}
+		opts.DisableDownsampling = !enabled
+	}
+
+	if v := os.Getenv("KOALEMOS_RETENTION_TIME"); v != "" {
+		d, err := parseRetentionDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_RETENTION_TIME: %w", err)
+		}
+		opts.RetentionDuration = int64(d / time.Second)
+	}
+	if v := os.Getenv("KOALEMOS_RETENTION_SIZE"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_RETENTION_SIZE: %w", err)
+		}
+		opts.RetentionBytes = n
+	}
+	if v := os.Getenv("KOALEMOS_RETENTION_RULES_FILE"); v != "" {
+		rules, err := readRetentionRules(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_RETENTION_RULES_FILE: %w", err)
+		}
+		opts.RetentionRules = rules
+	}
+
+	return opts, nil
+}
+
+// queryOptions reads the query engine's configuration from the environment,
+// see example.env.
+func queryOptions() (promql.Options, error) {
+	var opts promql.Options
+	if v := os.Getenv("KOALEMOS_QUERY_LOOKBACK_DELTA"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("KOALEMOS_QUERY_LOOKBACK_DELTA: %w", err)
+		}
+		opts.LookbackDelta = int64(d / time.Second)
+	}
+	return opts, nil
+}
+
+// ruleGroups reads the rule groups of the rules file configured in the
+// environment, or none if no file is configured.
+func ruleGroups() ([]*rules.Group, error) {
+	path := os.Getenv("KOALEMOS_RULES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	groups, err := rules.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("KOALEMOS_RULES_FILE: %w", err)
+	}
+	return groups, nil
+}
+
+// scrapeConfigs reads the scrape jobs of the scrape config file configured
+// in the environment, or none if no file is configured.
+func scrapeConfigs() ([]*scrape.Config, error) {
+	path := os.Getenv("KOALEMOS_SCRAPE_CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	configs, err := scrape.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("KOALEMOS_SCRAPE_CONFIG_FILE: %w", err)
+	}
+	return configs, nil
+}
+
+// alertNotifier returns the notifier alerts are sent to the Alertmanager
+// with, configured from the environment, or nil if none is configured.
+func alertNotifier() (*rules.Notifier, error) {
+	u := os.Getenv("KOALEMOS_ALERTMANAGER_URL")
+	if u == "" {
+		return nil, nil
+	}
+	return rules.NewNotifier(u, nil)
+}
+
+// objectBucket returns the object storage bucket persisted blocks are shipped to,
+// configured from the environment, or nil if none is configured.
+func objectBucket() (objstore.Bucket, error) {
+	switch typ := os.Getenv("KOALEMOS_OBJSTORE_TYPE"); typ {
+	case "":
+		return nil, nil
+	case "filesystem":
+		dir := os.Getenv("KOALEMOS_OBJSTORE_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("KOALEMOS_OBJSTORE_DIR: no directory given")
+		}
+		return objstore.NewFilesystem(dir)
+	case "s3":
+		b, err := objstore.NewS3(objstore.S3Config{
+			Endpoint:        os.Getenv("KOALEMOS_S3_ENDPOINT"),
+			Bucket:          os.Getenv("KOALEMOS_S3_BUCKET"),
+			Region:          os.Getenv("KOALEMOS_S3_REGION"),
+			AccessKeyID:     os.Getenv("KOALEMOS_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("KOALEMOS_S3_SECRET_ACCESS_KEY"),
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("KOALEMOS_S3_*: %w", err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("KOALEMOS_OBJSTORE_TYPE: unknown type %q", typ)
+	}
+}
+
+// retentionRuleConfig is a retention rule as written in the retention rules
+// file, e.g.
+//
+//	[
+//	  {"metric": "slo_requests_total", "retention": "90d"},
+//	  {"matchers": [{"name": "__name__", "type": "=~", "value": "debug_.*"}], "retention": "3d"}
+//	]
+type retentionRuleConfig struct {
+	// Metric is shorthand for a matcher on the metric name.
+	Metric   string `json:"metric"`
+	Matchers []struct {
+		Name  string `json:"name"`
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"matchers"`
+	Retention string `json:"retention"`
+}
+
+// readRetentionRules reads the retention rules file at path.
+func readRetentionRules(path string) ([]store.RetentionRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []retentionRuleConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("parsing retention rules: %w", err)
+	}
+
+	rules := make([]store.RetentionRule, 0, len(configs))
+	for i, c := range configs {
+		var rule store.RetentionRule
+		if c.Metric != "" {
+			rule.Matchers = append(rule.Matchers, metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, c.Metric))
+		}
+		for _, mc := range c.Matchers {
+			t, err := metrics.ParseMatchType(mc.Type)
+			if err != nil {
+				return nil, fmt.Errorf("retention rule %d: %w", i, err)
+			}
+			m, err := metrics.NewMatcher(t, mc.Name, mc.Value)
+			if err != nil {
+				return nil, fmt.Errorf("retention rule %d: %w", i, err)
+			}
+			rule.Matchers = append(rule.Matchers, m)
+		}
+		if len(rule.Matchers) == 0 {
+			return nil, fmt.Errorf("retention rule %d: no metric or matchers", i)
+		}
+		d, err := parseRetentionDuration(c.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("retention rule %d: %w", i, err)
+		}
+		rule.Duration = int64(d / time.Second)
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseRetentionDuration parses a duration as time.ParseDuration does, also
+// accepting a whole number of days or weeks, e.g. "15d" or "2w".
+func parseRetentionDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.ParseInt(n, 10, 64)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(v) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// parseBytes parses a number of bytes with an optional binary unit suffix,
+// e.g. "512MB" or "50GB".
+func parseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	n, unit := s, int64(1)
+	for _, u := range units {
+		if trimmed, ok := strings.CutSuffix(s, u.suffix); ok {
+			n, unit = trimmed, u.size
+			break
+		}
+	}
+	v, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v * unit, nil
+}
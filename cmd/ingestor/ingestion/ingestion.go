@@ -1,8 +1,11 @@
 package ingestion
 
 import (
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mikanmekan/koalemos/internal/log"
@@ -24,27 +27,65 @@ type Ingestor struct {
 }
 
 // HandleMetrics expects a POST request with a JSON body containing metrics in
-// Koalemos format.
+// Koalemos format. The response is only sent once the metrics have been
+// recorded in the store's write-ahead log.
 func (i *Ingestor) HandleMetrics(w http.ResponseWriter, r *http.Request) {
-	metricsReader := reader.NewReader()
+	i.ingest(w, r, reader.NewReader(), http.StatusOK)
+}
+
+// HandleRemoteWrite expects a POST request with a Prometheus remote_write
+// body: a snappy compressed WriteRequest protocol buffer.
+func (i *Ingestor) HandleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	i.ingest(w, r, reader.NewRemoteWriteReader(), http.StatusNoContent)
+}
 
+// HandleOTLP expects a POST request with an OTLP/HTTP metrics export request
+// body, encoded as a protocol buffer. JSON encoded requests are not
+// supported. Parameters of the content type, such as a charset, are ignored.
+func (i *Ingestor) HandleOTLP(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-protobuf" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	i.ingest(w, r, reader.NewOTLPReader(), http.StatusOK)
+}
+
+// ingest reads the metrics of the request body with metricsReader and adds
+// them to the store, responding with status once they have been recorded.
+func (i *Ingestor) ingest(w http.ResponseWriter, r *http.Request, metricsReader reader.Reader, status int) {
 	mfs, err := metricsReader.Read(r.Body)
 	if err != nil {
 		i.logger.Warn("failed to read metrics", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	i.logger.Info(fmt.Sprintf("%+v", mfs))
 
+	// Payloads without a leading timestamp are stamped with their time of
+	// receipt.
+	if mfs.Time == 0 {
+		mfs.Time = time.Now().Unix()
+	}
+
 	err = i.metricsIMS.AddMetricFamiliesTimeGroup(mfs)
+	if errors.Is(err, store.ErrOutOfOrderSample) || errors.Is(err, store.ErrConflictingSample) {
+		i.logger.Warn("rejected metrics", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		i.logger.Error("failed to write metrics to in memory store", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 }
 
 func (i *Ingestor) Register(r *mux.Router) {
 	r.HandleFunc("/metrics", i.HandleMetrics).Methods("POST")
+	r.HandleFunc("/api/v1/write", i.HandleRemoteWrite).Methods("POST")
+	r.HandleFunc("/api/v1/otlp/v1/metrics", i.HandleOTLP).Methods("POST")
 }
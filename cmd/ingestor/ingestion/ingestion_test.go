@@ -0,0 +1,75 @@
+package ingestion
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics/reader"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HandleOTLPContentType(t *testing.T) {
+	type Test struct {
+		desc         string
+		contentType  string
+		expectedCode int
+	}
+
+	tests := []Test{
+		{
+			desc:         "[POSITIVE] protocol buffer",
+			contentType:  "application/x-protobuf",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "[POSITIVE] protocol buffer with parameters",
+			contentType:  "application/x-protobuf; charset=utf-8",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "[POSITIVE] media type in another case",
+			contentType:  "Application/X-Protobuf",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "[NEGATIVE] JSON",
+			contentType:  "application/json",
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:         "[NEGATIVE] no content type",
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:         "[NEGATIVE] malformed content type",
+			contentType:  "application/x-protobuf; charset",
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+	router := mux.NewRouter()
+	New(log.NewLogger(), reader.NewReader(), ims).Register(router)
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			// An export request without metrics is empty.
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/otlp/v1/metrics", bytes.NewReader(nil))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+}
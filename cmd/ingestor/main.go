@@ -1,16 +1,123 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/mikanmekan/koalemos/cmd/ingestor/admin"
+	"github.com/mikanmekan/koalemos/cmd/ingestor/api"
 	"github.com/mikanmekan/koalemos/cmd/ingestor/ingestion"
 	"github.com/mikanmekan/koalemos/cmd/ingestor/server"
+	"github.com/mikanmekan/koalemos/internal/instrument"
 	"github.com/mikanmekan/koalemos/internal/log"
 	"github.com/mikanmekan/koalemos/internal/metrics/reader"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"github.com/mikanmekan/koalemos/internal/rules"
+	"github.com/mikanmekan/koalemos/internal/scrape"
+	"github.com/mikanmekan/koalemos/internal/shipper"
+	"github.com/mikanmekan/koalemos/internal/storegateway"
+	"go.uber.org/zap"
 )
 
+// persistInterval is how often the active block is checked for block ranges
+// ready to be written to disk.
+const persistInterval = time.Minute
+
+// shipInterval is how often persisted blocks are checked for ones to upload
+// to object storage.
+const shipInterval = time.Minute
+
+// gatewaySyncInterval is how often the blocks in object storage are checked
+// for ones to serve queries from.
+const gatewaySyncInterval = 5 * time.Minute
+
+// indexHeadersDirname is the directory within the data directory the index
+// headers of blocks in object storage are cached in.
+const indexHeadersDirname = "index-headers"
+
+// snapshotsDirname is the directory within the data directory snapshots are
+// created in.
+const snapshotsDirname = "snapshots"
+
 func main() {
 	reader := reader.NewReader()
 	logger := log.NewLogger()
-	ingestion := ingestion.New(logger, reader, nil)
-	s := server.New(8080, *ingestion)
+
+	registry := instrument.NewRegistry()
+
+	opts, err := storeOptions()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	opts.Registry = registry
+	queryOpts, err := queryOptions()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	bucket, err := objectBucket()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	groups, err := ruleGroups()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	notifier, err := alertNotifier()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	scrapeJobs, err := scrapeConfigs()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	var gateway *storegateway.Gateway
+	if bucket != nil {
+		gateway = storegateway.New(logger, bucket, filepath.Join(opts.DataDir, indexHeadersDirname), registry)
+		if err := gateway.Sync(context.Background()); err != nil {
+			logger.Error("failed to sync blocks from bucket", zap.Error(err))
+		}
+		opts.LongTermStorage = gateway
+	}
+	ims, err := store.Open(logger, opts)
+	if err != nil {
+		logger.Fatal("failed to open metrics store", zap.Error(err))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go ims.Run(ctx, persistInterval)
+	engine := promql.NewEngine(queryOpts)
+	if len(groups) > 0 {
+		go rules.NewManager(logger, ims, engine, groups, notifier, registry).Run(ctx)
+	}
+	if len(scrapeJobs) > 0 {
+		go scrape.NewManager(logger, ims, scrapeJobs, nil, registry).Run(ctx)
+	}
+	if bucket != nil {
+		go shipper.New(logger, bucket, opts.DataDir, registry).Run(ctx, shipInterval)
+		go gateway.Run(ctx, gatewaySyncInterval)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := ims.Close(); err != nil {
+			logger.Error("failed to close metrics store", zap.Error(err))
+		}
+		if gateway != nil {
+			if err := gateway.Close(); err != nil {
+				logger.Error("failed to close store gateway", zap.Error(err))
+			}
+		}
+		os.Exit(0)
+	}()
+
+	ingestion := ingestion.New(logger, reader, ims)
+	admin := admin.New(logger, ims, filepath.Join(opts.DataDir, snapshotsDirname))
+	api := api.New(logger, ims, engine)
+	s := server.New(8080, *ingestion, admin, api, registry)
 	s.HandleRequests()
 }
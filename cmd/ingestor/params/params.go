@@ -0,0 +1,26 @@
+// Package params parses the request parameters shared by the HTTP APIs of the
+// ingestor.
+package params
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ParseTime parses a time given as Unix seconds, possibly fractional, or in
+// RFC 3339, returning def if s is empty.
+func ParseTime(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Floor(f)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+	}
+	return t.Unix(), nil
+}
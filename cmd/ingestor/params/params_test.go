@@ -0,0 +1,61 @@
+package params
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseTime(t *testing.T) {
+	type Test struct {
+		desc     string
+		input    string
+		expected int64
+		errored  bool
+	}
+
+	tests := []Test{
+		{
+			desc:     "[POSITIVE] empty time",
+			input:    "",
+			expected: 42,
+		},
+		{
+			desc:     "[POSITIVE] Unix seconds",
+			input:    "1700000000",
+			expected: 1700000000,
+		},
+		{
+			desc:     "[POSITIVE] fractional Unix seconds",
+			input:    "1700000000.999",
+			expected: 1700000000,
+		},
+		{
+			desc:     "[POSITIVE] negative fractional Unix seconds",
+			input:    "-0.5",
+			expected: -1,
+		},
+		{
+			desc:     "[POSITIVE] RFC 3339",
+			input:    "2023-11-14T22:13:20.5Z",
+			expected: 1700000000,
+		},
+		{
+			desc:    "[NEGATIVE] neither Unix seconds nor RFC 3339",
+			input:   "yesterday",
+			errored: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			ts, err := ParseTime(tc.input, 42)
+			if tc.errored {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, ts)
+		})
+	}
+}
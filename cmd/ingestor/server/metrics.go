@@ -1 +1,16 @@
 package server
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// handleMetrics serves the ingestor's own metrics in the Koalemos metrics
+// ingestion format, so that they can be scraped or sent back into Koalemos.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := s.registry.WriteTo(w); err != nil {
+		s.logger.Warn("failed to write metrics", zap.Error(err))
+	}
+}
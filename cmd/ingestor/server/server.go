@@ -5,7 +5,10 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/mikanmekan/koalemos/cmd/ingestor/admin"
+	"github.com/mikanmekan/koalemos/cmd/ingestor/api"
 	"github.com/mikanmekan/koalemos/cmd/ingestor/ingestion"
+	"github.com/mikanmekan/koalemos/internal/instrument"
 	"github.com/mikanmekan/koalemos/internal/log"
 	"go.uber.org/zap"
 )
@@ -16,15 +19,22 @@ type Server struct {
 	router   *mux.Router
 	port     int
 	ingestor ingestion.Ingestor
+	admin    *admin.Admin
+	api      *api.API
+	registry *instrument.Registry
 }
 
-// New initializes a Server which will listen on the given port.
-func New(port int, ingestor ingestion.Ingestor) *Server {
+// New initializes a Server which will listen on the given port, serving the
+// administrative and query APIs and the metrics recorded in registry.
+func New(port int, ingestor ingestion.Ingestor, admin *admin.Admin, api *api.API, registry *instrument.Registry) *Server {
 	s := &Server{
 		logger:   log.NewLogger(),
 		router:   mux.NewRouter(),
 		port:     port,
 		ingestor: ingestor,
+		admin:    admin,
+		api:      api,
+		registry: registry,
 	}
 
 	return s
@@ -33,6 +43,9 @@ func New(port int, ingestor ingestion.Ingestor) *Server {
 // HandleRequests starts the server and listens for incoming requests.
 func (s *Server) HandleRequests() {
 	s.ingestor.Register(s.router)
+	s.admin.Register(s.router)
+	s.api.Register(s.router)
+	s.router.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
 
 	err := http.ListenAndServe(fmt.Sprintf(":%d", s.port), s.router)
 	if err != nil {
@@ -0,0 +1,83 @@
+// Command koalemosctl administers a running ingestor through its admin API.
+//
+// Usage:
+//
+//	koalemosctl [-url http://localhost:8080] snapshot [-skip-head]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	addr := flag.String("url", "http://localhost:8080", "base URL of the ingestor")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <command> [command flags]\n\nCommands:\n  snapshot\tsnapshot the ingestor's data\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "snapshot":
+		err = snapshot(*addr, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// snapshot asks the ingestor to snapshot its data, printing the path of the
+// snapshot within the ingestor's data directory.
+func snapshot(addr string, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	skipHead := fs.Bool("skip-head", false, "leave out the samples the ingestor holds in memory")
+	fs.Parse(args)
+
+	u, err := url.JoinPath(addr, "/api/v1/admin/tsdb/snapshot")
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.PostForm(u, url.Values{"skip_head": {strconv.FormatBool(*skipHead)}})
+	if err != nil {
+		return fmt.Errorf("requesting snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+	var res struct {
+		Error string `json:"error"`
+		Data  struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return fmt.Errorf("snapshot failed: %s: %s", resp.Status, body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot failed: %s: %s", resp.Status, res.Error)
+	}
+	fmt.Println("snapshots/" + res.Data.Name)
+	return nil
+}
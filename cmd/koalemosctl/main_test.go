@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Snapshot(t *testing.T) {
+	type Test struct {
+		desc          string
+		args          []string
+		status        int
+		body          string
+		expectedQuery string
+		expectedErr   string
+	}
+
+	tests := []Test{
+		{
+			desc:          "[POSITIVE] snapshot with the samples held in memory",
+			status:        http.StatusOK,
+			body:          `{"status": "success", "data": {"name": "20240102T150405Z-1a2b3c4d5e6f7a8b"}}`,
+			expectedQuery: "skip_head=false",
+		},
+		{
+			desc:          "[POSITIVE] snapshot without the samples held in memory",
+			args:          []string{"-skip-head"},
+			status:        http.StatusOK,
+			body:          `{"status": "success", "data": {"name": "20240102T150405Z-1a2b3c4d5e6f7a8b"}}`,
+			expectedQuery: "skip_head=true",
+		},
+		{
+			desc:          "[NEGATIVE] error response",
+			status:        http.StatusInternalServerError,
+			body:          `{"status": "error", "error": "disk full"}`,
+			expectedQuery: "skip_head=false",
+			expectedErr:   "snapshot failed: 500 Internal Server Error: disk full",
+		},
+		{
+			desc:          "[NEGATIVE] response which is not JSON",
+			status:        http.StatusBadGateway,
+			body:          "bad gateway",
+			expectedQuery: "skip_head=false",
+			expectedErr:   "snapshot failed: 502 Bad Gateway: bad gateway",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var query string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "/api/v1/admin/tsdb/snapshot", r.URL.Path)
+				require.NoError(t, r.ParseForm())
+				query = r.PostForm.Encode()
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			err := snapshot(srv.URL, tc.args)
+			assert.Equal(t, tc.expectedQuery, query)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
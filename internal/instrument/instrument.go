@@ -0,0 +1,227 @@
+package instrument
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry holds the metrics Koalemos records about itself, and writes them
+// out in the Koalemos metrics ingestion format.
+type Registry struct {
+	mtx     sync.Mutex
+	metrics map[string]*vec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]*vec{}}
+}
+
+// vec is a metric family whose series are distinguished by label values.
+type vec struct {
+	name       string
+	typ        string
+	help       string
+	labelNames []string
+
+	mtx    sync.Mutex
+	series map[string]*value
+}
+
+// value is the current value of one series.
+type value struct {
+	labelValues []string
+
+	mtx sync.Mutex
+	v   float64
+}
+
+func (v *value) add(d float64) {
+	v.mtx.Lock()
+	v.v += d
+	v.mtx.Unlock()
+}
+
+func (v *value) set(f float64) {
+	v.mtx.Lock()
+	v.v = f
+	v.mtx.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.v
+}
+
+// register returns the metric family registered under name, creating it if
+// needed. Registering a name twice returns the same family, so components
+// created more than once share their metrics.
+func (r *Registry) register(name, typ, help string, labelNames []string) *vec {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if v, ok := r.metrics[name]; ok {
+		if v.typ != typ || len(v.labelNames) != len(labelNames) {
+			panic(fmt.Sprintf("instrument: %s registered twice with different types or labels", name))
+		}
+		return v
+	}
+	v := &vec{name: name, typ: typ, help: help, labelNames: labelNames, series: map[string]*value{}}
+	r.metrics[name] = v
+	return v
+}
+
+func (v *vec) with(labelValues []string) *value {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("instrument: %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &value{labelValues: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Counter is a monotonically increasing metric.
+type Counter struct {
+	v *vec
+}
+
+// NewCounter registers a counter, optionally partitioned by labelNames.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{v: r.register(name, "counter", help, labelNames)}
+}
+
+// With returns the counter's series for the given label values, in the order
+// of the counter's label names.
+func (c *Counter) With(labelValues ...string) *CounterSeries {
+	return &CounterSeries{v: c.v.with(labelValues)}
+}
+
+// Inc increments the series of a counter registered without labels.
+func (c *Counter) Inc() { c.With().Inc() }
+
+// Add adds d, which must not be negative, to the series of a counter
+// registered without labels.
+func (c *Counter) Add(d float64) { c.With().Add(d) }
+
+// CounterSeries is one series of a Counter.
+type CounterSeries struct {
+	v *value
+}
+
+func (c *CounterSeries) Inc() { c.v.add(1) }
+
+func (c *CounterSeries) Add(d float64) {
+	if d < 0 {
+		panic("instrument: counters cannot decrease")
+	}
+	c.v.add(d)
+}
+
+// Gauge is a metric which can go up and down.
+type Gauge struct {
+	v *vec
+}
+
+// NewGauge registers a gauge, optionally partitioned by labelNames.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{v: r.register(name, "gauge", help, labelNames)}
+}
+
+// With returns the gauge's series for the given label values, in the order
+// of the gauge's label names.
+func (g *Gauge) With(labelValues ...string) *GaugeSeries {
+	return &GaugeSeries{v: g.v.with(labelValues)}
+}
+
+// Set sets the series of a gauge registered without labels.
+func (g *Gauge) Set(f float64) { g.With().Set(f) }
+
+// Add adds d to the series of a gauge registered without labels.
+func (g *Gauge) Add(d float64) { g.With().Add(d) }
+
+// GaugeSeries is one series of a Gauge.
+type GaugeSeries struct {
+	v *value
+}
+
+func (g *GaugeSeries) Set(f float64) { g.v.set(f) }
+func (g *GaugeSeries) Add(d float64) { g.v.add(d) }
+
+// WriteTo writes every registered metric to w in the Koalemos metrics
+// ingestion format, stamped with the current time.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mtx.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mtx.Unlock()
+	sort.Strings(names)
+
+	sb := strings.Builder{}
+	sb.WriteString(strconv.FormatInt(time.Now().Unix(), 10))
+	sb.WriteString("\n")
+	for _, name := range names {
+		r.mtx.Lock()
+		v := r.metrics[name]
+		r.mtx.Unlock()
+		v.write(&sb)
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (v *vec) write(sb *strings.Builder) {
+	v.mtx.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*value, 0, len(keys))
+	for _, k := range keys {
+		series = append(series, v.series[k])
+	}
+	v.mtx.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", v.name, v.typ)
+	for _, s := range series {
+		sb.WriteString(v.name)
+		sb.WriteString("{")
+		for i, ln := range v.labelNames {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(sb, "%s=%q", ln, s.labelValues[i])
+		}
+		sb.WriteString("} ")
+		sb.WriteString(formatFloat(s.get()))
+		sb.WriteString("\n")
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
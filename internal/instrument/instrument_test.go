@@ -0,0 +1,56 @@
+package instrument
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics/reader"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	deleted := r.NewCounter("blocks_deleted_total", "Blocks deleted.", "reason")
+	blocks := r.NewGauge("blocks", "Persisted blocks.")
+
+	deleted.With("size").Inc()
+	deleted.With("size").Add(2)
+	deleted.With("time").Inc()
+	blocks.Set(4)
+	blocks.Add(-1)
+	// Registering a name again returns the same metric.
+	r.NewGauge("blocks", "Persisted blocks.").Add(-1)
+
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	require.NoError(t, err)
+
+	// The output is valid Koalemos ingestion format.
+	mfs, err := reader.NewReader().Read(buf)
+	require.NoError(t, err)
+	assert.NotZero(t, mfs.Time)
+
+	values := map[string]float64{}
+	for _, mf := range mfs.Families {
+		for _, mps := range mf.HashedMetrics {
+			for _, mp := range mps {
+				values[mp.Name+"/"+mp.LabelSet["reason"]] = mp.Value
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"blocks/":                   2,
+		"blocks_deleted_total/size": 3,
+		"blocks_deleted_total/time": 1,
+	}, values)
+}
+
+func Test_Misuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "code")
+
+	assert.Panics(t, func() { c.With("200", "get") }, "wrong number of label values")
+	assert.Panics(t, func() { c.With("200").Add(-1) }, "decreasing counter")
+	assert.Panics(t, func() { r.NewGauge("requests_total", "Requests.", "code") }, "re-registered with another type")
+}
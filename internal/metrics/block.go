@@ -1,44 +1,195 @@
 package metrics
 
+import (
+	"math"
+	"sort"
+)
+
 type Block struct {
 	// metrics stored as a hash of metric definition + labelset
 	// hash(metricName, labelset) -> []timeseries.
 	// hash returns slice of timeseries because we are hash collision cognizant.
-	metrics map[uint64][]MetricFamilyTimeSeries
+	metrics map[uint64][]*MetricFamilyTimeSeries
+	// series indexes every timeseries by the reference it was assigned on
+	// creation.
+	series  map[uint64]*MetricFamilyTimeSeries
+	nextRef uint64
+
+	// minTime and maxTime are the oldest and newest timestamps of any metric
+	// point held by the block.
+	minTime int64
+	maxTime int64
 }
 
 func NewBlock() *Block {
-	return &Block{metrics: make(map[uint64][]MetricFamilyTimeSeries)}
+	return &Block{
+		metrics: make(map[uint64][]*MetricFamilyTimeSeries),
+		series:  make(map[uint64]*MetricFamilyTimeSeries),
+		nextRef: 1,
+		minTime: math.MaxInt64,
+		maxTime: math.MinInt64,
+	}
 }
 
-func (b *Block) AddMetricFamily(metricFamily *MetricFamily, hashed uint64) {
-	timeSeries := b.metrics[hashed]
-
+// AddMetricFamily adds every metric point of metricFamily to the block,
+// creating timeseries as needed. Metric points are indexed by their own hash
+// of metric name + label set.
+func (b *Block) AddMetricFamily(metricFamily *MetricFamily) {
 	for _, metrics := range metricFamily.HashedMetrics {
 		for _, mp := range metrics {
-			if len(timeSeries) == 0 {
-				b.addNewTimeSeries(metricFamily, mp, hashed)
-			} else {
-				foundTs := false
-				for _, ts := range timeSeries {
-					if mp.MetadataEquals(ts.ToMetricPoint()) {
-						ts.metrics = append(ts.metrics, *mp)
-						break
-					}
-				}
-				if !foundTs {
-					b.addNewTimeSeries(metricFamily, mp, hashed)
-				}
-			}
+			b.addMetricPoint(metricFamily, mp)
+		}
+	}
+}
+
+func (b *Block) addMetricPoint(metricFamily *MetricFamily, mp *MetricPoint) {
+	ref, _ := b.GetOrCreateSeries(metricFamily.Def, mp)
+	if mp.Histogram != nil {
+		b.AppendHistogram(ref, mp.Time, mp.Histogram)
+		return
+	}
+	b.Append(ref, mp.Time, mp.Value)
+}
+
+// GetOrCreateSeries returns the reference of the timeseries mp belongs to,
+// creating the timeseries with definition def if it does not exist yet.
+func (b *Block) GetOrCreateSeries(def MetricDefinition, mp *MetricPoint) (ref uint64, created bool) {
+	for _, ts := range b.metrics[mp.Hash] {
+		if ts.matches(mp) {
+			return ts.ref, false
+		}
+	}
+
+	ref = b.nextRef
+	b.addNewTimeSeries(ref, def, mp.LabelSet, mp.Hash)
+	return ref, true
+}
+
+// CreateSeries creates a timeseries under a reference assigned previously,
+// e.g. one recorded in a write-ahead log. It is a no-op if a timeseries with
+// ref already exists.
+func (b *Block) CreateSeries(ref uint64, def MetricDefinition, labelSet map[string]string) error {
+	if _, ok := b.series[ref]; ok {
+		return nil
+	}
+	hash, err := HashMetric(&MetricPoint{Name: def.Name, LabelSet: labelSet})
+	if err != nil {
+		return err
+	}
+	b.addNewTimeSeries(ref, def, labelSet, hash)
+	return nil
+}
+
+func (b *Block) addNewTimeSeries(ref uint64, def MetricDefinition, labelSet map[string]string, hash uint64) {
+	ts := &MetricFamilyTimeSeries{
+		Def:      def,
+		LabelSet: labelSet,
+		ref:      ref,
+		hash:     hash,
+		maxTime:  math.MinInt64,
+	}
+	b.metrics[hash] = append(b.metrics[hash], ts)
+	b.series[ref] = ts
+	if ref >= b.nextRef {
+		b.nextRef = ref + 1
+	}
+}
+
+// RemoveSeries removes the timeseries with reference ref, which must hold no
+// metric points, e.g. one created for metric points which could not be
+// recorded. Its reference is not reused.
+func (b *Block) RemoveSeries(ref uint64) {
+	ts, ok := b.series[ref]
+	if !ok {
+		return
+	}
+	delete(b.series, ref)
+	hashed := b.metrics[ts.hash]
+	for i, other := range hashed {
+		if other == ts {
+			hashed = append(hashed[:i], hashed[i+1:]...)
+			break
+		}
+	}
+	if len(hashed) == 0 {
+		delete(b.metrics, ts.hash)
+	} else {
+		b.metrics[ts.hash] = hashed
+	}
+}
+
+// HasSeries reports whether the block holds a timeseries with reference ref.
+func (b *Block) HasSeries(ref uint64) bool {
+	_, ok := b.series[ref]
+	return ok
+}
+
+// LookupSeries returns the definition and label set of the timeseries with
+// reference ref.
+func (b *Block) LookupSeries(ref uint64) (MetricDefinition, map[string]string, bool) {
+	ts, ok := b.series[ref]
+	if !ok {
+		return MetricDefinition{}, nil, false
+	}
+	return ts.Def, ts.LabelSet, true
+}
+
+// SeriesMaxTime returns the newest timestamp of the timeseries with
+// reference ref. It returns false if the timeseries does not exist or holds
+// no metric points.
+func (b *Block) SeriesMaxTime(ref uint64) (int64, bool) {
+	ts, ok := b.series[ref]
+	if !ok || len(ts.metrics) == 0 {
+		return 0, false
+	}
+	return ts.maxTime, true
+}
+
+// SampleAt returns the sample of the timeseries with reference ref at t.
+// Where several metric points share t the latest written is returned.
+func (b *Block) SampleAt(ref uint64, t int64) (Sample, bool) {
+	ts, ok := b.series[ref]
+	if !ok || t > ts.maxTime {
+		return Sample{}, false
+	}
+	for i := len(ts.metrics) - 1; i >= 0; i-- {
+		if mp := ts.metrics[i]; mp.Time == t {
+			return Sample{Time: t, Value: mp.Value, Histogram: mp.Histogram}, true
 		}
 	}
+	return Sample{}, false
+}
+
+// Append adds a sample to the timeseries with reference ref.
+func (b *Block) Append(ref uint64, t int64, v float64) error {
+	return b.append(ref, MetricPoint{Value: v, Time: t})
+}
+
+// AppendHistogram adds a native histogram sample to the timeseries with
+// reference ref.
+func (b *Block) AppendHistogram(ref uint64, t int64, h *Histogram) error {
+	return b.append(ref, MetricPoint{Histogram: h, Time: t})
+}
+
+func (b *Block) append(ref uint64, mp MetricPoint) error {
+	ts, ok := b.series[ref]
+	if !ok {
+		return ErrTimeSeriesNotFound
+	}
+	mp.Name, mp.LabelSet, mp.Hash = ts.Def.Name, ts.LabelSet, ts.hash
+	ts.metrics = append(ts.metrics, mp)
+	ts.maxTime = max(ts.maxTime, mp.Time)
+	b.updateTimes(mp.Time)
+	return nil
 }
 
-func (b *Block) addNewTimeSeries(metricFamily *MetricFamily, mp *MetricPoint, hashed uint64) {
-	ts := *metricFamily.ToMetricTimeSeries()
-	ts.LabelSet = mp.LabelSet
-	ts.metrics = append(ts.metrics, *mp)
-	b.metrics[hashed] = append(b.metrics[hashed], ts)
+func (b *Block) updateTimes(t int64) {
+	if t < b.minTime {
+		b.minTime = t
+	}
+	if t > b.maxTime {
+		b.maxTime = t
+	}
 }
 
 func (b *Block) GetTimeSeries(timeSeries MetricFamilyTimeSeries) (*MetricFamilyTimeSeries, error) {
@@ -47,20 +198,203 @@ func (b *Block) GetTimeSeries(timeSeries MetricFamilyTimeSeries) (*MetricFamilyT
 		panic("unexpected err hashing timeseries")
 	}
 
-	hashedTimeSeries := b.metrics[timeSeriesHash]
-	mp := MetricPoint{
-		Name:     timeSeries.Def.Name,
-		LabelSet: timeSeries.LabelSet,
+	mp := timeSeries.ToMetricPoint()
+	for _, ts := range b.metrics[timeSeriesHash] {
+		if ts.matches(mp) {
+			return ts, nil
+		}
 	}
+	return nil, ErrTimeSeriesNotFound
+}
+
+// Empty reports whether the block holds no metric points.
+func (b *Block) Empty() bool {
+	return b.minTime > b.maxTime
+}
+
+// MinTime returns the oldest timestamp held by the block.
+func (b *Block) MinTime() int64 {
+	return b.minTime
+}
+
+// MaxTime returns the newest timestamp held by the block.
+func (b *Block) MaxTime() int64 {
+	return b.maxTime
+}
+
+// Series returns a SeriesSet of every timeseries in the block, restricted to
+// samples with timestamps in [mint, maxt).
+func (b *Block) Series(mint, maxt int64) SeriesSet {
+	return b.Select(mint, maxt-1)
+}
+
+// Select returns the timeseries satisfying every matcher, restricted to
+// samples within [mint, maxt]. Samples are copied, so the result remains
+// valid as the block is written to.
+func (b *Block) Select(mint, maxt int64, matchers ...*Matcher) SeriesSet {
+	var series []Series
+	for _, hashed := range b.metrics {
+		for _, ts := range hashed {
+			if !MatchesSeries(ts.Def.Name, ts.LabelSet, matchers...) {
+				continue
+			}
+			samples := ts.samples(mint, maxt)
+			if len(samples) == 0 {
+				continue
+			}
+			series = append(series, &ListSeries{
+				Def:     ts.Def,
+				Labels:  ts.LabelSet,
+				Samples: samples,
+			})
+		}
+	}
+	return NewListSeriesSet(series)
+}
 
-	for _, ts := range hashedTimeSeries {
-		tsMp := MetricPoint{
-			Name:     ts.Def.Name,
-			LabelSet: ts.LabelSet,
+// LabelNames returns the sorted, distinct label names of all timeseries in
+// the block, including MetricNameLabel.
+func (b *Block) LabelNames() []string {
+	set := map[string]struct{}{}
+	for _, hashed := range b.metrics {
+		for _, ts := range hashed {
+			set[MetricNameLabel] = struct{}{}
+			for k := range ts.LabelSet {
+				set[k] = struct{}{}
+			}
 		}
-		if mp.MetadataEquals(&tsMp) {
-			return &ts, nil
+	}
+	return sortedKeys(set)
+}
+
+// LabelValues returns the sorted, distinct values of the named label across
+// all timeseries in the block.
+func (b *Block) LabelValues(name string) []string {
+	set := map[string]struct{}{}
+	for _, hashed := range b.metrics {
+		for _, ts := range hashed {
+			if name == MetricNameLabel {
+				set[ts.Def.Name] = struct{}{}
+			} else if v, ok := ts.LabelSet[name]; ok {
+				set[v] = struct{}{}
+			}
 		}
 	}
-	return nil, ErrTimeSeriesNotFound
+	return sortedKeys(set)
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Truncate drops every metric point with a timestamp before mint, and any
+// timeseries left without metric points.
+func (b *Block) Truncate(mint int64) {
+	b.minTime, b.maxTime = math.MaxInt64, math.MinInt64
+	for h, hashed := range b.metrics {
+		kept := hashed[:0]
+		for _, ts := range hashed {
+			points := ts.metrics[:0]
+			ts.maxTime = math.MinInt64
+			for _, mp := range ts.metrics {
+				if mp.Time >= mint {
+					points = append(points, mp)
+					ts.maxTime = max(ts.maxTime, mp.Time)
+					b.updateTimes(mp.Time)
+				}
+			}
+			ts.metrics = points
+			if len(points) > 0 {
+				kept = append(kept, ts)
+			} else {
+				delete(b.series, ts.ref)
+			}
+		}
+		if len(kept) == 0 {
+			delete(b.metrics, h)
+		} else {
+			b.metrics[h] = kept
+		}
+	}
+}
+
+// Delete drops the metric points deleted by tombstone. Timeseries left
+// without metric points are kept, as their references remain in use.
+func (b *Block) Delete(tombstone Tombstone) {
+	b.minTime, b.maxTime = math.MaxInt64, math.MinInt64
+	for _, hashed := range b.metrics {
+		for _, ts := range hashed {
+			if MatchesSeries(ts.Def.Name, ts.LabelSet, tombstone.Matchers...) {
+				points := ts.metrics[:0]
+				ts.maxTime = math.MinInt64
+				for _, mp := range ts.metrics {
+					if !tombstone.Covers(mp.Time) {
+						points = append(points, mp)
+						ts.maxTime = max(ts.maxTime, mp.Time)
+					}
+				}
+				ts.metrics = points
+			}
+			for _, mp := range ts.metrics {
+				b.updateTimes(mp.Time)
+			}
+		}
+	}
+}
+
+// Split returns two new blocks holding copies of the block's metric points
+// before t and at or after t respectively, in timeseries with the same
+// references.
+func (b *Block) Split(t int64) (before, after *Block) {
+	before, after = NewBlock(), NewBlock()
+	before.nextRef, after.nextRef = b.nextRef, b.nextRef
+	for _, hashed := range b.metrics {
+		for _, ts := range hashed {
+			for _, mp := range ts.metrics {
+				dst := after
+				if mp.Time < t {
+					dst = before
+				}
+				nts, ok := dst.series[ts.ref]
+				if !ok {
+					dst.addNewTimeSeries(ts.ref, ts.Def, ts.LabelSet, ts.hash)
+					nts = dst.series[ts.ref]
+				}
+				nts.metrics = append(nts.metrics, mp)
+				nts.maxTime = max(nts.maxTime, mp.Time)
+				dst.updateTimes(mp.Time)
+			}
+		}
+	}
+	return before, after
+}
+
+// samples returns the timeseries' samples within [mint, maxt], sorted by
+// time. Where several metric points share a timestamp the latest written
+// wins.
+func (ts *MetricFamilyTimeSeries) samples(mint, maxt int64) []Sample {
+	samples := make([]Sample, 0, len(ts.metrics))
+	for _, mp := range ts.metrics {
+		if mp.Time >= mint && mp.Time <= maxt {
+			samples = append(samples, Sample{Time: mp.Time, Value: mp.Value, Histogram: mp.Histogram})
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time < samples[j].Time
+	})
+
+	deduped := samples[:0]
+	for _, s := range samples {
+		if n := len(deduped); n > 0 && deduped[n-1].Time == s.Time {
+			deduped[n-1] = s
+			continue
+		}
+		deduped = append(deduped, s)
+	}
+	return deduped
 }
@@ -0,0 +1,216 @@
+package block
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSeries() []metrics.Series {
+	def := metrics.MetricDefinition{Name: "http_requests_total", Type: "counter", Help: "Total requests."}
+
+	var get, post []metrics.Sample
+	for i := int64(0); i < 300; i++ {
+		get = append(get, metrics.Sample{Time: 1000 + i*10, Value: float64(i)})
+		post = append(post, metrics.Sample{Time: 1000 + i*10, Value: float64(i) / 2})
+	}
+
+	return []metrics.Series{
+		&metrics.ListSeries{Def: def, Labels: map[string]string{"method": "get", "code": "200"}, Samples: get},
+		&metrics.ListSeries{Def: def, Labels: map[string]string{"method": "post", "code": "200"}, Samples: post},
+		&metrics.ListSeries{
+			Def:     metrics.MetricDefinition{Name: "up", Type: "gauge"},
+			Labels:  map[string]string{},
+			Samples: []metrics.Sample{{Time: 1000, Value: 1}, {Time: 4000, Value: 0}},
+		},
+	}
+}
+
+func writeTestBlock(t *testing.T) (string, *Meta) {
+	t.Helper()
+
+	parent := t.TempDir()
+	meta, err := Write(parent, 0, 10000, metrics.NewListSeriesSet(testSeries()))
+	require.NoError(t, err)
+	return filepath.Join(parent, meta.ULID.String()), meta
+}
+
+func Test_WriteRead(t *testing.T) {
+	type Test struct {
+		desc       string
+		mint, maxt int64
+		matchers   []*metrics.Matcher
+		expected   []metrics.Series
+	}
+
+	series := testSeries()
+	get, post, up := series[0].(*metrics.ListSeries), series[1].(*metrics.ListSeries), series[2]
+
+	tests := []Test{
+		{
+			desc:     "[POSITIVE] select every series",
+			mint:     0,
+			maxt:     10000,
+			expected: testSeries(),
+		},
+		{
+			desc:     "[POSITIVE] select by metric name",
+			mint:     0,
+			maxt:     10000,
+			matchers: []*metrics.Matcher{metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, "up")},
+			expected: []metrics.Series{up},
+		},
+		{
+			desc: "[POSITIVE] select by regexp and negative matcher",
+			mint: 0,
+			maxt: 10000,
+			matchers: []*metrics.Matcher{
+				metrics.MustNewMatcher(metrics.MatchRegexp, metrics.MetricNameLabel, "http_.*"),
+				metrics.MustNewMatcher(metrics.MatchNotEqual, "method", "get"),
+			},
+			expected: []metrics.Series{post},
+		},
+		{
+			desc:     "[POSITIVE] matcher on the empty value selects series without the label",
+			mint:     0,
+			maxt:     10000,
+			matchers: []*metrics.Matcher{metrics.MustNewMatcher(metrics.MatchEqual, "method", "")},
+			expected: []metrics.Series{up},
+		},
+		{
+			desc:     "[POSITIVE] samples are restricted to the time range",
+			mint:     1500,
+			maxt:     1520,
+			matchers: []*metrics.Matcher{metrics.MustNewMatcher(metrics.MatchEqual, "method", "get")},
+			expected: []metrics.Series{
+				&metrics.ListSeries{Def: get.Def, Labels: get.Labels, Samples: get.Samples[50:53]},
+			},
+		},
+		{
+			desc:     "[NEGATIVE] no series outside the block's time range",
+			mint:     20000,
+			maxt:     30000,
+			expected: nil,
+		},
+	}
+
+	dir, meta := writeTestBlock(t)
+	assert.Equal(t, uint64(3), meta.Stats.NumSeries)
+	assert.Equal(t, uint64(602), meta.Stats.NumSamples)
+
+	read, err := ReadMeta(dir)
+	require.NoError(t, err)
+	assert.Equal(t, meta, read)
+
+	r, err := Open(dir)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, meta, r.Meta())
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			q, err := r.Querier()
+			require.NoError(t, err)
+			defer q.Close()
+
+			set := q.Select(tc.mint, tc.maxt, tc.matchers...)
+			var res []metrics.Series
+			for set.Next() {
+				s := set.At()
+				samples, err := metrics.ExpandSamples(s.Iterator())
+				require.NoError(t, err)
+				res = append(res, &metrics.ListSeries{Def: s.Definition(), Labels: s.LabelSet(), Samples: samples})
+			}
+			assert.NoError(t, set.Err())
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+
+	q, err := r.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+
+	names, err := q.LabelNames()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{metrics.MetricNameLabel, "code", "method"}, names)
+
+	values, err := q.LabelValues("method")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"get", "post"}, values)
+}
+
+func Test_WriteReadHistograms(t *testing.T) {
+	h := func(count float64) *metrics.Histogram {
+		return &metrics.Histogram{
+			Schema:          0,
+			Count:           count,
+			Sum:             count * 1.5,
+			PositiveSpans:   []metrics.Span{{Offset: 0, Length: 2}},
+			PositiveBuckets: []float64{count / 2, count / 2},
+		}
+	}
+	// Float and native histogram samples are written to separate chunks.
+	var samples []metrics.Sample
+	for i := int64(0); i < 200; i++ {
+		s := metrics.Sample{Time: 1000 + i*10, Value: float64(i)}
+		if i >= 50 && i < 180 {
+			s = metrics.Sample{Time: 1000 + i*10, Histogram: h(float64(i))}
+		}
+		samples = append(samples, s)
+	}
+	series := &metrics.ListSeries{
+		Def:     metrics.MetricDefinition{Name: "http_request_duration_seconds", Type: "histogram"},
+		Labels:  map[string]string{"job": "api"},
+		Samples: samples,
+	}
+
+	parent := t.TempDir()
+	meta, err := Write(parent, 0, 10000, metrics.NewListSeriesSet([]metrics.Series{series}))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), meta.Stats.NumChunks)
+
+	r, err := Open(filepath.Join(parent, meta.ULID.String()))
+	require.NoError(t, err)
+	defer r.Close()
+	q, err := r.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+
+	set := q.Select(0, 10000)
+	require.True(t, set.Next())
+	read, err := metrics.ExpandSamples(set.At().Iterator())
+	require.NoError(t, err)
+	assert.Equal(t, samples, read)
+	assert.False(t, set.Next())
+}
+
+func Test_OpenCorrupted(t *testing.T) {
+	dir, _ := writeTestBlock(t)
+
+	path := filepath.Join(dir, indexFilename)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	// Flip a bit within the symbol table.
+	b[indexHeaderSize+6] ^= 0x01
+	require.NoError(t, os.WriteFile(path, b, 0o666))
+
+	_, err = Open(dir)
+	assert.ErrorIs(t, err, ErrInvalidChecksum)
+}
+
+func Test_List(t *testing.T) {
+	dir, meta := writeTestBlock(t)
+	parent := filepath.Dir(dir)
+
+	stale := filepath.Join(parent, "01HGW2N7Z3Q5X0K9J8R6T4V2B1"+tmpSuffix)
+	require.NoError(t, os.MkdirAll(stale, 0o777))
+
+	metas, err := List(parent)
+	require.NoError(t, err)
+	assert.Equal(t, []*Meta{meta}, metas)
+	assert.NoDirExists(t, stale)
+}
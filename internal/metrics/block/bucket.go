@@ -0,0 +1,354 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// maxRangeGap is the largest gap between two entries which are read
+	// from object storage with a single request.
+	maxRangeGap = 16 << 10
+	// entrySizeGuess is the number of bytes read for an entry whose size is
+	// not known up front. Longer entries take a second request.
+	entrySizeGuess = 512
+)
+
+// BucketReader reads a persisted block from object storage, as uploaded by
+// the shipper, without downloading it. Its index header, the symbol table
+// and postings offset table, is kept in a local index header file, built from
+// the index on first use; series, postings lists and chunks are fetched
+// with ranged reads as queries need them.
+type BucketReader struct {
+	bucket objstore.Bucket
+	meta   *Meta
+
+	headerFile *mmapFile
+	header     *indexHeader
+
+	mtx        sync.Mutex
+	tombstones []metrics.Tombstone
+	closed     bool
+	pending    sync.WaitGroup
+}
+
+// OpenBucket opens the block id in bkt for reading, caching its index header
+// in cacheDir/<id>/index-header.
+func OpenBucket(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, cacheDir string) (*BucketReader, error) {
+	r := &BucketReader{bucket: bkt}
+	if err := r.open(ctx, id, cacheDir); err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("opening block %s from bucket: %w", id, err)
+	}
+	return r, nil
+}
+
+func (r *BucketReader) open(ctx context.Context, id ulid.ULID, cacheDir string) error {
+	b, err := r.get(ctx, path.Join(id.String(), metaFilename))
+	if err != nil {
+		return fmt.Errorf("reading block meta: %w", err)
+	}
+	if r.meta, err = DecodeMeta(b); err != nil {
+		return err
+	}
+	if r.meta.ULID != id {
+		return fmt.Errorf("meta of block %s: %w", r.meta.ULID, ErrCorrupted)
+	}
+
+	b, err = r.get(ctx, path.Join(id.String(), tombstonesFilename))
+	switch {
+	case errors.Is(err, objstore.ErrObjectNotFound):
+	case err != nil:
+		return fmt.Errorf("reading tombstones: %w", err)
+	default:
+		if r.tombstones, err = decodeTombstones(b); err != nil {
+			return err
+		}
+	}
+
+	// A cached index header which cannot be read is rebuilt.
+	headerPath := filepath.Join(cacheDir, id.String(), IndexHeaderFilename)
+	if err := r.openIndexHeader(headerPath); err == nil {
+		return nil
+	}
+	r.unmap()
+	if err := r.buildIndexHeader(ctx, headerPath); err != nil {
+		return err
+	}
+	return r.openIndexHeader(headerPath)
+}
+
+func (r *BucketReader) openIndexHeader(path string) error {
+	f, err := openMmapFile(path)
+	if err != nil {
+		return fmt.Errorf("mapping index header: %w", err)
+	}
+	r.headerFile = f
+	r.header, _, err = readIndexHeaderFile(f.Bytes())
+	return err
+}
+
+// buildIndexHeader writes the index header file at path from ranged reads
+// of the block's index.
+func (r *BucketReader) buildIndexHeader(ctx context.Context, path string) error {
+	name := r.indexName()
+	size, err := r.bucket.Size(ctx, name)
+	if err != nil {
+		return fmt.Errorf("reading index size: %w", err)
+	}
+	if size < indexHeaderSize+indexTOCSize {
+		return fmt.Errorf("index too short: %w", ErrCorrupted)
+	}
+	indexSize := uint64(size)
+
+	toc, err := r.getRange(ctx, name, indexSize-indexTOCSize, indexTOCSize)
+	if err != nil {
+		return fmt.Errorf("reading index table of contents: %w", err)
+	}
+	t, err := readTOC(toc)
+	if err != nil {
+		return err
+	}
+	if t.symbols > t.series || t.series > t.postings || t.postings > t.postingsTable ||
+		t.postingsTable+indexTOCSize > indexSize {
+		return fmt.Errorf("index table of contents: %w", ErrCorrupted)
+	}
+
+	symbols, err := r.getRange(ctx, name, t.symbols, t.series-t.symbols)
+	if err != nil {
+		return fmt.Errorf("reading symbol table: %w", err)
+	}
+	postingsTable, err := r.getRange(ctx, name, t.postingsTable, indexSize-indexTOCSize-t.postingsTable)
+	if err != nil {
+		return fmt.Errorf("reading postings offset table: %w", err)
+	}
+	return writeIndexHeaderFile(path, indexSize, symbols, postingsTable, toc)
+}
+
+func (r *BucketReader) indexName() string {
+	return path.Join(r.meta.ULID.String(), indexFilename)
+}
+
+// Meta returns the block's metadata.
+func (r *BucketReader) Meta() *Meta {
+	return r.meta
+}
+
+// Querier returns a Querier over the block, without the data deleted by the
+// block's tombstones. The block cannot be closed until the querier is.
+func (r *BucketReader) Querier() (metrics.Querier, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.closed {
+		return nil, errReaderClosed
+	}
+	r.pending.Add(1)
+	return &blockQuerier{r: r, tombstones: r.tombstones, release: r.pending.Done}, nil
+}
+
+// Close waits for open queriers to be closed and then unmaps the index
+// header. The index header file is kept.
+func (r *BucketReader) Close() error {
+	r.mtx.Lock()
+	r.closed = true
+	r.mtx.Unlock()
+
+	r.pending.Wait()
+	return r.unmap()
+}
+
+func (r *BucketReader) unmap() error {
+	if r.headerFile == nil {
+		return nil
+	}
+	err := r.headerFile.Close()
+	r.headerFile = nil
+	return err
+}
+
+func (r *BucketReader) indexHeader() *indexHeader {
+	return r.header
+}
+
+func (r *BucketReader) readPostings(offsets []postingsOffset) ([][]uint32, error) {
+	order := make([]int, len(offsets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return offsets[order[i]].offset < offsets[order[j]].offset })
+
+	// The bounds of postings lists are known, so lists close to each other
+	// are read together, exactly.
+	res := make([][]uint32, len(offsets))
+	for i := 0; i < len(order); {
+		start, end := offsets[order[i]].offset, offsets[order[i]].end
+		j := i + 1
+		for j < len(order) && offsets[order[j]].offset <= end+maxRangeGap {
+			end = max(end, offsets[order[j]].end)
+			j++
+		}
+		b, err := r.getRange(context.Background(), r.indexName(), start, end-start)
+		if err != nil {
+			return nil, fmt.Errorf("reading postings: %w", err)
+		}
+		for _, k := range order[i:j] {
+			body, err := section(b, offsets[k].offset-start)
+			if err != nil {
+				return nil, fmt.Errorf("postings: %w", err)
+			}
+			if res[k], err = decodePostings(body); err != nil {
+				return nil, err
+			}
+		}
+		i = j
+	}
+	return res, nil
+}
+
+func (r *BucketReader) readSeries(refs []uint32) ([]*indexSeries, error) {
+	offsets := make([]uint64, len(refs))
+	for i, ref := range refs {
+		if uint64(ref) < r.header.toc.series || uint64(ref) >= r.header.toc.postings {
+			return nil, fmt.Errorf("series %d out of bounds: %w", ref, ErrCorrupted)
+		}
+		offsets[i] = uint64(ref)
+	}
+	entries, err := r.readEntries(r.indexName(), offsets, seriesEntryExtra)
+	if err != nil {
+		return nil, fmt.Errorf("reading series: %w", err)
+	}
+
+	res := make([]*indexSeries, 0, len(refs))
+	for i, e := range entries {
+		s, err := decodeSeries(r.header, e, refs[i])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func (r *BucketReader) readChunks(chunks []ChunkMeta) ([]rawChunk, error) {
+	res := make([]rawChunk, 0, len(chunks))
+	for i := 0; i < len(chunks); {
+		// The chunks in each segment are read together.
+		seq, _ := unpackChunkRef(chunks[i].Ref)
+		var offsets []uint64
+		j := i
+		for ; j < len(chunks); j++ {
+			s, offset := unpackChunkRef(chunks[j].Ref)
+			if s != seq {
+				break
+			}
+			offsets = append(offsets, uint64(offset))
+		}
+
+		name := path.Join(r.meta.ULID.String(), chunksDirname, segmentName(seq))
+		entries, err := r.readEntries(name, offsets, chunkRecordExtra)
+		if err != nil {
+			return nil, fmt.Errorf("reading chunks: %w", err)
+		}
+		for k, e := range entries {
+			chunk, err := decodeChunk(e, chunks[i+k].Ref)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, chunk)
+		}
+		i = j
+	}
+	return res, nil
+}
+
+// readEntries reads the entries at offsets, which are sorted, from the named
+// object: each a uvarint length, a body of that length and extra trailing
+// bytes. Entries close to each other are read with a single request.
+func (r *BucketReader) readEntries(name string, offsets []uint64, extra int) ([][]byte, error) {
+	res := make([][]byte, len(offsets))
+	for i := 0; i < len(offsets); {
+		j := i + 1
+		for j < len(offsets) && offsets[j]-offsets[j-1] <= maxRangeGap {
+			j++
+		}
+		start := offsets[i]
+		b, err := r.getRange(context.Background(), name, start, offsets[j-1]+entrySizeGuess-start)
+		if err != nil {
+			return nil, err
+		}
+		for k := i; k < j; k++ {
+			var e []byte
+			if off := offsets[k] - start; off < uint64(len(b)) {
+				e = b[off:]
+			}
+			if size, ok := entrySize(e, extra); ok && size <= len(e) {
+				res[k] = e[:size]
+				continue
+			}
+			if res[k], err = r.readEntry(name, offsets[k], extra); err != nil {
+				return nil, err
+			}
+		}
+		i = j
+	}
+	return res, nil
+}
+
+// readEntry reads the entry at offset in the named object by itself.
+func (r *BucketReader) readEntry(name string, offset uint64, extra int) ([]byte, error) {
+	b, err := r.getRange(context.Background(), name, offset, entrySizeGuess)
+	if err != nil {
+		return nil, err
+	}
+	size, ok := entrySize(b, extra)
+	if !ok {
+		return nil, fmt.Errorf("entry at %d: %w", offset, ErrCorrupted)
+	}
+	if size > len(b) {
+		if b, err = r.getRange(context.Background(), name, offset, uint64(size)); err != nil {
+			return nil, err
+		}
+	}
+	if size > len(b) {
+		return nil, fmt.Errorf("entry at %d overruns %s: %w", offset, name, ErrCorrupted)
+	}
+	return b[:size], nil
+}
+
+func (r *BucketReader) get(ctx context.Context, name string) ([]byte, error) {
+	rc, err := r.bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// getRange reads length bytes of the named object starting at off, or fewer
+// if the object ends first.
+func (r *BucketReader) getRange(ctx context.Context, name string, off, length uint64) ([]byte, error) {
+	rc, err := r.bucket.GetRange(ctx, name, int64(off), int64(length))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// RemoveIndexHeader removes the cached index header of the block id from
+// cacheDir.
+func RemoveIndexHeader(cacheDir string, id ulid.ULID) error {
+	return os.RemoveAll(filepath.Join(cacheDir, id.String()))
+}
@@ -0,0 +1,204 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBucket records the reads made of the objects of a bucket.
+type countingBucket struct {
+	objstore.Bucket
+
+	mtx        sync.Mutex
+	fullReads  map[string]int
+	rangeReads map[string]int
+}
+
+func (b *countingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.fullReads[filepath.Base(name)]++
+	b.mtx.Unlock()
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *countingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.rangeReads[filepath.Base(name)]++
+	b.mtx.Unlock()
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+// uploadBlock uploads every file of the block in dir to a new bucket.
+func uploadBlock(t *testing.T, dir string) *countingBucket {
+	t.Helper()
+	fsb, err := objstore.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(dir), p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fsb.Put(context.Background(), filepath.ToSlash(rel), f)
+	})
+	require.NoError(t, err)
+	return &countingBucket{Bucket: fsb, fullReads: map[string]int{}, rangeReads: map[string]int{}}
+}
+
+// selectAll returns the series and samples a querier selects.
+func selectAll(t *testing.T, q metrics.Querier, mint, maxt int64, matchers ...*metrics.Matcher) []metrics.Series {
+	t.Helper()
+	set := q.Select(mint, maxt, matchers...)
+	var res []metrics.Series
+	for set.Next() {
+		s := set.At()
+		samples, err := metrics.ExpandSamples(s.Iterator())
+		require.NoError(t, err)
+		res = append(res, &metrics.ListSeries{Def: s.Definition(), Labels: s.LabelSet(), Samples: samples})
+	}
+	require.NoError(t, set.Err())
+	return res
+}
+
+func Test_BucketReader(t *testing.T) {
+	// Enough series, some with labels longer than a guessed entry size, for
+	// series to be read in several batches and requests.
+	series := testSeries()
+	for i := 0; i < 300; i++ {
+		var samples []metrics.Sample
+		for j := int64(0); j < 200; j++ {
+			samples = append(samples, metrics.Sample{Time: 1000 + j*10, Value: float64(i * int(j))})
+		}
+		series = append(series, &metrics.ListSeries{
+			Def:     metrics.MetricDefinition{Name: "bulk", Type: "gauge"},
+			Labels:  map[string]string{"i": fmt.Sprintf("%03d", i), "pad": strings.Repeat("x", i*3)},
+			Samples: samples,
+		})
+	}
+	sort.Slice(series, func(i, j int) bool { return metrics.CompareSeries(series[i], series[j]) < 0 })
+	parent := t.TempDir()
+	meta, err := Write(parent, 0, 10000, metrics.NewListSeriesSet(series))
+	require.NoError(t, err)
+	dir := filepath.Join(parent, meta.ULID.String())
+
+	local, err := Open(dir)
+	require.NoError(t, err)
+	defer local.Close()
+	bucket := uploadBlock(t, dir)
+	cacheDir := t.TempDir()
+	remote, err := OpenBucket(context.Background(), bucket, meta.ULID, cacheDir)
+	require.NoError(t, err)
+	defer remote.Close()
+	assert.Equal(t, meta, remote.Meta())
+
+	tcs := []struct {
+		desc       string
+		mint, maxt int64
+		matchers   []*metrics.Matcher
+	}{
+		{desc: "[POSITIVE] every series", mint: 0, maxt: 10000},
+		{desc: "[POSITIVE] by metric name", mint: 0, maxt: 10000, matchers: []*metrics.Matcher{
+			metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, "up"),
+		}},
+		{desc: "[POSITIVE] by regexp over many values", mint: 0, maxt: 10000, matchers: []*metrics.Matcher{
+			metrics.MustNewMatcher(metrics.MatchRegexp, "i", "0.*|2[0-4].*"),
+		}},
+		{desc: "[POSITIVE] negative matcher", mint: 0, maxt: 10000, matchers: []*metrics.Matcher{
+			metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, "http_requests_total"),
+			metrics.MustNewMatcher(metrics.MatchNotEqual, "method", "get"),
+		}},
+		{desc: "[POSITIVE] samples restricted to the time range", mint: 1500, maxt: 2520, matchers: []*metrics.Matcher{
+			metrics.MustNewMatcher(metrics.MatchRegexp, "i", "1.*"),
+		}},
+		{desc: "[NEGATIVE] no matching series", mint: 0, maxt: 10000, matchers: []*metrics.Matcher{
+			metrics.MustNewMatcher(metrics.MatchEqual, "i", "missing"),
+		}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			lq, err := local.Querier()
+			require.NoError(t, err)
+			defer lq.Close()
+			rq, err := remote.Querier()
+			require.NoError(t, err)
+			defer rq.Close()
+
+			expected := selectAll(t, lq, tc.mint, tc.maxt, tc.matchers...)
+			assert.Equal(t, expected, selectAll(t, rq, tc.mint, tc.maxt, tc.matchers...))
+		})
+	}
+
+	rq, err := remote.Querier()
+	require.NoError(t, err)
+	values, err := rq.LabelValues("method")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"get", "post"}, values)
+	require.NoError(t, rq.Close())
+
+	// The index and chunks are only ever read in ranges.
+	assert.Zero(t, bucket.fullReads[indexFilename])
+	assert.Zero(t, bucket.fullReads[segmentName(1)])
+	assert.NotZero(t, bucket.rangeReads[segmentName(1)])
+
+	// The index header is cached, and rebuilt if it cannot be read.
+	headerPath := filepath.Join(cacheDir, meta.ULID.String(), IndexHeaderFilename)
+	assert.FileExists(t, headerPath)
+	indexReads := bucket.rangeReads[indexFilename]
+	reopened, err := OpenBucket(context.Background(), bucket, meta.ULID, cacheDir)
+	require.NoError(t, err)
+	require.NoError(t, reopened.Close())
+	assert.Equal(t, indexReads, bucket.rangeReads[indexFilename], "reopening reads the cached index header")
+
+	require.NoError(t, os.WriteFile(headerPath, []byte("garbage"), 0o666))
+	reopened, err = OpenBucket(context.Background(), bucket, meta.ULID, cacheDir)
+	require.NoError(t, err)
+	defer reopened.Close()
+	q, err := reopened.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+	assert.Len(t, selectAll(t, q, 0, 10000), len(series))
+}
+
+func Test_BucketReaderTombstones(t *testing.T) {
+	dir, meta := writeTestBlock(t)
+	local, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, local.AddTombstones(metrics.Tombstone{
+		Matchers: []*metrics.Matcher{metrics.MustNewMatcher(metrics.MatchEqual, "method", "get")},
+		MinTime:  0,
+		MaxTime:  10000,
+	}))
+	require.NoError(t, local.Close())
+
+	remote, err := OpenBucket(context.Background(), uploadBlock(t, dir), meta.ULID, t.TempDir())
+	require.NoError(t, err)
+	defer remote.Close()
+	q, err := remote.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+
+	res := selectAll(t, q, 0, 10000, metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, "http_requests_total"))
+	require.Len(t, res, 1)
+	assert.Equal(t, "post", res[0].LabelSet()["method"])
+}
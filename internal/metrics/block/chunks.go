@@ -0,0 +1,353 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+const (
+	chunksDirname = "chunks"
+
+	chunksMagic         uint32 = 0x4B4C4348 // "KLCH"
+	chunksFormatVersion byte   = 1
+	chunksHeaderSize           = 8
+
+	// maxSegmentSize is the size after which a new chunk segment file is
+	// started.
+	maxSegmentSize = 512 * 1024 * 1024
+
+	// maxSamplesPerChunk bounds the number of samples encoded into one chunk.
+	maxSamplesPerChunk = 120
+)
+
+// Encoding identifies how the samples of a chunk are encoded.
+type Encoding byte
+
+const (
+	// EncDeltaXOR encodes timestamps as deltas from the previous timestamp and
+	// values as the XOR of their bits with the previous value's bits.
+	EncDeltaXOR Encoding = 1
+	// EncHistogram encodes timestamps as deltas from the previous timestamp
+	// and native histograms in full.
+	EncHistogram Encoding = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkMeta points to an encoded chunk within a block's chunk segments.
+type ChunkMeta struct {
+	Ref     uint64
+	MinTime int64
+	MaxTime int64
+}
+
+// chunkRef packs a segment sequence number and an offset into it.
+func chunkRef(seq, offset int) uint64 {
+	return uint64(seq)<<32 | uint64(offset)
+}
+
+func unpackChunkRef(ref uint64) (seq, offset int) {
+	return int(ref >> 32), int(ref & math.MaxUint32)
+}
+
+func segmentFilename(dir string, seq int) string {
+	return filepath.Join(dir, chunksDirname, segmentName(seq))
+}
+
+// segmentName returns the name of a chunk segment file within the chunks
+// directory.
+func segmentName(seq int) string {
+	return fmt.Sprintf("%06d", seq)
+}
+
+// encodeChunk encodes samples, which must be sorted by time, with
+// EncDeltaXOR.
+func encodeChunk(samples []metrics.Sample) ([]byte, error) {
+	buf := make([]byte, 0, 16+len(samples)*4)
+	buf = binary.AppendUvarint(buf, uint64(len(samples)))
+
+	var prevT int64
+	var prevV uint64
+	for i, s := range samples {
+		v := math.Float64bits(s.Value)
+		if i == 0 {
+			buf = binary.AppendVarint(buf, s.Time)
+			buf = binary.BigEndian.AppendUint64(buf, v)
+		} else {
+			if s.Time <= prevT {
+				return nil, ErrOutOfOrder
+			}
+			buf = binary.AppendUvarint(buf, uint64(s.Time-prevT))
+			buf = binary.AppendUvarint(buf, v^prevV)
+		}
+		prevT, prevV = s.Time, v
+	}
+	return buf, nil
+}
+
+// encodeHistogramChunk encodes native histogram samples, which must be
+// sorted by time, with EncHistogram.
+func encodeHistogramChunk(samples []metrics.Sample) ([]byte, error) {
+	buf := make([]byte, 0, 16+len(samples)*64)
+	buf = binary.AppendUvarint(buf, uint64(len(samples)))
+
+	var prevT int64
+	for i, s := range samples {
+		if i == 0 {
+			buf = binary.AppendVarint(buf, s.Time)
+		} else {
+			if s.Time <= prevT {
+				return nil, ErrOutOfOrder
+			}
+			buf = binary.AppendUvarint(buf, uint64(s.Time-prevT))
+		}
+		buf = metrics.AppendHistogram(buf, s.Histogram)
+		prevT = s.Time
+	}
+	return buf, nil
+}
+
+// newChunkIterator returns an iterator decoding a chunk with encoding enc.
+func newChunkIterator(enc Encoding, b []byte) metrics.SeriesIterator {
+	switch enc {
+	case EncDeltaXOR:
+		return newXORChunkIterator(b)
+	case EncHistogram:
+		return newHistogramChunkIterator(b)
+	}
+	return &xorChunkIterator{err: fmt.Errorf("chunk encoding %d: %w", enc, ErrInvalidChunk)}
+}
+
+// xorChunkIterator decodes an EncDeltaXOR chunk.
+type xorChunkIterator struct {
+	b     []byte
+	total uint64
+	read  uint64
+	cur   metrics.Sample
+	bits  uint64
+	err   error
+}
+
+var _ metrics.SeriesIterator = (*xorChunkIterator)(nil)
+
+func newXORChunkIterator(b []byte) *xorChunkIterator {
+	it := &xorChunkIterator{}
+	n, sz := binary.Uvarint(b)
+	if sz <= 0 {
+		it.err = ErrInvalidChunk
+		return it
+	}
+	it.b, it.total = b[sz:], n
+	return it
+}
+
+func (it *xorChunkIterator) Next() bool {
+	if it.err != nil || it.read >= it.total {
+		return false
+	}
+	if it.read == 0 {
+		t, sz := binary.Varint(it.b)
+		if sz <= 0 || len(it.b) < sz+8 {
+			it.err = ErrInvalidChunk
+			return false
+		}
+		it.bits = binary.BigEndian.Uint64(it.b[sz:])
+		it.cur.Time = t
+		it.b = it.b[sz+8:]
+	} else {
+		dt, sz := binary.Uvarint(it.b)
+		if sz <= 0 {
+			it.err = ErrInvalidChunk
+			return false
+		}
+		xor, sz2 := binary.Uvarint(it.b[sz:])
+		if sz2 <= 0 {
+			it.err = ErrInvalidChunk
+			return false
+		}
+		it.bits ^= xor
+		it.cur.Time += int64(dt)
+		it.b = it.b[sz+sz2:]
+	}
+	it.cur.Value = math.Float64frombits(it.bits)
+	it.read++
+	return true
+}
+
+func (it *xorChunkIterator) At() metrics.Sample { return it.cur }
+func (it *xorChunkIterator) Err() error         { return it.err }
+
+// histogramChunkIterator decodes an EncHistogram chunk.
+type histogramChunkIterator struct {
+	b     []byte
+	total uint64
+	read  uint64
+	cur   metrics.Sample
+	err   error
+}
+
+var _ metrics.SeriesIterator = (*histogramChunkIterator)(nil)
+
+func newHistogramChunkIterator(b []byte) *histogramChunkIterator {
+	it := &histogramChunkIterator{}
+	n, sz := binary.Uvarint(b)
+	if sz <= 0 {
+		it.err = ErrInvalidChunk
+		return it
+	}
+	it.b, it.total = b[sz:], n
+	return it
+}
+
+func (it *histogramChunkIterator) Next() bool {
+	if it.err != nil || it.read >= it.total {
+		return false
+	}
+	if it.read == 0 {
+		t, sz := binary.Varint(it.b)
+		if sz <= 0 {
+			it.err = ErrInvalidChunk
+			return false
+		}
+		it.cur.Time = t
+		it.b = it.b[sz:]
+	} else {
+		dt, sz := binary.Uvarint(it.b)
+		if sz <= 0 {
+			it.err = ErrInvalidChunk
+			return false
+		}
+		it.cur.Time += int64(dt)
+		it.b = it.b[sz:]
+	}
+	h, sz, err := metrics.DecodeHistogram(it.b)
+	if err != nil {
+		it.err = fmt.Errorf("%w: %w", ErrInvalidChunk, err)
+		return false
+	}
+	it.cur.Histogram = h
+	it.b = it.b[sz:]
+	it.read++
+	return true
+}
+
+func (it *histogramChunkIterator) At() metrics.Sample { return it.cur }
+func (it *histogramChunkIterator) Err() error         { return it.err }
+
+// chunkWriter appends encoded chunks to a block's chunk segment files.
+type chunkWriter struct {
+	dir    string
+	seq    int
+	f      *os.File
+	w      *bufio.Writer
+	offset int
+}
+
+func newChunkWriter(dir string) (*chunkWriter, error) {
+	if err := os.MkdirAll(filepath.Join(dir, chunksDirname), 0o777); err != nil {
+		return nil, fmt.Errorf("creating chunks directory: %w", err)
+	}
+	return &chunkWriter{dir: dir}, nil
+}
+
+// WriteChunks encodes samples into one or more chunks and returns their
+// metadata. Float and native histogram samples are encoded into separate
+// chunks.
+func (cw *chunkWriter) WriteChunks(samples []metrics.Sample) ([]ChunkMeta, error) {
+	var metas []ChunkMeta
+	for len(samples) > 0 {
+		isHistogram := samples[0].Histogram != nil
+		n := 1
+		for n < min(len(samples), maxSamplesPerChunk) && (samples[n].Histogram != nil) == isHistogram {
+			n++
+		}
+		enc, encode := EncDeltaXOR, encodeChunk
+		if isHistogram {
+			enc, encode = EncHistogram, encodeHistogramChunk
+		}
+		data, err := encode(samples[:n])
+		if err != nil {
+			return nil, err
+		}
+		ref, err := cw.write(enc, data)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, ChunkMeta{
+			Ref:     ref,
+			MinTime: samples[0].Time,
+			MaxTime: samples[n-1].Time,
+		})
+		samples = samples[n:]
+	}
+	return metas, nil
+}
+
+func (cw *chunkWriter) write(enc Encoding, data []byte) (uint64, error) {
+	rec := binary.AppendUvarint(nil, uint64(len(data)))
+	rec = append(rec, byte(enc))
+	rec = append(rec, data...)
+	rec = binary.BigEndian.AppendUint32(rec, crc32.Checksum(rec[len(rec)-len(data)-1:], castagnoli))
+
+	if cw.f == nil || cw.offset+len(rec) > maxSegmentSize {
+		if err := cw.cut(); err != nil {
+			return 0, err
+		}
+	}
+
+	ref := chunkRef(cw.seq, cw.offset)
+	if _, err := cw.w.Write(rec); err != nil {
+		return 0, fmt.Errorf("writing chunk: %w", err)
+	}
+	cw.offset += len(rec)
+	return ref, nil
+}
+
+// cut finishes the current segment file and starts a new one.
+func (cw *chunkWriter) cut() error {
+	if err := cw.finishSegment(); err != nil {
+		return err
+	}
+
+	cw.seq++
+	f, err := os.Create(segmentFilename(cw.dir, cw.seq))
+	if err != nil {
+		return fmt.Errorf("creating chunk segment: %w", err)
+	}
+	cw.f, cw.w = f, bufio.NewWriterSize(f, 1<<20)
+
+	header := binary.BigEndian.AppendUint32(nil, chunksMagic)
+	header = append(header, chunksFormatVersion, 0, 0, 0)
+	if _, err := cw.w.Write(header); err != nil {
+		return fmt.Errorf("writing chunk segment header: %w", err)
+	}
+	cw.offset = chunksHeaderSize
+	return nil
+}
+
+func (cw *chunkWriter) finishSegment() error {
+	if cw.f == nil {
+		return nil
+	}
+	if err := cw.w.Flush(); err != nil {
+		return fmt.Errorf("flushing chunk segment: %w", err)
+	}
+	if err := cw.f.Sync(); err != nil {
+		return fmt.Errorf("syncing chunk segment: %w", err)
+	}
+	err := cw.f.Close()
+	cw.f, cw.w = nil, nil
+	return err
+}
+
+// Close flushes and closes the last segment file.
+func (cw *chunkWriter) Close() error {
+	return cw.finishSegment()
+}
@@ -0,0 +1,14 @@
+package block
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidMagic    = errors.New("invalid magic number")
+	ErrInvalidVersion  = errors.New("unsupported format version")
+	ErrInvalidChecksum = errors.New("checksum mismatch")
+	ErrInvalidChunk    = errors.New("invalid chunk")
+	ErrCorrupted       = errors.New("corrupted block data")
+	ErrOutOfOrder      = errors.New("series or samples are not in order")
+)
@@ -0,0 +1,220 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+const (
+	indexFilename = "index"
+
+	indexMagic         uint32 = 0x4B4C4958 // "KLIX"
+	indexFormatVersion byte   = 1
+	indexHeaderSize           = 5
+	indexTOCSize              = 4*8 + 4
+)
+
+// indexSeries is a series as recorded in the index.
+type indexSeries struct {
+	def    metrics.MetricDefinition
+	labels map[string]string
+	chunks []ChunkMeta
+}
+
+// labelPair is a label name and value, used as the key of a postings list.
+type labelPair struct {
+	name, value string
+}
+
+// allPostingsKey is the postings list containing every series in the block.
+var allPostingsKey = labelPair{}
+
+// writeIndex writes the index file for series, which must be sorted by
+// metrics.CompareSeries, to dir.
+func writeIndex(dir string, series []*indexSeries) error {
+	f, err := os.Create(filepath.Join(dir, indexFilename))
+	if err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+	defer f.Close()
+
+	iw := &indexWriter{w: bufio.NewWriterSize(f, 1<<20)}
+	if err := iw.write(series); err != nil {
+		return err
+	}
+	if err := iw.w.Flush(); err != nil {
+		return fmt.Errorf("flushing index: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing index: %w", err)
+	}
+	return f.Close()
+}
+
+type indexWriter struct {
+	w   *bufio.Writer
+	pos uint64
+	err error
+
+	symbols map[string]int
+}
+
+func (iw *indexWriter) write(series []*indexSeries) error {
+	iw.writeBytes(binary.BigEndian.AppendUint32(nil, indexMagic))
+	iw.writeBytes([]byte{indexFormatVersion})
+
+	symbolsOffset := iw.pos
+	iw.writeSymbols(series)
+
+	seriesOffset := iw.pos
+	postings := map[labelPair][]uint32{}
+	for _, s := range series {
+		if iw.pos > math.MaxUint32 {
+			return fmt.Errorf("index series section exceeds 4GiB")
+		}
+		ref := uint32(iw.pos)
+		iw.writeSeries(s)
+
+		postings[allPostingsKey] = append(postings[allPostingsKey], ref)
+		for k, v := range seriesLabels(s) {
+			key := labelPair{k, v}
+			postings[key] = append(postings[key], ref)
+		}
+	}
+
+	postingsOffset := iw.pos
+	keys := make([]labelPair, 0, len(postings))
+	for k := range postings {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].value < keys[j].value
+	})
+	offsets := make([]uint64, len(keys))
+	for i, k := range keys {
+		offsets[i] = iw.pos
+		iw.writePostings(postings[k])
+	}
+
+	postingsTableOffset := iw.pos
+	iw.writePostingsTable(keys, offsets)
+
+	toc := make([]byte, 0, indexTOCSize)
+	toc = binary.BigEndian.AppendUint64(toc, symbolsOffset)
+	toc = binary.BigEndian.AppendUint64(toc, seriesOffset)
+	toc = binary.BigEndian.AppendUint64(toc, postingsOffset)
+	toc = binary.BigEndian.AppendUint64(toc, postingsTableOffset)
+	toc = binary.BigEndian.AppendUint32(toc, crc32.Checksum(toc, castagnoli))
+	iw.writeBytes(toc)
+
+	return iw.err
+}
+
+// seriesLabels returns the labels of s with the metric name included.
+func seriesLabels(s *indexSeries) map[string]string {
+	lbls := make(map[string]string, len(s.labels)+1)
+	for k, v := range s.labels {
+		lbls[k] = v
+	}
+	lbls[metrics.MetricNameLabel] = s.def.Name
+	return lbls
+}
+
+func (iw *indexWriter) writeSymbols(series []*indexSeries) {
+	set := map[string]struct{}{"": {}}
+	for _, s := range series {
+		set[s.def.Type] = struct{}{}
+		set[s.def.Help] = struct{}{}
+		for k, v := range seriesLabels(s) {
+			set[k] = struct{}{}
+			set[v] = struct{}{}
+		}
+	}
+	symbols := make([]string, 0, len(set))
+	for s := range set {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+
+	iw.symbols = make(map[string]int, len(symbols))
+	body := binary.AppendUvarint(nil, uint64(len(symbols)))
+	for i, s := range symbols {
+		iw.symbols[s] = i
+		body = binary.AppendUvarint(body, uint64(len(s)))
+		body = append(body, s...)
+	}
+	iw.writeSection(body)
+}
+
+func (iw *indexWriter) writeSeries(s *indexSeries) {
+	lbls := seriesLabels(s)
+
+	body := binary.AppendUvarint(nil, uint64(len(lbls)))
+	for _, k := range metrics.SortedLabelNames(lbls) {
+		body = binary.AppendUvarint(body, uint64(iw.symbols[k]))
+		body = binary.AppendUvarint(body, uint64(iw.symbols[lbls[k]]))
+	}
+	body = binary.AppendUvarint(body, uint64(iw.symbols[s.def.Type]))
+	body = binary.AppendUvarint(body, uint64(iw.symbols[s.def.Help]))
+	body = binary.AppendUvarint(body, uint64(len(s.chunks)))
+	for _, c := range s.chunks {
+		body = binary.AppendVarint(body, c.MinTime)
+		body = binary.AppendUvarint(body, uint64(c.MaxTime-c.MinTime))
+		body = binary.AppendUvarint(body, c.Ref)
+	}
+
+	entry := binary.AppendUvarint(nil, uint64(len(body)))
+	entry = append(entry, body...)
+	entry = binary.BigEndian.AppendUint32(entry, crc32.Checksum(body, castagnoli))
+	iw.writeBytes(entry)
+}
+
+func (iw *indexWriter) writePostings(refs []uint32) {
+	body := binary.BigEndian.AppendUint32(nil, uint32(len(refs)))
+	for _, ref := range refs {
+		body = binary.BigEndian.AppendUint32(body, ref)
+	}
+	iw.writeSection(body)
+}
+
+func (iw *indexWriter) writePostingsTable(keys []labelPair, offsets []uint64) {
+	body := binary.AppendUvarint(nil, uint64(len(keys)))
+	for i, k := range keys {
+		body = binary.AppendUvarint(body, uint64(len(k.name)))
+		body = append(body, k.name...)
+		body = binary.AppendUvarint(body, uint64(len(k.value)))
+		body = append(body, k.value...)
+		body = binary.AppendUvarint(body, offsets[i])
+	}
+	iw.writeSection(body)
+}
+
+// writeSection writes body prefixed with its length and followed by its
+// checksum.
+func (iw *indexWriter) writeSection(body []byte) {
+	iw.writeBytes(binary.BigEndian.AppendUint32(nil, uint32(len(body))))
+	iw.writeBytes(body)
+	iw.writeBytes(binary.BigEndian.AppendUint32(nil, crc32.Checksum(body, castagnoli)))
+}
+
+func (iw *indexWriter) writeBytes(b []byte) {
+	if iw.err != nil {
+		return
+	}
+	n, err := iw.w.Write(b)
+	iw.pos += uint64(n)
+	if err != nil {
+		iw.err = fmt.Errorf("writing index: %w", err)
+	}
+}
@@ -0,0 +1,236 @@
+package block
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// IndexHeaderFilename is the file a block's index header is cached in.
+	IndexHeaderFilename = "index-header"
+
+	indexHeaderMagic         uint32 = 0x4B4C4948 // "KLIH"
+	indexHeaderFormatVersion byte   = 1
+	// indexHeaderPrefixSize is the size of the index header file's magic
+	// number, version and index size.
+	indexHeaderPrefixSize = 4 + 1 + 8
+)
+
+// indexTOC is the table of contents of an index, holding the offset of each
+// of its sections.
+type indexTOC struct {
+	symbols       uint64
+	series        uint64
+	postings      uint64
+	postingsTable uint64
+}
+
+// readTOC decodes the table of contents at the end of an index, verifying
+// its checksum.
+func readTOC(b []byte) (indexTOC, error) {
+	if len(b) < indexTOCSize {
+		return indexTOC{}, fmt.Errorf("index table of contents too short: %w", ErrCorrupted)
+	}
+	toc := b[len(b)-indexTOCSize:]
+	if crc32.Checksum(toc[:indexTOCSize-4], castagnoli) != binary.BigEndian.Uint32(toc[indexTOCSize-4:]) {
+		return indexTOC{}, fmt.Errorf("index table of contents: %w", ErrInvalidChecksum)
+	}
+	return indexTOC{
+		symbols:       binary.BigEndian.Uint64(toc[0:]),
+		series:        binary.BigEndian.Uint64(toc[8:]),
+		postings:      binary.BigEndian.Uint64(toc[16:]),
+		postingsTable: binary.BigEndian.Uint64(toc[24:]),
+	}, nil
+}
+
+// indexHeader holds the parts of an index needed to find the series
+// matching a query: its symbol table and postings offset table. The series
+// entries and postings lists themselves are read from the index as needed.
+type indexHeader struct {
+	// b holds the symbol table.
+	b   []byte
+	toc indexTOC
+
+	// symbols holds the offset within b of each symbol.
+	symbols []uint32
+	// postings maps label names to the postings lists of their values.
+	postings map[string][]postingsOffset
+}
+
+// postingsOffset locates the postings list of a label value within the
+// index.
+type postingsOffset struct {
+	value string
+	// offset and end bound the postings list's section.
+	offset, end uint64
+}
+
+// readSymbols reads the symbol table section at offset within h.b.
+func (h *indexHeader) readSymbols(offset uint64) error {
+	body, err := section(h.b, offset)
+	if err != nil {
+		return fmt.Errorf("symbol table: %w", err)
+	}
+	d := decbuf{b: body}
+	n := d.uvarint()
+	h.symbols = make([]uint32, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		h.symbols = append(h.symbols, uint32(offset+4+uint64(len(body)-len(d.b))))
+		d.skip(int(d.uvarint()))
+	}
+	if d.err != nil {
+		return fmt.Errorf("symbol table: %w", d.err)
+	}
+	return nil
+}
+
+func (h *indexHeader) symbol(ref uint64) (string, error) {
+	if ref >= uint64(len(h.symbols)) {
+		return "", fmt.Errorf("symbol %d out of range: %w", ref, ErrCorrupted)
+	}
+	d := decbuf{b: h.b[h.symbols[ref]:]}
+	s := d.bytes(int(d.uvarint()))
+	return string(s), d.err
+}
+
+// readPostingsTable reads the postings offset table section at offset
+// within h.b.
+func (h *indexHeader) readPostingsTable(offset uint64) error {
+	body, err := section(h.b, offset)
+	if err != nil {
+		return fmt.Errorf("postings offset table: %w", err)
+	}
+	d := decbuf{b: body}
+	n := d.uvarint()
+	h.postings = map[string][]postingsOffset{}
+	var all []*postingsOffset
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		name := string(d.bytes(int(d.uvarint())))
+		value := string(d.bytes(int(d.uvarint())))
+		h.postings[name] = append(h.postings[name], postingsOffset{value: value, offset: d.uvarint()})
+	}
+	if d.err != nil {
+		return fmt.Errorf("postings offset table: %w", d.err)
+	}
+
+	// Postings lists are written back to back, followed by the postings
+	// offset table, so each ends where the next begins.
+	for name := range h.postings {
+		for i := range h.postings[name] {
+			all = append(all, &h.postings[name][i])
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].offset < all[j].offset })
+	for i, po := range all {
+		po.end = h.toc.postingsTable
+		if i+1 < len(all) {
+			po.end = all[i+1].offset
+		}
+		if po.offset < h.toc.postings || po.end > h.toc.postingsTable {
+			return fmt.Errorf("postings list offset %d out of bounds: %w", po.offset, ErrCorrupted)
+		}
+	}
+	return nil
+}
+
+// lookup returns the postings list of a label value.
+func (h *indexHeader) lookup(name, value string) (postingsOffset, bool) {
+	offsets := h.postings[name]
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i].value >= value })
+	if i == len(offsets) || offsets[i].value != value {
+		return postingsOffset{}, false
+	}
+	return offsets[i], true
+}
+
+// newIndexHeader reads the index header of the whole index in b.
+func newIndexHeader(b []byte) (*indexHeader, error) {
+	if len(b) < indexHeaderSize+indexTOCSize {
+		return nil, fmt.Errorf("index too short: %w", ErrCorrupted)
+	}
+	if binary.BigEndian.Uint32(b) != indexMagic {
+		return nil, fmt.Errorf("index: %w", ErrInvalidMagic)
+	}
+	if b[4] != indexFormatVersion {
+		return nil, fmt.Errorf("index version %d: %w", b[4], ErrInvalidVersion)
+	}
+	toc, err := readTOC(b)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &indexHeader{b: b, toc: toc}
+	if err := h.readSymbols(toc.symbols); err != nil {
+		return nil, err
+	}
+	if err := h.readPostingsTable(toc.postingsTable); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// An index header file caches the sections of an index which make up its
+// index header, so that they need not be read from object storage again:
+//
+//	magic <4b> │ version <1b> │ index size <8b> │ symbol table │ postings offset table │ TOC
+//
+// The symbol table, postings offset table and table of contents are copied
+// from the index as they are, checksums included.
+
+// writeIndexHeaderFile writes an index header file to path from the sections
+// of an index of indexSize bytes, replacing the file atomically.
+func writeIndexHeaderFile(path string, indexSize uint64, symbols, postingsTable, toc []byte) error {
+	b := binary.BigEndian.AppendUint32(nil, indexHeaderMagic)
+	b = append(b, indexHeaderFormatVersion)
+	b = binary.BigEndian.AppendUint64(b, indexSize)
+	b = append(b, symbols...)
+	b = append(b, postingsTable...)
+	b = append(b, toc...)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return fmt.Errorf("creating index header directory: %w", err)
+	}
+	if err := writeFileSync(path+tmpSuffix, b); err != nil {
+		return fmt.Errorf("writing index header: %w", err)
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return fmt.Errorf("writing index header: %w", err)
+	}
+	return nil
+}
+
+// readIndexHeaderFile reads the index header file in b, returning the index
+// header and the size of the index it was read from.
+func readIndexHeaderFile(b []byte) (*indexHeader, uint64, error) {
+	if len(b) < indexHeaderPrefixSize+indexTOCSize {
+		return nil, 0, fmt.Errorf("index header too short: %w", ErrCorrupted)
+	}
+	if binary.BigEndian.Uint32(b) != indexHeaderMagic {
+		return nil, 0, fmt.Errorf("index header: %w", ErrInvalidMagic)
+	}
+	if b[4] != indexHeaderFormatVersion {
+		return nil, 0, fmt.Errorf("index header version %d: %w", b[4], ErrInvalidVersion)
+	}
+	indexSize := binary.BigEndian.Uint64(b[5:])
+	toc, err := readTOC(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if toc.symbols > toc.series || toc.postingsTable+indexTOCSize > indexSize ||
+		indexHeaderPrefixSize+(toc.series-toc.symbols)+(indexSize-indexTOCSize-toc.postingsTable)+indexTOCSize != uint64(len(b)) {
+		return nil, 0, fmt.Errorf("index header sections: %w", ErrCorrupted)
+	}
+
+	h := &indexHeader{b: b, toc: toc}
+	if err := h.readSymbols(indexHeaderPrefixSize); err != nil {
+		return nil, 0, err
+	}
+	if err := h.readPostingsTable(indexHeaderPrefixSize + toc.series - toc.symbols); err != nil {
+		return nil, 0, err
+	}
+	return h, indexSize, nil
+}
@@ -0,0 +1,135 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	metaFilename = "meta.json"
+	metaVersion  = 1
+)
+
+// Meta describes a persisted block. It is stored as meta.json in the block's
+// directory.
+type Meta struct {
+	ULID ulid.ULID `json:"ulid"`
+	// MinTime and MaxTime bound the samples in the block as [MinTime, MaxTime).
+	MinTime    int64           `json:"minTime"`
+	MaxTime    int64           `json:"maxTime"`
+	Stats      BlockStats      `json:"stats"`
+	Compaction BlockCompaction `json:"compaction"`
+	// Downsample is set for blocks of aggregates downsampled from another.
+	Downsample *BlockDownsample `json:"downsample,omitempty"`
+	Version    int              `json:"version"`
+}
+
+// Resolution returns the width, in seconds, of the windows the block's
+// samples aggregate, or zero for blocks of raw samples.
+func (m *Meta) Resolution() int64 {
+	if m.Downsample == nil {
+		return 0
+	}
+	return m.Downsample.Resolution
+}
+
+// Source returns the ULID of the block of raw samples the block's data came
+// from: that of the block itself unless it is downsampled.
+func (m *Meta) Source() ulid.ULID {
+	if m.Downsample == nil {
+		return m.ULID
+	}
+	return m.Downsample.Source
+}
+
+// BlockDownsample records which block a downsampled block was produced
+// from.
+type BlockDownsample struct {
+	// Resolution is the width, in seconds, of the windows each sample
+	// aggregates.
+	Resolution int64 `json:"resolution"`
+	// Source is the block of raw samples the block's aggregates were
+	// computed from, possibly through a block of a finer resolution.
+	Source ulid.ULID `json:"source"`
+}
+
+// BlockCompaction records how a block came to be.
+type BlockCompaction struct {
+	// Level is 1 for blocks persisted from the active block, and one more
+	// than the highest level of its parents for compacted blocks.
+	Level int `json:"level"`
+	// Sources are the level 1 blocks whose data the block holds.
+	Sources []ulid.ULID `json:"sources,omitempty"`
+	// Parents are the blocks compacted into this one.
+	Parents []ulid.ULID `json:"parents,omitempty"`
+}
+
+// BlockStats holds counts of the data held in a block.
+type BlockStats struct {
+	NumSamples uint64 `json:"numSamples"`
+	NumSeries  uint64 `json:"numSeries"`
+	NumChunks  uint64 `json:"numChunks"`
+}
+
+// ReadMeta reads the meta.json of the block in dir.
+func ReadMeta(dir string) (*Meta, error) {
+	b, err := os.ReadFile(filepath.Join(dir, metaFilename))
+	if err != nil {
+		return nil, fmt.Errorf("reading block meta: %w", err)
+	}
+	return DecodeMeta(b)
+}
+
+// DecodeMeta decodes the contents of a meta.json.
+func DecodeMeta(b []byte) (*Meta, error) {
+	var m Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decoding block meta: %w", err)
+	}
+	if m.Version != metaVersion {
+		return nil, fmt.Errorf("block meta version %d: %w", m.Version, ErrInvalidVersion)
+	}
+	return &m, nil
+}
+
+func writeMeta(dir string, m *Meta) error {
+	m.Version = metaVersion
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding block meta: %w", err)
+	}
+	return writeFileSync(filepath.Join(dir, metaFilename), b)
+}
+
+// writeFileSync writes b to a new file at path and fsyncs it.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sortMetas orders metas by MinTime, breaking ties by ULID.
+func sortMetas(metas []*Meta) {
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].MinTime != metas[j].MinTime {
+			return metas[i].MinTime < metas[j].MinTime
+		}
+		return metas[i].ULID.Compare(metas[j].ULID) < 0
+	})
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package block
+
+import (
+	"os"
+)
+
+// mmapFile holds a whole file in memory on platforms without mmap support.
+type mmapFile struct {
+	b []byte
+}
+
+func openMmapFile(path string) (*mmapFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapFile{b: b}, nil
+}
+
+func (f *mmapFile) Bytes() []byte {
+	return f.b
+}
+
+func (f *mmapFile) Close() error {
+	f.b = nil
+	return nil
+}
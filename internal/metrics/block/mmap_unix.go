@@ -0,0 +1,49 @@
+//go:build unix
+
+package block
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapFile is a read only memory mapping of a whole file.
+type mmapFile struct {
+	b []byte
+}
+
+func openMmapFile(path string) (*mmapFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", path, err)
+	}
+	if info.Size() == 0 {
+		return &mmapFile{}, nil
+	}
+
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap %s: %w", path, err)
+	}
+	return &mmapFile{b: b}, nil
+}
+
+func (f *mmapFile) Bytes() []byte {
+	return f.b
+}
+
+func (f *mmapFile) Close() error {
+	if f.b == nil {
+		return nil
+	}
+	err := syscall.Munmap(f.b)
+	f.b = nil
+	return err
+}
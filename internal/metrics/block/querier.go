@@ -0,0 +1,294 @@
+package block
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// seriesBatchSize is the number of series a blockSeriesSet decodes at once.
+const seriesBatchSize = 64
+
+// blockReader reads the data of a persisted block, from local disk or from
+// object storage.
+type blockReader interface {
+	Meta() *Meta
+	indexHeader() *indexHeader
+	// readPostings returns the postings list at each offset.
+	readPostings(offsets []postingsOffset) ([][]uint32, error)
+	// readSeries decodes the series at refs, which are sorted.
+	readSeries(refs []uint32) ([]*indexSeries, error)
+	// readChunks returns the chunks of a series, which are sorted by
+	// reference.
+	readChunks(chunks []ChunkMeta) ([]rawChunk, error)
+}
+
+// blockQuerier implements metrics.Querier over a persisted block.
+type blockQuerier struct {
+	r          blockReader
+	tombstones []metrics.Tombstone
+	// release is called when the querier is closed.
+	release   func()
+	closeOnce sync.Once
+}
+
+var _ metrics.Querier = (*blockQuerier)(nil)
+
+func (q *blockQuerier) Select(mint, maxt int64, matchers ...*metrics.Matcher) metrics.SeriesSet {
+	if meta := q.r.Meta(); maxt < meta.MinTime || mint >= meta.MaxTime {
+		return metrics.NewListSeriesSet(nil)
+	}
+
+	refs, err := q.postingsForMatchers(matchers)
+	if err != nil {
+		return metrics.ErrSeriesSet(err)
+	}
+	return metrics.NewTombstoneSeriesSet(&blockSeriesSet{r: q.r, refs: refs, mint: mint, maxt: maxt}, q.tombstones)
+}
+
+// postingsForMatchers returns the sorted references of the series satisfying
+// every matcher.
+func (q *blockQuerier) postingsForMatchers(matchers []*metrics.Matcher) ([]uint32, error) {
+	var (
+		refs     []uint32
+		have     bool
+		excluded []uint32
+	)
+	h := q.r.indexHeader()
+	for _, m := range matchers {
+		// Matchers which match the empty string also select series without
+		// the label, so they are applied by excluding the values they reject.
+		matchesEmpty := m.Matches("")
+
+		var offsets []postingsOffset
+		for _, po := range h.postings[m.Name] {
+			if m.Matches(po.value) != matchesEmpty {
+				offsets = append(offsets, po)
+			}
+		}
+		lists, err := q.r.readPostings(offsets)
+		if err != nil {
+			return nil, err
+		}
+
+		if matchesEmpty {
+			excluded = unionPostings(append(lists, excluded)...)
+			continue
+		}
+		union := unionPostings(lists...)
+		if !have {
+			refs, have = union, true
+		} else {
+			refs = intersectPostings(refs, union)
+		}
+	}
+
+	if !have {
+		if po, ok := h.lookup(allPostingsKey.name, allPostingsKey.value); ok {
+			lists, err := q.r.readPostings([]postingsOffset{po})
+			if err != nil {
+				return nil, err
+			}
+			refs = lists[0]
+		}
+	}
+	return subtractPostings(refs, excluded), nil
+}
+
+func (q *blockQuerier) LabelNames() ([]string, error) {
+	postings := q.r.indexHeader().postings
+	names := make([]string, 0, len(postings))
+	for name := range postings {
+		if name != allPostingsKey.name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (q *blockQuerier) LabelValues(name string) ([]string, error) {
+	if name == allPostingsKey.name {
+		return nil, nil
+	}
+	offsets := q.r.indexHeader().postings[name]
+	values := make([]string, 0, len(offsets))
+	for _, po := range offsets {
+		values = append(values, po.value)
+	}
+	return values, nil
+}
+
+func (q *blockQuerier) Close() error {
+	q.closeOnce.Do(q.release)
+	return nil
+}
+
+// blockSeriesSet lazily decodes the series at refs, a batch at a time.
+type blockSeriesSet struct {
+	r          blockReader
+	refs       []uint32
+	batch      []*indexSeries
+	mint, maxt int64
+
+	cur metrics.Series
+	err error
+}
+
+func (s *blockSeriesSet) Next() bool {
+	for s.err == nil {
+		if len(s.batch) == 0 {
+			if len(s.refs) == 0 {
+				return false
+			}
+			n := min(len(s.refs), seriesBatchSize)
+			batch, err := s.r.readSeries(s.refs[:n])
+			if err != nil {
+				s.err = err
+				return false
+			}
+			s.batch, s.refs = batch, s.refs[n:]
+		}
+		series := s.batch[0]
+		s.batch = s.batch[1:]
+
+		var chunks []ChunkMeta
+		for _, c := range series.chunks {
+			if c.MaxTime >= s.mint && c.MinTime <= s.maxt {
+				chunks = append(chunks, c)
+			}
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+		s.cur = &blockSeries{
+			r:      s.r,
+			def:    series.def,
+			labels: series.labels,
+			chunks: chunks,
+			mint:   s.mint,
+			maxt:   s.maxt,
+		}
+		return true
+	}
+	return false
+}
+
+func (s *blockSeriesSet) At() metrics.Series { return s.cur }
+func (s *blockSeriesSet) Err() error         { return s.err }
+
+type blockSeries struct {
+	r          blockReader
+	def        metrics.MetricDefinition
+	labels     map[string]string
+	chunks     []ChunkMeta
+	mint, maxt int64
+}
+
+func (s *blockSeries) Definition() metrics.MetricDefinition { return s.def }
+func (s *blockSeries) LabelSet() map[string]string          { return s.labels }
+
+func (s *blockSeries) Iterator() metrics.SeriesIterator {
+	return &blockSeriesIterator{s: s, chunks: s.chunks}
+}
+
+// blockSeriesIterator reads a series' chunks, all at once, and decodes them
+// in turn, skipping samples outside the selected time range.
+type blockSeriesIterator struct {
+	s      *blockSeries
+	chunks []ChunkMeta
+	raw    []rawChunk
+	chunk  metrics.SeriesIterator
+	err    error
+}
+
+func (it *blockSeriesIterator) Next() bool {
+	if it.raw == nil && len(it.chunks) > 0 {
+		raw, err := it.s.r.readChunks(it.chunks)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.raw, it.chunks = raw, nil
+	}
+	for it.err == nil {
+		if it.chunk == nil {
+			if len(it.raw) == 0 {
+				return false
+			}
+			it.chunk = newChunkIterator(it.raw[0].enc, it.raw[0].data)
+			it.raw = it.raw[1:]
+		}
+
+		for it.chunk.Next() {
+			t := it.chunk.At().Time
+			if t > it.s.maxt {
+				it.raw = nil
+				break
+			}
+			if t >= it.s.mint {
+				return true
+			}
+		}
+		if err := it.chunk.Err(); err != nil {
+			it.err = err
+			return false
+		}
+		it.chunk = nil
+	}
+	return false
+}
+
+func (it *blockSeriesIterator) At() metrics.Sample { return it.chunk.At() }
+func (it *blockSeriesIterator) Err() error         { return it.err }
+
+func intersectPostings(a, b []uint32) []uint32 {
+	var res []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+func unionPostings(lists ...[]uint32) []uint32 {
+	set := map[uint32]struct{}{}
+	for _, list := range lists {
+		for _, ref := range list {
+			set[ref] = struct{}{}
+		}
+	}
+	res := make([]uint32, 0, len(set))
+	for ref := range set {
+		res = append(res, ref)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func subtractPostings(a, b []uint32) []uint32 {
+	if len(b) == 0 {
+		return a
+	}
+	var res []uint32
+	j := 0
+	for _, ref := range a {
+		for j < len(b) && b[j] < ref {
+			j++
+		}
+		if j < len(b) && b[j] == ref {
+			continue
+		}
+		res = append(res, ref)
+	}
+	return res
+}
@@ -0,0 +1,416 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+var errReaderClosed = errors.New("block reader closed")
+
+// Reader reads a persisted block through read only memory mappings of its
+// index and chunk segment files, so that only the pages a query touches are
+// loaded.
+type Reader struct {
+	dir  string
+	meta *Meta
+	// size is the number of bytes the block occupies on disk.
+	size int64
+
+	index    *mmapFile
+	segments []*mmapFile
+	header   *indexHeader
+
+	mtx sync.Mutex
+	// tombstones record data deleted from the block since it was written.
+	tombstones []metrics.Tombstone
+	closed     bool
+	pending    sync.WaitGroup
+}
+
+// Open opens the persisted block in dir for reading, verifying the
+// checksums of its index table of contents, symbol table and postings
+// offset table.
+func Open(dir string) (*Reader, error) {
+	meta, err := ReadMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{dir: dir, meta: meta}
+	if err := r.open(); err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("opening block %s: %w", meta.ULID, err)
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("opening block %s: %w", meta.ULID, err)
+	}
+	r.size = size
+	if r.tombstones, err = ReadTombstones(dir); err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("opening block %s: %w", meta.ULID, err)
+	}
+	return r, nil
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("measuring block size: %w", err)
+	}
+	return size, nil
+}
+
+func (r *Reader) open() error {
+	index, err := openMmapFile(filepath.Join(r.dir, indexFilename))
+	if err != nil {
+		return fmt.Errorf("mapping index: %w", err)
+	}
+	r.index = index
+
+	if r.header, err = newIndexHeader(index.Bytes()); err != nil {
+		return err
+	}
+	return r.openSegments()
+}
+
+// section returns the body of the length prefixed, checksummed section at
+// offset within b.
+func section(b []byte, offset uint64) ([]byte, error) {
+	if offset+4 > uint64(len(b)) {
+		return nil, fmt.Errorf("section offset %d out of bounds: %w", offset, ErrCorrupted)
+	}
+	l := uint64(binary.BigEndian.Uint32(b[offset:]))
+	start, end := offset+4, offset+4+l
+	if end+4 > uint64(len(b)) {
+		return nil, fmt.Errorf("section at %d overruns file: %w", offset, ErrCorrupted)
+	}
+	body := b[start:end]
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(b[end:]) {
+		return nil, fmt.Errorf("section at %d: %w", offset, ErrInvalidChecksum)
+	}
+	return body, nil
+}
+
+func (r *Reader) openSegments() error {
+	entries, err := os.ReadDir(filepath.Join(r.dir, chunksDirname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("listing chunk segments: %w", err)
+	}
+
+	for i, e := range entries {
+		if e.Name() != filepath.Base(segmentFilename(r.dir, i+1)) {
+			return fmt.Errorf("unexpected chunk segment %s: %w", e.Name(), ErrCorrupted)
+		}
+		seg, err := openMmapFile(filepath.Join(r.dir, chunksDirname, e.Name()))
+		if err != nil {
+			return fmt.Errorf("mapping chunk segment: %w", err)
+		}
+		r.segments = append(r.segments, seg)
+
+		b := seg.Bytes()
+		if len(b) < chunksHeaderSize || binary.BigEndian.Uint32(b) != chunksMagic {
+			return fmt.Errorf("chunk segment %s: %w", e.Name(), ErrInvalidMagic)
+		}
+		if b[4] != chunksFormatVersion {
+			return fmt.Errorf("chunk segment %s version %d: %w", e.Name(), b[4], ErrInvalidVersion)
+		}
+	}
+	return nil
+}
+
+// Meta returns the block's metadata.
+func (r *Reader) Meta() *Meta {
+	return r.meta
+}
+
+// Size returns the number of bytes the block occupies on disk.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Dir returns the block's directory.
+func (r *Reader) Dir() string {
+	return r.dir
+}
+
+// Querier returns a Querier over the block, without the data deleted by the
+// block's tombstones. The block cannot be closed until the querier is.
+func (r *Reader) Querier() (metrics.Querier, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.closed {
+		return nil, errReaderClosed
+	}
+	r.pending.Add(1)
+	return &blockQuerier{r: r, tombstones: r.tombstones, release: r.pending.Done}, nil
+}
+
+func (r *Reader) indexHeader() *indexHeader {
+	return r.header
+}
+
+// Close waits for open queriers to be closed and then unmaps the block's
+// files.
+func (r *Reader) Close() error {
+	r.mtx.Lock()
+	r.closed = true
+	r.mtx.Unlock()
+
+	r.pending.Wait()
+	return r.unmap()
+}
+
+func (r *Reader) unmap() error {
+	var errs []error
+	if r.index != nil {
+		errs = append(errs, r.index.Close())
+	}
+	for _, seg := range r.segments {
+		errs = append(errs, seg.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Reader) readSeries(refs []uint32) ([]*indexSeries, error) {
+	b := r.index.Bytes()
+	res := make([]*indexSeries, 0, len(refs))
+	for _, ref := range refs {
+		if uint64(ref) >= uint64(len(b)) {
+			return nil, fmt.Errorf("series %d out of bounds: %w", ref, ErrCorrupted)
+		}
+		s, err := decodeSeries(r.header, b[ref:], ref)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func (r *Reader) readPostings(offsets []postingsOffset) ([][]uint32, error) {
+	res := make([][]uint32, 0, len(offsets))
+	for _, po := range offsets {
+		body, err := section(r.index.Bytes(), po.offset)
+		if err != nil {
+			return nil, fmt.Errorf("postings: %w", err)
+		}
+		refs, err := decodePostings(body)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, refs)
+	}
+	return res, nil
+}
+
+func (r *Reader) readChunks(chunks []ChunkMeta) ([]rawChunk, error) {
+	res := make([]rawChunk, 0, len(chunks))
+	for _, c := range chunks {
+		seq, offset := unpackChunkRef(c.Ref)
+		if seq < 1 || seq > len(r.segments) {
+			return nil, fmt.Errorf("chunk segment %d: %w", seq, ErrCorrupted)
+		}
+		b := r.segments[seq-1].Bytes()
+		if offset >= len(b) {
+			return nil, fmt.Errorf("chunk offset %d out of bounds: %w", offset, ErrCorrupted)
+		}
+		chunk, err := decodeChunk(b[offset:], c.Ref)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, chunk)
+	}
+	return res, nil
+}
+
+// entrySize returns the size of the entry at the start of b: a uvarint
+// length, a body of that length and extra trailing bytes. ok is false if b is
+// too short to hold the length.
+func entrySize(b []byte, extra int) (size int, ok bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > math.MaxInt32 {
+		return 0, false
+	}
+	return n + int(l) + extra, true
+}
+
+// seriesEntryExtra is the size of the checksum following a series entry's
+// body.
+const seriesEntryExtra = 4
+
+// decodeSeries decodes the series entry at the start of b, at ref within the
+// index, verifying its checksum. Its symbols are looked up in h.
+func decodeSeries(h *indexHeader, b []byte, ref uint32) (*indexSeries, error) {
+	d := decbuf{b: b}
+	body := d.bytes(int(d.uvarint()))
+	crc := d.be32()
+	if d.err != nil {
+		return nil, fmt.Errorf("series %d: %w", ref, d.err)
+	}
+	if crc32.Checksum(body, castagnoli) != crc {
+		return nil, fmt.Errorf("series %d: %w", ref, ErrInvalidChecksum)
+	}
+
+	d = decbuf{b: body}
+	s := &indexSeries{labels: map[string]string{}}
+	n := d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		k, err := h.symbol(d.uvarint())
+		if err != nil {
+			return nil, err
+		}
+		v, err := h.symbol(d.uvarint())
+		if err != nil {
+			return nil, err
+		}
+		if k == metrics.MetricNameLabel {
+			s.def.Name = v
+		} else {
+			s.labels[k] = v
+		}
+	}
+	var err error
+	if s.def.Type, err = h.symbol(d.uvarint()); err != nil {
+		return nil, err
+	}
+	if s.def.Help, err = h.symbol(d.uvarint()); err != nil {
+		return nil, err
+	}
+	n = d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		mint := d.varint()
+		maxt := mint + int64(d.uvarint())
+		s.chunks = append(s.chunks, ChunkMeta{Ref: d.uvarint(), MinTime: mint, MaxTime: maxt})
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("series %d: %w", ref, d.err)
+	}
+	return s, nil
+}
+
+// decodePostings decodes the body of a postings list section.
+func decodePostings(body []byte) ([]uint32, error) {
+	d := decbuf{b: body}
+	n := d.be32()
+	refs := make([]uint32, 0, n)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		refs = append(refs, d.be32())
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("postings: %w", d.err)
+	}
+	return refs, nil
+}
+
+// rawChunk is an encoded chunk.
+type rawChunk struct {
+	enc  Encoding
+	data []byte
+}
+
+// chunkRecordExtra is the size of the encoding preceding a chunk record's
+// data and the checksum following it.
+const chunkRecordExtra = 1 + 4
+
+// decodeChunk decodes the chunk record at the start of b, at ref within the
+// block's chunk segments, verifying its checksum.
+func decodeChunk(b []byte, ref uint64) (rawChunk, error) {
+	d := decbuf{b: b}
+	l := int(d.uvarint())
+	rec := d.bytes(l + 1)
+	crc := d.be32()
+	if d.err != nil {
+		return rawChunk{}, fmt.Errorf("chunk %d: %w", ref, d.err)
+	}
+	if crc32.Checksum(rec, castagnoli) != crc {
+		return rawChunk{}, fmt.Errorf("chunk %d: %w", ref, ErrInvalidChecksum)
+	}
+	return rawChunk{enc: Encoding(rec[0]), data: rec[1:]}, nil
+}
+
+// decbuf decodes values from a byte slice, recording the first error.
+type decbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *decbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) be32() uint32 {
+	b := d.bytes(4)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decbuf) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = ErrCorrupted
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decbuf) skip(n int) {
+	d.bytes(n)
+}
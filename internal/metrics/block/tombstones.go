@@ -0,0 +1,87 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+const (
+	tombstonesFilename = "tombstones.json"
+	tombstonesVersion  = 1
+)
+
+// tombstonesFile is the contents of a block's tombstones.json, recording
+// data deleted from the block since it was written.
+type tombstonesFile struct {
+	Version    int                 `json:"version"`
+	Tombstones []metrics.Tombstone `json:"tombstones"`
+}
+
+// ReadTombstones reads the tombstones file in dir, e.g. that of a block. A
+// directory without a tombstones file has no tombstones.
+func ReadTombstones(dir string) ([]metrics.Tombstone, error) {
+	b, err := os.ReadFile(filepath.Join(dir, tombstonesFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading tombstones: %w", err)
+	}
+	return decodeTombstones(b)
+}
+
+// decodeTombstones decodes the contents of a tombstones.json.
+func decodeTombstones(b []byte) ([]metrics.Tombstone, error) {
+	var f tombstonesFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("decoding tombstones: %w", err)
+	}
+	if f.Version != tombstonesVersion {
+		return nil, fmt.Errorf("tombstones version %d: %w", f.Version, ErrInvalidVersion)
+	}
+	return f.Tombstones, nil
+}
+
+// WriteTombstones replaces the tombstones file in dir, e.g. that of a block.
+// The file is written under a temporary name and renamed into place, so it
+// is either whole or left as it was.
+func WriteTombstones(dir string, tombstones []metrics.Tombstone) error {
+	b, err := json.MarshalIndent(tombstonesFile{Version: tombstonesVersion, Tombstones: tombstones}, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding tombstones: %w", err)
+	}
+	path := filepath.Join(dir, tombstonesFilename)
+	if err := writeFileSync(path+tmpSuffix, b); err != nil {
+		return fmt.Errorf("writing tombstones: %w", err)
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return fmt.Errorf("writing tombstones: %w", err)
+	}
+	return nil
+}
+
+// Tombstones returns the tombstones recorded against the block.
+func (r *Reader) Tombstones() []metrics.Tombstone {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.tombstones
+}
+
+// AddTombstones records tombstones against the block. Queriers opened
+// afterwards no longer return the data they delete.
+func (r *Reader) AddTombstones(tombstones ...metrics.Tombstone) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	all := append(append([]metrics.Tombstone(nil), r.tombstones...), tombstones...)
+	if err := WriteTombstones(r.dir, all); err != nil {
+		return fmt.Errorf("block %s: %w", r.meta.ULID, err)
+	}
+	r.tombstones = all
+	return nil
+}
@@ -0,0 +1,284 @@
+package block
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/oklog/ulid/v2"
+)
+
+// tmpSuffix marks a block directory which is still being written. Such
+// directories are left behind by a crash and removed on startup.
+const tmpSuffix = ".tmp"
+
+// Write persists the samples of set within [mint, maxt) as a new block in a
+// directory under parentDir, named after the block's ULID. The block is
+// written to a temporary directory which is renamed into place once
+// complete, so a block directory is either whole or absent.
+func Write(parentDir string, mint, maxt int64, set metrics.SeriesSet) (*Meta, error) {
+	meta := &Meta{
+		ULID:    newULID(),
+		MinTime: mint,
+		MaxTime: maxt,
+	}
+	meta.Compaction.Level = 1
+	meta.Compaction.Sources = []ulid.ULID{meta.ULID}
+	return write(parentDir, meta, set)
+}
+
+// WriteCompacted persists set as a new block replacing the blocks described
+// by parents, covering their combined time range one compaction level above
+// the highest of theirs. The parents are not removed.
+func WriteCompacted(parentDir string, parents []*Meta, set metrics.SeriesSet) (*Meta, error) {
+	meta := &Meta{
+		ULID:    newULID(),
+		MinTime: math.MaxInt64,
+		MaxTime: math.MinInt64,
+	}
+	sources := map[ulid.ULID]struct{}{}
+	for _, p := range parents {
+		meta.MinTime = min(meta.MinTime, p.MinTime)
+		meta.MaxTime = max(meta.MaxTime, p.MaxTime)
+		meta.Compaction.Level = max(meta.Compaction.Level, p.Compaction.Level+1)
+		for _, s := range p.Compaction.Sources {
+			sources[s] = struct{}{}
+		}
+		meta.Compaction.Parents = append(meta.Compaction.Parents, p.ULID)
+	}
+	for s := range sources {
+		meta.Compaction.Sources = append(meta.Compaction.Sources, s)
+	}
+	sort.Slice(meta.Compaction.Sources, func(i, j int) bool {
+		return meta.Compaction.Sources[i].Compare(meta.Compaction.Sources[j]) < 0
+	})
+	return write(parentDir, meta, set)
+}
+
+// WriteRewritten persists set as a new block replacing parent, covering the
+// same time range at the same compaction level, e.g. once series have been
+// dropped from it. The parent is not removed.
+func WriteRewritten(parentDir string, parent *Meta, set metrics.SeriesSet) (*Meta, error) {
+	meta := &Meta{
+		ULID:    newULID(),
+		MinTime: parent.MinTime,
+		MaxTime: parent.MaxTime,
+	}
+	meta.Compaction.Level = parent.Compaction.Level
+	meta.Compaction.Sources = append([]ulid.ULID(nil), parent.Compaction.Sources...)
+	meta.Compaction.Parents = []ulid.ULID{parent.ULID}
+	if parent.Downsample != nil {
+		d := *parent.Downsample
+		meta.Downsample = &d
+	}
+	return write(parentDir, meta, set)
+}
+
+// WriteDownsampled persists set, the aggregates of the block described by
+// source at the given resolution, as a new block covering the same time
+// range. The source is not replaced, so it is not listed as a parent.
+func WriteDownsampled(parentDir string, source *Meta, resolution int64, set metrics.SeriesSet) (*Meta, error) {
+	meta := &Meta{
+		ULID:    newULID(),
+		MinTime: source.MinTime,
+		MaxTime: source.MaxTime,
+		Downsample: &BlockDownsample{
+			Resolution: resolution,
+			Source:     source.ULID,
+		},
+	}
+	if source.Downsample != nil {
+		meta.Downsample.Source = source.Downsample.Source
+	}
+	meta.Compaction.Level = source.Compaction.Level
+	meta.Compaction.Sources = append([]ulid.ULID(nil), source.Compaction.Sources...)
+	return write(parentDir, meta, set)
+}
+
+func newULID() ulid.ULID {
+	return ulid.MustNew(ulid.Timestamp(time.Now()), rand.Reader)
+}
+
+func write(parentDir string, meta *Meta, set metrics.SeriesSet) (*Meta, error) {
+	dir := filepath.Join(parentDir, meta.ULID.String())
+	tmp := dir + tmpSuffix
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, fmt.Errorf("removing stale temporary block: %w", err)
+	}
+	if err := os.MkdirAll(tmp, 0o777); err != nil {
+		return nil, fmt.Errorf("creating temporary block: %w", err)
+	}
+
+	if err := writeBlock(tmp, meta, set); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("renaming block into place: %w", err)
+	}
+	if err := syncDir(parentDir); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func writeBlock(dir string, meta *Meta, set metrics.SeriesSet) error {
+	cw, err := newChunkWriter(dir)
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+
+	var (
+		series []*indexSeries
+		prev   metrics.Series
+	)
+	for set.Next() {
+		s := set.At()
+		if prev != nil && metrics.CompareSeries(prev, s) >= 0 {
+			return fmt.Errorf("writing series: %w", ErrOutOfOrder)
+		}
+		prev = s
+
+		var samples []metrics.Sample
+		it := s.Iterator()
+		for it.Next() {
+			if smpl := it.At(); smpl.Time >= meta.MinTime && smpl.Time < meta.MaxTime {
+				samples = append(samples, smpl)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("iterating series samples: %w", err)
+		}
+		if len(samples) == 0 {
+			continue
+		}
+
+		chunks, err := cw.WriteChunks(samples)
+		if err != nil {
+			return fmt.Errorf("writing chunks: %w", err)
+		}
+		series = append(series, &indexSeries{
+			def:    s.Definition(),
+			labels: s.LabelSet(),
+			chunks: chunks,
+		})
+		meta.Stats.NumSeries++
+		meta.Stats.NumChunks += uint64(len(chunks))
+		meta.Stats.NumSamples += uint64(len(samples))
+	}
+	if err := set.Err(); err != nil {
+		return fmt.Errorf("iterating series: %w", err)
+	}
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := writeIndex(dir, series); err != nil {
+		return err
+	}
+	if err := writeMeta(dir, meta); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Join(dir, chunksDirname)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that entries created within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening directory to sync: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing directory: %w", err)
+	}
+	return nil
+}
+
+// List returns the metadata of every complete block under parentDir ordered
+// by MinTime. Incomplete temporary block directories are removed, as are
+// blocks already compacted into another block, which are left behind if the
+// process stops after writing a compacted block but before removing its
+// parents, and downsampled blocks whose source block has been removed.
+func List(parentDir string) ([]*Meta, error) {
+	entries, err := os.ReadDir(parentDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listing blocks: %w", err)
+	}
+
+	var metas []*Meta
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		path := filepath.Join(parentDir, e.Name())
+		if filepath.Ext(e.Name()) == tmpSuffix {
+			if err := os.RemoveAll(path); err != nil {
+				return nil, fmt.Errorf("removing incomplete block: %w", err)
+			}
+			continue
+		}
+		if _, err := ulid.ParseStrict(e.Name()); err != nil {
+			continue
+		}
+
+		meta, err := ReadMeta(path)
+		if err != nil {
+			return nil, fmt.Errorf("block %s: %w", e.Name(), err)
+		}
+		metas = append(metas, meta)
+	}
+
+	compacted := map[ulid.ULID]struct{}{}
+	for _, m := range metas {
+		for _, p := range m.Compaction.Parents {
+			compacted[p] = struct{}{}
+		}
+	}
+	kept := metas[:0]
+	for _, m := range metas {
+		if _, ok := compacted[m.ULID]; !ok {
+			kept = append(kept, m)
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(parentDir, m.ULID.String())); err != nil {
+			return nil, fmt.Errorf("removing compacted block: %w", err)
+		}
+	}
+
+	raw := map[ulid.ULID]struct{}{}
+	for _, m := range kept {
+		if m.Downsample == nil {
+			raw[m.ULID] = struct{}{}
+		}
+	}
+	current := kept[:0]
+	for _, m := range kept {
+		if _, ok := raw[m.Source()]; ok {
+			current = append(current, m)
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(parentDir, m.ULID.String())); err != nil {
+			return nil, fmt.Errorf("removing downsampled block: %w", err)
+		}
+	}
+	kept = current
+
+	sortMetas(kept)
+	return kept, nil
+}
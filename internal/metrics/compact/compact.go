@@ -0,0 +1,222 @@
+package compact
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+)
+
+// DefaultRanges returns the compaction levels for blocks persisted over
+// blockRange: blocks are first compacted into 3x blockRange, then 12x, e.g.
+// 2h → 6h → 24h.
+func DefaultRanges(blockRange int64) []int64 {
+	return []int64{blockRange, 3 * blockRange, 12 * blockRange}
+}
+
+// Compactor merges adjacent or overlapping persisted blocks into blocks
+// covering larger time ranges.
+type Compactor struct {
+	// ranges are the time ranges of each compaction level, ascending. The
+	// first is the range of blocks persisted from the active block.
+	ranges []int64
+}
+
+func NewCompactor(ranges []int64) *Compactor {
+	return &Compactor{ranges: ranges}
+}
+
+// Plan returns the blocks which should be compacted together next, or nil
+// if there are none. Overlapping blocks are always compacted first. Otherwise
+// the oldest group of at least two blocks falling within the same aligned
+// window of a compaction level's range is chosen, once either the group
+// spans the whole window or a newer block exists beyond the window, so that
+// windows are not compacted while they are still filling up.
+//
+// Plan is deterministic for a given set of blocks.
+func (c *Compactor) Plan(metas []*block.Meta) []*block.Meta {
+	if len(metas) < 2 {
+		return nil
+	}
+
+	sorted := append([]*block.Meta(nil), metas...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].MinTime != sorted[j].MinTime {
+			return sorted[i].MinTime < sorted[j].MinTime
+		}
+		return sorted[i].ULID.Compare(sorted[j].ULID) < 0
+	})
+
+	if overlapping := overlappingBlocks(sorted); len(overlapping) > 0 {
+		return overlapping
+	}
+
+	newest := sorted[len(sorted)-1].MaxTime
+	for _, r := range c.ranges[1:] {
+		for _, group := range splitByRange(sorted, r) {
+			if len(group) < 2 {
+				continue
+			}
+			start := windowStart(group[0].MinTime, r)
+			end := start + r
+			full := group[0].MinTime == start && group[len(group)-1].MaxTime == end
+			if full || end <= newest {
+				return group
+			}
+		}
+	}
+	return nil
+}
+
+// overlappingBlocks returns the first run of blocks, sorted by MinTime, whose
+// time ranges overlap.
+func overlappingBlocks(sorted []*block.Meta) []*block.Meta {
+	var (
+		group []*block.Meta
+		maxt  int64 = math.MinInt64
+	)
+	for _, m := range sorted {
+		if m.MinTime < maxt {
+			group = append(group, m)
+		} else {
+			if len(group) > 1 {
+				return group
+			}
+			group = []*block.Meta{m}
+		}
+		maxt = max(maxt, m.MaxTime)
+	}
+	if len(group) > 1 {
+		return group
+	}
+	return nil
+}
+
+// splitByRange groups blocks, sorted by MinTime, by the aligned window of
+// width r they fall within. Blocks spanning more than one window are left
+// out.
+func splitByRange(sorted []*block.Meta, r int64) [][]*block.Meta {
+	var (
+		groups [][]*block.Meta
+		group  []*block.Meta
+		cur    int64
+	)
+	for _, m := range sorted {
+		start := windowStart(m.MinTime, r)
+		if m.MaxTime > start+r {
+			continue
+		}
+		if len(group) > 0 && start != cur {
+			groups = append(groups, group)
+			group = nil
+		}
+		cur = start
+		group = append(group, m)
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// windowStart returns the start of the aligned window of width r containing
+// t.
+func windowStart(t, r int64) int64 {
+	if t >= 0 {
+		return t - t%r
+	}
+	return -(((-t - 1) / r) + 1) * r
+}
+
+// Compact merges the series of blocks into a new block under parentDir and
+// returns its metadata. Series with equal metric names and label sets are
+// merged; where samples share a timestamp, the sample from the newest block
+// wins. The source blocks are left in place for the caller to remove once
+// the new block is in use.
+func (c *Compactor) Compact(parentDir string, blocks []*block.Reader) (*block.Meta, error) {
+	if len(blocks) == 0 {
+		return nil, errors.New("no blocks to compact")
+	}
+
+	// Order sources oldest first by ULID, i.e. by creation, so that samples
+	// from more recently written blocks win.
+	blocks = append([]*block.Reader(nil), blocks...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Meta().ULID.Compare(blocks[j].Meta().ULID) < 0
+	})
+
+	metas := make([]*block.Meta, 0, len(blocks))
+	queriers := make([]metrics.Querier, 0, len(blocks))
+	defer func() {
+		for _, q := range queriers {
+			q.Close()
+		}
+	}()
+
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, b := range blocks {
+		meta := b.Meta()
+		metas = append(metas, meta)
+		mint, maxt = min(mint, meta.MinTime), max(maxt, meta.MaxTime)
+
+		q, err := b.Querier()
+		if err != nil {
+			return nil, fmt.Errorf("opening block %s: %w", meta.ULID, err)
+		}
+		queriers = append(queriers, q)
+	}
+
+	sets := make([]metrics.SeriesSet, 0, len(queriers))
+	for _, q := range queriers {
+		sets = append(sets, q.Select(mint, maxt-1))
+	}
+
+	meta, err := block.WriteCompacted(parentDir, metas, metrics.NewMergeSeriesSet(sets...))
+	if err != nil {
+		return nil, fmt.Errorf("writing compacted block: %w", err)
+	}
+	return meta, nil
+}
+
+// Rewrite writes a copy of b without the series for which drop, if not nil,
+// returns true to a new block under parentDir, and returns its metadata. The
+// data deleted by b's tombstones is left out too. The new block keeps b's
+// time range and compaction level. b is left in place for the caller to
+// remove once the new block is in use.
+func (c *Compactor) Rewrite(parentDir string, b *block.Reader, drop func(metrics.Series) bool) (*block.Meta, error) {
+	meta := b.Meta()
+	q, err := b.Querier()
+	if err != nil {
+		return nil, fmt.Errorf("opening block %s: %w", meta.ULID, err)
+	}
+	defer q.Close()
+
+	set := q.Select(meta.MinTime, meta.MaxTime-1)
+	if drop != nil {
+		set = &filterSeriesSet{SeriesSet: set, drop: drop}
+	}
+	rewritten, err := block.WriteRewritten(parentDir, meta, set)
+	if err != nil {
+		return nil, fmt.Errorf("writing rewritten block: %w", err)
+	}
+	return rewritten, nil
+}
+
+// filterSeriesSet skips the series of a SeriesSet for which drop returns
+// true.
+type filterSeriesSet struct {
+	metrics.SeriesSet
+	drop func(metrics.Series) bool
+}
+
+func (s *filterSeriesSet) Next() bool {
+	for s.SeriesSet.Next() {
+		if !s.drop(s.SeriesSet.At()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package compact
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBlockRange = 2 * 3600
+
+func testMeta(id uint64, mint, maxt int64) *block.Meta {
+	return &block.Meta{
+		ULID:    ulid.ULID{15: byte(id)},
+		MinTime: mint * 3600,
+		MaxTime: maxt * 3600,
+	}
+}
+
+func Test_Plan(t *testing.T) {
+	type Test struct {
+		desc     string
+		metas    []*block.Meta
+		expected []*block.Meta
+	}
+
+	b1, b2, b3 := testMeta(1, 0, 2), testMeta(2, 2, 4), testMeta(3, 4, 6)
+	b4, b5 := testMeta(4, 6, 8), testMeta(5, 8, 10)
+	b6h, b6h2 := testMeta(6, 0, 6), testMeta(7, 6, 12)
+	overlap1, overlap2 := testMeta(8, 0, 2), testMeta(9, 1, 3)
+
+	tests := []Test{
+		{
+			desc:     "[POSITIVE] a single block is not compacted",
+			metas:    []*block.Meta{b1},
+			expected: nil,
+		},
+		{
+			desc:     "[POSITIVE] a full 6h window is compacted",
+			metas:    []*block.Meta{b3, b1, b2},
+			expected: []*block.Meta{b1, b2, b3},
+		},
+		{
+			desc:     "[POSITIVE] a partial window still filling up is not compacted",
+			metas:    []*block.Meta{b4, b5},
+			expected: nil,
+		},
+		{
+			desc:     "[POSITIVE] a partial window is compacted once a newer block exists",
+			metas:    []*block.Meta{b1, b2, b4},
+			expected: []*block.Meta{b1, b2},
+		},
+		{
+			desc:     "[POSITIVE] 6h blocks are compacted into 24h once the window is closed",
+			metas:    []*block.Meta{b6h, b6h2, testMeta(10, 24, 26)},
+			expected: []*block.Meta{b6h, b6h2},
+		},
+		{
+			desc:     "[POSITIVE] overlapping blocks are compacted first",
+			metas:    []*block.Meta{b4, b5, overlap2, overlap1, testMeta(11, 12, 14)},
+			expected: []*block.Meta{overlap1, overlap2},
+		},
+	}
+
+	c := NewCompactor(DefaultRanges(testBlockRange))
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, c.Plan(tc.metas))
+			// Plans do not depend on the order blocks are listed in.
+			reversed := make([]*block.Meta, len(tc.metas))
+			for i, m := range tc.metas {
+				reversed[len(tc.metas)-1-i] = m
+			}
+			assert.Equal(t, tc.expected, c.Plan(reversed))
+		})
+	}
+}
+
+func Test_Compact(t *testing.T) {
+	def := metrics.MetricDefinition{Name: "http_requests_total", Type: "counter"}
+	lbls := map[string]string{"method": "get"}
+	dir := t.TempDir()
+
+	writeBlock := func(mint, maxt int64, series ...metrics.Series) *block.Reader {
+		meta, err := block.Write(dir, mint, maxt, metrics.NewListSeriesSet(series))
+		require.NoError(t, err)
+		r, err := block.Open(filepath.Join(dir, meta.ULID.String()))
+		require.NoError(t, err)
+		t.Cleanup(func() { r.Close() })
+		return r
+	}
+
+	older := writeBlock(0, 100,
+		&metrics.ListSeries{Def: def, Labels: lbls, Samples: []metrics.Sample{{Time: 10, Value: 1}, {Time: 50, Value: 2}}},
+		&metrics.ListSeries{Def: metrics.MetricDefinition{Name: "up"}, Labels: map[string]string{}, Samples: []metrics.Sample{{Time: 10, Value: 1}}},
+	)
+	// The newer block overlaps the older one and rewrites the sample at 50.
+	newer := writeBlock(50, 200,
+		&metrics.ListSeries{Def: def, Labels: lbls, Samples: []metrics.Sample{{Time: 50, Value: 3}, {Time: 150, Value: 4}}},
+	)
+
+	c := NewCompactor(DefaultRanges(testBlockRange))
+	meta, err := c.Compact(dir, []*block.Reader{newer, older})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(0), meta.MinTime)
+	assert.Equal(t, int64(200), meta.MaxTime)
+	assert.Equal(t, 2, meta.Compaction.Level)
+	assert.ElementsMatch(t, []ulid.ULID{older.Meta().ULID, newer.Meta().ULID}, meta.Compaction.Sources)
+	assert.Equal(t, uint64(2), meta.Stats.NumSeries)
+	assert.Equal(t, uint64(4), meta.Stats.NumSamples)
+
+	r, err := block.Open(filepath.Join(dir, meta.ULID.String()))
+	require.NoError(t, err)
+	defer r.Close()
+	q, err := r.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+
+	set := q.Select(0, 200, metrics.MustNewMatcher(metrics.MatchEqual, "method", "get"))
+	require.True(t, set.Next())
+	samples, err := metrics.ExpandSamples(set.At().Iterator())
+	require.NoError(t, err)
+	assert.Equal(t, []metrics.Sample{{Time: 10, Value: 1}, {Time: 50, Value: 3}, {Time: 150, Value: 4}}, samples)
+	assert.False(t, set.Next())
+
+	// Once a compacted block is written, its parents are no longer listed.
+	metas, err := block.List(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []*block.Meta{meta}, metas)
+}
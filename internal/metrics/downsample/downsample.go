@@ -0,0 +1,221 @@
+package downsample
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+)
+
+const (
+	// ResLevel1 is the width, in seconds, of the windows of blocks
+	// downsampled from raw blocks.
+	ResLevel1 = int64(5 * 60)
+	// ResLevel2 is the width, in seconds, of the windows of blocks
+	// downsampled from ResLevel1 blocks.
+	ResLevel2 = int64(60 * 60)
+)
+
+// Resolutions are the resolutions blocks are downsampled to, finest first.
+var Resolutions = []int64{ResLevel1, ResLevel2}
+
+// AggrLabel is the label identifying which aggregate a series of a
+// downsampled block holds. It is not exposed to queriers.
+const AggrLabel = "__aggr__"
+
+// Aggr is an aggregate of the samples within a window.
+type Aggr int
+
+const (
+	// AggrAuto reads AggrCounter for counters and AggrAverage otherwise.
+	AggrAuto Aggr = iota
+	AggrCount
+	AggrSum
+	AggrMin
+	AggrMax
+	// AggrCounter is the value of a counter at the end of the window,
+	// adjusted for counter resets within the block, so that rates computed
+	// over downsampled data account for resets hidden within a window.
+	AggrCounter
+	// AggrAverage is AggrSum divided by AggrCount. It is computed when read
+	// rather than stored.
+	AggrAverage
+)
+
+// storedAggrs are the aggregates written to downsampled blocks.
+var storedAggrs = []Aggr{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter}
+
+var aggrNames = map[Aggr]string{
+	AggrAuto:    "auto",
+	AggrCount:   "count",
+	AggrSum:     "sum",
+	AggrMin:     "min",
+	AggrMax:     "max",
+	AggrCounter: "counter",
+	AggrAverage: "avg",
+}
+
+func (a Aggr) String() string {
+	if name, ok := aggrNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("Aggr(%d)", int(a))
+}
+
+// ParseAggr returns the Aggr named s, e.g. "max".
+func ParseAggr(s string) (Aggr, error) {
+	for a, name := range aggrNames {
+		if name == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("aggregate %q: %w", s, ErrUnknownAggr)
+}
+
+// Downsample writes the aggregates of the samples of b over windows of the
+// given resolution to a new block under parentDir, and returns its metadata.
+// b may itself be downsampled, in which case its aggregates are aggregated
+// further, so resolution must be coarser than b's. Each aggregate is stored
+// as a series with its name under AggrLabel, at the time of the last sample
+// in its window. The counter aggregate is only stored for counters. Native
+// histogram samples and staleness markers are not downsampled.
+func Downsample(parentDir string, b *block.Reader, resolution int64) (*block.Meta, error) {
+	meta := b.Meta()
+	if resolution <= meta.Resolution() {
+		return nil, fmt.Errorf("downsampling %s to %ds: %w", meta.ULID, resolution, ErrInvalidResolution)
+	}
+
+	q, err := b.Querier()
+	if err != nil {
+		return nil, fmt.Errorf("opening block %s: %w", meta.ULID, err)
+	}
+	defer q.Close()
+
+	var out []metrics.Series
+	set := q.Select(meta.MinTime, meta.MaxTime-1)
+	for set.Next() {
+		s := set.At()
+		samples, err := metrics.ExpandSamples(s.Iterator())
+		if err != nil {
+			return nil, fmt.Errorf("reading series: %w", err)
+		}
+		if samples = floatSamples(samples); len(samples) == 0 {
+			continue
+		}
+
+		if meta.Resolution() > 0 {
+			aggr, err := ParseAggr(s.LabelSet()[AggrLabel])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, &metrics.ListSeries{
+				Def:     s.Definition(),
+				Labels:  withAggr(s.LabelSet(), aggr),
+				Samples: aggregate(samples, resolution, aggr),
+			})
+			continue
+		}
+
+		for _, aggr := range storedAggrs {
+			if aggr == AggrCounter && s.Definition().Type != "counter" {
+				continue
+			}
+			out = append(out, &metrics.ListSeries{
+				Def:     s.Definition(),
+				Labels:  withAggr(s.LabelSet(), aggr),
+				Samples: aggregate(rawAggregates(samples, aggr), resolution, aggr),
+			})
+		}
+	}
+	if err := set.Err(); err != nil {
+		return nil, fmt.Errorf("reading block %s: %w", meta.ULID, err)
+	}
+
+	downsampled, err := block.WriteDownsampled(parentDir, meta, resolution, metrics.NewListSeriesSet(out))
+	if err != nil {
+		return nil, fmt.Errorf("writing downsampled block: %w", err)
+	}
+	return downsampled, nil
+}
+
+// withAggr returns a copy of labelSet with aggr under AggrLabel.
+func withAggr(labelSet map[string]string, aggr Aggr) map[string]string {
+	lbls := make(map[string]string, len(labelSet)+1)
+	for k, v := range labelSet {
+		lbls[k] = v
+	}
+	lbls[AggrLabel] = aggr.String()
+	return lbls
+}
+
+// floatSamples returns samples without their native histogram samples and
+// staleness markers.
+func floatSamples(samples []metrics.Sample) []metrics.Sample {
+	floats := samples[:0]
+	for _, s := range samples {
+		if s.Histogram == nil && !metrics.IsStaleNaN(s.Value) {
+			floats = append(floats, s)
+		}
+	}
+	return floats
+}
+
+// rawAggregates returns raw samples as the aggr aggregates of windows each
+// holding a single sample, so that raw and downsampled samples are
+// aggregated alike.
+func rawAggregates(samples []metrics.Sample, aggr Aggr) []metrics.Sample {
+	out := make([]metrics.Sample, len(samples))
+	var adjust float64
+	for i, s := range samples {
+		out[i] = s
+		switch aggr {
+		case AggrCount:
+			out[i].Value = 1
+		case AggrCounter:
+			if i > 0 && s.Value < samples[i-1].Value {
+				adjust += samples[i-1].Value
+			}
+			out[i].Value = s.Value + adjust
+		}
+	}
+	return out
+}
+
+// aggregate combines samples, each an aggr aggregate, into one aggr aggregate
+// per window of the given resolution, stamped with the time of the window's
+// last sample.
+func aggregate(samples []metrics.Sample, resolution int64, aggr Aggr) []metrics.Sample {
+	var out []metrics.Sample
+	for i := 0; i < len(samples); {
+		window := windowStart(samples[i].Time, resolution)
+		acc := samples[i]
+		j := i + 1
+		for ; j < len(samples) && samples[j].Time < window+resolution; j++ {
+			s := samples[j]
+			switch aggr {
+			case AggrCount, AggrSum:
+				acc.Value += s.Value
+			case AggrMin:
+				acc.Value = math.Min(acc.Value, s.Value)
+			case AggrMax:
+				acc.Value = math.Max(acc.Value, s.Value)
+			case AggrCounter:
+				acc.Value = s.Value
+			}
+			acc.Time = s.Time
+		}
+		out = append(out, acc)
+		i = j
+	}
+	return out
+}
+
+// windowStart returns the start of the aligned window of width r containing
+// t.
+func windowStart(t, r int64) int64 {
+	if t >= 0 {
+		return t - t%r
+	}
+	return -(((-t - 1) / r) + 1) * r
+}
@@ -0,0 +1,120 @@
+package downsample
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Downsample(t *testing.T) {
+	type Test struct {
+		desc       string
+		resolution int64
+		aggr       Aggr
+		metric     string
+		expected   []metrics.Sample
+	}
+
+	dir := t.TempDir()
+	counter := &metrics.ListSeries{
+		Def:    metrics.MetricDefinition{Name: "requests_total", Type: "counter"},
+		Labels: map[string]string{"code": "200"},
+		// The counter resets between 200 and 300.
+		Samples: []metrics.Sample{{Time: 0, Value: 10}, {Time: 100, Value: 20}, {Time: 200, Value: 30}, {Time: 300, Value: 5}, {Time: 400, Value: 15}, {Time: 500, Value: 25}},
+	}
+	gauge := &metrics.ListSeries{
+		Def:     metrics.MetricDefinition{Name: "temperature", Type: "gauge"},
+		Labels:  map[string]string{},
+		Samples: []metrics.Sample{{Time: 0, Value: 1}, {Time: 100, Value: 3}, {Time: 400, Value: 8}},
+	}
+	raw, err := block.Write(dir, 0, 3600, metrics.NewListSeriesSet([]metrics.Series{counter, gauge}))
+	require.NoError(t, err)
+	open := func(meta *block.Meta) *block.Reader {
+		r, err := block.Open(filepath.Join(dir, meta.ULID.String()))
+		require.NoError(t, err)
+		t.Cleanup(func() { r.Close() })
+		return r
+	}
+
+	level1, err := Downsample(dir, open(raw), ResLevel1)
+	require.NoError(t, err)
+	assert.Equal(t, ResLevel1, level1.Resolution())
+	assert.Equal(t, raw.ULID, level1.Source())
+	level2, err := Downsample(dir, open(level1), ResLevel2)
+	require.NoError(t, err)
+	assert.Equal(t, raw.ULID, level2.Source())
+
+	_, err = Downsample(dir, open(level2), ResLevel1)
+	assert.ErrorIs(t, err, ErrInvalidResolution)
+
+	readers := map[int64]*block.Reader{ResLevel1: open(level1), ResLevel2: open(level2)}
+
+	tests := []Test{
+		{desc: "[POSITIVE] 5m count", resolution: ResLevel1, aggr: AggrCount, metric: "requests_total", expected: []metrics.Sample{{Time: 200, Value: 3}, {Time: 500, Value: 3}}},
+		{desc: "[POSITIVE] 5m sum", resolution: ResLevel1, aggr: AggrSum, metric: "requests_total", expected: []metrics.Sample{{Time: 200, Value: 60}, {Time: 500, Value: 45}}},
+		{desc: "[POSITIVE] 5m min", resolution: ResLevel1, aggr: AggrMin, metric: "requests_total", expected: []metrics.Sample{{Time: 200, Value: 10}, {Time: 500, Value: 5}}},
+		{desc: "[POSITIVE] 5m max", resolution: ResLevel1, aggr: AggrMax, metric: "requests_total", expected: []metrics.Sample{{Time: 200, Value: 30}, {Time: 500, Value: 25}}},
+		{desc: "[POSITIVE] 5m counter is adjusted for resets", resolution: ResLevel1, aggr: AggrCounter, metric: "requests_total", expected: []metrics.Sample{{Time: 200, Value: 30}, {Time: 500, Value: 55}}},
+		{desc: "[POSITIVE] 5m average", resolution: ResLevel1, aggr: AggrAverage, metric: "requests_total", expected: []metrics.Sample{{Time: 200, Value: 20}, {Time: 500, Value: 15}}},
+		{desc: "[POSITIVE] 5m auto reads counters as counter", resolution: ResLevel1, aggr: AggrAuto, metric: "requests_total", expected: []metrics.Sample{{Time: 200, Value: 30}, {Time: 500, Value: 55}}},
+		{desc: "[POSITIVE] 5m auto reads gauges as average", resolution: ResLevel1, aggr: AggrAuto, metric: "temperature", expected: []metrics.Sample{{Time: 100, Value: 2}, {Time: 400, Value: 8}}},
+		{desc: "[POSITIVE] 1h count", resolution: ResLevel2, aggr: AggrCount, metric: "requests_total", expected: []metrics.Sample{{Time: 500, Value: 6}}},
+		{desc: "[POSITIVE] 1h min", resolution: ResLevel2, aggr: AggrMin, metric: "requests_total", expected: []metrics.Sample{{Time: 500, Value: 5}}},
+		{desc: "[POSITIVE] 1h counter", resolution: ResLevel2, aggr: AggrCounter, metric: "requests_total", expected: []metrics.Sample{{Time: 500, Value: 55}}},
+		{desc: "[POSITIVE] 1h average", resolution: ResLevel2, aggr: AggrAverage, metric: "requests_total", expected: []metrics.Sample{{Time: 500, Value: 17.5}}},
+		{desc: "[NEGATIVE] gauges have no counter aggregate", resolution: ResLevel2, aggr: AggrCounter, metric: "temperature", expected: nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			bq, err := readers[tc.resolution].Querier()
+			require.NoError(t, err)
+			q := NewQuerier(bq, tc.resolution, tc.aggr)
+			defer q.Close()
+
+			set := q.Select(0, 3600, metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, tc.metric))
+			var samples []metrics.Sample
+			for set.Next() {
+				_, ok := set.At().LabelSet()[AggrLabel]
+				assert.False(t, ok)
+				s, err := metrics.ExpandSamples(set.At().Iterator())
+				require.NoError(t, err)
+				samples = append(samples, s...)
+			}
+			require.NoError(t, set.Err())
+			assert.Equal(t, tc.expected, samples)
+
+			names, err := q.LabelNames()
+			require.NoError(t, err)
+			assert.NotContains(t, names, AggrLabel)
+		})
+	}
+}
+
+func Test_ResolutionFor(t *testing.T) {
+	type Test struct {
+		desc       string
+		mint, maxt int64
+		step       int64
+		expected   int64
+	}
+
+	tests := []Test{
+		{desc: "[POSITIVE] short steps read raw samples", mint: 0, maxt: 86400, step: 60, expected: 0},
+		{desc: "[POSITIVE] steps of at least 25m read 5m aggregates", mint: 0, maxt: 86400, step: 1500, expected: ResLevel1},
+		{desc: "[POSITIVE] steps of at least 5h read 1h aggregates", mint: 0, maxt: 86400 * 90, step: 5 * 3600, expected: ResLevel2},
+		{desc: "[POSITIVE] without a step, a day is read raw", mint: 0, maxt: 86400, expected: 0},
+		{desc: "[POSITIVE] without a step, a week reads 5m aggregates", mint: 0, maxt: 86400 * 7, expected: ResLevel1},
+		{desc: "[POSITIVE] without a step, 90 days read 1h aggregates", mint: 0, maxt: 86400 * 90, expected: ResLevel2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ResolutionFor(tc.mint, tc.maxt, tc.step))
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package downsample
+
+import "errors"
+
+var (
+	ErrInvalidResolution = errors.New("resolution must be coarser than the block's")
+	ErrUnknownAggr       = errors.New("unknown aggregate")
+)
@@ -0,0 +1,252 @@
+package downsample
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// defaultPoints is the number of points a query is assumed to be evaluated
+// at when its step is not known.
+const defaultPoints = 250
+
+// ResolutionFor returns the coarsest resolution suitable for a query over
+// [mint, maxt] evaluated every step seconds: the coarsest whose windows are
+// at most a fifth of the step, so that each step still spans several
+// aggregates. If step is zero, the range is assumed to be evaluated at
+// defaultPoints points. Zero means raw samples should be read.
+func ResolutionFor(mint, maxt, step int64) int64 {
+	if step <= 0 {
+		step = (maxt - mint) / defaultPoints
+	}
+	var res int64
+	for _, r := range Resolutions {
+		if r*5 <= step {
+			res = r
+		}
+	}
+	return res
+}
+
+// NewQuerier returns a Querier reading the aggr aggregate of the series of q,
+// a querier over a block of the given resolution. Series are returned without
+// AggrLabel, so that they merge with the same series of other blocks. The
+// samples of raw blocks, with a resolution of zero, are read as the
+// aggregates of windows each holding a single sample.
+func NewQuerier(q metrics.Querier, resolution int64, aggr Aggr) metrics.Querier {
+	if resolution == 0 {
+		return &rawQuerier{Querier: q, aggr: aggr}
+	}
+	return &querier{Querier: q, aggr: aggr}
+}
+
+// querier reads aggregates from a downsampled block.
+type querier struct {
+	metrics.Querier
+	aggr Aggr
+}
+
+// aggrGroup holds the aggregate series of one series of a downsampled block.
+type aggrGroup struct {
+	def    metrics.MetricDefinition
+	labels map[string]string
+	aggrs  map[Aggr]metrics.Series
+}
+
+func (q *querier) Select(mint, maxt int64, matchers ...*metrics.Matcher) metrics.SeriesSet {
+	var needed []string
+	switch q.aggr {
+	case AggrAuto:
+		needed = []string{AggrCounter.String(), AggrSum.String(), AggrCount.String()}
+	case AggrAverage:
+		needed = []string{AggrSum.String(), AggrCount.String()}
+	default:
+		needed = []string{q.aggr.String()}
+	}
+	m, err := metrics.NewMatcher(metrics.MatchRegexp, AggrLabel, strings.Join(needed, "|"))
+	if err != nil {
+		return metrics.ErrSeriesSet(err)
+	}
+
+	// Removing AggrLabel can change the order of series, so they are
+	// gathered and sorted again.
+	groups := map[string]*aggrGroup{}
+	set := q.Querier.Select(mint, maxt, append(append([]*metrics.Matcher(nil), matchers...), m)...)
+	for set.Next() {
+		s := set.At()
+		aggr, err := ParseAggr(s.LabelSet()[AggrLabel])
+		if err != nil {
+			return metrics.ErrSeriesSet(err)
+		}
+		lbls := make(map[string]string, len(s.LabelSet()))
+		for k, v := range s.LabelSet() {
+			if k != AggrLabel {
+				lbls[k] = v
+			}
+		}
+
+		key := groupKey(s.Definition().Name, lbls)
+		g, ok := groups[key]
+		if !ok {
+			g = &aggrGroup{def: s.Definition(), labels: lbls, aggrs: map[Aggr]metrics.Series{}}
+			groups[key] = g
+		}
+		g.aggrs[aggr] = s
+	}
+	if err := set.Err(); err != nil {
+		return metrics.ErrSeriesSet(err)
+	}
+
+	out := make([]metrics.Series, 0, len(groups))
+	for _, g := range groups {
+		if s := g.series(q.aggr); s != nil {
+			out = append(out, s)
+		}
+	}
+	return metrics.NewListSeriesSet(out)
+}
+
+// series returns the group's aggr aggregate, or nil if the group does not
+// hold it.
+func (g *aggrGroup) series(aggr Aggr) metrics.Series {
+	if aggr == AggrAuto {
+		aggr = AggrAverage
+		if _, ok := g.aggrs[AggrCounter]; ok {
+			aggr = AggrCounter
+		}
+	}
+
+	if aggr == AggrAverage {
+		sum, count := g.aggrs[AggrSum], g.aggrs[AggrCount]
+		if sum == nil || count == nil {
+			return nil
+		}
+		return &series{def: g.def, labels: g.labels, iterator: func() metrics.SeriesIterator {
+			return &averageIterator{sum: sum.Iterator(), count: count.Iterator()}
+		}}
+	}
+
+	s := g.aggrs[aggr]
+	if s == nil {
+		return nil
+	}
+	return &series{def: g.def, labels: g.labels, iterator: s.Iterator}
+}
+
+func groupKey(name string, lbls map[string]string) string {
+	sb := strings.Builder{}
+	sb.WriteString(name)
+	for _, k := range metrics.SortedLabelNames(lbls) {
+		sb.WriteString("\xff")
+		sb.WriteString(k)
+		sb.WriteString("\xff")
+		sb.WriteString(lbls[k])
+	}
+	return sb.String()
+}
+
+func (q *querier) LabelNames() ([]string, error) {
+	names, err := q.Querier.LabelNames()
+	if err != nil {
+		return nil, err
+	}
+	return withoutAggrLabel(names), nil
+}
+
+func (q *querier) LabelValues(name string) ([]string, error) {
+	if name == AggrLabel {
+		return nil, nil
+	}
+	return q.Querier.LabelValues(name)
+}
+
+func withoutAggrLabel(names []string) []string {
+	i := sort.SearchStrings(names, AggrLabel)
+	if i < len(names) && names[i] == AggrLabel {
+		return append(names[:i:i], names[i+1:]...)
+	}
+	return names
+}
+
+// rawQuerier reads the samples of a raw block as aggregates.
+type rawQuerier struct {
+	metrics.Querier
+	aggr Aggr
+}
+
+func (q *rawQuerier) Select(mint, maxt int64, matchers ...*metrics.Matcher) metrics.SeriesSet {
+	set := q.Querier.Select(mint, maxt, matchers...)
+	if q.aggr != AggrCount {
+		return set
+	}
+	return &countSeriesSet{SeriesSet: set}
+}
+
+// countSeriesSet reads every sample of its series as a count of one.
+type countSeriesSet struct {
+	metrics.SeriesSet
+}
+
+func (s *countSeriesSet) At() metrics.Series {
+	inner := s.SeriesSet.At()
+	return &series{def: inner.Definition(), labels: inner.LabelSet(), iterator: func() metrics.SeriesIterator {
+		return &countIterator{SeriesIterator: inner.Iterator()}
+	}}
+}
+
+type countIterator struct {
+	metrics.SeriesIterator
+}
+
+func (it *countIterator) At() metrics.Sample {
+	return metrics.Sample{Time: it.SeriesIterator.At().Time, Value: 1}
+}
+
+// series is a Series whose samples are read through iterator.
+type series struct {
+	def      metrics.MetricDefinition
+	labels   map[string]string
+	iterator func() metrics.SeriesIterator
+}
+
+func (s *series) Definition() metrics.MetricDefinition { return s.def }
+func (s *series) LabelSet() map[string]string          { return s.labels }
+func (s *series) Iterator() metrics.SeriesIterator     { return s.iterator() }
+
+// averageIterator divides sums by counts of the same windows.
+type averageIterator struct {
+	sum, count metrics.SeriesIterator
+	cur        metrics.Sample
+}
+
+func (it *averageIterator) Next() bool {
+	if !it.sum.Next() || !it.count.Next() {
+		return false
+	}
+	for {
+		s, c := it.sum.At(), it.count.At()
+		switch {
+		case s.Time < c.Time:
+			if !it.sum.Next() {
+				return false
+			}
+		case c.Time < s.Time:
+			if !it.count.Next() {
+				return false
+			}
+		default:
+			it.cur = metrics.Sample{Time: s.Time, Value: s.Value / c.Value}
+			return true
+		}
+	}
+}
+
+func (it *averageIterator) At() metrics.Sample { return it.cur }
+
+func (it *averageIterator) Err() error {
+	if err := it.sum.Err(); err != nil {
+		return err
+	}
+	return it.count.Err()
+}
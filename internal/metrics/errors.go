@@ -8,4 +8,5 @@ var (
 	ErrMetricFamilyNotFound    = errors.New("metric family not found")
 	ErrTimeSeriesNotFound      = errors.New("timeseries not found")
 	ErrDuplicateMetricLabelSet = errors.New("label set should not be repeated within a MetricFamiliesTimeGroup")
+	ErrInvalidHistogram        = errors.New("invalid native histogram")
 )
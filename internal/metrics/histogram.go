@@ -0,0 +1,470 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The schemas a native histogram may have. The bucket boundaries of schema s
+// grow by a factor of 2^(2^-s), from 65536 for schema -4 to about 1.0027 for
+// schema 8.
+const (
+	MinHistogramSchema = -4
+	MaxHistogramSchema = 8
+)
+
+// Histogram is a native histogram: a histogram with exponentially growing
+// buckets, of which only those holding observations need be stored, as
+// Prometheus native histograms and OpenTelemetry exponential histograms
+// have.
+//
+// Positive bucket i holds the observations in (b^(i-1), b^i], where b is
+// 2^(2^-Schema), and negative bucket i those in [-b^i, -b^(i-1)). The zero
+// bucket holds the observations in [-ZeroThreshold, ZeroThreshold]. Bucket
+// counts are absolute, not deltas, and may be fractional, e.g. once a
+// histogram has been rated.
+type Histogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     float64
+	// Count is the number of observations, and Sum their sum.
+	Count float64
+	Sum   float64
+
+	PositiveSpans   []Span
+	PositiveBuckets []float64
+	NegativeSpans   []Span
+	NegativeBuckets []float64
+}
+
+// Span is a run of Length consecutive buckets. The first span of a
+// histogram starts at bucket index Offset, and every other span Offset
+// buckets after the end of the span before it.
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+// HistogramBucket is a bucket of a native histogram with its bounds.
+type HistogramBucket struct {
+	Lower, Upper float64
+	// LowerInclusive and UpperInclusive report whether observations equal
+	// to the bound fall within the bucket.
+	LowerInclusive, UpperInclusive bool
+	Count                          float64
+}
+
+// Validate returns ErrInvalidHistogram if h has a schema out of range,
+// spans not matching its buckets, or a negative or NaN count.
+func (h *Histogram) Validate() error {
+	if h.Schema < MinHistogramSchema || h.Schema > MaxHistogramSchema {
+		return fmt.Errorf("%w: schema %d out of range", ErrInvalidHistogram, h.Schema)
+	}
+	if !(h.ZeroThreshold >= 0) {
+		return fmt.Errorf("%w: zero threshold %v", ErrInvalidHistogram, h.ZeroThreshold)
+	}
+	if err := validateSpans(h.PositiveSpans, h.PositiveBuckets); err != nil {
+		return fmt.Errorf("%w: positive buckets: %w", ErrInvalidHistogram, err)
+	}
+	if err := validateSpans(h.NegativeSpans, h.NegativeBuckets); err != nil {
+		return fmt.Errorf("%w: negative buckets: %w", ErrInvalidHistogram, err)
+	}
+	counts := append([]float64{h.Count, h.ZeroCount}, h.PositiveBuckets...)
+	for _, c := range append(counts, h.NegativeBuckets...) {
+		if !(c >= 0) {
+			return fmt.Errorf("%w: count %v", ErrInvalidHistogram, c)
+		}
+	}
+	return nil
+}
+
+func validateSpans(spans []Span, buckets []float64) error {
+	var n int
+	for i, s := range spans {
+		if i > 0 && s.Offset < 0 {
+			return fmt.Errorf("span %d has negative offset %d", i, s.Offset)
+		}
+		n += int(s.Length)
+	}
+	if n != len(buckets) {
+		return fmt.Errorf("spans hold %d buckets, have %d", n, len(buckets))
+	}
+	return nil
+}
+
+// Copy returns a deep copy of h.
+func (h *Histogram) Copy() *Histogram {
+	c := *h
+	c.PositiveSpans = append([]Span(nil), h.PositiveSpans...)
+	c.PositiveBuckets = append([]float64(nil), h.PositiveBuckets...)
+	c.NegativeSpans = append([]Span(nil), h.NegativeSpans...)
+	c.NegativeBuckets = append([]float64(nil), h.NegativeBuckets...)
+	return &c
+}
+
+// Equals reports whether h and o are identical, comparing floats by their
+// bits so that identical NaNs are equal.
+func (h *Histogram) Equals(o *Histogram) bool {
+	if h == nil || o == nil {
+		return h == o
+	}
+	return h.Schema == o.Schema &&
+		sameFloats([]float64{h.ZeroThreshold, h.ZeroCount, h.Count, h.Sum}, []float64{o.ZeroThreshold, o.ZeroCount, o.Count, o.Sum}) &&
+		sameSpans(h.PositiveSpans, o.PositiveSpans) && sameFloats(h.PositiveBuckets, o.PositiveBuckets) &&
+		sameSpans(h.NegativeSpans, o.NegativeSpans) && sameFloats(h.NegativeBuckets, o.NegativeBuckets)
+}
+
+func sameFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Float64bits(a[i]) != math.Float64bits(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSpans(a, b []Span) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// bucketBound returns the upper bound of positive bucket idx of schema.
+func bucketBound(schema, idx int32) float64 {
+	if schema <= 0 {
+		return math.Ldexp(1, int(idx)<<-schema)
+	}
+	return math.Exp2(float64(idx) / float64(int32(1)<<schema))
+}
+
+// Buckets returns the buckets of h ordered by their bounds: the negative
+// buckets, the zero bucket, if it has a width or holds observations, and
+// the positive buckets.
+func (h *Histogram) Buckets() []HistogramBucket {
+	var res []HistogramBucket
+	neg := indexBuckets(h.NegativeSpans, h.NegativeBuckets)
+	for i := len(neg) - 1; i >= 0; i-- {
+		res = append(res, HistogramBucket{
+			Lower:          -bucketBound(h.Schema, neg[i].index),
+			Upper:          -bucketBound(h.Schema, neg[i].index-1),
+			LowerInclusive: true,
+			Count:          neg[i].count,
+		})
+	}
+	if h.ZeroThreshold > 0 || h.ZeroCount > 0 {
+		res = append(res, HistogramBucket{
+			Lower:          -h.ZeroThreshold,
+			Upper:          h.ZeroThreshold,
+			LowerInclusive: true,
+			UpperInclusive: true,
+			Count:          h.ZeroCount,
+		})
+	}
+	for _, b := range indexBuckets(h.PositiveSpans, h.PositiveBuckets) {
+		res = append(res, HistogramBucket{
+			Lower:          bucketBound(h.Schema, b.index-1),
+			Upper:          bucketBound(h.Schema, b.index),
+			UpperInclusive: true,
+			Count:          b.count,
+		})
+	}
+	return res
+}
+
+// indexedBucket is a bucket count and the bucket's index.
+type indexedBucket struct {
+	index int32
+	count float64
+}
+
+// indexBuckets returns the buckets given by spans with their indexes, in
+// ascending order of index.
+func indexBuckets(spans []Span, counts []float64) []indexedBucket {
+	res := make([]indexedBucket, 0, len(counts))
+	var idx int32
+	for i, s := range spans {
+		if i == 0 {
+			idx = s.Offset
+		} else {
+			idx += s.Offset
+		}
+		for j := uint32(0); j < s.Length && len(res) < len(counts); j++ {
+			res = append(res, indexedBucket{index: idx, count: counts[len(res)]})
+			idx++
+		}
+	}
+	return res
+}
+
+// spanBuckets returns the spans and counts of buckets by index.
+func spanBuckets(buckets map[int32]float64) ([]Span, []float64) {
+	indexes := make([]int32, 0, len(buckets))
+	for idx := range buckets {
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	var (
+		spans  []Span
+		counts = make([]float64, 0, len(indexes))
+		next   int32
+	)
+	for i, idx := range indexes {
+		switch {
+		case i == 0:
+			spans = append(spans, Span{Offset: idx, Length: 1})
+		case idx == next:
+			spans[len(spans)-1].Length++
+		default:
+			spans = append(spans, Span{Offset: idx - next, Length: 1})
+		}
+		counts = append(counts, buckets[idx])
+		next = idx + 1
+	}
+	return spans, counts
+}
+
+// reduceBuckets adds the buckets given by spans, of schema from, into
+// buckets of the lower resolution schema to.
+func reduceBuckets(buckets map[int32]float64, spans []Span, counts []float64, from, to int32, sign float64) {
+	for _, b := range indexBuckets(spans, counts) {
+		// Bucket i of schema s is within bucket ((i-1) >> d) + 1 of schema
+		// s - d.
+		buckets[((b.index-1)>>(from-to))+1] += sign * b.count
+	}
+}
+
+// Mul returns h with its counts and sum multiplied by f.
+func (h *Histogram) Mul(f float64) *Histogram {
+	res := h.Copy()
+	res.ZeroCount *= f
+	res.Count *= f
+	res.Sum *= f
+	for i := range res.PositiveBuckets {
+		res.PositiveBuckets[i] *= f
+	}
+	for i := range res.NegativeBuckets {
+		res.NegativeBuckets[i] *= f
+	}
+	return res
+}
+
+// Add returns the sum of h and o, at the lower resolution of their schemas
+// and with the wider of their zero buckets.
+func (h *Histogram) Add(o *Histogram) *Histogram {
+	return combine(h, o, 1)
+}
+
+// Sub returns o subtracted from h, as Add combines them.
+func (h *Histogram) Sub(o *Histogram) *Histogram {
+	return combine(h, o, -1)
+}
+
+func combine(a, b *Histogram, sign float64) *Histogram {
+	res := &Histogram{
+		Schema:        min(a.Schema, b.Schema),
+		ZeroThreshold: max(a.ZeroThreshold, b.ZeroThreshold),
+		ZeroCount:     a.ZeroCount + sign*b.ZeroCount,
+		Count:         a.Count + sign*b.Count,
+		Sum:           a.Sum + sign*b.Sum,
+	}
+	pos, neg := map[int32]float64{}, map[int32]float64{}
+	reduceBuckets(pos, a.PositiveSpans, a.PositiveBuckets, a.Schema, res.Schema, 1)
+	reduceBuckets(pos, b.PositiveSpans, b.PositiveBuckets, b.Schema, res.Schema, sign)
+	reduceBuckets(neg, a.NegativeSpans, a.NegativeBuckets, a.Schema, res.Schema, 1)
+	reduceBuckets(neg, b.NegativeSpans, b.NegativeBuckets, b.Schema, res.Schema, sign)
+	res.widenZeroBucket(pos, neg)
+	res.PositiveSpans, res.PositiveBuckets = spanBuckets(pos)
+	res.NegativeSpans, res.NegativeBuckets = spanBuckets(neg)
+	return res
+}
+
+// widenZeroBucket moves the buckets overlapping h's zero bucket into it,
+// widening it to the upper bound of any bucket only partly within it.
+func (h *Histogram) widenZeroBucket(pos, neg map[int32]float64) {
+	if h.ZeroThreshold == 0 {
+		return
+	}
+	for widened := true; widened; {
+		widened = false
+		for _, buckets := range []map[int32]float64{pos, neg} {
+			for idx, count := range buckets {
+				if bucketBound(h.Schema, idx-1) >= h.ZeroThreshold {
+					continue
+				}
+				h.ZeroCount += count
+				delete(buckets, idx)
+				if upper := bucketBound(h.Schema, idx); upper > h.ZeroThreshold {
+					h.ZeroThreshold = upper
+					widened = true
+				}
+			}
+		}
+	}
+}
+
+// ResetSince reports whether h, a counter, was reset since prev: whether it
+// has a higher resolution schema than prev, or a lower count than prev in
+// any bucket as Sub compares them.
+func (h *Histogram) ResetSince(prev *Histogram) bool {
+	if h.Schema > prev.Schema {
+		return true
+	}
+	d := h.Sub(prev)
+	if d.Count < 0 || d.ZeroCount < 0 {
+		return true
+	}
+	for _, c := range append(d.PositiveBuckets, d.NegativeBuckets...) {
+		if c < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// String prints h, e.g. {count:6, sum:4.5, [-1,-0.5):1, (0.5,1]:2}.
+func (h *Histogram) String() string {
+	parts := []string{
+		"count:" + strconv.FormatFloat(h.Count, 'f', -1, 64),
+		"sum:" + strconv.FormatFloat(h.Sum, 'f', -1, 64),
+	}
+	for _, b := range h.Buckets() {
+		if b.Count == 0 {
+			continue
+		}
+		open, closed := "(", "]"
+		if b.LowerInclusive {
+			open = "["
+		}
+		if !b.UpperInclusive {
+			closed = ")"
+		}
+		parts = append(parts, fmt.Sprintf("%s%g,%g%s:%g", open, b.Lower, b.Upper, closed, b.Count))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// AppendHistogram appends the binary encoding of h to b, as documented for
+// the chunks of persisted blocks.
+func AppendHistogram(b []byte, h *Histogram) []byte {
+	b = binary.AppendVarint(b, int64(h.Schema))
+	for _, v := range []float64{h.ZeroThreshold, h.ZeroCount, h.Count, h.Sum} {
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	b = appendBuckets(b, h.PositiveSpans, h.PositiveBuckets)
+	return appendBuckets(b, h.NegativeSpans, h.NegativeBuckets)
+}
+
+func appendBuckets(b []byte, spans []Span, counts []float64) []byte {
+	b = binary.AppendUvarint(b, uint64(len(spans)))
+	for _, s := range spans {
+		b = binary.AppendVarint(b, int64(s.Offset))
+		b = binary.AppendUvarint(b, uint64(s.Length))
+	}
+	for _, c := range counts {
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(c))
+	}
+	return b
+}
+
+// DecodeHistogram decodes a histogram encoded by AppendHistogram at the
+// start of b, returning it and the number of bytes read.
+func DecodeHistogram(b []byte) (*Histogram, int, error) {
+	d := histogramDecoder{b: b}
+	h := &Histogram{Schema: int32(d.varint())}
+	h.ZeroThreshold = d.float()
+	h.ZeroCount = d.float()
+	h.Count = d.float()
+	h.Sum = d.float()
+	h.PositiveSpans, h.PositiveBuckets = d.buckets()
+	h.NegativeSpans, h.NegativeBuckets = d.buckets()
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+	return h, len(b) - len(d.b), nil
+}
+
+// histogramDecoder decodes the fields of an encoded histogram, recording the
+// first error.
+type histogramDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *histogramDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidHistogram
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *histogramDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidHistogram
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *histogramDecoder) float() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = ErrInvalidHistogram
+		return 0
+	}
+	v := math.Float64frombits(binary.BigEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *histogramDecoder) buckets() ([]Span, []float64) {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = ErrInvalidHistogram
+		return nil, nil
+	}
+	var (
+		spans  []Span
+		counts []float64
+		total  uint64
+	)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		s := Span{Offset: int32(d.varint()), Length: uint32(d.uvarint())}
+		total += uint64(s.Length)
+		spans = append(spans, s)
+	}
+	if total*8 > uint64(len(d.b)) {
+		d.err = ErrInvalidHistogram
+		return nil, nil
+	}
+	for i := uint64(0); i < total && d.err == nil; i++ {
+		counts = append(counts, d.float())
+	}
+	return spans, counts
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// MatchType is the comparison a Matcher makes against a label value.
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return fmt.Sprintf("MatchType(%d)", int(t))
+}
+
+// ParseMatchType returns the MatchType written as s, e.g. "=~".
+func ParseMatchType(s string) (MatchType, error) {
+	for _, t := range []MatchType{MatchEqual, MatchNotEqual, MatchRegexp, MatchNotRegexp} {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown match type %q", s)
+}
+
+// Matcher selects series by the value of one of their labels. The metric
+// name is matched as the MetricNameLabel label. A label a series does not
+// have is matched as the empty string.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher returns a Matcher. Regular expressions are anchored at both
+// ends.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("compiling matcher regexp: %w", err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// MustNewMatcher is like NewMatcher but panics on an invalid regexp.
+func MustNewMatcher(t MatchType, name, value string) *Matcher {
+	m, err := NewMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Matches reports whether v satisfies the matcher.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	panic("metrics: invalid match type")
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// MatchesSeries reports whether a series with the given metric name and label
+// set satisfies every matcher.
+func MatchesSeries(name string, labelSet map[string]string, matchers ...*Matcher) bool {
+	for _, m := range matchers {
+		v := labelSet[m.Name]
+		if m.Name == MetricNameLabel {
+			v = name
+		}
+		if !m.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// matcherJSON is the JSON form of a Matcher, e.g.
+// {"name": "job", "type": "=~", "value": "api.*"}.
+type matcherJSON struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (m *Matcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(matcherJSON{Name: m.Name, Type: m.Type.String(), Value: m.Value})
+}
+
+func (m *Matcher) UnmarshalJSON(b []byte) error {
+	var mj matcherJSON
+	if err := json.Unmarshal(b, &mj); err != nil {
+		return err
+	}
+	t, err := ParseMatchType(mj.Type)
+	if err != nil {
+		return err
+	}
+	parsed, err := NewMatcher(t, mj.Name, mj.Value)
+	if err != nil {
+		return err
+	}
+	*m = *parsed
+	return nil
+}
@@ -9,13 +9,15 @@ import (
 	"github.com/mitchellh/hashstructure/v2"
 )
 
-// MetricPoint represents a single Koalemos data model metric datum.
+// MetricPoint represents a single Koalemos data model metric datum. Its
+// value is a native histogram if Histogram is set, and Value otherwise.
 type MetricPoint struct {
-	Name     string
-	Value    float64 `hash:"ignore"`
-	LabelSet map[string]string
-	Time     int64  `hash:"ignore"`
-	Hash     uint64 `hash:"ignore"`
+	Name      string
+	Value     float64    `hash:"ignore"`
+	Histogram *Histogram `hash:"ignore"`
+	LabelSet  map[string]string
+	Time      int64  `hash:"ignore"`
+	Hash      uint64 `hash:"ignore"`
 }
 
 func (m *MetricPoint) String() string {
@@ -28,6 +30,9 @@ func (m *MetricPoint) String() string {
 		"Labels:"
 
 	floatStr := strconv.FormatFloat(m.Value, 'f', 4, 64)
+	if m.Histogram != nil {
+		floatStr = m.Histogram.String()
+	}
 	metricPoint = fmt.Sprintf(metricPoint, floatStr, m.Time)
 
 	sb.WriteString(metricPoint)
@@ -171,7 +176,8 @@ func (m *MetricFamiliesTimeGroup) GetMetricFamily(metricName string) (*MetricFam
 }
 
 // checkCollision returns ErrDuplicateMetricLabelSet if mf contains
-// mp. Also update metric family inside mfs to contain the new hash.
+// mp, or another metric point of its series at the same time. Also update
+// metric family inside mfs to contain the new hash.
 func checkCollision(mf *MetricFamily, mp *MetricPoint) error {
 	hashedMps, found := mf.HashedMetrics[mp.Hash]
 	if !found {
@@ -179,7 +185,7 @@ func checkCollision(mf *MetricFamily, mp *MetricPoint) error {
 	}
 
 	for _, hashedMp := range hashedMps {
-		if hashedMp.MetadataEquals(mp) {
+		if hashedMp.MetadataEquals(mp) && hashedMp.Time == mp.Time {
 			return ErrDuplicateMetricLabelSet
 		}
 	}
@@ -192,6 +198,13 @@ type MetricFamilyTimeSeries struct {
 	Def      MetricDefinition
 	LabelSet map[string]string
 	metrics  []MetricPoint
+
+	// ref identifies the timeseries within its Block, and hash is its hash of
+	// metric name + label set.
+	ref  uint64
+	hash uint64
+	// maxTime is the newest timestamp of the timeseries' metric points.
+	maxTime int64
 }
 
 func (ts *MetricFamilyTimeSeries) Hash() (uint64, error) {
@@ -208,3 +221,14 @@ func (ts *MetricFamilyTimeSeries) ToMetricPoint() *MetricPoint {
 		LabelSet: ts.LabelSet,
 	}
 }
+
+// MetricPoints returns the metric points written to the timeseries.
+func (ts *MetricFamilyTimeSeries) MetricPoints() []MetricPoint {
+	return ts.metrics
+}
+
+// matches reports whether mp belongs to the timeseries, i.e. has the same
+// metric name and label set.
+func (ts *MetricFamilyTimeSeries) matches(mp *MetricPoint) bool {
+	return ts.Def.Name == mp.Name && reflect.DeepEqual(ts.LabelSet, mp.LabelSet)
+}
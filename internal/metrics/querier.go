@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"errors"
+	"sort"
+)
+
+// Querier provides read access to the series of a block, persisted or in
+// memory.
+type Querier interface {
+	// Select returns the series satisfying every matcher, restricted to
+	// samples within [mint, maxt], ordered by CompareSeries.
+	Select(mint, maxt int64, matchers ...*Matcher) SeriesSet
+	// LabelNames returns the sorted, distinct label names of all series,
+	// including MetricNameLabel.
+	LabelNames() ([]string, error)
+	// LabelValues returns the sorted, distinct values of the named label.
+	LabelValues(name string) ([]string, error)
+	// Close releases the querier's resources. Series returned by Select must
+	// not be used afterwards.
+	Close() error
+}
+
+// NewMergeQuerier returns a Querier over the union of queriers. Series with
+// equal metric names and label sets are merged; where samples share a
+// timestamp, the sample from the querier listed last wins.
+func NewMergeQuerier(queriers ...Querier) Querier {
+	return mergeQuerier(queriers)
+}
+
+type mergeQuerier []Querier
+
+func (q mergeQuerier) Select(mint, maxt int64, matchers ...*Matcher) SeriesSet {
+	sets := make([]SeriesSet, 0, len(q))
+	for _, querier := range q {
+		sets = append(sets, querier.Select(mint, maxt, matchers...))
+	}
+	return NewMergeSeriesSet(sets...)
+}
+
+func (q mergeQuerier) LabelNames() ([]string, error) {
+	return q.mergeStrings(func(querier Querier) ([]string, error) {
+		return querier.LabelNames()
+	})
+}
+
+func (q mergeQuerier) LabelValues(name string) ([]string, error) {
+	return q.mergeStrings(func(querier Querier) ([]string, error) {
+		return querier.LabelValues(name)
+	})
+}
+
+func (q mergeQuerier) mergeStrings(f func(Querier) ([]string, error)) ([]string, error) {
+	set := map[string]struct{}{}
+	for _, querier := range q {
+		vals, err := f(querier)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			set[v] = struct{}{}
+		}
+	}
+	res := make([]string, 0, len(set))
+	for v := range set {
+		res = append(res, v)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (q mergeQuerier) Close() error {
+	var errs []error
+	for _, querier := range q {
+		errs = append(errs, querier.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// mergeSeriesSet merges several SeriesSets, each ordered by CompareSeries,
+// into one.
+type mergeSeriesSet struct {
+	sets []SeriesSet
+	// ok records which sets have a current series.
+	ok  []bool
+	cur Series
+	err error
+}
+
+// NewMergeSeriesSet returns a SeriesSet over the union of sets. Series with
+// equal metric names and label sets are merged; where samples share a
+// timestamp, the sample from the set listed last wins.
+func NewMergeSeriesSet(sets ...SeriesSet) SeriesSet {
+	if len(sets) == 1 {
+		return sets[0]
+	}
+	s := &mergeSeriesSet{sets: sets, ok: make([]bool, len(sets))}
+	for i, set := range sets {
+		s.ok[i] = set.Next()
+	}
+	return s
+}
+
+func (s *mergeSeriesSet) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	var next Series
+	for i, set := range s.sets {
+		if !s.ok[i] {
+			if err := set.Err(); err != nil {
+				s.err = err
+				return false
+			}
+			continue
+		}
+		if next == nil || CompareSeries(set.At(), next) < 0 {
+			next = set.At()
+		}
+	}
+	if next == nil {
+		return false
+	}
+
+	var same []Series
+	for i, set := range s.sets {
+		if s.ok[i] && CompareSeries(set.At(), next) == 0 {
+			same = append(same, set.At())
+			s.ok[i] = set.Next()
+		}
+	}
+	if len(same) == 1 {
+		s.cur = same[0]
+	} else {
+		s.cur = &mergedSeries{series: same}
+	}
+	return true
+}
+
+func (s *mergeSeriesSet) At() Series { return s.cur }
+func (s *mergeSeriesSet) Err() error { return s.err }
+
+// mergedSeries is a series whose samples are read from several series with
+// equal metric names and label sets.
+type mergedSeries struct {
+	series []Series
+}
+
+func (s *mergedSeries) Definition() MetricDefinition {
+	// Prefer the most recent non-empty metadata.
+	def := s.series[0].Definition()
+	for _, series := range s.series[1:] {
+		d := series.Definition()
+		if d.Type != "" {
+			def.Type = d.Type
+		}
+		if d.Help != "" {
+			def.Help = d.Help
+		}
+	}
+	return def
+}
+
+func (s *mergedSeries) LabelSet() map[string]string { return s.series[0].LabelSet() }
+
+func (s *mergedSeries) Iterator() SeriesIterator {
+	its := make([]SeriesIterator, len(s.series))
+	for i, series := range s.series {
+		its[i] = series.Iterator()
+	}
+	return NewMergeSeriesIterator(its...)
+}
+
+type mergeSeriesIterator struct {
+	its []SeriesIterator
+	ok  []bool
+	cur Sample
+	err error
+}
+
+// NewMergeSeriesIterator merges iterators, each ordered by time, into one.
+// Where samples share a timestamp, the sample from the iterator listed last
+// wins.
+func NewMergeSeriesIterator(its ...SeriesIterator) SeriesIterator {
+	it := &mergeSeriesIterator{its: its, ok: make([]bool, len(its))}
+	for i, sub := range its {
+		it.ok[i] = sub.Next()
+	}
+	return it
+}
+
+func (it *mergeSeriesIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	found := false
+	var t int64
+	for i, sub := range it.its {
+		if !it.ok[i] {
+			if err := sub.Err(); err != nil {
+				it.err = err
+				return false
+			}
+			continue
+		}
+		if !found || sub.At().Time < t {
+			t, found = sub.At().Time, true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	for i, sub := range it.its {
+		if it.ok[i] && sub.At().Time == t {
+			it.cur = sub.At()
+			it.ok[i] = sub.Next()
+		}
+	}
+	return true
+}
+
+func (it *mergeSeriesIterator) At() Sample { return it.cur }
+func (it *mergeSeriesIterator) Err() error { return it.err }
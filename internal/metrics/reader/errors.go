@@ -10,4 +10,10 @@ var (
 	ErrInvalidValue         = errors.New("invalid value in metric line")
 	ErrOddLabelSetParts     = errors.New("odd number of label parts")
 	ErrDuplicateLabelKey    = errors.New("label keys should not be repeated within a metric point")
+	ErrUnknownMetricType    = errors.New("unknown metric type")
+	ErrInvalidLabelValue    = errors.New("invalid label value")
+	ErrMissingMetricName    = errors.New("series has no metric name")
+	ErrInvalidProtobuf      = errors.New("invalid protocol buffer message")
+	ErrInvalidSnappy        = errors.New("invalid snappy block")
+	ErrDeltaTemporality     = errors.New("delta temporality is not supported")
 )
@@ -0,0 +1,360 @@
+package reader
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// otlpDelta is the delta aggregation temporality.
+const otlpDelta = 1
+
+// otlpNoRecordedValue is the data point flag marking a point without a
+// value, e.g. one a series ended with.
+const otlpNoRecordedValue = 1
+
+// OTLPReader reads OpenTelemetry metrics export requests: protocol buffer
+// ExportMetricsServiceRequests, as sent to /v1/metrics by OTLP/HTTP
+// exporters.
+//
+// Gauges and sums are read as float samples, monotonic sums as counters, and
+// exponential histograms as native histograms, with scales above
+// metrics.MaxHistogramSchema reduced to it. Metrics of delta temporality are
+// rejected with ErrDeltaTemporality, and explicit bucket histograms and
+// summaries are skipped. Metric and attribute names are made valid by
+// replacing invalid characters with underscores. The service.name resource
+// attribute, prefixed with service.namespace if set, becomes the job label,
+// and service.instance.id the instance label.
+type OTLPReader struct{}
+
+var _ Reader = (*OTLPReader)(nil)
+
+func NewOTLPReader() *OTLPReader {
+	return &OTLPReader{}
+}
+
+// otlpMetric is a metric of an export request.
+type otlpMetric struct {
+	name, description string
+	typ               string
+	temporality       uint64
+	points            []otlpPoint
+}
+
+// otlpPoint is a data point of a metric.
+type otlpPoint struct {
+	attributes map[string]string
+	flags      uint64
+	metrics.MetricPoint
+}
+
+// otlpResource holds the metrics of a ResourceMetrics message.
+type otlpResource struct {
+	attributes map[string]string
+	metrics    []otlpMetric
+}
+
+// Read reads an OTLP metrics export request.
+func (r *OTLPReader) Read(requestReader io.Reader) (*metrics.MetricFamiliesTimeGroup, error) {
+	b, err := io.ReadAll(requestReader)
+	if err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+
+	var resources []otlpResource
+	d := newProtoDecoder(b)
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { resources = append(resources, decodeOTLPResource(m)) })
+		default:
+			d.skip(wireType)
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("decoding export request: %w", d.err)
+	}
+
+	metricFamilies := metrics.NewMetricFamiliesTimeGroup()
+	for _, res := range resources {
+		for _, m := range res.metrics {
+			if err := addOTLPMetric(metricFamilies, res.attributes, m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return metricFamilies, nil
+}
+
+// addOTLPMetric adds the data points of m to the metric family it is read
+// as.
+func addOTLPMetric(metricFamilies *metrics.MetricFamiliesTimeGroup, resource map[string]string, m otlpMetric) error {
+	if m.typ == "" {
+		return nil
+	}
+	if m.temporality == otlpDelta {
+		return fmt.Errorf("%s: %w", m.name, ErrDeltaTemporality)
+	}
+
+	name := sanitizeName(m.name, true)
+	mf := metrics.NewMetricFamily(metrics.MetricDefinition{Name: name, Type: m.typ, Help: m.description})
+	metricFamilies.AddMetricFamily(&mf)
+	for _, p := range m.points {
+		if p.flags&otlpNoRecordedValue != 0 {
+			continue
+		}
+		labelSet := make(map[string]string, len(p.attributes)+2)
+		for k, v := range p.attributes {
+			labelSet[sanitizeName(k, false)] = v
+		}
+		if job := resource["service.name"]; job != "" {
+			if ns := resource["service.namespace"]; ns != "" {
+				job = ns + "/" + job
+			}
+			labelSet["job"] = job
+		}
+		if instance := resource["service.instance.id"]; instance != "" {
+			labelSet["instance"] = instance
+		}
+		if err := addMetricPoints(metricFamilies, name, labelSet, []metrics.MetricPoint{p.MetricPoint}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitizeName replaces the characters of s not valid in a metric name, or
+// a label name if colons is false, with underscores, and prefixes it with
+// an underscore if it starts with a digit.
+func sanitizeName(s string, colons bool) string {
+	var sb strings.Builder
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', colons && c == ':':
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+		default:
+			c = '_'
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// decodeOTLPResource decodes a ResourceMetrics message.
+func decodeOTLPResource(d *protoDecoder) otlpResource {
+	res := otlpResource{attributes: map[string]string{}}
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) {
+				for m.more() {
+					switch field, wireType := m.field(); {
+					case field == 1 && wireType == wireBytes:
+						m.message(func(kv *protoDecoder) { decodeOTLPAttribute(kv, res.attributes) })
+					default:
+						m.skip(wireType)
+					}
+				}
+			})
+		case field == 2 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) {
+				for m.more() {
+					switch field, wireType := m.field(); {
+					case field == 2 && wireType == wireBytes:
+						m.message(func(mm *protoDecoder) { res.metrics = append(res.metrics, decodeOTLPMetric(mm)) })
+					default:
+						m.skip(wireType)
+					}
+				}
+			})
+		default:
+			d.skip(wireType)
+		}
+	}
+	return res
+}
+
+// decodeOTLPAttribute decodes a KeyValue message into attributes. Values
+// are formatted as strings; array, map and bytes values are skipped.
+func decodeOTLPAttribute(d *protoDecoder, attributes map[string]string) {
+	var (
+		key, value string
+		ok         bool
+	)
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			key = string(d.bytes())
+		case field == 2 && wireType == wireBytes:
+			d.message(func(v *protoDecoder) { value, ok = decodeOTLPValue(v) })
+		default:
+			d.skip(wireType)
+		}
+	}
+	if ok {
+		attributes[key] = value
+	}
+}
+
+// decodeOTLPValue decodes an AnyValue message as a string, reporting false
+// for values without a string form.
+func decodeOTLPValue(d *protoDecoder) (string, bool) {
+	var (
+		value string
+		ok    bool
+	)
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			value, ok = string(d.bytes()), true
+		case field == 2 && wireType == wireVarint:
+			value, ok = strconv.FormatBool(d.uvarint() != 0), true
+		case field == 3 && wireType == wireVarint:
+			value, ok = strconv.FormatInt(int64(d.uvarint()), 10), true
+		case field == 4 && wireType == wireFixed64:
+			value, ok = strconv.FormatFloat(d.double(), 'g', -1, 64), true
+		default:
+			d.skip(wireType)
+		}
+	}
+	return value, ok
+}
+
+// decodeOTLPMetric decodes a Metric message. The type of metrics not read
+// is left empty.
+func decodeOTLPMetric(d *protoDecoder) otlpMetric {
+	var m otlpMetric
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			m.name = string(d.bytes())
+		case field == 2 && wireType == wireBytes:
+			m.description = string(d.bytes())
+		case field == 5 && wireType == wireBytes:
+			m.typ = "gauge"
+			d.message(func(dd *protoDecoder) { decodeOTLPData(dd, &m, decodeOTLPNumberPoint) })
+		case field == 7 && wireType == wireBytes:
+			m.typ = "gauge"
+			d.message(func(dd *protoDecoder) { decodeOTLPData(dd, &m, decodeOTLPNumberPoint) })
+		case field == 10 && wireType == wireBytes:
+			m.typ = "histogram"
+			d.message(func(dd *protoDecoder) { decodeOTLPData(dd, &m, decodeOTLPHistogramPoint) })
+		default:
+			d.skip(wireType)
+		}
+	}
+	return m
+}
+
+// decodeOTLPData decodes a Gauge, Sum or ExponentialHistogram message,
+// decoding its data points with decodePoint. Monotonic sums are counters.
+func decodeOTLPData(d *protoDecoder, m *otlpMetric, decodePoint func(*protoDecoder) otlpPoint) {
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			d.message(func(p *protoDecoder) { m.points = append(m.points, decodePoint(p)) })
+		case field == 2 && wireType == wireVarint:
+			m.temporality = d.uvarint()
+		case field == 3 && wireType == wireVarint:
+			if d.uvarint() != 0 {
+				m.typ = "counter"
+			}
+		default:
+			d.skip(wireType)
+		}
+	}
+}
+
+// decodeOTLPNumberPoint decodes a NumberDataPoint message.
+func decodeOTLPNumberPoint(d *protoDecoder) otlpPoint {
+	p := otlpPoint{attributes: map[string]string{}}
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 3 && wireType == wireFixed64:
+			p.Time = nanosToSeconds(d.fixed64())
+		case field == 4 && wireType == wireFixed64:
+			p.Value = d.double()
+		case field == 6 && wireType == wireFixed64:
+			p.Value = float64(int64(d.fixed64()))
+		case field == 7 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { decodeOTLPAttribute(m, p.attributes) })
+		case field == 8 && wireType == wireVarint:
+			p.flags = d.uvarint()
+		default:
+			d.skip(wireType)
+		}
+	}
+	return p
+}
+
+// decodeOTLPHistogramPoint decodes an ExponentialHistogramDataPoint message
+// as a native histogram. Bucket i of an OTLP histogram at scale s covers
+// (base^i, base^(i+1)], as bucket i+1 of schema s does.
+func decodeOTLPHistogramPoint(d *protoDecoder) otlpPoint {
+	var h metrics.Histogram
+	p := otlpPoint{attributes: map[string]string{}}
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { decodeOTLPAttribute(m, p.attributes) })
+		case field == 3 && wireType == wireFixed64:
+			p.Time = nanosToSeconds(d.fixed64())
+		case field == 4 && wireType == wireFixed64:
+			h.Count = float64(d.fixed64())
+		case field == 5 && wireType == wireFixed64:
+			h.Sum = d.double()
+		case field == 6 && wireType == wireVarint:
+			h.Schema = int32(d.sint())
+		case field == 7 && wireType == wireFixed64:
+			h.ZeroCount = float64(d.fixed64())
+		case field == 8 && wireType == wireBytes:
+			d.message(func(b *protoDecoder) { h.PositiveSpans, h.PositiveBuckets = decodeOTLPBuckets(b) })
+		case field == 9 && wireType == wireBytes:
+			d.message(func(b *protoDecoder) { h.NegativeSpans, h.NegativeBuckets = decodeOTLPBuckets(b) })
+		case field == 10 && wireType == wireVarint:
+			p.flags = d.uvarint()
+		case field == 14 && wireType == wireFixed64:
+			h.ZeroThreshold = d.double()
+		default:
+			d.skip(wireType)
+		}
+	}
+	p.Histogram = &h
+	if h.Schema > metrics.MaxHistogramSchema {
+		// Adding an empty histogram reduces the buckets to its schema.
+		p.Histogram = h.Add(&metrics.Histogram{Schema: metrics.MaxHistogramSchema})
+	}
+	return p
+}
+
+// decodeOTLPBuckets decodes a Buckets message as a single span.
+func decodeOTLPBuckets(d *protoDecoder) ([]metrics.Span, []float64) {
+	var (
+		offset int32
+		counts []float64
+	)
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireVarint:
+			offset = int32(d.sint())
+		case field == 2:
+			d.repeatedUvarints(wireType, func(v uint64) { counts = append(counts, float64(v)) })
+		default:
+			d.skip(wireType)
+		}
+	}
+	if len(counts) == 0 {
+		return nil, nil
+	}
+	return []metrics.Span{{Offset: offset + 1, Length: uint32(len(counts))}}, counts
+}
+
+func nanosToSeconds(ns uint64) int64 {
+	return int64(ns / 1e9)
+}
@@ -0,0 +1,148 @@
+package reader
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func otlpAttribute(m *protoEncoder, field int, key, value string) {
+	m.message(field, func(kv *protoEncoder) {
+		kv.string(1, key)
+		kv.message(2, func(v *protoEncoder) { v.string(1, value) })
+	})
+}
+
+// otlpRequest encodes an export request of a single resource, of the
+// service "checkout" in namespace "shop", holding the given metrics.
+func otlpRequest(metricsFns ...func(m *protoEncoder)) []byte {
+	req := &protoEncoder{}
+	req.message(1, func(rm *protoEncoder) {
+		rm.message(1, func(r *protoEncoder) {
+			otlpAttribute(r, 1, "service.name", "checkout")
+			otlpAttribute(r, 1, "service.namespace", "shop")
+			otlpAttribute(r, 1, "service.instance.id", "host-1")
+		})
+		rm.message(2, func(sm *protoEncoder) {
+			for _, f := range metricsFns {
+				sm.message(2, f)
+			}
+		})
+	})
+	return req.b
+}
+
+func Test_ReadOTLP(t *testing.T) {
+	const ns = 978595200 * 1e9
+	body := otlpRequest(
+		func(m *protoEncoder) {
+			m.string(1, "http.server.requests")
+			m.string(2, "Requests served.")
+			m.message(7, func(sum *protoEncoder) {
+				sum.message(1, func(p *protoEncoder) {
+					p.fixed64(3, ns)
+					p.fixed64(6, 42)
+					otlpAttribute(p, 7, "http.method", "GET")
+				})
+				sum.uvarint(2, 2)
+				sum.uvarint(3, 1)
+			})
+		},
+		func(m *protoEncoder) {
+			m.string(1, "rpc.duration")
+			m.message(10, func(eh *protoEncoder) {
+				eh.message(1, func(p *protoEncoder) {
+					p.fixed64(3, ns)
+					p.fixed64(4, 5)
+					p.double(5, 7.5)
+					p.sint(6, 9)
+					p.fixed64(7, 1)
+					// Buckets 0 to 3 of scale 9 are bucket 1 and 2 of
+					// schema 8.
+					p.message(8, func(b *protoEncoder) {
+						b.sint(1, 0)
+						b.message(2, func(c *protoEncoder) {
+							for _, v := range []uint64{1, 1, 1, 1} {
+								c.b = append(c.b, byte(v))
+							}
+						})
+					})
+				})
+				eh.uvarint(2, 2)
+			})
+		},
+	)
+
+	res, err := NewOTLPReader().Read(bytes.NewReader(body))
+	require.NoError(t, err)
+
+	mf, err := res.GetMetricFamily("http_server_requests")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.MetricDefinition{Name: "http_server_requests", Type: "counter", Help: "Requests served."}, mf.Def)
+	require.Len(t, mf.HashedMetrics, 1)
+	for _, mps := range mf.HashedMetrics {
+		assert.Equal(t, map[string]string{"http_method": "GET", "job": "shop/checkout", "instance": "host-1"}, mps[0].LabelSet)
+		assert.Equal(t, 42.0, mps[0].Value)
+		assert.Equal(t, int64(978595200), mps[0].Time)
+	}
+
+	mf, err = res.GetMetricFamily("rpc_duration")
+	require.NoError(t, err)
+	assert.Equal(t, "histogram", mf.Def.Type)
+	require.Len(t, mf.HashedMetrics, 1)
+	for _, mps := range mf.HashedMetrics {
+		expected := &metrics.Histogram{
+			Schema:          8,
+			Count:           5,
+			Sum:             7.5,
+			ZeroCount:       1,
+			PositiveSpans:   []metrics.Span{{Offset: 1, Length: 2}},
+			PositiveBuckets: []float64{2, 2},
+		}
+		assert.True(t, expected.Equals(mps[0].Histogram), mps[0].Histogram.String())
+	}
+}
+
+func Test_ReadOTLPInvalid(t *testing.T) {
+	type Test struct {
+		desc        string
+		metric      func(m *protoEncoder)
+		expectedErr error
+	}
+
+	tests := []Test{
+		{
+			desc: "[NEGATIVE] sum of delta temporality",
+			metric: func(m *protoEncoder) {
+				m.string(1, "requests")
+				m.message(7, func(sum *protoEncoder) {
+					sum.message(1, func(p *protoEncoder) { p.fixed64(6, 1) })
+					sum.uvarint(2, 1)
+					sum.uvarint(3, 1)
+				})
+			},
+			expectedErr: ErrDeltaTemporality,
+		},
+		{
+			desc: "[NEGATIVE] exponential histogram of too low a scale",
+			metric: func(m *protoEncoder) {
+				m.string(1, "latency")
+				m.message(10, func(eh *protoEncoder) {
+					eh.message(1, func(p *protoEncoder) { p.sint(6, -5) })
+					eh.uvarint(2, 2)
+				})
+			},
+			expectedErr: metrics.ErrInvalidHistogram,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := NewOTLPReader().Read(bytes.NewReader(otlpRequest(tc.metric)))
+			assert.ErrorIs(t, err, tc.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package reader
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoDecoder decodes the fields of a protocol buffer message in turn,
+// recording the first error. Messages are decoded from the wire format
+// directly rather than through generated code:
+//
+//	for d.more() {
+//		switch field, wireType := d.field(); {
+//		case field == 1 && wireType == wireBytes:
+//			name = string(d.bytes())
+//		default:
+//			d.skip(wireType)
+//		}
+//	}
+type protoDecoder struct {
+	b   []byte
+	err error
+}
+
+func newProtoDecoder(b []byte) *protoDecoder {
+	return &protoDecoder{b: b}
+}
+
+// more reports whether fields remain to be decoded.
+func (d *protoDecoder) more() bool {
+	return d.err == nil && len(d.b) > 0
+}
+
+// field decodes the key of the next field, its number and wire type.
+func (d *protoDecoder) field() (int, int) {
+	key := d.uvarint()
+	return int(key >> 3), int(key & 7)
+}
+
+func (d *protoDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidProtobuf
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// sint decodes a zigzag encoded sint32 or sint64.
+func (d *protoDecoder) sint() int64 {
+	return unzigzag(d.uvarint())
+}
+
+// unzigzag decodes a zigzag encoded value, as held by sint fields.
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (d *protoDecoder) fixed64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = ErrInvalidProtobuf
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *protoDecoder) double() float64 {
+	return math.Float64frombits(d.fixed64())
+}
+
+// bytes decodes a length delimited field: a string, bytes, an embedded
+// message or a packed repeated field.
+func (d *protoDecoder) bytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if l > uint64(len(d.b)) {
+		d.err = ErrInvalidProtobuf
+		return nil
+	}
+	v := d.b[:l]
+	d.b = d.b[l:]
+	return v
+}
+
+// message decodes an embedded message field, returning a decoder of its
+// fields which reports its errors to d.
+func (d *protoDecoder) message(f func(m *protoDecoder)) {
+	m := newProtoDecoder(d.bytes())
+	if d.err != nil {
+		return
+	}
+	f(m)
+	if m.err != nil {
+		d.err = m.err
+	}
+}
+
+// skip skips a field of the given wire type.
+func (d *protoDecoder) skip(wireType int) {
+	switch wireType {
+	case wireVarint:
+		d.uvarint()
+	case wireFixed64:
+		d.fixed64()
+	case wireBytes:
+		d.bytes()
+	case wireFixed32:
+		if len(d.b) < 4 {
+			d.err = ErrInvalidProtobuf
+			return
+		}
+		d.b = d.b[4:]
+	default:
+		d.err = ErrInvalidProtobuf
+	}
+}
+
+// repeatedUvarints decodes a repeated varint field, packed or not, calling
+// f with each value.
+func (d *protoDecoder) repeatedUvarints(wireType int, f func(uint64)) {
+	if wireType == wireVarint {
+		f(d.uvarint())
+		return
+	}
+	packed := newProtoDecoder(d.bytes())
+	for packed.more() {
+		f(packed.uvarint())
+	}
+	if packed.err != nil {
+		d.err = packed.err
+	}
+}
+
+// repeatedDoubles decodes a repeated double field, packed or not, calling f
+// with each value.
+func (d *protoDecoder) repeatedDoubles(wireType int, f func(float64)) {
+	if wireType == wireFixed64 {
+		f(d.double())
+		return
+	}
+	packed := newProtoDecoder(d.bytes())
+	for packed.more() {
+		f(packed.double())
+	}
+	if packed.err != nil {
+		d.err = packed.err
+	}
+}
@@ -19,13 +19,22 @@ const (
 	NAME
 	TEXT
 
-	// Match valid labelsets {method="post",code="400"}
-	// https://regex101.com/r/IgomLp/1
-	LABELSET_REGEX = `([a-zA-Z_][a-zA-Z0-9_]*?)="([a-zA-Z0-9_]*?)"(,|})`
+	// Match valid labelsets {method="post",code="400",le="0.5"}, whose
+	// values may hold any character, with quotes and backslashes escaped.
+	LABELSET_REGEX = `([a-zA-Z_][a-zA-Z0-9_]*?)="((?:[^"\\]|\\.)*)"(,|})`
 )
 
 var labelsetRegex = regexp.MustCompile(LABELSET_REGEX)
 
+// metricTypes are the types a TYPE line may declare.
+var metricTypes = map[string]struct{}{
+	"counter":   {},
+	"gauge":     {},
+	"histogram": {},
+	"summary":   {},
+	"untyped":   {},
+}
+
 // Reader reads incoming byte streams for metrics.
 type Reader interface {
 	Read(io.Reader) (*metrics.MetricFamiliesTimeGroup, error)
@@ -89,25 +98,30 @@ func BytesToString(b []byte) string {
 // and applies the information to the metricFamilies.
 func processLine(line string, metricFamilies *metrics.MetricFamiliesTimeGroup) error {
 	var err error
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
 	if line[0] == '#' {
 		err = stripMetricFamilyMetadata(line, metricFamilies)
 	} else {
-		err = processMetric(line, metricFamilies)
+		err = processMetric(line, 0, metricFamilies)
 	}
 	return err
 }
 
-// processMetric with input line in format metric_name{lbl1="val",lbl2="val"} 10
-func processMetric(line string, metricFamilies *metrics.MetricFamiliesTimeGroup) error {
+// processMetric with input line in format metric_name{lbl1="val",lbl2="val"} 10,
+// at time ts, or the payload's time if 0.
+func processMetric(line string, ts int64, metricFamilies *metrics.MetricFamiliesTimeGroup) error {
 	const (
 		NAME_PART = iota
 		LABEL_PART
 	)
 
-	lineParts := strings.SplitN(line, "{", -1)
+	lineParts := strings.SplitN(line, "{", 2)
 
-	if len(lineParts) != 2 {
-		return ErrUnexpectedMetricLine
+	// Metrics without labels may leave out the braces.
+	if len(lineParts) == 1 {
+		lineParts = []string{strings.Fields(line)[0], "}"}
 	}
 
 	labelSetParts := labelsetRegex.FindAllStringSubmatch(lineParts[LABEL_PART], -1)
@@ -115,6 +129,7 @@ func processMetric(line string, metricFamilies *metrics.MetricFamiliesTimeGroup)
 	mp := metrics.MetricPoint{
 		Name:     lineParts[NAME_PART],
 		LabelSet: map[string]string{},
+		Time:     ts,
 	}
 
 	err := processLabelSets(&mp, labelSetParts)
@@ -135,6 +150,7 @@ func processMetric(line string, metricFamilies *metrics.MetricFamiliesTimeGroup)
 	}
 	mp.Value = val
 
+	addComponentFamily(mp.Name, metricFamilies)
 	err = metricFamilies.AddMetricPoint(&mp)
 	if err != nil {
 		return fmt.Errorf("adding metric point: %w", err)
@@ -143,7 +159,43 @@ func processMetric(line string, metricFamilies *metrics.MetricFamiliesTimeGroup)
 	return nil
 }
 
+// componentSuffixes are the suffixes of the names of the series histograms
+// and summaries are made up of, by type.
+var componentSuffixes = map[string][]string{
+	"histogram": {"_bucket", "_sum", "_count"},
+	"summary":   {"_sum", "_count"},
+}
+
+// addComponentFamily adds a metric family for the series name if it is a
+// component of a histogram or summary, e.g. the buckets of the histogram
+// http_request_duration_seconds are http_request_duration_seconds_bucket.
+// The family takes the type and help of its histogram or summary.
+func addComponentFamily(name string, metricFamilies *metrics.MetricFamiliesTimeGroup) {
+	if _, err := metricFamilies.GetMetricFamily(name); err == nil {
+		return
+	}
+	for typ, suffixes := range componentSuffixes {
+		for _, suffix := range suffixes {
+			base, ok := strings.CutSuffix(name, suffix)
+			if !ok {
+				continue
+			}
+			mf, err := metricFamilies.GetMetricFamily(base)
+			if err != nil || mf.Def.Type != typ {
+				continue
+			}
+			m := metrics.NewMetricFamily(metrics.MetricDefinition{Name: name, Type: typ, Help: mf.Def.Help})
+			metricFamilies.AddMetricFamily(&m)
+			return
+		}
+	}
+}
+
 func parseValue(line string) (float64, error) {
+	// The value follows the labels, whose values may hold spaces.
+	if i := strings.LastIndexByte(line, '}'); i >= 0 {
+		line = "}" + line[i+1:]
+	}
 	valueStr := strings.Fields(line)
 
 	if len(valueStr) != 2 {
@@ -165,9 +217,13 @@ func processLabelSets(mp *metrics.MetricPoint, labelSetParts [][]string) error {
 	)
 
 	for i := 0; i < len(labelSetParts); i++ {
+		value, err := strconv.Unquote(`"` + labelSetParts[i][VALUE] + `"`)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidLabelValue, labelSetParts[i][VALUE])
+		}
 		// Return err if there's a repeated key.
 		if _, found := mp.LabelSet[labelSetParts[i][KEY]]; !found {
-			mp.LabelSet[labelSetParts[i][KEY]] = labelSetParts[i][VALUE]
+			mp.LabelSet[labelSetParts[i][KEY]] = value
 		} else {
 			return ErrDuplicateLabelKey
 		}
@@ -177,25 +233,35 @@ func processLabelSets(mp *metrics.MetricPoint, labelSetParts [][]string) error {
 }
 
 func stripMetricFamilyMetadata(line string, metricFamilies *metrics.MetricFamiliesTimeGroup) error {
-	// metadataString is the full line `# HELP metric desc....` ->
-	// `HELP metric desc....`
-	metadataString := line[2:]
+	// metadataString is the full line `# HELP metric desc....`, with or
+	// without the space after the #, -> `HELP metric desc....`
+	metadataString := strings.TrimLeft(line[1:], " ")
 	// Split such that the first element is the metric family name, and the
 	// second is the relevant metadata.
 	metadataPieces := strings.SplitN(metadataString, " ", 3)
 
 	switch metadataPieces[TYPE] {
 	case "TYPE":
+		if len(metadataPieces) != 3 {
+			return ErrUnexpectedMetadata
+		}
+		if _, ok := metricTypes[metadataPieces[TEXT]]; !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownMetricType, metadataPieces[TEXT])
+		}
 		def := metrics.MetricDefinition{
 			Name: metadataPieces[NAME],
-			Type: "gauge", // TO-DO: Support other metric types.
+			Type: metadataPieces[TEXT],
 		}
 		m := metrics.NewMetricFamily(def)
 		metricFamilies.AddMetricFamily(&m)
 	case "HELP":
-		def := metrics.MetricDefinition{
-			Name: metadataPieces[NAME],
-			Help: metadataPieces[TEXT],
+		// The help text may be empty, but not the metric family name.
+		if len(metadataPieces) < 2 || metadataPieces[NAME] == "" {
+			return ErrUnexpectedMetadata
+		}
+		def := metrics.MetricDefinition{Name: metadataPieces[NAME]}
+		if len(metadataPieces) == 3 {
+			def.Help = metadataPieces[TEXT]
 		}
 		m := metrics.NewMetricFamily(def)
 		metricFamilies.AddMetricFamily(&m)
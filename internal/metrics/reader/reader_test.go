@@ -6,6 +6,7 @@ import (
 
 	"github.com/mikanmekan/koalemos/internal/metrics"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_Read(t *testing.T) {
@@ -96,6 +97,59 @@ http_requests_total{method="post",code="422"} 1`,
 			},
 			expectedErr: nil,
 		},
+		{
+			desc: "[POSITIVE] metric family keeps its declared type",
+			literalInput: `978595200
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027`,
+			expectedMetrics: &metrics.MetricFamiliesTimeGroup{
+				Time: 978595200,
+				Families: map[string]*metrics.MetricFamily{
+					"http_requests_total": {
+						Def: metrics.MetricDefinition{
+							Name: "http_requests_total",
+							Type: "counter",
+						},
+						HashedMetrics: map[uint64][]*metrics.MetricPoint{mp1.Hash: {&mp1}},
+					},
+				},
+			},
+			expectedErr: nil,
+		},
+		{
+			desc: "[POSITIVE] metric family with an empty help text",
+			literalInput: `978595200
+# HELP http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027`,
+			expectedMetrics: &metrics.MetricFamiliesTimeGroup{
+				Time: 978595200,
+				Families: map[string]*metrics.MetricFamily{
+					"http_requests_total": {
+						Def: metrics.MetricDefinition{
+							Name: "http_requests_total",
+							Type: "counter",
+						},
+						HashedMetrics: map[uint64][]*metrics.MetricPoint{mp1.Hash: {&mp1}},
+					},
+				},
+			},
+			expectedErr: nil,
+		},
+		{
+			desc: "[NEGATIVE] help line without a metric family name",
+			literalInput: `978595200
+# HELP
+http_requests_total{method="post",code="200"} 1027`,
+			expectedErr: ErrUnexpectedMetadata,
+		},
+		{
+			desc: "[NEGATIVE] metric family declares an unknown type",
+			literalInput: `978595200
+# TYPE http_requests_total countr
+http_requests_total{method="post",code="200"} 1027`,
+			expectedErr: ErrUnknownMetricType,
+		},
 		{
 			desc: "[NEGATIVE] input metrics payload has duplicated label set, i.e. two method=post & code=200 entries",
 			literalInput: `978595200
@@ -125,3 +179,56 @@ http_requests_total{method="post",code="200"} 1`,
 		})
 	}
 }
+
+func Test_ReadHistogram(t *testing.T) {
+	input := `978595200
+#HELP http_request_duration_seconds Duration of HTTP requests in seconds
+#TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.1"} 5
+http_request_duration_seconds_bucket{le="+Inf"} 150
+
+http_request_duration_seconds_sum 45.0
+http_request_duration_seconds_count 150
+`
+	res, err := NewReader().Read(bytes.NewReader([]byte(input)))
+	require.NoError(t, err)
+
+	// The series of the histogram are in families of their own, which take
+	// its type and help.
+	for _, name := range []string{"http_request_duration_seconds_bucket", "http_request_duration_seconds_sum", "http_request_duration_seconds_count"} {
+		mf, err := res.GetMetricFamily(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, metrics.MetricDefinition{Name: name, Type: "histogram", Help: "Duration of HTTP requests in seconds"}, mf.Def)
+	}
+
+	mf, err := res.GetMetricFamily("http_request_duration_seconds_bucket")
+	require.NoError(t, err)
+	var les []string
+	for _, mps := range mf.HashedMetrics {
+		for _, mp := range mps {
+			les = append(les, mp.LabelSet["le"])
+		}
+	}
+	assert.ElementsMatch(t, []string{"0.1", "+Inf"}, les)
+
+	mf, err = res.GetMetricFamily("http_request_duration_seconds_sum")
+	require.NoError(t, err)
+	require.Len(t, mf.HashedMetrics, 1)
+	for _, mps := range mf.HashedMetrics {
+		assert.Equal(t, map[string]string{}, mps[0].LabelSet)
+		assert.Equal(t, 45.0, mps[0].Value)
+	}
+}
+
+func Test_ReadLabelValues(t *testing.T) {
+	input := `978595200
+# TYPE build_info gauge
+build_info{version="1.0.0",path="C:\\bin",quote="say \"hi\""} 1`
+	res, err := NewReader().Read(bytes.NewReader([]byte(input)))
+	require.NoError(t, err)
+	mf, err := res.GetMetricFamily("build_info")
+	require.NoError(t, err)
+	for _, mps := range mf.HashedMetrics {
+		assert.Equal(t, map[string]string{"version": "1.0.0", "path": `C:\bin`, "quote": `say "hi"`}, mps[0].LabelSet)
+	}
+}
@@ -0,0 +1,277 @@
+package reader
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// remoteWriteTypes maps the metric types of remote_write metadata to
+// metric family types.
+var remoteWriteTypes = map[uint64]string{
+	0: "untyped",
+	1: "counter",
+	2: "gauge",
+	3: "histogram",
+	4: "histogram",
+	5: "summary",
+	6: "gauge",
+	7: "gauge",
+}
+
+// RemoteWriteReader reads Prometheus remote_write requests: snappy
+// compressed WriteRequest protocol buffers, holding series with float and
+// native histogram samples, and the metadata of their metric families.
+// Sample timestamps are converted from milliseconds to seconds.
+type RemoteWriteReader struct{}
+
+var _ Reader = (*RemoteWriteReader)(nil)
+
+func NewRemoteWriteReader() *RemoteWriteReader {
+	return &RemoteWriteReader{}
+}
+
+// remoteSeries is a series of a WriteRequest.
+type remoteSeries struct {
+	labels     map[string]string
+	samples    []metrics.MetricPoint
+	histograms int
+}
+
+// Read reads a remote_write request.
+func (r *RemoteWriteReader) Read(requestReader io.Reader) (*metrics.MetricFamiliesTimeGroup, error) {
+	compressed, err := io.ReadAll(requestReader)
+	if err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+	b, err := decodeSnappy(compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		series []remoteSeries
+		defs   []metrics.MetricDefinition
+	)
+	d := newProtoDecoder(b)
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { series = append(series, decodeRemoteSeries(m)) })
+		case field == 3 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { defs = append(defs, decodeRemoteMetadata(m)) })
+		default:
+			d.skip(wireType)
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("decoding write request: %w", d.err)
+	}
+
+	metricFamilies := metrics.NewMetricFamiliesTimeGroup()
+	for i := range defs {
+		mf := metrics.NewMetricFamily(defs[i])
+		metricFamilies.AddMetricFamily(&mf)
+	}
+	for _, s := range series {
+		name, ok := s.labels[metrics.MetricNameLabel]
+		if !ok {
+			return nil, ErrMissingMetricName
+		}
+		delete(s.labels, metrics.MetricNameLabel)
+
+		addComponentFamily(name, metricFamilies)
+		if _, err := metricFamilies.GetMetricFamily(name); err != nil {
+			typ := "untyped"
+			if s.histograms > 0 {
+				typ = "histogram"
+			}
+			mf := metrics.NewMetricFamily(metrics.MetricDefinition{Name: name, Type: typ})
+			metricFamilies.AddMetricFamily(&mf)
+		}
+		if err := addMetricPoints(metricFamilies, name, s.labels, s.samples); err != nil {
+			return nil, err
+		}
+	}
+	return metricFamilies, nil
+}
+
+// addMetricPoints adds samples of the series with the given name and labels
+// to its metric family.
+func addMetricPoints(metricFamilies *metrics.MetricFamiliesTimeGroup, name string, labelSet map[string]string, samples []metrics.MetricPoint) error {
+	for i := range samples {
+		mp := samples[i]
+		mp.Name, mp.LabelSet = name, labelSet
+		if mp.Histogram != nil {
+			if err := mp.Histogram.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		hash, err := metrics.HashMetric(&mp)
+		if err != nil {
+			return fmt.Errorf("hashing metric: %w", err)
+		}
+		mp.Hash = hash
+		if err := metricFamilies.AddMetricPoint(&mp); err != nil {
+			return fmt.Errorf("adding metric point: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeRemoteSeries decodes a TimeSeries message.
+func decodeRemoteSeries(d *protoDecoder) remoteSeries {
+	s := remoteSeries{labels: map[string]string{}}
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) {
+				name, value := decodeStringPair(m)
+				s.labels[name] = value
+			})
+		case field == 2 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { s.samples = append(s.samples, decodeRemoteSample(m)) })
+		case field == 4 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) {
+				s.samples = append(s.samples, decodeRemoteHistogram(m))
+				s.histograms++
+			})
+		default:
+			d.skip(wireType)
+		}
+	}
+	return s
+}
+
+// decodeStringPair decodes a message of two string fields, such as a Label.
+func decodeStringPair(d *protoDecoder) (string, string) {
+	var first, second string
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireBytes:
+			first = string(d.bytes())
+		case field == 2 && wireType == wireBytes:
+			second = string(d.bytes())
+		default:
+			d.skip(wireType)
+		}
+	}
+	return first, second
+}
+
+// decodeRemoteSample decodes a Sample message.
+func decodeRemoteSample(d *protoDecoder) metrics.MetricPoint {
+	var mp metrics.MetricPoint
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireFixed64:
+			mp.Value = d.double()
+		case field == 2 && wireType == wireVarint:
+			mp.Time = millisToSeconds(int64(d.uvarint()))
+		default:
+			d.skip(wireType)
+		}
+	}
+	return mp
+}
+
+// decodeRemoteHistogram decodes a Histogram message, whose bucket counts
+// are either integer deltas from the bucket before or float counts.
+func decodeRemoteHistogram(d *protoDecoder) metrics.MetricPoint {
+	var (
+		mp                   metrics.MetricPoint
+		h                    metrics.Histogram
+		posDeltas, negDeltas []int64
+	)
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireVarint:
+			h.Count = float64(d.uvarint())
+		case field == 2 && wireType == wireFixed64:
+			h.Count = d.double()
+		case field == 3 && wireType == wireFixed64:
+			h.Sum = d.double()
+		case field == 4 && wireType == wireVarint:
+			h.Schema = int32(d.sint())
+		case field == 5 && wireType == wireFixed64:
+			h.ZeroThreshold = d.double()
+		case field == 6 && wireType == wireVarint:
+			h.ZeroCount = float64(d.uvarint())
+		case field == 7 && wireType == wireFixed64:
+			h.ZeroCount = d.double()
+		case field == 8 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { h.NegativeSpans = append(h.NegativeSpans, decodeSpan(m)) })
+		case field == 9:
+			d.repeatedUvarints(wireType, func(v uint64) { negDeltas = append(negDeltas, unzigzag(v)) })
+		case field == 10:
+			d.repeatedDoubles(wireType, func(v float64) { h.NegativeBuckets = append(h.NegativeBuckets, v) })
+		case field == 11 && wireType == wireBytes:
+			d.message(func(m *protoDecoder) { h.PositiveSpans = append(h.PositiveSpans, decodeSpan(m)) })
+		case field == 12:
+			d.repeatedUvarints(wireType, func(v uint64) { posDeltas = append(posDeltas, unzigzag(v)) })
+		case field == 13:
+			d.repeatedDoubles(wireType, func(v float64) { h.PositiveBuckets = append(h.PositiveBuckets, v) })
+		case field == 15 && wireType == wireVarint:
+			mp.Time = millisToSeconds(int64(d.uvarint()))
+		default:
+			d.skip(wireType)
+		}
+	}
+	h.PositiveBuckets = append(h.PositiveBuckets, deltasToCounts(posDeltas)...)
+	h.NegativeBuckets = append(h.NegativeBuckets, deltasToCounts(negDeltas)...)
+	mp.Histogram = &h
+	return mp
+}
+
+// decodeSpan decodes a BucketSpan message.
+func decodeSpan(d *protoDecoder) metrics.Span {
+	var s metrics.Span
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireVarint:
+			s.Offset = int32(d.sint())
+		case field == 2 && wireType == wireVarint:
+			s.Length = uint32(d.uvarint())
+		default:
+			d.skip(wireType)
+		}
+	}
+	return s
+}
+
+// deltasToCounts returns the bucket counts given as deltas from the count of
+// the bucket before.
+func deltasToCounts(deltas []int64) []float64 {
+	counts := make([]float64, 0, len(deltas))
+	var count int64
+	for _, delta := range deltas {
+		count += delta
+		counts = append(counts, float64(count))
+	}
+	return counts
+}
+
+// decodeRemoteMetadata decodes a MetricMetadata message.
+func decodeRemoteMetadata(d *protoDecoder) metrics.MetricDefinition {
+	def := metrics.MetricDefinition{Type: "untyped"}
+	for d.more() {
+		switch field, wireType := d.field(); {
+		case field == 1 && wireType == wireVarint:
+			if typ, ok := remoteWriteTypes[d.uvarint()]; ok {
+				def.Type = typ
+			}
+		case field == 2 && wireType == wireBytes:
+			def.Name = string(d.bytes())
+		case field == 4 && wireType == wireBytes:
+			def.Help = string(d.bytes())
+		default:
+			d.skip(wireType)
+		}
+	}
+	return def
+}
+
+func millisToSeconds(ms int64) int64 {
+	return ms / 1000
+}
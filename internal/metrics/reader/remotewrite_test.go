@@ -0,0 +1,236 @@
+package reader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// protoEncoder encodes protocol buffer messages for tests.
+type protoEncoder struct {
+	b []byte
+}
+
+func (e *protoEncoder) key(field, wireType int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field<<3|wireType))
+}
+
+func (e *protoEncoder) uvarint(field int, v uint64) {
+	e.key(field, wireVarint)
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+func (e *protoEncoder) sint(field int, v int64) {
+	e.uvarint(field, uint64(v<<1)^uint64(v>>63))
+}
+
+func (e *protoEncoder) fixed64(field int, v uint64) {
+	e.key(field, wireFixed64)
+	e.b = binary.LittleEndian.AppendUint64(e.b, v)
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	e.fixed64(field, math.Float64bits(v))
+}
+
+func (e *protoEncoder) bytes(field int, b []byte) {
+	e.key(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *protoEncoder) string(field int, s string) {
+	e.bytes(field, []byte(s))
+}
+
+func (e *protoEncoder) message(field int, f func(m *protoEncoder)) {
+	m := &protoEncoder{}
+	f(m)
+	e.bytes(field, m.b)
+}
+
+// encodeSnappy encodes b as a snappy block of literals only.
+func encodeSnappy(b []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(b)))
+	for len(b) > 0 {
+		n := min(len(b), 60)
+		dst = append(dst, byte(n-1)<<2)
+		dst = append(dst, b[:n]...)
+		b = b[n:]
+	}
+	return dst
+}
+
+func remoteLabels(m *protoEncoder, labels ...string) {
+	for i := 0; i < len(labels); i += 2 {
+		m.message(1, func(l *protoEncoder) {
+			l.string(1, labels[i])
+			l.string(2, labels[i+1])
+		})
+	}
+}
+
+func Test_DecodeSnappy(t *testing.T) {
+	type Test struct {
+		desc        string
+		input       []byte
+		expected    []byte
+		expectedErr error
+	}
+
+	tests := []Test{
+		{
+			desc:     "[POSITIVE] literal then overlapping copy",
+			input:    []byte{9, 0x08, 'a', 'b', 'c', 0x09, 3},
+			expected: []byte("abcabcabc"),
+		},
+		{
+			desc:     "[POSITIVE] literals longer than 60 bytes",
+			input:    append([]byte{70, 60 << 2, 69}, bytes.Repeat([]byte("x"), 70)...),
+			expected: bytes.Repeat([]byte("x"), 70),
+		},
+		{
+			desc:        "[NEGATIVE] copy before the start of the output",
+			input:       []byte{9, 0x08, 'a', 'b', 'c', 0x09, 4},
+			expectedErr: ErrInvalidSnappy,
+		},
+		{
+			desc:        "[NEGATIVE] output shorter than its length",
+			input:       []byte{4, 0x08, 'a', 'b', 'c'},
+			expectedErr: ErrInvalidSnappy,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			res, err := decodeSnappy(tc.input)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+}
+
+func Test_ReadRemoteWrite(t *testing.T) {
+	req := &protoEncoder{}
+	req.message(1, func(ts *protoEncoder) {
+		remoteLabels(ts, "__name__", "http_requests_total", "code", "200")
+		for i, v := range []float64{1, 3} {
+			ts.message(2, func(s *protoEncoder) {
+				s.double(1, v)
+				s.uvarint(2, uint64(978595200000+60000*i))
+			})
+		}
+	})
+	req.message(1, func(ts *protoEncoder) {
+		remoteLabels(ts, "__name__", "rpc_duration_seconds")
+		ts.message(4, func(h *protoEncoder) {
+			h.uvarint(1, 6)
+			h.double(3, 4.5)
+			h.sint(4, 0)
+			h.double(5, 0.001)
+			h.uvarint(6, 1)
+			h.message(11, func(s *protoEncoder) {
+				s.sint(1, 0)
+				s.uvarint(2, 2)
+			})
+			// Integer bucket counts are deltas: 2, then 3.
+			h.message(12, func(p *protoEncoder) {
+				p.b = binary.AppendUvarint(p.b, 4)
+				p.b = binary.AppendUvarint(p.b, 2)
+			})
+			h.uvarint(15, 978595200000)
+		})
+	})
+	req.message(3, func(m *protoEncoder) {
+		m.uvarint(1, 1)
+		m.string(2, "http_requests_total")
+		m.string(4, "The total number of HTTP requests.")
+	})
+
+	res, err := NewRemoteWriteReader().Read(bytes.NewReader(encodeSnappy(req.b)))
+	require.NoError(t, err)
+
+	mf, err := res.GetMetricFamily("http_requests_total")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.MetricDefinition{Name: "http_requests_total", Type: "counter", Help: "The total number of HTTP requests."}, mf.Def)
+	var times []int64
+	for _, mps := range mf.HashedMetrics {
+		for _, mp := range mps {
+			assert.Equal(t, map[string]string{"code": "200"}, mp.LabelSet)
+			times = append(times, mp.Time)
+		}
+	}
+	assert.ElementsMatch(t, []int64{978595200, 978595260}, times)
+
+	mf, err = res.GetMetricFamily("rpc_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, "histogram", mf.Def.Type)
+	require.Len(t, mf.HashedMetrics, 1)
+	for _, mps := range mf.HashedMetrics {
+		assert.Equal(t, &metrics.Histogram{
+			Count:           6,
+			Sum:             4.5,
+			ZeroThreshold:   0.001,
+			ZeroCount:       1,
+			PositiveSpans:   []metrics.Span{{Offset: 0, Length: 2}},
+			PositiveBuckets: []float64{2, 3},
+		}, mps[0].Histogram)
+		assert.Equal(t, int64(978595200), mps[0].Time)
+	}
+}
+
+func Test_ReadRemoteWriteInvalid(t *testing.T) {
+	type Test struct {
+		desc        string
+		request     func(req *protoEncoder)
+		expectedErr error
+	}
+
+	tests := []Test{
+		{
+			desc: "[NEGATIVE] series without a metric name",
+			request: func(req *protoEncoder) {
+				req.message(1, func(ts *protoEncoder) { remoteLabels(ts, "code", "200") })
+			},
+			expectedErr: ErrMissingMetricName,
+		},
+		{
+			desc: "[NEGATIVE] histogram with spans not matching its buckets",
+			request: func(req *protoEncoder) {
+				req.message(1, func(ts *protoEncoder) {
+					remoteLabels(ts, "__name__", "rpc_duration_seconds")
+					ts.message(4, func(h *protoEncoder) {
+						h.message(11, func(s *protoEncoder) { s.uvarint(2, 3) })
+					})
+				})
+			},
+			expectedErr: metrics.ErrInvalidHistogram,
+		},
+		{
+			desc: "[NEGATIVE] truncated message",
+			request: func(req *protoEncoder) {
+				req.message(1, func(ts *protoEncoder) { remoteLabels(ts, "__name__", "up") })
+				req.b = req.b[:len(req.b)-1]
+			},
+			expectedErr: ErrInvalidProtobuf,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := &protoEncoder{}
+			tc.request(req)
+			_, err := NewRemoteWriteReader().Read(bytes.NewReader(encodeSnappy(req.b)))
+			assert.ErrorIs(t, err, tc.expectedErr)
+		})
+	}
+}
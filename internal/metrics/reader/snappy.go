@@ -0,0 +1,91 @@
+package reader
+
+import (
+	"encoding/binary"
+)
+
+// maxSnappyDecodedLen bounds the decoded length of a snappy block, guarding
+// against allocating for a corrupted or malicious length.
+const maxSnappyDecodedLen = 64 << 20
+
+// Snappy element tags, the low two bits of an element's first byte.
+const (
+	snappyLiteral = 0
+	snappyCopy1   = 1
+	snappyCopy2   = 2
+	snappyCopy4   = 3
+)
+
+// decodeSnappy decodes a block in the snappy block format, as remote_write
+// requests are compressed: the decoded length as a uvarint, followed by
+// literals and copies of earlier output.
+func decodeSnappy(src []byte) ([]byte, error) {
+	n, sz := binary.Uvarint(src)
+	if sz <= 0 || n > maxSnappyDecodedLen {
+		return nil, ErrInvalidSnappy
+	}
+	src = src[sz:]
+	dst := make([]byte, 0, n)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case snappyLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				// The length is held in the following 1 to 4 bytes.
+				extra := length - 59
+				if len(src) < extra {
+					return nil, ErrInvalidSnappy
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || len(dst)+length > int(n) {
+				return nil, ErrInvalidSnappy
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case snappyCopy1:
+			if len(src) < 2 {
+				return nil, ErrInvalidSnappy
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case snappyCopy2:
+			if len(src) < 3 {
+				return nil, ErrInvalidSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case snappyCopy4:
+			if len(src) < 5 {
+				return nil, ErrInvalidSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, ErrInvalidSnappy
+		}
+		// Copies may overlap their own output, so are made byte by byte.
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, ErrInvalidSnappy
+	}
+	return dst, nil
+}
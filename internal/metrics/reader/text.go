@@ -0,0 +1,143 @@
+package reader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// PrometheusTextReader reads metrics in the Prometheus text exposition
+// format, as served by the /metrics endpoints of Prometheus exporters and
+// client libraries.
+//
+// Unlike the Koalemos format there is no leading timestamp line, so the
+// time of the payload is left 0 for the caller to set. Samples may carry a
+// timestamp of their own, in milliseconds, which is converted to seconds.
+// Series without a TYPE line are untyped, comments other than HELP and TYPE
+// lines are ignored, as are OpenMetrics exemplars.
+type PrometheusTextReader struct{}
+
+var _ Reader = (*PrometheusTextReader)(nil)
+
+// NewPrometheusTextReader returns a reader of the Prometheus text format.
+func NewPrometheusTextReader() *PrometheusTextReader {
+	return &PrometheusTextReader{}
+}
+
+// helpReplacer unescapes the backslashes and newlines of HELP lines.
+var helpReplacer = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+// Read reads metrics in the Prometheus text format.
+func (r *PrometheusTextReader) Read(requestReader io.Reader) (*metrics.MetricFamiliesTimeGroup, error) {
+	metricFamilies := metrics.NewMetricFamiliesTimeGroup()
+
+	scanner := bufio.NewScanner(requestReader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(BytesToString(scanner.Bytes()))
+		if line == "" {
+			continue
+		}
+		var err error
+		if line[0] == '#' {
+			err = processTextComment(line, metricFamilies)
+		} else {
+			err = processTextSample(line, metricFamilies)
+		}
+		if err != nil {
+			return metricFamilies, err
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	return metricFamilies, nil
+}
+
+// processTextComment applies a HELP or TYPE line to metricFamilies, and
+// ignores any other comment.
+func processTextComment(line string, metricFamilies *metrics.MetricFamiliesTimeGroup) error {
+	metadataPieces := strings.SplitN(strings.TrimLeft(line[1:], " "), " ", 3)
+	if len(metadataPieces) < 2 || metadataPieces[NAME] == "" {
+		return nil
+	}
+	text := ""
+	if len(metadataPieces) == 3 {
+		text = metadataPieces[TEXT]
+	}
+
+	def := metrics.MetricDefinition{Name: metadataPieces[NAME]}
+	switch metadataPieces[TYPE] {
+	case "TYPE":
+		def.Type = text
+		// Types of OpenMetrics' own are stored as untyped.
+		if _, ok := metricTypes[def.Type]; !ok {
+			def.Type = "untyped"
+		}
+	case "HELP":
+		def.Help = helpReplacer.Replace(text)
+	default:
+		return nil
+	}
+	m := metrics.NewMetricFamily(def)
+	return metricFamilies.AddMetricFamily(&m)
+}
+
+// processTextSample adds the sample of a line in the format
+// metric_name{lbl1="val",lbl2="val"} 10 [timestamp] to metricFamilies.
+func processTextSample(line string, metricFamilies *metrics.MetricFamiliesTimeGroup) error {
+	end := seriesEnd(line)
+	rest := line[end:]
+	// Drop the exemplar, e.g. # {trace_id="abc"} 0.5
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) != 1 && len(fields) != 2 {
+		return ErrInvalidValue
+	}
+	var ts int64
+	if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: timestamp %q", ErrInvalidValue, fields[1])
+		}
+		ts = ms / 1000
+	}
+
+	name := line[:strings.IndexAny(line+"{", "{ \t")]
+	addComponentFamily(name, metricFamilies)
+	if _, err := metricFamilies.GetMetricFamily(name); err != nil {
+		m := metrics.NewMetricFamily(metrics.MetricDefinition{Name: name, Type: "untyped"})
+		metricFamilies.AddMetricFamily(&m)
+	}
+	return processMetric(line[:end]+" "+fields[0], ts, metricFamilies)
+}
+
+// seriesEnd returns the index just after the name and labels of the series
+// a sample line starts with.
+func seriesEnd(line string) int {
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 {
+		return len(line)
+	}
+	if line[i] != '{' {
+		return i
+	}
+	quoted := false
+	for j := i + 1; j < len(line); j++ {
+		switch {
+		case quoted && line[j] == '\\':
+			j++
+		case line[j] == '"':
+			quoted = !quoted
+		case !quoted && line[j] == '}':
+			return j + 1
+		}
+	}
+	return len(line)
+}
@@ -0,0 +1,104 @@
+package reader
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReadPrometheusText(t *testing.T) {
+	input := `# HELP http_requests_total The total number of HTTP requests,\nby code.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# A comment to be ignored.
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+# TYPE info_metric info
+info_metric{path="a # b"} 1 # {trace_id="abc"} 0.5
+untyped_metric +Inf
+nan_metric NaN
+# EOF
+`
+	res, err := NewPrometheusTextReader().Read(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), res.Time)
+
+	defs := map[string]metrics.MetricDefinition{}
+	points := map[string]*metrics.MetricPoint{}
+	for name, mf := range res.Families {
+		defs[name] = mf.Def
+		for _, mps := range mf.HashedMetrics {
+			for _, mp := range mps {
+				points[mp.String()] = mp
+			}
+		}
+	}
+	assert.Equal(t, map[string]metrics.MetricDefinition{
+		"http_requests_total":        {Name: "http_requests_total", Type: "counter", Help: "The total number of HTTP requests,\nby code."},
+		"rpc_duration_seconds":       {Name: "rpc_duration_seconds", Type: "summary"},
+		"rpc_duration_seconds_sum":   {Name: "rpc_duration_seconds_sum", Type: "summary"},
+		"rpc_duration_seconds_count": {Name: "rpc_duration_seconds_count", Type: "summary"},
+		"info_metric":                {Name: "info_metric", Type: "untyped"},
+		"untyped_metric":             {Name: "untyped_metric", Type: "untyped"},
+		"nan_metric":                 {Name: "nan_metric", Type: "untyped"},
+	}, defs)
+	require.Len(t, points, 8)
+
+	for _, mp := range points {
+		switch mp.Name {
+		case "http_requests_total":
+			// Timestamps are converted from milliseconds.
+			assert.Equal(t, int64(1395066363), mp.Time)
+		case "info_metric":
+			assert.Equal(t, map[string]string{"path": "a # b"}, mp.LabelSet)
+			assert.Equal(t, 1.0, mp.Value)
+		case "untyped_metric":
+			assert.True(t, math.IsInf(mp.Value, 1))
+		case "nan_metric":
+			assert.True(t, math.IsNaN(mp.Value))
+		default:
+			assert.Equal(t, int64(0), mp.Time)
+		}
+	}
+}
+
+func Test_ReadPrometheusTextInvalid(t *testing.T) {
+	type Test struct {
+		desc        string
+		input       string
+		expectedErr error
+	}
+
+	tests := []Test{
+		{
+			desc:        "[NEGATIVE] sample without a value",
+			input:       `http_requests_total{code="200"}`,
+			expectedErr: ErrInvalidValue,
+		},
+		{
+			desc:        "[NEGATIVE] sample with an invalid timestamp",
+			input:       `http_requests_total{code="200"} 1 now`,
+			expectedErr: ErrInvalidValue,
+		},
+		{
+			desc:        "[NEGATIVE] series repeated",
+			input:       "up 1\nup 0",
+			expectedErr: metrics.ErrDuplicateMetricLabelSet,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := NewPrometheusTextReader().Read(strings.NewReader(tc.input))
+			assert.ErrorIs(t, err, tc.expectedErr)
+		})
+	}
+}
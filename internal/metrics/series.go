@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+)
+
+// MetricNameLabel is the label under which a metric's name is stored when a
+// series is flattened into a plain label set, e.g. in a persisted block index.
+const MetricNameLabel = "__name__"
+
+// StaleNaNBits is the bit pattern of StaleNaN.
+const StaleNaNBits uint64 = 0x7ff0000000000002
+
+// StaleNaN is the value of a staleness marker: a sample written when a
+// series stops being produced, e.g. by a recording rule, so that queries
+// treat the series as ended there rather than looking back past it. It is a
+// NaN distinct from math.NaN, and is told apart from other NaNs by its bits.
+var StaleNaN = math.Float64frombits(StaleNaNBits)
+
+// IsStaleNaN reports whether v is a staleness marker.
+func IsStaleNaN(v float64) bool {
+	return math.Float64bits(v) == StaleNaNBits
+}
+
+// Sample is a single timestamped value of a timeseries: a native histogram
+// if Histogram is set, and Value otherwise.
+type Sample struct {
+	Time      int64
+	Value     float64
+	Histogram *Histogram
+}
+
+// Series is a single timeseries yielded by a SeriesSet.
+type Series interface {
+	Definition() MetricDefinition
+	LabelSet() map[string]string
+	Iterator() SeriesIterator
+}
+
+// SeriesIterator iterates over the samples of a series in timestamp order.
+type SeriesIterator interface {
+	Next() bool
+	At() Sample
+	Err() error
+}
+
+// SeriesSet iterates over a set of series, ordered by CompareSeries.
+type SeriesSet interface {
+	Next() bool
+	At() Series
+	Err() error
+}
+
+// ListSeries is a Series backed by an in memory slice of samples.
+type ListSeries struct {
+	Def     MetricDefinition
+	Labels  map[string]string
+	Samples []Sample
+}
+
+var _ Series = (*ListSeries)(nil)
+
+func (s *ListSeries) Definition() MetricDefinition { return s.Def }
+func (s *ListSeries) LabelSet() map[string]string  { return s.Labels }
+
+func (s *ListSeries) Iterator() SeriesIterator {
+	return NewListSeriesIterator(s.Samples)
+}
+
+type listSeriesIterator struct {
+	samples []Sample
+	i       int
+}
+
+// NewListSeriesIterator returns a SeriesIterator over samples, which must
+// already be sorted by time.
+func NewListSeriesIterator(samples []Sample) SeriesIterator {
+	return &listSeriesIterator{samples: samples, i: -1}
+}
+
+func (it *listSeriesIterator) Next() bool {
+	it.i++
+	return it.i < len(it.samples)
+}
+
+func (it *listSeriesIterator) At() Sample { return it.samples[it.i] }
+func (it *listSeriesIterator) Err() error { return nil }
+
+type listSeriesSet struct {
+	series []Series
+	i      int
+}
+
+// NewListSeriesSet sorts series by CompareSeries and returns a SeriesSet
+// over them.
+func NewListSeriesSet(series []Series) SeriesSet {
+	sort.Slice(series, func(i, j int) bool {
+		return CompareSeries(series[i], series[j]) < 0
+	})
+	return &listSeriesSet{series: series, i: -1}
+}
+
+func (s *listSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *listSeriesSet) At() Series { return s.series[s.i] }
+func (s *listSeriesSet) Err() error { return nil }
+
+// ErrSeriesSet returns an empty SeriesSet which reports err.
+func ErrSeriesSet(err error) SeriesSet {
+	return &errSeriesSet{err: err}
+}
+
+type errSeriesSet struct {
+	err error
+}
+
+func (s *errSeriesSet) Next() bool { return false }
+func (s *errSeriesSet) At() Series { return nil }
+func (s *errSeriesSet) Err() error { return s.err }
+
+// ExpandSamples drains it into a slice.
+func ExpandSamples(it SeriesIterator) ([]Sample, error) {
+	var samples []Sample
+	for it.Next() {
+		samples = append(samples, it.At())
+	}
+	return samples, it.Err()
+}
+
+// LabelsWithName returns the label set of s with the metric name included
+// under MetricNameLabel.
+func LabelsWithName(s Series) map[string]string {
+	lbls := make(map[string]string, len(s.LabelSet())+1)
+	for k, v := range s.LabelSet() {
+		lbls[k] = v
+	}
+	lbls[MetricNameLabel] = s.Definition().Name
+	return lbls
+}
+
+// CompareSeries orders series by metric name, then by their label sets
+// compared as sorted (name, value) pairs.
+func CompareSeries(a, b Series) int {
+	an, bn := a.Definition().Name, b.Definition().Name
+	if an != bn {
+		if an < bn {
+			return -1
+		}
+		return 1
+	}
+	return CompareLabelSets(a.LabelSet(), b.LabelSet())
+}
+
+// CompareLabelSets orders two label sets by their sorted (name, value) pairs.
+func CompareLabelSets(a, b map[string]string) int {
+	ak, bk := SortedLabelNames(a), SortedLabelNames(b)
+	for i := 0; i < len(ak) && i < len(bk); i++ {
+		if ak[i] != bk[i] {
+			if ak[i] < bk[i] {
+				return -1
+			}
+			return 1
+		}
+		if av, bv := a[ak[i]], b[bk[i]]; av != bv {
+			if av < bv {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(ak) - len(bk)
+}
+
+// SortedLabelNames returns the label names of lbls in ascending order.
+func SortedLabelNames(lbls map[string]string) []string {
+	names := make([]string, 0, len(lbls))
+	for k := range lbls {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
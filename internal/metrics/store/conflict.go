@@ -0,0 +1,95 @@
+package store
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/wal"
+)
+
+// ConflictPolicy controls what happens to a sample whose series already holds
+// a different value at the same timestamp.
+type ConflictPolicy string
+
+const (
+	// ConflictReject rejects the conflicting sample with
+	// ErrConflictingSample.
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictLastWriteWins replaces the value held with the conflicting
+	// sample's. Samples in a block range already being persisted can no
+	// longer be replaced, and are rejected with ErrConflictingSample.
+	ConflictLastWriteWins ConflictPolicy = "last-write-wins"
+	// ConflictFirstWriteWins keeps the value held and drops the conflicting
+	// sample without error.
+	ConflictFirstWriteWins ConflictPolicy = "first-write-wins"
+)
+
+// ParseConflictPolicy parses a ConflictPolicy by name.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictReject, ConflictLastWriteWins, ConflictFirstWriteWins:
+		return p, nil
+	}
+	return "", fmt.Errorf("%q: %w", s, ErrInvalidConflictPolicy)
+}
+
+// Outcomes of a sample at a timestamp its series already holds.
+const (
+	duplicateIdentical = "identical"
+	duplicateRejected  = "rejected"
+	duplicateReplaced  = "replaced"
+	duplicateDropped   = "dropped"
+)
+
+// lookupSample returns the sample held in memory by the series with
+// reference ref at t, and where a sample replacing it must be appended for it
+// to win. Samples already persisted are not looked up. It must be called with
+// the lock held.
+func (ims *IMSImpl) lookupSample(ref uint64, t int64) (metrics.Sample, appendTarget, bool) {
+	if s, ok := ims.activeBlock.SampleAt(ref, t); ok {
+		return s, appendActive, true
+	}
+	if s, ok := ims.oooBlock.SampleAt(ref, t); ok {
+		return s, appendOOO, true
+	}
+	if ims.oooFlushing != nil {
+		if s, ok := ims.oooFlushing.SampleAt(ref, t); ok {
+			return s, appendOOO, true
+		}
+	}
+	return metrics.Sample{}, appendActive, false
+}
+
+// resolveDuplicate returns where a sample at a timestamp its series already
+// holds in memory is appended, as decided by the conflict policy. Samples
+// identical to the one held are dropped. It must be called with the lock
+// held.
+func (ims *IMSImpl) resolveDuplicate(held metrics.Sample, s wal.RefSample, heldIn appendTarget) (appendTarget, string) {
+	if identicalSamples(held, s) {
+		return appendDropped, duplicateIdentical
+	}
+	switch ims.opts.ConflictPolicy {
+	case ConflictLastWriteWins:
+		// The range of samples older than minValidTime is being persisted
+		// from the active block, which is then truncated, dropping a
+		// replacement appended to it.
+		if heldIn == appendActive && s.Time < ims.minValidTime {
+			return appendConflict, duplicateRejected
+		}
+		return heldIn, duplicateReplaced
+	case ConflictFirstWriteWins:
+		return appendDropped, duplicateDropped
+	default:
+		return appendConflict, duplicateRejected
+	}
+}
+
+// identicalSamples reports whether s has the same value as held, comparing
+// floats by their bits so that identical NaNs are equal.
+func identicalSamples(held metrics.Sample, s wal.RefSample) bool {
+	if held.Histogram != nil || s.Histogram != nil {
+		return held.Histogram.Equals(s.Histogram)
+	}
+	return math.Float64bits(held.Value) == math.Float64bits(s.Value)
+}
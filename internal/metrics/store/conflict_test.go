@@ -0,0 +1,116 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ConflictPolicy(t *testing.T) {
+	type Test struct {
+		desc            string
+		policy          ConflictPolicy
+		expectedErr     error
+		expectedSamples []metrics.Sample
+		expectedOutcome string
+	}
+
+	tests := []Test{
+		{
+			desc:            "[POSITIVE] reject rejects conflicting samples",
+			policy:          ConflictReject,
+			expectedErr:     ErrConflictingSample,
+			expectedSamples: []metrics.Sample{{Time: 100, Value: 1}, {Time: 200, Value: 1}},
+			expectedOutcome: duplicateRejected,
+		},
+		{
+			desc:            "[POSITIVE] last-write-wins replaces the value held",
+			policy:          ConflictLastWriteWins,
+			expectedSamples: []metrics.Sample{{Time: 100, Value: 2}, {Time: 200, Value: 2}},
+			expectedOutcome: duplicateReplaced,
+		},
+		{
+			desc:            "[POSITIVE] first-write-wins keeps the value held",
+			policy:          ConflictFirstWriteWins,
+			expectedSamples: []metrics.Sample{{Time: 100, Value: 1}, {Time: 200, Value: 1}},
+			expectedOutcome: duplicateDropped,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := Options{
+				OutOfOrderWindow: 1000,
+				ConflictPolicy:   tc.policy,
+				Registry:         instrument.NewRegistry(),
+			}
+			ims, err := Open(log.NewLogger(), opts)
+			require.NoError(t, err)
+			defer ims.Close()
+
+			require.NoError(t, addSample(t, ims, 200, 1))
+			require.NoError(t, addSample(t, ims, 100, 1))
+
+			// Identical samples are dropped without error, whether held by
+			// the active or the out-of-order block.
+			for _, ts := range []int64{200, 100} {
+				require.NoError(t, addSample(t, ims, ts, 1))
+			}
+
+			for _, ts := range []int64{200, 100} {
+				err := addSample(t, ims, ts, 2)
+				if tc.expectedErr != nil {
+					assert.ErrorIs(t, err, tc.expectedErr)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+			assert.Equal(t, tc.expectedSamples, selectSamples(t, ims))
+
+			buf := &bytes.Buffer{}
+			_, err = opts.Registry.WriteTo(buf)
+			require.NoError(t, err)
+			lines := strings.Split(buf.String(), "\n")
+			assert.Contains(t, lines, `koalemos_store_duplicate_samples_total{outcome="identical"} 2`)
+			assert.Contains(t, lines, `koalemos_store_duplicate_samples_total{outcome="`+tc.expectedOutcome+`"} 2`)
+		})
+	}
+}
+
+func Test_LastWriteWinsWhilePersisting(t *testing.T) {
+	opts := Options{
+		DataDir:        t.TempDir(),
+		ConflictPolicy: ConflictLastWriteWins,
+		Registry:       instrument.NewRegistry(),
+	}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer func() { ims.Close() }()
+
+	require.NoError(t, addSample(t, ims, 100, 1))
+	require.NoError(t, addSample(t, ims, 11000, 1))
+
+	// persistRange raises minValidTime before writing the range's block
+	// without the lock held. A replacement arriving meanwhile would be
+	// truncated from the active block with the range, so it is rejected.
+	ims.mtx.Lock()
+	ims.minValidTime = DefaultBlockRange
+	ims.mtx.Unlock()
+	assert.ErrorIs(t, addSample(t, ims, 100, 2), ErrConflictingSample)
+	require.NoError(t, addSample(t, ims, 11000, 2))
+
+	require.NoError(t, ims.persistRange(0, DefaultBlockRange))
+	expected := []metrics.Sample{{Time: 100, Value: 1}, {Time: 11000, Value: 2}}
+	assert.Equal(t, expected, selectSamples(t, ims))
+
+	require.NoError(t, ims.Close())
+	ims, err = Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, expected, selectSamples(t, ims))
+}
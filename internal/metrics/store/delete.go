@@ -0,0 +1,151 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/wal"
+	"go.uber.org/zap"
+)
+
+// DeleteSeries deletes the samples within [mint, maxt] of the series
+// satisfying every matcher. Samples held in memory are dropped, recording
+// the deletion in the write-ahead log, while persisted blocks record it as a
+// tombstone until CleanTombstones rewrites them. Long-term storage cannot be
+// rewritten, so its deleted samples are filtered out of queries for good.
+// Queries no longer return the deleted samples once DeleteSeries returns.
+func (ims *IMSImpl) DeleteSeries(mint, maxt int64, matchers ...*metrics.Matcher) error {
+	if len(matchers) == 0 {
+		return ErrNoMatchers
+	}
+	tombstone := metrics.Tombstone{Matchers: matchers, MinTime: mint, MaxTime: maxt}
+
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	ims.mtx.Lock()
+	if ims.wal != nil {
+		if err := ims.wal.Log(wal.EncodeTombstones([]metrics.Tombstone{tombstone})); err != nil {
+			ims.mtx.Unlock()
+			return fmt.Errorf("writing to write-ahead log: %w", err)
+		}
+	}
+	ims.activeBlock.Delete(tombstone)
+	ims.oooBlock.Delete(tombstone)
+	if ims.oooFlushing != nil {
+		ims.oooFlushing.Delete(tombstone)
+	}
+	blocks := append([]*block.Reader(nil), ims.blocks...)
+	ims.mtx.Unlock()
+
+	for _, b := range blocks {
+		if m := b.Meta(); m.MaxTime <= mint || m.MinTime > maxt {
+			continue
+		}
+		if err := b.AddTombstones(tombstone); err != nil {
+			return err
+		}
+	}
+	if err := ims.addLongTermTombstone(tombstone); err != nil {
+		return err
+	}
+
+	ims.metrics.tombstones.Inc()
+	ims.logger.Info("deleted series",
+		zap.Stringers("matchers", matchers),
+		zap.Int64("minTime", mint),
+		zap.Int64("maxTime", maxt),
+	)
+	return nil
+}
+
+// addLongTermTombstone records tombstone against long-term storage, if the
+// store reads from any. It is recorded in the data directory, if there is
+// one, so that it holds across restarts.
+func (ims *IMSImpl) addLongTermTombstone(tombstone metrics.Tombstone) error {
+	if ims.opts.LongTermStorage == nil {
+		return nil
+	}
+	ims.mtx.RLock()
+	all := append(append([]metrics.Tombstone(nil), ims.longTermTombstones...), tombstone)
+	ims.mtx.RUnlock()
+
+	if ims.opts.DataDir != "" {
+		dir := filepath.Join(ims.opts.DataDir, longTermDirname)
+		if err := os.MkdirAll(dir, 0o777); err != nil {
+			return fmt.Errorf("creating long-term storage directory: %w", err)
+		}
+		if err := block.WriteTombstones(dir, all); err != nil {
+			return fmt.Errorf("long-term storage: %w", err)
+		}
+	}
+
+	ims.mtx.Lock()
+	ims.longTermTombstones = all
+	ims.mtx.Unlock()
+	return nil
+}
+
+// CleanTombstones rewrites every persisted block with tombstones without the
+// data they delete. Blocks left empty are deleted.
+func (ims *IMSImpl) CleanTombstones() error {
+	if ims.opts.DataDir == "" {
+		return nil
+	}
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	for {
+		b := ims.nextTombstoned()
+		if b == nil {
+			return nil
+		}
+
+		meta, err := ims.compactor.Rewrite(ims.opts.DataDir, b, nil)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(ims.opts.DataDir, meta.ULID.String())
+		if meta.Stats.NumSeries == 0 {
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("removing empty block: %w", err)
+			}
+			if err := ims.deleteBlocks([]*block.Reader{b}, deletedTombstones); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := block.Open(dir)
+		if err != nil {
+			return fmt.Errorf("opening rewritten block: %w", err)
+		}
+		if err := ims.replaceBlocks([]*block.Reader{b}, r); err != nil {
+			return err
+		}
+		ims.metrics.blocksRewritten.With(deletedTombstones).Inc()
+		ims.logger.Info("rewrote block without deleted data",
+			zap.String("ulid", meta.ULID.String()),
+			zap.String("parent", b.Meta().ULID.String()),
+			zap.Uint64("numSeries", meta.Stats.NumSeries),
+			zap.Uint64("numSamples", meta.Stats.NumSamples),
+		)
+	}
+}
+
+// nextTombstoned returns the first persisted block with tombstones, or nil if
+// there is none.
+func (ims *IMSImpl) nextTombstoned() *block.Reader {
+	ims.mtx.RLock()
+	defer ims.mtx.RUnlock()
+
+	for _, b := range ims.blocks {
+		if len(b.Tombstones()) > 0 {
+			return b
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DeleteSeries(t *testing.T) {
+	dir := t.TempDir()
+	var series []metrics.Series
+	for _, job := range []string{"a", "b"} {
+		series = append(series, &metrics.ListSeries{
+			Def:     metrics.MetricDefinition{Name: "up"},
+			Labels:  map[string]string{"job": job},
+			Samples: []metrics.Sample{{Time: 100, Value: 1}, {Time: 200, Value: 1}},
+		})
+	}
+	_, err := block.Write(dir, 0, DefaultBlockRange, metrics.NewListSeriesSet(series))
+	require.NoError(t, err)
+
+	opts := Options{DataDir: dir, Registry: instrument.NewRegistry()}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer func() { ims.Close() }()
+	require.NoError(t, addSample(t, ims, DefaultBlockRange+100, 1))
+
+	jobA := metrics.MustNewMatcher(metrics.MatchEqual, "job", "a")
+	assert.ErrorIs(t, ims.DeleteSeries(0, 1000), ErrNoMatchers)
+	require.NoError(t, ims.DeleteSeries(150, DefaultBlockRange+100, jobA))
+
+	// Deleted samples are no longer returned, from persisted blocks and the
+	// active block alike.
+	expected := map[string][]int64{"a": {100}, "b": {100, 200}}
+	selectTimes := func() map[string][]int64 {
+		q, err := ims.Querier()
+		require.NoError(t, err)
+		defer q.Close()
+
+		res := map[string][]int64{}
+		set := q.Select(0, 2*DefaultBlockRange)
+		for set.Next() {
+			samples, err := metrics.ExpandSamples(set.At().Iterator())
+			require.NoError(t, err)
+			for _, s := range samples {
+				res[set.At().LabelSet()["job"]] = append(res[set.At().LabelSet()["job"]], s.Time)
+			}
+		}
+		require.NoError(t, set.Err())
+		return res
+	}
+	assert.Equal(t, expected, selectTimes())
+
+	// Deletions survive a restart, through the tombstones of persisted
+	// blocks and the write-ahead log.
+	require.NoError(t, ims.Close())
+	ims, err = Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, expected, selectTimes())
+
+	before := ims.Blocks()
+	require.Len(t, before, 1)
+	require.NoError(t, ims.CleanTombstones())
+	after := ims.Blocks()
+	require.Len(t, after, 1)
+	assert.NotEqual(t, before[0].ULID, after[0].ULID)
+	assert.Equal(t, uint64(3), after[0].Stats.NumSamples)
+	assert.Equal(t, expected, selectTimes())
+
+	r, err := block.Open(filepath.Join(dir, after[0].ULID.String()))
+	require.NoError(t, err)
+	assert.Empty(t, r.Tombstones())
+	require.NoError(t, r.Close())
+}
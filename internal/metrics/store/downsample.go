@@ -0,0 +1,179 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/downsample"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+// QueryOptions configures the resolution a Querier reads persisted data at.
+type QueryOptions struct {
+	// Step is the interval, in seconds, the query is evaluated at. The
+	// resolution is chosen from Step and the query's range, see
+	// downsample.ResolutionFor.
+	Step int64
+	// Raw forces raw samples to be read, regardless of Step.
+	Raw bool
+	// Aggr is the aggregate read from downsampled data.
+	Aggr downsample.Aggr
+}
+
+// QuerierFor returns a Querier for a query over [mint, maxt], reading each
+// persisted block at the coarsest resolution suited to the query which the
+// block has been downsampled to. Blocks which have not been downsampled far
+// enough, and the active block, are read raw. The querier must be closed once
+// the caller is done with its results.
+func (ims *IMSImpl) QuerierFor(mint, maxt int64, opts QueryOptions) (metrics.Querier, error) {
+	if opts.Raw {
+		return ims.Querier()
+	}
+	return ims.querier(downsample.ResolutionFor(mint, maxt, opts.Step), opts.Aggr)
+}
+
+// querier returns a Querier over the active, out-of-order and persisted blocks
+// and long-term storage, reading each raw block through the block downsampled from it at the
+// coarsest resolution up to res, if there is one. Data deleted from long-term
+// storage is filtered out.
+func (ims *IMSImpl) querier(res int64, aggr downsample.Aggr) (metrics.Querier, error) {
+	ims.mtx.RLock()
+	defer ims.mtx.RUnlock()
+
+	best := map[ulid.ULID]*block.Reader{}
+	for _, b := range ims.blocks {
+		m := b.Meta()
+		if m.Resolution() > res {
+			continue
+		}
+		if cur, ok := best[m.Source()]; !ok || m.Resolution() > cur.Meta().Resolution() {
+			best[m.Source()] = b
+		}
+	}
+
+	queriers := make([]metrics.Querier, 0, len(best)+3)
+	// Long-term storage is listed first so that the store's own samples win
+	// over it.
+	if lts := ims.opts.LongTermStorage; lts != nil {
+		q, err := lts.Querier()
+		if err != nil {
+			return nil, fmt.Errorf("opening long-term storage querier: %w", err)
+		}
+		q = metrics.NewTombstoneQuerier(q, ims.longTermTombstones)
+		if res > 0 {
+			q = downsample.NewQuerier(q, 0, aggr)
+		}
+		queriers = append(queriers, q)
+	}
+	for _, b := range ims.blocks {
+		if best[b.Meta().Source()] != b {
+			continue
+		}
+		q, err := b.Querier()
+		if err != nil {
+			metrics.NewMergeQuerier(queriers...).Close()
+			return nil, fmt.Errorf("opening block querier: %w", err)
+		}
+		if res > 0 {
+			q = downsample.NewQuerier(q, b.Meta().Resolution(), aggr)
+		}
+		queriers = append(queriers, q)
+	}
+
+	// The active block is listed last so its samples win over persisted and
+	// out-of-order ones.
+	for _, head := range []metrics.Querier{ims.oooQuerier(), ims.activeBlockQuerier()} {
+		if res > 0 {
+			head = downsample.NewQuerier(head, 0, aggr)
+		}
+		queriers = append(queriers, head)
+	}
+	return metrics.NewMergeQuerier(queriers...), nil
+}
+
+// Downsample downsamples the raw blocks which are no longer compacted, i.e.
+// those spanning the largest compaction range, to downsample.ResLevel1, and
+// those blocks in turn to downsample.ResLevel2. Downsampled blocks are kept
+// alongside the block they were produced from, and removed with it.
+func (ims *IMSImpl) Downsample() error {
+	if ims.opts.DataDir == "" || ims.opts.DisableDownsampling {
+		return nil
+	}
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	for {
+		src, res := ims.nextDownsample()
+		if src == nil {
+			return nil
+		}
+
+		meta, err := downsample.Downsample(ims.opts.DataDir, src, res)
+		if err != nil {
+			return err
+		}
+		r, err := block.Open(filepath.Join(ims.opts.DataDir, meta.ULID.String()))
+		if err != nil {
+			return fmt.Errorf("opening downsampled block: %w", err)
+		}
+
+		ims.mtx.Lock()
+		ims.blocks = append(ims.blocks, r)
+		sort.Slice(ims.blocks, func(i, j int) bool {
+			return ims.blocks[i].Meta().MinTime < ims.blocks[j].Meta().MinTime
+		})
+		ims.updateBlockMetrics()
+		ims.mtx.Unlock()
+
+		ims.metrics.blocksDownsampled.With(strconv.FormatInt(res, 10)).Inc()
+		ims.logger.Info("downsampled block",
+			zap.String("ulid", meta.ULID.String()),
+			zap.String("source", src.Meta().ULID.String()),
+			zap.Int64("resolution", res),
+			zap.Uint64("numSeries", meta.Stats.NumSeries),
+			zap.Uint64("numSamples", meta.Stats.NumSamples),
+		)
+	}
+}
+
+// nextDownsample returns the next block to downsample and the resolution to
+// downsample it to, or nil if there is none.
+func (ims *IMSImpl) nextDownsample() (*block.Reader, int64) {
+	ims.mtx.RLock()
+	defer ims.mtx.RUnlock()
+
+	maxRange := ims.opts.CompactionRanges[len(ims.opts.CompactionRanges)-1]
+	have := map[ulid.ULID]map[int64]struct{}{}
+	for _, b := range ims.blocks {
+		m := b.Meta()
+		if have[m.Source()] == nil {
+			have[m.Source()] = map[int64]struct{}{}
+		}
+		have[m.Source()][m.Resolution()] = struct{}{}
+	}
+
+	for _, b := range ims.blocks {
+		m := b.Meta()
+		if m.Resolution() == 0 && m.MaxTime-m.MinTime < maxRange {
+			continue
+		}
+		for i, res := range downsample.Resolutions {
+			prev := int64(0)
+			if i > 0 {
+				prev = downsample.Resolutions[i-1]
+			}
+			if m.Resolution() != prev {
+				continue
+			}
+			if _, ok := have[m.Source()][res]; !ok {
+				return b, res
+			}
+		}
+	}
+	return nil, 0
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/downsample"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Downsample(t *testing.T) {
+	dir := t.TempDir()
+	day := int64(86400)
+	series := &metrics.ListSeries{
+		Def:    metrics.MetricDefinition{Name: "requests_total", Type: "counter"},
+		Labels: map[string]string{},
+	}
+	for ts := int64(0); ts < day; ts += 60 {
+		series.Samples = append(series.Samples, metrics.Sample{Time: ts, Value: float64(ts)})
+	}
+	// A day long block is not compacted any further, so it is downsampled.
+	raw, err := block.Write(dir, 0, day, metrics.NewListSeriesSet([]metrics.Series{series}))
+	require.NoError(t, err)
+	_, err = block.Write(dir, day, day+DefaultBlockRange, metrics.NewListSeriesSet([]metrics.Series{
+		&metrics.ListSeries{Def: series.Def, Labels: series.Labels, Samples: []metrics.Sample{{Time: day, Value: float64(day)}}},
+	}))
+	require.NoError(t, err)
+
+	opts := Options{DataDir: dir, Registry: instrument.NewRegistry()}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer ims.Close()
+
+	require.NoError(t, ims.Downsample())
+	resolutions := map[int64]int{}
+	for _, m := range ims.Blocks() {
+		resolutions[m.Resolution()]++
+		if m.Resolution() > 0 {
+			assert.Equal(t, raw.ULID, m.Source())
+		}
+	}
+	assert.Equal(t, map[int64]int{0: 2, downsample.ResLevel1: 1, downsample.ResLevel2: 1}, resolutions)
+
+	// Downsampled blocks overlap their source but are not compacted with it.
+	require.NoError(t, ims.Compact())
+	assert.Len(t, ims.Blocks(), 4)
+
+	numSamples := func(opts QueryOptions) int {
+		q, err := ims.QuerierFor(0, day, opts)
+		require.NoError(t, err)
+		defer q.Close()
+
+		set := q.Select(0, day)
+		require.True(t, set.Next())
+		samples, err := metrics.ExpandSamples(set.At().Iterator())
+		require.NoError(t, err)
+		assert.False(t, set.Next())
+		return len(samples)
+	}
+	assert.Equal(t, 1441, numSamples(QueryOptions{Step: 60}))
+	assert.Equal(t, 289, numSamples(QueryOptions{Step: 3600}))
+	assert.Equal(t, 25, numSamples(QueryOptions{Step: 6 * 3600}))
+	assert.Equal(t, 1441, numSamples(QueryOptions{Step: 6 * 3600, Raw: true}))
+
+	// Downsampled blocks are deleted along with their source.
+	ims.opts.RetentionDuration = DefaultBlockRange
+	require.NoError(t, ims.ApplyRetention())
+	assert.Len(t, ims.Blocks(), 1)
+	metas, err := block.List(dir)
+	require.NoError(t, err)
+	assert.Len(t, metas, 1)
+}
+
+func Test_LongTermStorage(t *testing.T) {
+	series := &metrics.ListSeries{
+		Def:     metrics.MetricDefinition{Name: "up", Type: "gauge"},
+		Labels:  map[string]string{"job": "a"},
+		Samples: []metrics.Sample{{Time: 100, Value: 1}, {Time: 200, Value: 2}},
+	}
+	remote := t.TempDir()
+	meta, err := block.Write(remote, 0, DefaultBlockRange, metrics.NewListSeriesSet([]metrics.Series{series}))
+	require.NoError(t, err)
+	lts, err := block.Open(filepath.Join(remote, meta.ULID.String()))
+	require.NoError(t, err)
+	defer lts.Close()
+
+	opts := Options{DataDir: t.TempDir(), LongTermStorage: lts, Registry: instrument.NewRegistry()}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer ims.Close()
+	require.NoError(t, addSample(t, ims, 200, 5))
+	require.NoError(t, addSample(t, ims, 300, 3))
+
+	// The store's own samples win over long-term storage.
+	assert.Equal(t, []metrics.Sample{{Time: 100, Value: 1}, {Time: 200, Value: 5}, {Time: 300, Value: 3}}, selectSamples(t, ims))
+}
+
+func Test_LongTermStorageDeleteSeries(t *testing.T) {
+	series := &metrics.ListSeries{
+		Def:     metrics.MetricDefinition{Name: "up", Type: "gauge"},
+		Labels:  map[string]string{"job": "a"},
+		Samples: []metrics.Sample{{Time: 100, Value: 1}, {Time: 200, Value: 2}},
+	}
+	remote := t.TempDir()
+	meta, err := block.Write(remote, 0, DefaultBlockRange, metrics.NewListSeriesSet([]metrics.Series{series}))
+	require.NoError(t, err)
+	lts, err := block.Open(filepath.Join(remote, meta.ULID.String()))
+	require.NoError(t, err)
+	defer lts.Close()
+
+	opts := Options{DataDir: t.TempDir(), LongTermStorage: lts, Registry: instrument.NewRegistry()}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer func() { ims.Close() }()
+	require.NoError(t, addSample(t, ims, 300, 3))
+
+	// Samples shipped to long-term storage are deleted with the store's own.
+	require.NoError(t, ims.DeleteSeries(150, 250, metrics.MustNewMatcher(metrics.MatchEqual, "job", "a")))
+	expected := []metrics.Sample{{Time: 100, Value: 1}, {Time: 300, Value: 3}}
+	assert.Equal(t, expected, selectSamples(t, ims))
+
+	// And stay deleted after a restart.
+	require.NoError(t, ims.Close())
+	ims, err = Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, expected, selectSamples(t, ims))
+
+	require.NoError(t, ims.DeleteSeries(0, 1000, metrics.MustNewMatcher(metrics.MatchEqual, "job", "a")))
+	q, err := ims.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+	assert.False(t, q.Select(0, 1000).Next())
+}
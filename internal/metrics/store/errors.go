@@ -0,0 +1,10 @@
+package store
+
+import "errors"
+
+var (
+	ErrOutOfOrderSample      = errors.New("sample is older than the out-of-order window")
+	ErrConflictingSample     = errors.New("sample conflicts with a different value at the same timestamp")
+	ErrInvalidConflictPolicy = errors.New("invalid conflict policy")
+	ErrNoMatchers            = errors.New("at least one matcher is required")
+)
@@ -0,0 +1,58 @@
+package store
+
+import "github.com/mikanmekan/koalemos/internal/instrument"
+
+// Reasons a persisted block is deleted or rewritten.
+const (
+	deletedRetentionTime = "retention_time"
+	deletedRetentionSize = "retention_size"
+	deletedTombstones    = "tombstones"
+)
+
+// Reasons a sample is rejected.
+const (
+	rejectedOutOfOrder = "out_of_order"
+	rejectedConflict   = "conflict"
+)
+
+// storeMetrics are the metrics a store records about itself.
+type storeMetrics struct {
+	blocks             *instrument.Gauge
+	blocksBytes        *instrument.Gauge
+	blocksDeleted      *instrument.Counter
+	blocksDeletedBytes *instrument.Counter
+	blocksRewritten    *instrument.Counter
+	seriesDeleted      *instrument.Counter
+	blocksDownsampled  *instrument.Counter
+	oooSamplesAppended *instrument.Counter
+	samplesRejected    *instrument.Counter
+	duplicateSamples   *instrument.Counter
+	tombstones         *instrument.Counter
+}
+
+func newStoreMetrics(r *instrument.Registry) *storeMetrics {
+	return &storeMetrics{
+		blocks: r.NewGauge("koalemos_store_blocks",
+			"Number of persisted blocks."),
+		blocksBytes: r.NewGauge("koalemos_store_blocks_bytes",
+			"Bytes occupied on disk by persisted blocks."),
+		blocksDeleted: r.NewCounter("koalemos_store_blocks_deleted_total",
+			"Number of persisted blocks deleted, by reason.", "reason"),
+		blocksDeletedBytes: r.NewCounter("koalemos_store_blocks_deleted_bytes_total",
+			"Bytes of persisted blocks deleted, by reason.", "reason"),
+		blocksRewritten: r.NewCounter("koalemos_store_blocks_rewritten_total",
+			"Number of persisted blocks rewritten to drop series, by reason.", "reason"),
+		seriesDeleted: r.NewCounter("koalemos_store_series_deleted_total",
+			"Number of series deleted from persisted blocks, by reason.", "reason"),
+		blocksDownsampled: r.NewCounter("koalemos_store_blocks_downsampled_total",
+			"Number of downsampled blocks written, by resolution in seconds.", "resolution"),
+		oooSamplesAppended: r.NewCounter("koalemos_store_ooo_samples_appended_total",
+			"Number of samples appended within the out-of-order window."),
+		samplesRejected: r.NewCounter("koalemos_store_samples_rejected_total",
+			"Number of samples rejected, by reason.", "reason"),
+		duplicateSamples: r.NewCounter("koalemos_store_duplicate_samples_total",
+			"Number of samples at a timestamp their series already held, by outcome.", "outcome"),
+		tombstones: r.NewCounter("koalemos_store_tombstones_total",
+			"Number of series deletions recorded as tombstones."),
+	}
+}
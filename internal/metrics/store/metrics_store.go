@@ -1,37 +1,823 @@
 package store
 
 import (
-	"github.com/mikanmekan/koalemos/internal/hash"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
 	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/compact"
+	"github.com/mikanmekan/koalemos/internal/metrics/downsample"
+	"github.com/mikanmekan/koalemos/internal/metrics/wal"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
 )
 
+// walDirname is the directory within the data directory holding the
+// write-ahead log of the active block.
+const walDirname = "wal"
+
+// longTermDirname is the directory within the data directory holding the
+// tombstones of the data deleted from long-term storage.
+const longTermDirname = "long-term"
+
+// DefaultBlockRange is the span of time, in seconds, covered by a block
+// persisted from the active block.
+const DefaultBlockRange = int64(2 * time.Hour / time.Second)
+
 // MetricsIMS is the interface for an in memory store for metrics.
 type IMS interface {
 	AddMetricFamiliesTimeGroup(metricFamiliesTimeGroup *metrics.MetricFamiliesTimeGroup) error
 	GetTimeSeries(timeSeries *metrics.MetricFamilyTimeSeries) (*metrics.MetricFamilyTimeSeries, error)
 }
 
+// Options configures where and how a store persists its blocks.
+type Options struct {
+	// DataDir is the directory persisted blocks are written to. Blocks are
+	// not persisted if DataDir is empty.
+	DataDir string
+	// BlockRange is the span of time, in seconds, covered by each persisted
+	// block.
+	BlockRange int64
+	// CompactionRanges are the time ranges, in seconds, persisted blocks are
+	// compacted into, starting with BlockRange. Defaults to
+	// compact.DefaultRanges(BlockRange).
+	CompactionRanges []int64
+	// WAL configures the write-ahead log of the active block, which is kept
+	// within DataDir.
+	WAL wal.Options
+	// RetentionDuration is how long, in seconds, persisted blocks are kept
+	// for, measured from the newest metric point. Zero keeps blocks
+	// regardless of age.
+	RetentionDuration int64
+	// RetentionRules override RetentionDuration for the series they match.
+	// The first matching rule applies.
+	RetentionRules []RetentionRule
+	// RetentionBytes is the maximum number of bytes persisted blocks and the
+	// write-ahead log may occupy on disk. Zero keeps blocks regardless of
+	// size.
+	RetentionBytes int64
+	// OutOfOrderWindow is how far, in seconds, behind the newest metric point
+	// a sample older than the newest sample of its series may be and still
+	// be accepted. Such samples are kept apart from the active block until
+	// persisted. Zero rejects every out-of-order sample.
+	OutOfOrderWindow int64
+	// ConflictPolicy decides what happens to a sample whose series already
+	// holds a different value at the same timestamp. Defaults to
+	// ConflictReject.
+	ConflictPolicy ConflictPolicy
+	// DisableDownsampling stops blocks which are no longer compacted from
+	// being downsampled.
+	DisableDownsampling bool
+	// LongTermStorage serves the blocks kept elsewhere than DataDir, such as
+	// those shipped to object storage. Its samples are read alongside the
+	// store's own, which win where both hold a sample.
+	LongTermStorage Queryable
+	// Registry is where the store records metrics about itself. Defaults to
+	// a registry of the store's own.
+	Registry *instrument.Registry
+}
+
+// Queryable provides Queriers over stored series.
+type Queryable interface {
+	Querier() (metrics.Querier, error)
+}
+
 // MetricsIMSImpl is the in memory store for metrics.
 type IMSImpl struct {
+	logger log.Logger
+	opts   Options
+
+	// cmtx serialises the operations writing, replacing or deleting
+	// persisted blocks.
+	cmtx sync.Mutex
+	mtx  sync.RWMutex
 	// activeBlock is the metrics block that all incoming metrics will be written to.
-	activeBlock metrics.Block
+	activeBlock *metrics.Block
+	// minValidTime is the end of the newest block range persisted from the
+	// active block. Older samples are no longer appended to it.
+	minValidTime int64
+	// oooBlock holds samples appended out of order, which are persisted
+	// separately from the active block. oooFlushing holds those being
+	// persisted.
+	oooBlock    *metrics.Block
+	oooFlushing *metrics.Block
+	// blocks are the persisted blocks, ordered by time.
+	blocks []*block.Reader
+	// longTermTombstones record the data deleted from long-term storage,
+	// which is filtered out as it is read.
+	longTermTombstones []metrics.Tombstone
+
+	compactor *compact.Compactor
+	metrics   *storeMetrics
+	// wal records every metric point added to the active block, so that the
+	// active block can be rebuilt after a crash.
+	wal *wal.WAL
 }
 
 var _ IMS = (*IMSImpl)(nil)
 
 func New() *IMSImpl {
-	return &IMSImpl{}
+	return &IMSImpl{
+		logger:       log.NewLogger(),
+		opts:         Options{BlockRange: DefaultBlockRange, ConflictPolicy: ConflictReject},
+		activeBlock:  metrics.NewBlock(),
+		minValidTime: math.MinInt64,
+		oooBlock:     metrics.NewBlock(),
+		compactor:    compact.NewCompactor(compact.DefaultRanges(DefaultBlockRange)),
+		metrics:      newStoreMetrics(instrument.NewRegistry()),
+	}
+}
+
+// Open returns a store which persists blocks to opts.DataDir, loading any
+// blocks already persisted there.
+func Open(l log.Logger, opts Options) (*IMSImpl, error) {
+	if opts.BlockRange <= 0 {
+		opts.BlockRange = DefaultBlockRange
+	}
+	if len(opts.CompactionRanges) == 0 {
+		opts.CompactionRanges = compact.DefaultRanges(opts.BlockRange)
+	}
+	if opts.ConflictPolicy == "" {
+		opts.ConflictPolicy = ConflictReject
+	}
+	if _, err := ParseConflictPolicy(string(opts.ConflictPolicy)); err != nil {
+		return nil, err
+	}
+	if opts.Registry == nil {
+		opts.Registry = instrument.NewRegistry()
+	}
+	ims := &IMSImpl{
+		logger:       l,
+		opts:         opts,
+		activeBlock:  metrics.NewBlock(),
+		minValidTime: math.MinInt64,
+		oooBlock:     metrics.NewBlock(),
+		compactor:    compact.NewCompactor(opts.CompactionRanges),
+		metrics:      newStoreMetrics(opts.Registry),
+	}
+	if opts.DataDir == "" {
+		return ims, nil
+	}
+
+	if err := os.MkdirAll(opts.DataDir, 0o777); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+	metas, err := block.List(opts.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("loading persisted blocks: %w", err)
+	}
+	for _, meta := range metas {
+		r, err := block.Open(filepath.Join(opts.DataDir, meta.ULID.String()))
+		if err != nil {
+			ims.Close()
+			return nil, fmt.Errorf("loading persisted blocks: %w", err)
+		}
+		ims.blocks = append(ims.blocks, r)
+		ims.minValidTime = max(ims.minValidTime, meta.MaxTime)
+	}
+	ims.updateBlockMetrics()
+	l.Info("loaded persisted blocks", zap.Int("count", len(ims.blocks)))
+
+	if ims.longTermTombstones, err = block.ReadTombstones(filepath.Join(opts.DataDir, longTermDirname)); err != nil {
+		ims.Close()
+		return nil, fmt.Errorf("loading long-term storage tombstones: %w", err)
+	}
+
+	walDir := filepath.Join(opts.DataDir, walDirname)
+	if err := ims.replayWAL(walDir); err != nil {
+		ims.Close()
+		return nil, fmt.Errorf("replaying write-ahead log: %w", err)
+	}
+	w, err := wal.Open(walDir, opts.WAL)
+	if err != nil {
+		ims.Close()
+		return nil, fmt.Errorf("opening write-ahead log: %w", err)
+	}
+	ims.wal = w
+
+	return ims, nil
+}
+
+// replayWAL rebuilds the active and out-of-order blocks from the last
+// checkpoint of the write-ahead log in dir and the segments following it.
+// In-order samples already covered by a persisted block are skipped.
+func (ims *IMSImpl) replayWAL(dir string) error {
+	var (
+		numSeries, numSamples int
+		numOOOSamples         int
+		unknownRefs           int
+	)
+	torn, err := wal.ReplayCheckpointed(dir, func(rec []byte) error {
+		switch wal.Type(rec) {
+		case wal.RecordSeries:
+			series, err := wal.DecodeSeries(rec)
+			if err != nil {
+				return err
+			}
+			for _, s := range series {
+				if err := ims.activeBlock.CreateSeries(s.Ref, s.Def, s.LabelSet); err != nil {
+					return err
+				}
+			}
+			numSeries += len(series)
+		case wal.RecordSamples, wal.RecordHistogramSamples:
+			samples, err := wal.DecodeSamples(rec)
+			if err != nil {
+				return err
+			}
+			for _, s := range samples {
+				if s.Time < ims.minValidTime {
+					continue
+				}
+				if err := appendSample(ims.activeBlock, s); err != nil {
+					unknownRefs++
+					continue
+				}
+				numSamples++
+			}
+		case wal.RecordOOOSamples, wal.RecordOOOHistogramSamples:
+			samples, err := wal.DecodeSamples(rec)
+			if err != nil {
+				return err
+			}
+			for _, s := range samples {
+				if err := ims.appendOOO(s); err != nil {
+					unknownRefs++
+					continue
+				}
+				numOOOSamples++
+			}
+		case wal.RecordTombstones:
+			tombstones, err := wal.DecodeTombstones(rec)
+			if err != nil {
+				return err
+			}
+			for _, t := range tombstones {
+				ims.activeBlock.Delete(t)
+				ims.oooBlock.Delete(t)
+			}
+		default:
+			return wal.ErrUnknownRecord
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if torn {
+		ims.logger.Warn("truncated torn tail of write-ahead log")
+	}
+	if unknownRefs > 0 {
+		ims.logger.Warn("skipped samples of unknown series in write-ahead log", zap.Int("count", unknownRefs))
+	}
+	ims.logger.Info("replayed write-ahead log",
+		zap.Int("numSeries", numSeries),
+		zap.Int("numSamples", numSamples),
+		zap.Int("numOutOfOrderSamples", numOOOSamples),
+	)
+	return nil
 }
 
 // AddMetricFamiliesTimeGroup adds all metrics read in from a metrics payload.
+// Metric points without a timestamp of their own take the payload's time.
+// The metric points are recorded in the write-ahead log before they are
+// added to the active block, or to the out-of-order block if they are older
+// than the newest sample of their series. Metric points at a timestamp their
+// series already holds are dropped if identical, and otherwise handled as
+// the ConflictPolicy decides. Metric points outside the out-of-order window
+// are rejected with ErrOutOfOrderSample, and those in conflict with
+// ErrConflictingSample, once the rest are added.
 func (ims *IMSImpl) AddMetricFamiliesTimeGroup(metricFamiliesTimeGroup *metrics.MetricFamiliesTimeGroup) error {
-	for metricName, metricFamily := range metricFamiliesTimeGroup.Families {
-		hashed := hash.HashString(metricName)
-		ims.activeBlock.AddMetricFamily(metricFamily, hashed)
+	ims.mtx.Lock()
+	defer ims.mtx.Unlock()
+
+	var (
+		series     []wal.RefSeries
+		samples    []wal.RefSample
+		oooSamples []wal.RefSample
+		total      int
+		outOfOrder int
+		conflicts  int
+	)
+	for _, metricFamily := range metricFamiliesTimeGroup.Families {
+		for _, mps := range metricFamily.HashedMetrics {
+			for _, mp := range mps {
+				if mp.Time == 0 {
+					mp.Time = metricFamiliesTimeGroup.Time
+				}
+
+				ref, created := ims.activeBlock.GetOrCreateSeries(metricFamily.Def, mp)
+				if created {
+					series = append(series, wal.RefSeries{Ref: ref, Def: metricFamily.Def, LabelSet: mp.LabelSet})
+				}
+				total++
+				s := wal.RefSample{Ref: ref, Time: mp.Time, Value: mp.Value, Histogram: mp.Histogram}
+				target := ims.appendTarget(ref, mp.Time)
+				if held, heldIn, ok := ims.lookupSample(ref, mp.Time); ok {
+					var outcome string
+					target, outcome = ims.resolveDuplicate(held, s, heldIn)
+					ims.metrics.duplicateSamples.With(outcome).Inc()
+				}
+
+				switch target {
+				case appendActive:
+					samples = append(samples, s)
+				case appendOOO:
+					oooSamples = append(oooSamples, s)
+				case appendOutOfOrder:
+					outOfOrder++
+				case appendConflict:
+					conflicts++
+				}
+			}
+		}
 	}
-	return nil
+
+	if ims.wal != nil {
+		var recs [][]byte
+		if len(series) > 0 {
+			recs = append(recs, wal.EncodeSeries(series))
+		}
+		floats, histograms := splitHistogramSamples(samples)
+		if len(floats) > 0 {
+			recs = append(recs, wal.EncodeSamples(floats))
+		}
+		if len(histograms) > 0 {
+			recs = append(recs, wal.EncodeHistogramSamples(histograms))
+		}
+		floats, histograms = splitHistogramSamples(oooSamples)
+		if len(floats) > 0 {
+			recs = append(recs, wal.EncodeOOOSamples(floats))
+		}
+		if len(histograms) > 0 {
+			recs = append(recs, wal.EncodeOOOHistogramSamples(histograms))
+		}
+		if err := ims.wal.Log(recs...); err != nil {
+			// Series left in the head without their series record would be
+			// unknown to a replay of the log.
+			for _, s := range series {
+				ims.activeBlock.RemoveSeries(s.Ref)
+			}
+			return fmt.Errorf("writing to write-ahead log: %w", err)
+		}
+	}
+
+	for _, s := range samples {
+		if err := appendSample(ims.activeBlock, s); err != nil {
+			return fmt.Errorf("adding metric point: %w", err)
+		}
+	}
+	for _, s := range oooSamples {
+		if err := ims.appendOOO(s); err != nil {
+			return fmt.Errorf("adding out-of-order metric point: %w", err)
+		}
+	}
+	ims.metrics.oooSamplesAppended.Add(float64(len(oooSamples)))
+
+	var errs []error
+	if outOfOrder > 0 {
+		ims.metrics.samplesRejected.With(rejectedOutOfOrder).Add(float64(outOfOrder))
+		errs = append(errs, fmt.Errorf("rejected %d of %d metric points: %w", outOfOrder, total, ErrOutOfOrderSample))
+	}
+	if conflicts > 0 {
+		ims.metrics.samplesRejected.With(rejectedConflict).Add(float64(conflicts))
+		errs = append(errs, fmt.Errorf("rejected %d of %d metric points: %w", conflicts, total, ErrConflictingSample))
+	}
+	return errors.Join(errs...)
+}
+
+// splitHistogramSamples splits samples into float and native histogram
+// samples, which are recorded in the write-ahead log separately.
+func splitHistogramSamples(samples []wal.RefSample) (floats, histograms []wal.RefSample) {
+	for _, s := range samples {
+		if s.Histogram != nil {
+			histograms = append(histograms, s)
+		} else {
+			floats = append(floats, s)
+		}
+	}
+	return floats, histograms
 }
 
 func (ims *IMSImpl) GetTimeSeries(timeSeries *metrics.MetricFamilyTimeSeries) (*metrics.MetricFamilyTimeSeries, error) {
-	return nil, nil
+	ims.mtx.RLock()
+	defer ims.mtx.RUnlock()
+
+	return ims.activeBlock.GetTimeSeries(*timeSeries)
+}
+
+// Blocks returns the metadata of the persisted blocks, ordered by time.
+func (ims *IMSImpl) Blocks() []*block.Meta {
+	ims.mtx.RLock()
+	defer ims.mtx.RUnlock()
+
+	metas := make([]*block.Meta, 0, len(ims.blocks))
+	for _, b := range ims.blocks {
+		metas = append(metas, b.Meta())
+	}
+	return metas
+}
+
+// rawBlocks returns the metadata of the persisted blocks of raw samples,
+// ordered by time.
+func (ims *IMSImpl) rawBlocks() []*block.Meta {
+	var metas []*block.Meta
+	for _, m := range ims.Blocks() {
+		if m.Resolution() == 0 {
+			metas = append(metas, m)
+		}
+	}
+	return metas
+}
+
+// Querier returns a Querier over the raw samples of the active block and
+// every persisted block. The querier must be closed once the caller is done
+// with its results.
+func (ims *IMSImpl) Querier() (metrics.Querier, error) {
+	return ims.querier(0, downsample.AggrAuto)
+}
+
+// Close closes the write-ahead log and the persisted blocks, waiting for open
+// queriers to finish.
+func (ims *IMSImpl) Close() error {
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	ims.mtx.Lock()
+	blocks := ims.blocks
+	ims.blocks = nil
+	ims.mtx.Unlock()
+
+	var errs []error
+	if ims.wal != nil {
+		errs = append(errs, ims.wal.Close())
+	}
+	for _, b := range blocks {
+		errs = append(errs, b.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Run periodically persists completed block ranges of the active block,
+// compacts and downsamples persisted blocks and deletes blocks outside the
+// retention policy until ctx is cancelled.
+func (ims *IMSImpl) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ims.PersistActiveBlock(); err != nil {
+				ims.logger.Error("failed to persist active block", zap.Error(err))
+			}
+			if err := ims.Compact(); err != nil {
+				ims.logger.Error("failed to compact blocks", zap.Error(err))
+			}
+			if err := ims.Downsample(); err != nil {
+				ims.logger.Error("failed to downsample blocks", zap.Error(err))
+			}
+			if err := ims.ApplyRetention(); err != nil {
+				ims.logger.Error("failed to apply retention", zap.Error(err))
+			}
+		}
+	}
+}
+
+// PersistActiveBlock writes out every block range of the active block which
+// is complete, i.e. which ends at least half a block range before the newest
+// metric point, and drops the persisted metric points from memory. The
+// out-of-order samples before the end of the last persisted range are then
+// persisted too, in blocks of their own.
+func (ims *IMSImpl) PersistActiveBlock() error {
+	if ims.opts.DataDir == "" {
+		return nil
+	}
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	// A previous attempt may have failed to persist out-of-order samples.
+	if err := ims.persistOOO(); err != nil {
+		return err
+	}
+
+	persisted := false
+	var end int64
+	for {
+		ims.mtx.RLock()
+		empty := ims.activeBlock.Empty()
+		mint, maxt := ims.activeBlock.MinTime(), ims.activeBlock.MaxTime()
+		ims.mtx.RUnlock()
+
+		if empty {
+			break
+		}
+		start := rangeStart(mint, ims.opts.BlockRange)
+		if maxt < start+ims.opts.BlockRange+ims.opts.BlockRange/2 {
+			break
+		}
+
+		end = start + ims.opts.BlockRange
+		if err := ims.persistRange(start, end); err != nil {
+			return err
+		}
+		persisted = true
+	}
+	if !persisted {
+		return nil
+	}
+
+	last, err := ims.cutOOO(end)
+	if err != nil {
+		return err
+	}
+	if err := ims.persistOOO(); err != nil {
+		return err
+	}
+	return ims.truncateWAL(end, last)
+}
+
+// persistRange writes the active block's metric points within [mint, maxt)
+// to a new block, then drops them from the active block.
+func (ims *IMSImpl) persistRange(mint, maxt int64) error {
+	// Metric points older than maxt are no longer appended to the active
+	// block once the range is complete, but to the out-of-order block or
+	// rejected, so none are lost as the active block is truncated and the
+	// series can be read without holding the lock while writing.
+	ims.mtx.Lock()
+	ims.minValidTime = max(ims.minValidTime, maxt)
+	set := ims.activeBlock.Series(mint, maxt)
+	ims.mtx.Unlock()
+
+	meta, err := block.Write(ims.opts.DataDir, mint, maxt, set)
+	if err != nil {
+		return fmt.Errorf("persisting block [%d, %d): %w", mint, maxt, err)
+	}
+	ims.logger.Info("persisted block",
+		zap.String("ulid", meta.ULID.String()),
+		zap.Int64("minTime", meta.MinTime),
+		zap.Int64("maxTime", meta.MaxTime),
+		zap.Uint64("numSeries", meta.Stats.NumSeries),
+		zap.Uint64("numSamples", meta.Stats.NumSamples),
+	)
+
+	r, err := block.Open(filepath.Join(ims.opts.DataDir, meta.ULID.String()))
+	if err != nil {
+		return fmt.Errorf("opening persisted block: %w", err)
+	}
+
+	ims.mtx.Lock()
+	defer ims.mtx.Unlock()
+
+	ims.blocks = append(ims.blocks, r)
+	ims.updateBlockMetrics()
+	ims.activeBlock.Truncate(maxt)
+	return nil
+}
+
+// Compact compacts persisted blocks as planned by the compactor until there
+// is nothing left to compact. Each compacted block is written in full before
+// the blocks it replaces are removed.
+func (ims *IMSImpl) Compact() error {
+	if ims.opts.DataDir == "" {
+		return nil
+	}
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	for {
+		plan := ims.compactor.Plan(ims.rawBlocks())
+		if len(plan) == 0 {
+			return nil
+		}
+
+		sources := ims.blockReaders(plan)
+		meta, err := ims.compactor.Compact(ims.opts.DataDir, sources)
+		if err != nil {
+			return err
+		}
+		r, err := block.Open(filepath.Join(ims.opts.DataDir, meta.ULID.String()))
+		if err != nil {
+			return fmt.Errorf("opening compacted block: %w", err)
+		}
+		ims.logger.Info("compacted blocks",
+			zap.String("ulid", meta.ULID.String()),
+			zap.Int("level", meta.Compaction.Level),
+			zap.Int("numSources", len(sources)),
+			zap.Int64("minTime", meta.MinTime),
+			zap.Int64("maxTime", meta.MaxTime),
+		)
+
+		if err := ims.replaceBlocks(sources, r); err != nil {
+			return err
+		}
+	}
+}
+
+// blockReaders returns the readers of the persisted blocks described by
+// metas.
+func (ims *IMSImpl) blockReaders(metas []*block.Meta) []*block.Reader {
+	ims.mtx.RLock()
+	defer ims.mtx.RUnlock()
+
+	var readers []*block.Reader
+	for _, m := range metas {
+		for _, b := range ims.blocks {
+			if b.Meta().ULID == m.ULID {
+				readers = append(readers, b)
+			}
+		}
+	}
+	return readers
+}
+
+// replaceBlocks swaps old for replacement, if not nil, in the set of
+// persisted blocks, then closes and deletes old once their open queriers are
+// closed. Blocks downsampled from old are removed along with it.
+func (ims *IMSImpl) replaceBlocks(old []*block.Reader, replacement *block.Reader) error {
+	removed := map[*block.Reader]struct{}{}
+	removedRaw := map[ulid.ULID]struct{}{}
+	for _, b := range old {
+		removed[b] = struct{}{}
+		if b.Meta().Resolution() == 0 {
+			removedRaw[b.Meta().ULID] = struct{}{}
+		}
+	}
+
+	ims.mtx.Lock()
+	old = append([]*block.Reader(nil), old...)
+	kept := make([]*block.Reader, 0, len(ims.blocks))
+	for _, b := range ims.blocks {
+		if _, ok := removed[b]; ok {
+			continue
+		}
+		if _, ok := removedRaw[b.Meta().Source()]; ok {
+			old = append(old, b)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	if replacement != nil {
+		kept = append(kept, replacement)
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Meta().MinTime < kept[j].Meta().MinTime
+	})
+	ims.blocks = kept
+	ims.updateBlockMetrics()
+	ims.mtx.Unlock()
+
+	var errs []error
+	for _, b := range old {
+		errs = append(errs, b.Close(), os.RemoveAll(b.Dir()))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("removing replaced blocks: %w", err)
+	}
+	return nil
+}
+
+// updateBlockMetrics records the number and size of the persisted blocks.
+// It must be called with the lock held.
+func (ims *IMSImpl) updateBlockMetrics() {
+	var size int64
+	for _, b := range ims.blocks {
+		size += b.Size()
+	}
+	ims.metrics.blocks.Set(float64(len(ims.blocks)))
+	ims.metrics.blocksBytes.Set(float64(size))
+}
+
+// truncateWAL checkpoints the segments of the write-ahead log up to last,
+// keeping the records of series still in the active or out-of-order block and
+// of samples at or after mint, then deletes the checkpointed segments. This
+// bounds the log, and so replay on startup, to roughly the contents of the
+// active and out-of-order blocks.
+func (ims *IMSImpl) truncateWAL(mint int64, last int) error {
+	if ims.wal == nil || last == 0 {
+		return nil
+	}
+
+	keep := func(ref uint64) bool {
+		ims.mtx.RLock()
+		defer ims.mtx.RUnlock()
+
+		return ims.activeBlock.HasSeries(ref) || ims.oooBlock.HasSeries(ref)
+	}
+	dir := ims.wal.Dir()
+	stats, err := wal.Checkpoint(dir, last, keep, mint)
+	if err != nil {
+		return fmt.Errorf("checkpointing write-ahead log: %w", err)
+	}
+	if err := wal.Truncate(dir, last); err != nil {
+		return fmt.Errorf("truncating write-ahead log: %w", err)
+	}
+	if err := wal.DeleteCheckpoints(dir, last); err != nil {
+		return fmt.Errorf("truncating write-ahead log: %w", err)
+	}
+
+	ims.logger.Info("checkpointed write-ahead log",
+		zap.Int("lastSegment", last),
+		zap.Int("droppedSeries", stats.DroppedSeries),
+		zap.Int("droppedSamples", stats.DroppedSamples),
+		zap.Int("totalSeries", stats.TotalSeries),
+		zap.Int("totalSamples", stats.TotalSamples),
+	)
+	return nil
+}
+
+// rangeStart returns the start of the block range containing t.
+func rangeStart(t, blockRange int64) int64 {
+	if t >= 0 {
+		return t - t%blockRange
+	}
+	return -(((-t - 1) / blockRange) + 1) * blockRange
+}
+
+// headQuerier implements metrics.Querier over blocks held in memory by the
+// store. Each call reads the blocks returned by blocks under the store's
+// lock.
+type headQuerier struct {
+	ims    *IMSImpl
+	blocks func() []*metrics.Block
+}
+
+// activeBlockQuerier returns a querier over the active block.
+func (ims *IMSImpl) activeBlockQuerier() *headQuerier {
+	return &headQuerier{ims: ims, blocks: func() []*metrics.Block {
+		return []*metrics.Block{ims.activeBlock}
+	}}
+}
+
+// oooQuerier returns a querier over the out-of-order block, including any
+// part of it being persisted.
+func (ims *IMSImpl) oooQuerier() *headQuerier {
+	return &headQuerier{ims: ims, blocks: func() []*metrics.Block {
+		if ims.oooFlushing != nil {
+			return []*metrics.Block{ims.oooFlushing, ims.oooBlock}
+		}
+		return []*metrics.Block{ims.oooBlock}
+	}}
+}
+
+func (q *headQuerier) Select(mint, maxt int64, matchers ...*metrics.Matcher) metrics.SeriesSet {
+	q.ims.mtx.RLock()
+	defer q.ims.mtx.RUnlock()
+
+	var sets []metrics.SeriesSet
+	for _, b := range q.blocks() {
+		sets = append(sets, b.Select(mint, maxt, matchers...))
+	}
+	return metrics.NewMergeSeriesSet(sets...)
+}
+
+func (q *headQuerier) LabelNames() ([]string, error) {
+	q.ims.mtx.RLock()
+	defer q.ims.mtx.RUnlock()
+
+	set := map[string]struct{}{}
+	for _, b := range q.blocks() {
+		for _, n := range b.LabelNames() {
+			set[n] = struct{}{}
+		}
+	}
+	return sortedKeys(set), nil
+}
+
+func (q *headQuerier) LabelValues(name string) ([]string, error) {
+	q.ims.mtx.RLock()
+	defer q.ims.mtx.RUnlock()
+
+	set := map[string]struct{}{}
+	for _, b := range q.blocks() {
+		for _, v := range b.LabelValues(name) {
+			set[v] = struct{}{}
+		}
+	}
+	return sortedKeys(set), nil
+}
+
+func (q *headQuerier) Close() error {
+	return nil
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NativeHistograms(t *testing.T) {
+	opts := Options{
+		DataDir:          t.TempDir(),
+		OutOfOrderWindow: 1800,
+		Registry:         instrument.NewRegistry(),
+	}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer func() { ims.Close() }()
+
+	histogram := func(count float64) *metrics.Histogram {
+		return &metrics.Histogram{
+			Count:           count,
+			Sum:             count / 2,
+			PositiveSpans:   []metrics.Span{{Offset: 1, Length: 1}},
+			PositiveBuckets: []float64{count},
+		}
+	}
+	add := func(ts int64, h *metrics.Histogram) error {
+		mp := &metrics.MetricPoint{Name: "up", LabelSet: map[string]string{"job": "a"}, Time: ts, Histogram: h}
+		hash, err := metrics.HashMetric(mp)
+		require.NoError(t, err)
+		mp.Hash = hash
+		mf := metrics.NewMetricFamily(metrics.MetricDefinition{Name: "up", Type: "histogram"})
+		mf.HashedMetrics[mp.Hash] = []*metrics.MetricPoint{mp}
+		mfs := metrics.NewMetricFamiliesTimeGroup()
+		require.NoError(t, mfs.AddMetricFamily(&mf))
+		return ims.AddMetricFamiliesTimeGroup(mfs)
+	}
+	expected := []metrics.Sample{
+		{Time: 9000, Histogram: histogram(1)},
+		{Time: 10000, Histogram: histogram(2)},
+		{Time: 18000, Histogram: histogram(3)},
+	}
+	assertSamples := func() {
+		t.Helper()
+		samples := selectSamples(t, ims)
+		require.Len(t, samples, len(expected))
+		for i := range expected {
+			assert.Equal(t, expected[i].Time, samples[i].Time)
+			assert.True(t, expected[i].Histogram.Equals(samples[i].Histogram), samples[i].Histogram.String())
+		}
+	}
+
+	require.NoError(t, add(10000, histogram(2)))
+	require.NoError(t, add(9000, histogram(1)))
+	require.NoError(t, add(18000, histogram(3)))
+	// Identical histograms are dropped, and differing ones conflict.
+	require.NoError(t, add(10000, histogram(2)))
+	assert.ErrorIs(t, add(10000, histogram(4)), ErrConflictingSample)
+	assertSamples()
+
+	// Histograms are replayed from the write-ahead log.
+	require.NoError(t, ims.Close())
+	ims, err = Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	assertSamples()
+
+	// And read back from persisted blocks.
+	require.NoError(t, ims.PersistActiveBlock())
+	assert.NotEmpty(t, ims.Blocks())
+	assertSamples()
+}
+
+func Test_WALWriteFailure(t *testing.T) {
+	opts := Options{
+		DataDir:  t.TempDir(),
+		Registry: instrument.NewRegistry(),
+	}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer func() { ims.Close() }()
+
+	// A closed log fails every write.
+	failing, err := wal.Open(t.TempDir(), wal.Options{})
+	require.NoError(t, err)
+	require.NoError(t, failing.Close())
+	w := ims.wal
+	ims.wal = failing
+	assert.ErrorIs(t, addSample(t, ims, 10000, 1), wal.ErrClosed)
+	ims.wal = w
+
+	// The series created for the failed write is not left in the head, so
+	// its series record is logged with the next write to it.
+	q, err := ims.Querier()
+	require.NoError(t, err)
+	assert.False(t, q.Select(0, 1<<20).Next())
+	require.NoError(t, q.Close())
+	require.NoError(t, addSample(t, ims, 10010, 2))
+
+	require.NoError(t, ims.Close())
+	ims, err = Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, []metrics.Sample{{Time: 10010, Value: 2}}, selectSamples(t, ims))
+}
+
+func Test_PersistRestart(t *testing.T) {
+	opts := Options{
+		DataDir:  t.TempDir(),
+		Registry: instrument.NewRegistry(),
+	}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer func() { ims.Close() }()
+
+	expected := []metrics.Sample{{Time: 1000, Value: 1}, {Time: 2000, Value: 2}, {Time: 11000, Value: 3}}
+	for _, s := range expected {
+		require.NoError(t, addSample(t, ims, s.Time, s.Value))
+	}
+	require.NoError(t, ims.PersistActiveBlock())
+	metas := ims.Blocks()
+	require.Len(t, metas, 1)
+	assert.Equal(t, int64(0), metas[0].MinTime)
+	assert.Equal(t, int64(7200), metas[0].MaxTime)
+	assert.Equal(t, uint64(2), metas[0].Stats.NumSamples)
+
+	// Late samples in the persisted range are rejected rather than dropped
+	// with the range from the active block.
+	assert.ErrorIs(t, addSample(t, ims, 3000, 4), ErrOutOfOrderSample)
+	assert.Equal(t, expected, selectSamples(t, ims))
+
+	// Persisted blocks are loaded again, and the rest replayed from the
+	// write-ahead log.
+	require.NoError(t, ims.Close())
+	ims, err = Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, metas, ims.Blocks())
+	assert.Equal(t, expected, selectSamples(t, ims))
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/wal"
+	"go.uber.org/zap"
+)
+
+// appendTarget is where a sample is appended.
+type appendTarget int
+
+const (
+	appendActive appendTarget = iota
+	appendOOO
+	// appendOutOfOrder rejects a sample outside the out-of-order window.
+	appendOutOfOrder
+	// appendConflict rejects a sample conflicting with the value held.
+	appendConflict
+	// appendDropped drops a sample without error.
+	appendDropped
+)
+
+// appendTarget returns where a sample at t of the series with reference ref
+// is appended. Samples no older than the newest sample of their series go to
+// the active block, unless their block range has already been persisted.
+// Older samples go to the out-of-order block if they are within the
+// out-of-order window of the newest metric point, and are rejected
+// otherwise. It must be called with the lock held.
+func (ims *IMSImpl) appendTarget(ref uint64, t int64) appendTarget {
+	if t >= ims.minValidTime {
+		if last, ok := ims.activeBlock.SeriesMaxTime(ref); !ok || t >= last {
+			return appendActive
+		}
+	}
+
+	newest := ims.minValidTime
+	if !ims.activeBlock.Empty() {
+		newest = max(newest, ims.activeBlock.MaxTime())
+	}
+	if ims.opts.OutOfOrderWindow > 0 && t >= newest-ims.opts.OutOfOrderWindow {
+		return appendOOO
+	}
+	return appendOutOfOrder
+}
+
+// appendOOO adds s to the out-of-order block, creating its series there from
+// the active block's. It must be called with the lock held.
+func (ims *IMSImpl) appendOOO(s wal.RefSample) error {
+	if !ims.oooBlock.HasSeries(s.Ref) {
+		def, labelSet, ok := ims.activeBlock.LookupSeries(s.Ref)
+		if !ok {
+			return metrics.ErrTimeSeriesNotFound
+		}
+		if err := ims.oooBlock.CreateSeries(s.Ref, def, labelSet); err != nil {
+			return err
+		}
+	}
+	return appendSample(ims.oooBlock, s)
+}
+
+// appendSample adds s to b, as a native histogram sample if it is one.
+func appendSample(b *metrics.Block, s wal.RefSample) error {
+	if s.Histogram != nil {
+		return b.AppendHistogram(s.Ref, s.Time, s.Histogram)
+	}
+	return b.Append(s.Ref, s.Time, s.Value)
+}
+
+// cutOOO sets the out-of-order samples before end aside to be persisted,
+// and starts a new write-ahead log segment, returning the last complete one.
+// Both happen under the lock, so that the out-of-order samples before end in
+// the segments up to the one returned are all set aside.
+func (ims *IMSImpl) cutOOO(end int64) (int, error) {
+	ims.mtx.Lock()
+	defer ims.mtx.Unlock()
+
+	if !ims.oooBlock.Empty() && ims.oooBlock.MinTime() < end {
+		ims.oooFlushing, ims.oooBlock = ims.oooBlock.Split(end)
+	}
+	if ims.wal == nil {
+		return 0, nil
+	}
+	last, err := ims.wal.NextSegment()
+	if err != nil {
+		return 0, fmt.Errorf("starting write-ahead log segment: %w", err)
+	}
+	return last, nil
+}
+
+// persistOOO writes the out-of-order samples set aside by cutOOO to a new
+// block per block range. The blocks overlap those persisted from the active
+// block, and are merged with them on compaction.
+func (ims *IMSImpl) persistOOO() error {
+	ims.mtx.RLock()
+	flushing := ims.oooFlushing
+	ims.mtx.RUnlock()
+
+	if flushing == nil {
+		return nil
+	}
+
+	// Samples are no longer appended to flushing, so it can be read without
+	// holding the lock.
+	for start := rangeStart(flushing.MinTime(), ims.opts.BlockRange); start <= flushing.MaxTime(); start += ims.opts.BlockRange {
+		end := start + ims.opts.BlockRange
+		set := flushing.Series(start, end)
+		if !set.Next() {
+			continue
+		}
+		set = flushing.Series(start, end)
+
+		meta, err := block.Write(ims.opts.DataDir, start, end, set)
+		if err != nil {
+			return fmt.Errorf("persisting out-of-order block [%d, %d): %w", start, end, err)
+		}
+		r, err := block.Open(filepath.Join(ims.opts.DataDir, meta.ULID.String()))
+		if err != nil {
+			return fmt.Errorf("opening persisted block: %w", err)
+		}
+
+		ims.mtx.Lock()
+		ims.blocks = append(ims.blocks, r)
+		sort.Slice(ims.blocks, func(i, j int) bool {
+			return ims.blocks[i].Meta().MinTime < ims.blocks[j].Meta().MinTime
+		})
+		ims.updateBlockMetrics()
+		ims.mtx.Unlock()
+
+		ims.logger.Info("persisted out-of-order block",
+			zap.String("ulid", meta.ULID.String()),
+			zap.Int64("minTime", meta.MinTime),
+			zap.Int64("maxTime", meta.MaxTime),
+			zap.Uint64("numSeries", meta.Stats.NumSeries),
+			zap.Uint64("numSamples", meta.Stats.NumSamples),
+		)
+	}
+
+	ims.mtx.Lock()
+	ims.oooFlushing = nil
+	ims.mtx.Unlock()
+	return nil
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_OutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		DataDir:          dir,
+		OutOfOrderWindow: 1800,
+		Registry:         instrument.NewRegistry(),
+	}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer func() { ims.Close() }()
+
+	add := func(ts int64) error {
+		return addSample(t, ims, ts, float64(ts))
+	}
+	times := func() []int64 {
+		var res []int64
+		for _, s := range selectSamples(t, ims) {
+			res = append(res, s.Time)
+		}
+		return res
+	}
+
+	require.NoError(t, add(10000))
+	// Late samples are accepted within the window and rejected beyond it.
+	require.NoError(t, add(9000))
+	assert.ErrorIs(t, add(5000), ErrOutOfOrderSample)
+	assert.Equal(t, []int64{9000, 10000}, times())
+
+	// Persisting the active block's first range also persists the late
+	// sample within it, in an overlapping block.
+	require.NoError(t, add(18000))
+	require.NoError(t, add(17000))
+	require.NoError(t, ims.PersistActiveBlock())
+	require.Len(t, ims.Blocks(), 2)
+	for _, m := range ims.Blocks() {
+		assert.Equal(t, int64(7200), m.MinTime)
+	}
+	assert.Equal(t, []int64{9000, 10000, 17000, 18000}, times())
+
+	// Samples in a persisted range are out of order for every series.
+	assert.ErrorIs(t, add(13000), ErrOutOfOrderSample)
+	require.NoError(t, add(16500))
+
+	require.NoError(t, ims.Compact())
+	assert.Len(t, ims.Blocks(), 1)
+	assert.Equal(t, []int64{9000, 10000, 16500, 17000, 18000}, times())
+
+	// Late samples not yet persisted are replayed from the write-ahead log.
+	require.NoError(t, ims.Close())
+	ims, err = Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{9000, 10000, 16500, 17000, 18000}, times())
+
+	buf := &bytes.Buffer{}
+	_, err = opts.Registry.WriteTo(buf)
+	require.NoError(t, err)
+	lines := strings.Split(buf.String(), "\n")
+	assert.Contains(t, lines, `koalemos_store_ooo_samples_appended_total{} 3`)
+	assert.Contains(t, lines, `koalemos_store_samples_rejected_total{reason="out_of_order"} 2`)
+}
+
+// addSample adds a sample of the series up{job="a"} to ims.
+func addSample(t *testing.T, ims *IMSImpl, ts int64, v float64) error {
+	t.Helper()
+	mp := &metrics.MetricPoint{Name: "up", LabelSet: map[string]string{"job": "a"}, Time: ts, Value: v}
+	hash, err := metrics.HashMetric(mp)
+	require.NoError(t, err)
+	mp.Hash = hash
+	mf := metrics.NewMetricFamily(metrics.MetricDefinition{Name: "up", Type: "gauge"})
+	mf.HashedMetrics[mp.Hash] = []*metrics.MetricPoint{mp}
+	mfs := metrics.NewMetricFamiliesTimeGroup()
+	require.NoError(t, mfs.AddMetricFamily(&mf))
+	return ims.AddMetricFamiliesTimeGroup(mfs)
+}
+
+// selectSamples returns the samples of the series up{job="a"} held by ims.
+func selectSamples(t *testing.T, ims *IMSImpl) []metrics.Sample {
+	t.Helper()
+	q, err := ims.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+
+	set := q.Select(0, 1<<20)
+	require.True(t, set.Next())
+	samples, err := metrics.ExpandSamples(set.At().Iterator())
+	require.NoError(t, err)
+	assert.False(t, set.Next())
+	return samples
+}
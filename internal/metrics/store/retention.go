@@ -0,0 +1,276 @@
+package store
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"path/filepath"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+// RetentionRule overrides the retention duration of the series it matches,
+// e.g. to keep SLO metrics for longer than high cardinality debug metrics.
+type RetentionRule struct {
+	// Matchers select the series the rule applies to. Metric names are
+	// matched under metrics.MetricNameLabel, and tenants, once metrics are
+	// ingested per tenant, by their label.
+	Matchers []*metrics.Matcher
+	// Duration is how long, in seconds, matched series are kept for. Zero
+	// keeps them regardless of age.
+	Duration int64
+}
+
+// ApplyRetention deletes the persisted data falling outside the retention
+// policy. Series are expired once the block holding them ends more than their
+// retention duration before the newest metric point. Blocks whose series have
+// all expired are deleted whole, while blocks holding some expired series are
+// rewritten without them. Then, while the blocks and write-ahead log occupy
+// more than RetentionBytes on disk, the oldest remaining blocks are deleted.
+func (ims *IMSImpl) ApplyRetention() error {
+	if ims.opts.DataDir == "" {
+		return nil
+	}
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	if err := ims.applyTimeRetention(); err != nil {
+		return err
+	}
+	return ims.applySizeRetention()
+}
+
+// retentionFor returns the retention duration of the series with the given
+// name and label set: that of the first matching rule, or RetentionDuration
+// if none match.
+func (ims *IMSImpl) retentionFor(name string, labelSet map[string]string) int64 {
+	for _, r := range ims.opts.RetentionRules {
+		if metrics.MatchesSeries(name, labelSet, r.Matchers...) {
+			return r.Duration
+		}
+	}
+	return ims.opts.RetentionDuration
+}
+
+// minRetention returns the shortest retention duration of any series, or
+// zero if every series is kept regardless of age.
+func (ims *IMSImpl) minRetention() int64 {
+	d := ims.opts.RetentionDuration
+	for _, r := range ims.opts.RetentionRules {
+		if r.Duration > 0 && (d == 0 || r.Duration < d) {
+			d = r.Duration
+		}
+	}
+	return d
+}
+
+func (ims *IMSImpl) applyTimeRetention() error {
+	minRetention := ims.minRetention()
+	if minRetention <= 0 {
+		return nil
+	}
+
+	ims.mtx.RLock()
+	// Age is measured from the newest metric point rather than the wall
+	// clock, so that backfilled or replayed data is not deleted on arrival.
+	newest := int64(math.MinInt64)
+	if !ims.activeBlock.Empty() {
+		newest = ims.activeBlock.MaxTime()
+	}
+	for _, b := range ims.blocks {
+		newest = max(newest, b.Meta().MaxTime)
+	}
+	blocks := append([]*block.Reader(nil), ims.blocks...)
+	ims.mtx.RUnlock()
+
+	var expiredBlocks []*block.Reader
+	for _, b := range blocks {
+		// Downsampled blocks are removed along with their source block.
+		if b.Meta().Resolution() > 0 {
+			continue
+		}
+		maxt := b.Meta().MaxTime
+		if maxt > newest-minRetention {
+			continue
+		}
+		expired := func(s metrics.Series) bool {
+			d := ims.retentionFor(s.Definition().Name, s.LabelSet())
+			return d > 0 && maxt <= newest-d
+		}
+
+		numExpired, numSeries, err := countSeries(b, expired)
+		if err != nil {
+			return err
+		}
+		switch {
+		case numExpired == 0:
+		case numExpired == numSeries:
+			expiredBlocks = append(expiredBlocks, b)
+		default:
+			if err := ims.rewriteBlock(b, expired, numExpired); err != nil {
+				return err
+			}
+		}
+	}
+	return ims.deleteBlocks(expiredBlocks, deletedRetentionTime)
+}
+
+// countSeries returns the number of series of b for which pred returns true,
+// and the total number of series.
+func countSeries(b *block.Reader, pred func(metrics.Series) bool) (matched, total int, err error) {
+	q, err := b.Querier()
+	if err != nil {
+		return 0, 0, fmt.Errorf("opening block %s: %w", b.Meta().ULID, err)
+	}
+	defer q.Close()
+
+	meta := b.Meta()
+	set := q.Select(meta.MinTime, meta.MaxTime-1)
+	for set.Next() {
+		total++
+		if pred(set.At()) {
+			matched++
+		}
+	}
+	if err := set.Err(); err != nil {
+		return 0, 0, fmt.Errorf("reading block %s: %w", meta.ULID, err)
+	}
+	return matched, total, nil
+}
+
+// rewriteBlock replaces b with a copy without its expired series.
+func (ims *IMSImpl) rewriteBlock(b *block.Reader, expired func(metrics.Series) bool, numExpired int) error {
+	meta, err := ims.compactor.Rewrite(ims.opts.DataDir, b, expired)
+	if err != nil {
+		return err
+	}
+	r, err := block.Open(filepath.Join(ims.opts.DataDir, meta.ULID.String()))
+	if err != nil {
+		return fmt.Errorf("opening rewritten block: %w", err)
+	}
+	if err := ims.replaceBlocks([]*block.Reader{b}, r); err != nil {
+		return err
+	}
+
+	ims.metrics.blocksRewritten.With(deletedRetentionTime).Inc()
+	ims.metrics.seriesDeleted.With(deletedRetentionTime).Add(float64(numExpired))
+	ims.logger.Info("rewrote block without expired series",
+		zap.String("ulid", meta.ULID.String()),
+		zap.String("parent", b.Meta().ULID.String()),
+		zap.Int("droppedSeries", numExpired),
+		zap.Uint64("numSeries", meta.Stats.NumSeries),
+	)
+	return nil
+}
+
+func (ims *IMSImpl) applySizeRetention() error {
+	if ims.opts.RetentionBytes <= 0 {
+		return nil
+	}
+
+	var total int64
+	if ims.wal != nil {
+		size, err := diskSize(ims.wal.Dir())
+		if err != nil {
+			return fmt.Errorf("measuring write-ahead log: %w", err)
+		}
+		total = size
+	}
+
+	ims.mtx.RLock()
+	// sizes holds the size of each raw block together with the blocks
+	// downsampled from it, which are deleted with it.
+	sizes := map[ulid.ULID]int64{}
+	for _, b := range ims.blocks {
+		total += b.Size()
+		sizes[b.Meta().Source()] += b.Size()
+	}
+	// Blocks are ordered by MinTime, so the oldest are deleted first.
+	var oversized []*block.Reader
+	for _, b := range ims.blocks {
+		if total <= ims.opts.RetentionBytes {
+			break
+		}
+		if b.Meta().Resolution() > 0 {
+			continue
+		}
+		oversized = append(oversized, b)
+		total -= sizes[b.Meta().ULID]
+	}
+	ims.mtx.RUnlock()
+
+	return ims.deleteBlocks(oversized, deletedRetentionSize)
+}
+
+// deleteBlocks removes blocks from the store and deletes them from disk,
+// recording the reason they were deleted.
+func (ims *IMSImpl) deleteBlocks(blocks []*block.Reader, reason string) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	blocks = ims.withDownsampled(blocks)
+	if err := ims.replaceBlocks(blocks, nil); err != nil {
+		return err
+	}
+
+	for _, b := range blocks {
+		meta := b.Meta()
+		ims.metrics.blocksDeleted.With(reason).Inc()
+		ims.metrics.blocksDeletedBytes.With(reason).Add(float64(b.Size()))
+		if meta.Resolution() == 0 {
+			ims.metrics.seriesDeleted.With(reason).Add(float64(meta.Stats.NumSeries))
+		}
+		ims.logger.Info("deleted block",
+			zap.String("ulid", meta.ULID.String()),
+			zap.String("reason", reason),
+			zap.Int64("minTime", meta.MinTime),
+			zap.Int64("maxTime", meta.MaxTime),
+			zap.Int64("bytes", b.Size()),
+		)
+	}
+	return nil
+}
+
+// withDownsampled returns blocks along with the blocks downsampled from them.
+func (ims *IMSImpl) withDownsampled(blocks []*block.Reader) []*block.Reader {
+	sources := map[ulid.ULID]struct{}{}
+	for _, b := range blocks {
+		if b.Meta().Resolution() == 0 {
+			sources[b.Meta().ULID] = struct{}{}
+		}
+	}
+
+	ims.mtx.RLock()
+	defer ims.mtx.RUnlock()
+
+	res := append([]*block.Reader(nil), blocks...)
+	for _, b := range ims.blocks {
+		if _, ok := sources[b.Meta().Source()]; ok && b.Meta().Resolution() > 0 {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+// diskSize returns the total size of the regular files under dir.
+func diskSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
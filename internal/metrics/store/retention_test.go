@@ -0,0 +1,185 @@
+package store
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ApplyRetention(t *testing.T) {
+	type Test struct {
+		desc              string
+		retentionDuration int64
+		// retentionBlocks sets RetentionBytes to the size of the newest
+		// retentionBlocks blocks.
+		retentionBlocks int
+		expectedKept    []int
+		expectedMetric  string
+	}
+
+	tests := []Test{
+		{
+			desc:         "[POSITIVE] no retention policy keeps every block",
+			expectedKept: []int{0, 1, 2, 3},
+		},
+		{
+			desc:              "[POSITIVE] blocks older than the retention duration are deleted",
+			retentionDuration: 2 * DefaultBlockRange,
+			expectedKept:      []int{2, 3},
+			expectedMetric:    `koalemos_store_blocks_deleted_total{reason="retention_time"} 2`,
+		},
+		{
+			desc:            "[POSITIVE] the oldest blocks are deleted when over the size limit",
+			retentionBlocks: 3,
+			expectedKept:    []int{1, 2, 3},
+			expectedMetric:  `koalemos_store_blocks_deleted_total{reason="retention_size"} 1`,
+		},
+		{
+			desc:              "[POSITIVE] size is enforced over the blocks within the retention duration",
+			retentionDuration: 3 * DefaultBlockRange,
+			retentionBlocks:   1,
+			expectedKept:      []int{3},
+			expectedMetric:    `koalemos_store_blocks_deleted_total{reason="retention_size"} 2`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			var (
+				ids   []ulid.ULID
+				sizes []int64
+			)
+			for i := int64(0); i < 4; i++ {
+				mint := i * DefaultBlockRange
+				series := &metrics.ListSeries{
+					Def:     metrics.MetricDefinition{Name: "up"},
+					Labels:  map[string]string{},
+					Samples: []metrics.Sample{{Time: mint, Value: 1}},
+				}
+				meta, err := block.Write(dir, mint, mint+DefaultBlockRange, metrics.NewListSeriesSet([]metrics.Series{series}))
+				require.NoError(t, err)
+				r, err := block.Open(filepath.Join(dir, meta.ULID.String()))
+				require.NoError(t, err)
+				ids, sizes = append(ids, meta.ULID), append(sizes, r.Size())
+				require.NoError(t, r.Close())
+			}
+
+			opts := Options{
+				DataDir:           dir,
+				RetentionDuration: tc.retentionDuration,
+				Registry:          instrument.NewRegistry(),
+			}
+			for i := 0; i < tc.retentionBlocks; i++ {
+				opts.RetentionBytes += sizes[len(sizes)-1-i]
+			}
+			ims, err := Open(log.NewLogger(), opts)
+			require.NoError(t, err)
+			defer ims.Close()
+
+			require.NoError(t, ims.ApplyRetention())
+
+			var kept []ulid.ULID
+			for _, m := range ims.Blocks() {
+				kept = append(kept, m.ULID)
+			}
+			var expected []ulid.ULID
+			for _, i := range tc.expectedKept {
+				expected = append(expected, ids[i])
+			}
+			assert.Equal(t, expected, kept)
+
+			metas, err := block.List(dir)
+			require.NoError(t, err)
+			assert.Len(t, metas, len(tc.expectedKept))
+
+			buf := &bytes.Buffer{}
+			_, err = opts.Registry.WriteTo(buf)
+			require.NoError(t, err)
+			if tc.expectedMetric != "" {
+				assert.Contains(t, strings.Split(buf.String(), "\n"), tc.expectedMetric)
+			}
+		})
+	}
+}
+
+func Test_ApplyRetentionRules(t *testing.T) {
+	dir := t.TempDir()
+	for i := int64(0); i < 4; i++ {
+		mint := i * DefaultBlockRange
+		var series []metrics.Series
+		for _, name := range []string{"debug_allocs", "slo_requests_total", "up"} {
+			series = append(series, &metrics.ListSeries{
+				Def:     metrics.MetricDefinition{Name: name},
+				Labels:  map[string]string{},
+				Samples: []metrics.Sample{{Time: mint, Value: 1}},
+			})
+		}
+		_, err := block.Write(dir, mint, mint+DefaultBlockRange, metrics.NewListSeriesSet(series))
+		require.NoError(t, err)
+	}
+
+	opts := Options{
+		DataDir:           dir,
+		RetentionDuration: 3 * DefaultBlockRange,
+		RetentionRules: []RetentionRule{
+			{Matchers: []*metrics.Matcher{metrics.MustNewMatcher(metrics.MatchRegexp, metrics.MetricNameLabel, "debug_.*")}, Duration: DefaultBlockRange},
+			{Matchers: []*metrics.Matcher{metrics.MustNewMatcher(metrics.MatchRegexp, metrics.MetricNameLabel, "slo_.*")}},
+		},
+		Registry: instrument.NewRegistry(),
+	}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer ims.Close()
+
+	before := ims.Blocks()
+	require.NoError(t, ims.ApplyRetention())
+	after := ims.Blocks()
+	require.Len(t, after, 4)
+
+	// The newest block holds no expired series and is left in place, while
+	// the older blocks are rewritten without their expired series.
+	assert.Equal(t, before[3], after[3])
+	expected := [][]string{
+		{"slo_requests_total"},
+		{"slo_requests_total", "up"},
+		{"slo_requests_total", "up"},
+		{"debug_allocs", "slo_requests_total", "up"},
+	}
+	q, err := ims.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+	for i, m := range after {
+		assert.Equal(t, before[i].MinTime, m.MinTime)
+		assert.Equal(t, before[i].Compaction.Level, m.Compaction.Level)
+
+		var names []string
+		set := q.Select(m.MinTime, m.MaxTime-1)
+		for set.Next() {
+			names = append(names, set.At().Definition().Name)
+		}
+		require.NoError(t, set.Err())
+		assert.Equal(t, expected[i], names)
+	}
+
+	// Rewritten blocks replace their parents on disk.
+	metas, err := block.List(dir)
+	require.NoError(t, err)
+	assert.Equal(t, after, metas)
+
+	buf := &bytes.Buffer{}
+	_, err = opts.Registry.WriteTo(buf)
+	require.NoError(t, err)
+	lines := strings.Split(buf.String(), "\n")
+	assert.Contains(t, lines, `koalemos_store_blocks_rewritten_total{reason="retention_time"} 3`)
+	assert.Contains(t, lines, `koalemos_store_series_deleted_total{reason="retention_time"} 4`)
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"go.uber.org/zap"
+)
+
+// Snapshot writes a consistent copy of the store's data to dir, which must
+// not exist yet: every persisted block and the tombstones of the data deleted
+// from long-term storage, hard linked where possible, and, if withHead is set, the samples held in memory written out as one more block.
+// Ingestion continues while the snapshot is taken, but blocks are not
+// persisted, compacted or deleted until it is done. The snapshot is written
+// to a temporary directory which is renamed to dir once complete, and can be
+// used as a data directory.
+func (ims *IMSImpl) Snapshot(dir string, withHead bool) error {
+	ims.cmtx.Lock()
+	defer ims.cmtx.Unlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot %s: %w", dir, fs.ErrExist)
+	}
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("removing stale temporary snapshot: %w", err)
+	}
+	if err := os.MkdirAll(tmp, 0o777); err != nil {
+		return fmt.Errorf("creating snapshot directory: %w", err)
+	}
+
+	// The persisted blocks and the head are read at the same instant, and
+	// the head's samples copied, so that ingestion can continue while they
+	// are written.
+	ims.mtx.RLock()
+	blocks := append([]*block.Reader(nil), ims.blocks...)
+	var (
+		head       []metrics.SeriesSet
+		mint, maxt int64 = math.MaxInt64, math.MinInt64
+	)
+	if withHead {
+		// The active block is listed last so its samples win over
+		// out-of-order ones.
+		for _, b := range []*metrics.Block{ims.oooFlushing, ims.oooBlock, ims.activeBlock} {
+			if b == nil || b.Empty() {
+				continue
+			}
+			head = append(head, b.Series(math.MinInt64, math.MaxInt64))
+			mint, maxt = min(mint, b.MinTime()), max(maxt, b.MaxTime())
+		}
+	}
+	ims.mtx.RUnlock()
+
+	for _, b := range blocks {
+		if err := linkDir(b.Dir(), filepath.Join(tmp, filepath.Base(b.Dir()))); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("snapshotting block %s: %w", b.Meta().ULID, err)
+		}
+	}
+	longTerm := filepath.Join(ims.opts.DataDir, longTermDirname)
+	if _, err := os.Stat(longTerm); err == nil {
+		if err := linkDir(longTerm, filepath.Join(tmp, longTermDirname)); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("snapshotting long-term storage tombstones: %w", err)
+		}
+	}
+	var headMeta *block.Meta
+	if len(head) > 0 {
+		meta, err := block.Write(tmp, mint, maxt+1, metrics.NewMergeSeriesSet(head...))
+		if err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("snapshotting head: %w", err)
+		}
+		headMeta = meta
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("renaming snapshot: %w", err)
+	}
+
+	fields := []zap.Field{zap.String("dir", dir), zap.Int("numBlocks", len(blocks))}
+	if headMeta != nil {
+		fields = append(fields, zap.String("head", headMeta.ULID.String()))
+	}
+	ims.logger.Info("created snapshot", fields...)
+	return nil
+}
+
+// linkDir recreates the directory tree at src under dst, hard linking every
+// file. Files are copied where they cannot be linked, e.g. across
+// filesystems. Persisted block files are never modified in place, so a link
+// keeps the file's contents at the time it was made.
+func linkDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o777)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+// copyFile copies the file at src to a new file at dst and fsyncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	series := &metrics.ListSeries{
+		Def:     metrics.MetricDefinition{Name: "up"},
+		Labels:  map[string]string{"job": "a"},
+		Samples: []metrics.Sample{{Time: 100, Value: 1}},
+	}
+	persisted, err := block.Write(dir, 0, DefaultBlockRange, metrics.NewListSeriesSet([]metrics.Series{series}))
+	require.NoError(t, err)
+
+	opts := Options{DataDir: dir, OutOfOrderWindow: DefaultBlockRange, Registry: instrument.NewRegistry()}
+	ims, err := Open(log.NewLogger(), opts)
+	require.NoError(t, err)
+	defer ims.Close()
+	require.NoError(t, addSample(t, ims, DefaultBlockRange+200, 2))
+	require.NoError(t, addSample(t, ims, DefaultBlockRange+100, 3))
+
+	snapshot := filepath.Join(dir, "snapshots", "test")
+	require.NoError(t, ims.Snapshot(snapshot, true))
+	assert.ErrorIs(t, ims.Snapshot(snapshot, true), fs.ErrExist)
+	require.NoError(t, ims.Snapshot(filepath.Join(dir, "snapshots", "no-head"), false))
+
+	// Persisted blocks are hard linked into the snapshot.
+	orig, err := os.Stat(filepath.Join(dir, persisted.ULID.String(), "index"))
+	require.NoError(t, err)
+	linked, err := os.Stat(filepath.Join(snapshot, persisted.ULID.String(), "index"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(orig, linked))
+
+	// Samples added after the snapshot are not in it.
+	require.NoError(t, addSample(t, ims, DefaultBlockRange+300, 4))
+
+	for snapshot, expected := range map[string][]metrics.Sample{
+		"test":    {{Time: 100, Value: 1}, {Time: DefaultBlockRange + 100, Value: 3}, {Time: DefaultBlockRange + 200, Value: 2}},
+		"no-head": {{Time: 100, Value: 1}},
+	} {
+		restored, err := Open(log.NewLogger(), Options{DataDir: filepath.Join(dir, "snapshots", snapshot), Registry: instrument.NewRegistry()})
+		require.NoError(t, err)
+		assert.Equal(t, expected, selectSamples(t, restored), snapshot)
+		require.NoError(t, restored.Close())
+	}
+}
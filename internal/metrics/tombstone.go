@@ -0,0 +1,103 @@
+package metrics
+
+// Tombstone marks the samples within [MinTime, MaxTime] of the series
+// satisfying every matcher as deleted.
+type Tombstone struct {
+	Matchers []*Matcher `json:"matchers"`
+	MinTime  int64      `json:"minTime"`
+	MaxTime  int64      `json:"maxTime"`
+}
+
+// Covers reports whether t is within the tombstone's time range.
+func (t *Tombstone) Covers(ts int64) bool {
+	return ts >= t.MinTime && ts <= t.MaxTime
+}
+
+// NewTombstoneQuerier returns a Querier over the series of q without the
+// samples deleted by tombstones.
+func NewTombstoneQuerier(q Querier, tombstones []Tombstone) Querier {
+	if len(tombstones) == 0 {
+		return q
+	}
+	return &tombstoneQuerier{Querier: q, tombstones: tombstones}
+}
+
+type tombstoneQuerier struct {
+	Querier
+	tombstones []Tombstone
+}
+
+func (q *tombstoneQuerier) Select(mint, maxt int64, matchers ...*Matcher) SeriesSet {
+	return NewTombstoneSeriesSet(q.Querier.Select(mint, maxt, matchers...), q.tombstones)
+}
+
+// NewTombstoneSeriesSet returns a SeriesSet over the series of set without
+// the samples deleted by tombstones. Series left without samples are
+// skipped.
+func NewTombstoneSeriesSet(set SeriesSet, tombstones []Tombstone) SeriesSet {
+	if len(tombstones) == 0 {
+		return set
+	}
+	return &tombstoneSeriesSet{SeriesSet: set, tombstones: tombstones}
+}
+
+type tombstoneSeriesSet struct {
+	SeriesSet
+	tombstones []Tombstone
+
+	cur Series
+	err error
+}
+
+func (s *tombstoneSeriesSet) Next() bool {
+	for s.err == nil && s.SeriesSet.Next() {
+		series := s.SeriesSet.At()
+		var matching []Tombstone
+		for _, t := range s.tombstones {
+			if MatchesSeries(series.Definition().Name, series.LabelSet(), t.Matchers...) {
+				matching = append(matching, t)
+			}
+		}
+		if len(matching) == 0 {
+			s.cur = series
+			return true
+		}
+
+		samples, err := ExpandSamples(series.Iterator())
+		if err != nil {
+			s.err = err
+			return false
+		}
+		kept := samples[:0]
+		for _, smpl := range samples {
+			if !deleted(matching, smpl.Time) {
+				kept = append(kept, smpl)
+			}
+		}
+		if len(kept) > 0 {
+			s.cur = &ListSeries{Def: series.Definition(), Labels: series.LabelSet(), Samples: kept}
+			return true
+		}
+	}
+	return false
+}
+
+// deleted reports whether any of tombstones, which all match the series,
+// covers t.
+func deleted(tombstones []Tombstone, t int64) bool {
+	for _, ts := range tombstones {
+		if ts.Covers(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *tombstoneSeriesSet) At() Series { return s.cur }
+
+func (s *tombstoneSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.SeriesSet.Err()
+}
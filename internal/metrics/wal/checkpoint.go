@@ -0,0 +1,236 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const checkpointPrefix = "checkpoint."
+
+// CheckpointStats counts the records kept and dropped by a checkpoint.
+type CheckpointStats struct {
+	DroppedSeries  int
+	DroppedSamples int
+	TotalSeries    int
+	TotalSamples   int
+}
+
+// checkpointName returns the path of the checkpoint covering segments up to
+// and including seq.
+func checkpointName(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%08d", checkpointPrefix, seq))
+}
+
+// LastCheckpoint returns the directory and last covered segment of the most
+// recent checkpoint in dir. It returns an empty directory if there is none.
+func LastCheckpoint(dir string) (string, int, error) {
+	seqs, err := listCheckpoints(dir)
+	if err != nil || len(seqs) == 0 {
+		return "", 0, err
+	}
+	seq := seqs[len(seqs)-1]
+	return checkpointName(dir, seq), seq, nil
+}
+
+func listCheckpoints(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listing write-ahead log checkpoints: %w", err)
+	}
+
+	var seqs []int
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), checkpointPrefix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimPrefix(e.Name(), checkpointPrefix))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// Checkpoint compacts the last checkpoint and every segment up to and
+// including seq into a new checkpoint. Series records are kept for series
+// which keep reports as still active, samples records, in or out of order,
+// for samples at or after mint, and tombstones records for tombstones
+// covering any time at or after mint. The checkpoint is written to a
+// temporary directory and renamed into place once complete.
+//
+// Checkpoint does not delete what it compacted; see Truncate and
+// DeleteCheckpoints.
+func Checkpoint(dir string, seq int, keep func(ref uint64) bool, mint int64) (*CheckpointStats, error) {
+	stats := &CheckpointStats{}
+
+	final := checkpointName(dir, seq)
+	tmp := final + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, fmt.Errorf("removing stale temporary checkpoint: %w", err)
+	}
+	cp, err := Open(tmp, Options{SyncPolicy: SyncNever})
+	if err != nil {
+		return nil, fmt.Errorf("creating checkpoint: %w", err)
+	}
+
+	fn := func(rec []byte) error {
+		switch Type(rec) {
+		case RecordSeries:
+			series, err := DecodeSeries(rec)
+			if err != nil {
+				return err
+			}
+			kept := series[:0]
+			for _, s := range series {
+				if keep(s.Ref) {
+					kept = append(kept, s)
+				}
+			}
+			stats.TotalSeries += len(series)
+			stats.DroppedSeries += len(series) - len(kept)
+			if len(kept) > 0 {
+				return cp.Log(EncodeSeries(kept))
+			}
+		case RecordSamples, RecordOOOSamples, RecordHistogramSamples, RecordOOOHistogramSamples:
+			samples, err := DecodeSamples(rec)
+			if err != nil {
+				return err
+			}
+			kept := samples[:0]
+			for _, s := range samples {
+				if s.Time >= mint && keep(s.Ref) {
+					kept = append(kept, s)
+				}
+			}
+			stats.TotalSamples += len(samples)
+			stats.DroppedSamples += len(samples) - len(kept)
+			if len(kept) > 0 {
+				return cp.Log(encodeSamples(Type(rec), kept))
+			}
+		case RecordTombstones:
+			tombstones, err := DecodeTombstones(rec)
+			if err != nil {
+				return err
+			}
+			kept := tombstones[:0]
+			for _, t := range tombstones {
+				if t.MaxTime >= mint {
+					kept = append(kept, t)
+				}
+			}
+			if len(kept) > 0 {
+				return cp.Log(EncodeTombstones(kept))
+			}
+		default:
+			return ErrUnknownRecord
+		}
+		return nil
+	}
+
+	err = replayCheckpointed(dir, seq, fn)
+	if closeErr := cp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("writing checkpoint: %w", err)
+	}
+
+	if err := os.Rename(tmp, final); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("renaming checkpoint into place: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// replayCheckpointed passes the records of the last checkpoint, followed by
+// those of the segments after it up to and including to, to fn.
+func replayCheckpointed(dir string, to int, fn func(rec []byte) error) error {
+	cpDir, cpSeq, err := LastCheckpoint(dir)
+	if err != nil {
+		return err
+	}
+	if cpDir != "" {
+		if _, err := Replay(cpDir, 0, fn); err != nil {
+			return fmt.Errorf("reading checkpoint: %w", err)
+		}
+	}
+
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if seq <= cpSeq || seq > to {
+			continue
+		}
+		if _, err := replaySegment(SegmentName(dir, seq), fn); err != nil {
+			return fmt.Errorf("reading segment %d: %w", seq, err)
+		}
+	}
+	return nil
+}
+
+// ReplayCheckpointed passes every record in dir to fn: those of the last
+// checkpoint followed by those of the segments after it. A torn tail of the
+// last segment is handled as by Replay.
+func ReplayCheckpointed(dir string, fn func(rec []byte) error) (torn bool, err error) {
+	cpDir, cpSeq, err := LastCheckpoint(dir)
+	if err != nil {
+		return false, err
+	}
+	if cpDir != "" {
+		if _, err := Replay(cpDir, 0, fn); err != nil {
+			return false, fmt.Errorf("replaying checkpoint: %w", err)
+		}
+	}
+	return Replay(dir, cpSeq+1, fn)
+}
+
+// Truncate deletes the segments in dir with sequence numbers up to and
+// including seq.
+func Truncate(dir string, seq int) error {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s > seq {
+			break
+		}
+		if err := os.Remove(SegmentName(dir, s)); err != nil {
+			return fmt.Errorf("deleting write-ahead log segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteCheckpoints deletes the checkpoints in dir covering segments before
+// seq.
+func DeleteCheckpoints(dir string, seq int) error {
+	seqs, err := listCheckpoints(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s >= seq {
+			break
+		}
+		if err := os.RemoveAll(checkpointName(dir, s)); err != nil {
+			return fmt.Errorf("deleting write-ahead log checkpoint: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package wal
+
+import (
+	"errors"
+)
+
+var (
+	ErrClosed            = errors.New("write-ahead log closed")
+	ErrCorrupted         = errors.New("corrupted write-ahead log record")
+	ErrUnknownRecord     = errors.New("unknown write-ahead log record type")
+	ErrInvalidSyncPolicy = errors.New("invalid write-ahead log sync policy")
+	ErrRecordTooLarge    = errors.New("write-ahead log record exceeds segment size")
+)
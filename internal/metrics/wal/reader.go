@@ -0,0 +1,93 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Replay reads every record of the segments in dir with sequence numbers of
+// at least from, in order, and passes each to fn. The record passed to fn is
+// only valid until fn returns.
+//
+// A torn or corrupted record at the tail of the last segment, as left by a
+// crash mid-write, is truncated away and reported through torn. Corruption
+// anywhere else is returned as ErrCorrupted.
+func Replay(dir string, from int, fn func(rec []byte) error) (torn bool, err error) {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return false, err
+	}
+
+	for i, seq := range seqs {
+		if seq < from {
+			continue
+		}
+		last := i == len(seqs)-1
+
+		valid, err := replaySegment(SegmentName(dir, seq), fn)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrCorrupted) || !last {
+			return false, fmt.Errorf("replaying segment %d: %w", seq, err)
+		}
+		if err := os.Truncate(SegmentName(dir, seq), valid); err != nil {
+			return false, fmt.Errorf("truncating torn segment %d: %w", seq, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// replaySegment passes every record of the segment at path to fn, returning
+// the offset after the last valid record.
+func replaySegment(path string, fn func(rec []byte) error) (valid int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("opening segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	header := make([]byte, recordHeaderSize)
+	var rec []byte
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return valid, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return valid, fmt.Errorf("incomplete record header: %w", ErrCorrupted)
+			}
+			return valid, err
+		}
+
+		l := binary.BigEndian.Uint32(header)
+		if l > maxRecordSize {
+			return valid, fmt.Errorf("record length %d: %w", l, ErrCorrupted)
+		}
+		if cap(rec) < int(l) {
+			rec = make([]byte, l)
+		}
+		rec = rec[:l]
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return valid, fmt.Errorf("incomplete record: %w", ErrCorrupted)
+			}
+			return valid, err
+		}
+		if crc32.Checksum(rec, castagnoli) != binary.BigEndian.Uint32(header[4:]) {
+			return valid, fmt.Errorf("record checksum mismatch: %w", ErrCorrupted)
+		}
+
+		if err := fn(rec); err != nil {
+			return valid, err
+		}
+		valid += int64(recordHeaderSize + len(rec))
+	}
+}
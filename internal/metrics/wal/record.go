@@ -0,0 +1,297 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// RecordType identifies the contents of a record.
+type RecordType byte
+
+const (
+	// RecordSeries records the creation of timeseries and the references
+	// they were assigned.
+	RecordSeries RecordType = 1
+	// RecordSamples records samples appended to timeseries by reference.
+	RecordSamples RecordType = 2
+	// RecordOOOSamples records samples appended out of order to timeseries
+	// by reference. It is encoded as RecordSamples.
+	RecordOOOSamples RecordType = 3
+	// RecordTombstones records the deletion of samples from timeseries
+	// matching a set of matchers.
+	RecordTombstones RecordType = 4
+	// RecordHistogramSamples records native histogram samples appended to
+	// timeseries by reference.
+	RecordHistogramSamples RecordType = 5
+	// RecordOOOHistogramSamples records native histogram samples appended
+	// out of order to timeseries by reference. It is encoded as
+	// RecordHistogramSamples.
+	RecordOOOHistogramSamples RecordType = 6
+)
+
+// RefSeries is a timeseries and the reference it was assigned.
+type RefSeries struct {
+	Ref      uint64
+	Def      metrics.MetricDefinition
+	LabelSet map[string]string
+}
+
+// RefSample is a sample appended to the timeseries with reference Ref: a
+// native histogram if Histogram is set, and Value otherwise.
+type RefSample struct {
+	Ref       uint64
+	Time      int64
+	Value     float64
+	Histogram *metrics.Histogram
+}
+
+// Type returns the type of an encoded record.
+func Type(rec []byte) RecordType {
+	if len(rec) == 0 {
+		return 0
+	}
+	return RecordType(rec[0])
+}
+
+// EncodeSeries encodes series as a RecordSeries record.
+func EncodeSeries(series []RefSeries) []byte {
+	b := []byte{byte(RecordSeries)}
+	b = binary.AppendUvarint(b, uint64(len(series)))
+	for _, s := range series {
+		b = binary.AppendUvarint(b, s.Ref)
+		b = appendString(b, s.Def.Name)
+		b = appendString(b, s.Def.Type)
+		b = appendString(b, s.Def.Help)
+		b = binary.AppendUvarint(b, uint64(len(s.LabelSet)))
+		for _, k := range metrics.SortedLabelNames(s.LabelSet) {
+			b = appendString(b, k)
+			b = appendString(b, s.LabelSet[k])
+		}
+	}
+	return b
+}
+
+// DecodeSeries decodes a RecordSeries record.
+func DecodeSeries(rec []byte) ([]RefSeries, error) {
+	if Type(rec) != RecordSeries {
+		return nil, ErrUnknownRecord
+	}
+	d := decbuf{b: rec[1:]}
+	n := d.uvarint()
+	series := make([]RefSeries, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		s := RefSeries{Ref: d.uvarint(), LabelSet: map[string]string{}}
+		s.Def.Name = d.string()
+		s.Def.Type = d.string()
+		s.Def.Help = d.string()
+		nl := d.uvarint()
+		for j := uint64(0); j < nl && d.err == nil; j++ {
+			k := d.string()
+			s.LabelSet[k] = d.string()
+		}
+		series = append(series, s)
+	}
+	return series, d.err
+}
+
+// EncodeSamples encodes samples as a RecordSamples record.
+func EncodeSamples(samples []RefSample) []byte {
+	return encodeSamples(RecordSamples, samples)
+}
+
+// EncodeOOOSamples encodes samples as a RecordOOOSamples record.
+func EncodeOOOSamples(samples []RefSample) []byte {
+	return encodeSamples(RecordOOOSamples, samples)
+}
+
+// EncodeHistogramSamples encodes native histogram samples as a
+// RecordHistogramSamples record.
+func EncodeHistogramSamples(samples []RefSample) []byte {
+	return encodeSamples(RecordHistogramSamples, samples)
+}
+
+// EncodeOOOHistogramSamples encodes native histogram samples as a
+// RecordOOOHistogramSamples record.
+func EncodeOOOHistogramSamples(samples []RefSample) []byte {
+	return encodeSamples(RecordOOOHistogramSamples, samples)
+}
+
+func encodeSamples(t RecordType, samples []RefSample) []byte {
+	b := []byte{byte(t)}
+	b = binary.AppendUvarint(b, uint64(len(samples)))
+	for _, s := range samples {
+		b = binary.AppendUvarint(b, s.Ref)
+		b = binary.AppendVarint(b, s.Time)
+		if isHistogramRecord(t) {
+			b = metrics.AppendHistogram(b, s.Histogram)
+		} else {
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(s.Value))
+		}
+	}
+	return b
+}
+
+func isHistogramRecord(t RecordType) bool {
+	return t == RecordHistogramSamples || t == RecordOOOHistogramSamples
+}
+
+// DecodeSamples decodes a RecordSamples or RecordOOOSamples record, or
+// either of their native histogram counterparts.
+func DecodeSamples(rec []byte) ([]RefSample, error) {
+	t := Type(rec)
+	if t != RecordSamples && t != RecordOOOSamples && !isHistogramRecord(t) {
+		return nil, ErrUnknownRecord
+	}
+	d := decbuf{b: rec[1:]}
+	n := d.uvarint()
+	samples := make([]RefSample, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		s := RefSample{Ref: d.uvarint(), Time: d.varint()}
+		if isHistogramRecord(t) {
+			s.Histogram = d.histogram()
+		} else {
+			s.Value = math.Float64frombits(d.be64())
+		}
+		samples = append(samples, s)
+	}
+	return samples, d.err
+}
+
+// EncodeTombstones encodes tombstones as a RecordTombstones record.
+func EncodeTombstones(tombstones []metrics.Tombstone) []byte {
+	b := []byte{byte(RecordTombstones)}
+	b = binary.AppendUvarint(b, uint64(len(tombstones)))
+	for _, t := range tombstones {
+		b = binary.AppendVarint(b, t.MinTime)
+		b = binary.AppendVarint(b, t.MaxTime)
+		b = binary.AppendUvarint(b, uint64(len(t.Matchers)))
+		for _, m := range t.Matchers {
+			b = append(b, byte(m.Type))
+			b = appendString(b, m.Name)
+			b = appendString(b, m.Value)
+		}
+	}
+	return b
+}
+
+// DecodeTombstones decodes a RecordTombstones record.
+func DecodeTombstones(rec []byte) ([]metrics.Tombstone, error) {
+	if Type(rec) != RecordTombstones {
+		return nil, ErrUnknownRecord
+	}
+	d := decbuf{b: rec[1:]}
+	n := d.uvarint()
+	tombstones := make([]metrics.Tombstone, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		t := metrics.Tombstone{MinTime: d.varint(), MaxTime: d.varint()}
+		nm := d.uvarint()
+		for j := uint64(0); j < nm && d.err == nil; j++ {
+			typ := metrics.MatchType(d.byte())
+			name := d.string()
+			value := d.string()
+			if d.err != nil {
+				break
+			}
+			m, err := metrics.NewMatcher(typ, name, value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+			}
+			t.Matchers = append(t.Matchers, m)
+		}
+		tombstones = append(tombstones, t)
+	}
+	return tombstones, d.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decbuf decodes values from a record, recording the first error.
+type decbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *decbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 1 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decbuf) be64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decbuf) histogram() *metrics.Histogram {
+	if d.err != nil {
+		return nil
+	}
+	h, n, err := metrics.DecodeHistogram(d.b)
+	if err != nil {
+		d.err = ErrCorrupted
+		return nil
+	}
+	d.b = d.b[n:]
+	return h
+}
+
+func (d *decbuf) string() string {
+	l := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if l > uint64(len(d.b)) {
+		d.err = ErrCorrupted
+		return ""
+	}
+	s := string(d.b[:l])
+	d.b = d.b[l:]
+	return s
+}
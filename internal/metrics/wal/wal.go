@@ -0,0 +1,323 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSegmentSize is the size after which a new segment file is
+	// started.
+	DefaultSegmentSize = 128 * 1024 * 1024
+	// DefaultSyncInterval is how often the log is fsynced under SyncInterval.
+	DefaultSyncInterval = 5 * time.Second
+
+	// recordHeaderSize is the size of the length and checksum preceding each
+	// record.
+	recordHeaderSize = 8
+	// maxRecordSize bounds the length of a record read back, so a corrupted
+	// length is not mistaken for a huge record.
+	maxRecordSize = 1 << 30
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncPolicy controls when writes to the log are fsynced.
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs the log before every Log call returns.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs the log periodically, bounding the data lost on a
+	// machine crash to one interval.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// ParseSyncPolicy parses a SyncPolicy by name.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("%q: %w", s, ErrInvalidSyncPolicy)
+}
+
+// Options configures a WAL.
+type Options struct {
+	SegmentSize  int64
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+}
+
+// WAL is a write-ahead log made of numbered segment files within a
+// directory. Each record is written as
+//
+//	len <4b> │ CRC32(data) <4b> │ data <len bytes>
+//
+// and never spans two segments.
+type WAL struct {
+	dir  string
+	opts Options
+
+	mtx     sync.Mutex
+	seg     *os.File
+	w       *bufio.Writer
+	segSeq  int
+	segSize int64
+	dirty   bool
+	closed  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the write-ahead log in dir, creating dir if needed. Writes go to
+// a new segment following any existing ones, so existing segments should be
+// replayed with Replay before the log is written to.
+func Open(dir string, opts Options) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncPolicy == "" {
+		opts.SyncPolicy = SyncAlways
+	}
+	if _, err := ParseSyncPolicy(string(opts.SyncPolicy)); err != nil {
+		return nil, err
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, fmt.Errorf("creating write-ahead log directory: %w", err)
+	}
+
+	_, last, err := Segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Segments covered by a checkpoint may all have been deleted, in which
+	// case numbering continues after the checkpoint.
+	_, cpSeq, err := LastCheckpoint(dir)
+	if err != nil {
+		return nil, err
+	}
+	last = max(last, cpSeq)
+
+	w := &WAL{dir: dir, opts: opts, segSeq: last}
+	if opts.SyncPolicy == SyncInterval {
+		w.stop, w.done = make(chan struct{}), make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// Dir returns the log's directory.
+func (w *WAL) Dir() string {
+	return w.dir
+}
+
+// Log writes recs to the log, each as its own record, and fsyncs according
+// to the sync policy.
+func (w *WAL) Log(recs ...[]byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	for _, rec := range recs {
+		if err := w.log(rec); err != nil {
+			return err
+		}
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("flushing write-ahead log: %w", err)
+	}
+	w.dirty = true
+
+	if w.opts.SyncPolicy == SyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+func (w *WAL) log(rec []byte) error {
+	size := int64(recordHeaderSize + len(rec))
+	if size > w.opts.SegmentSize {
+		return ErrRecordTooLarge
+	}
+	if w.seg == nil || w.segSize+size > w.opts.SegmentSize {
+		if err := w.cut(); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(len(rec)))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(rec, castagnoli))
+	if _, err := w.w.Write(header); err != nil {
+		return fmt.Errorf("writing write-ahead log record: %w", err)
+	}
+	if _, err := w.w.Write(rec); err != nil {
+		return fmt.Errorf("writing write-ahead log record: %w", err)
+	}
+	w.segSize += size
+	return nil
+}
+
+// NextSegment closes the current segment so that following writes go to a
+// new one, and returns the sequence number of the closed segment. Every
+// segment up to the returned one is then complete and may be checkpointed.
+func (w *WAL) NextSegment() (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+	closed := w.segSeq
+	if err := w.cut(); err != nil {
+		return 0, err
+	}
+	return closed, nil
+}
+
+// cut closes the current segment, if any, and starts a new one.
+func (w *WAL) cut() error {
+	if err := w.closeSegment(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(SegmentName(w.dir, w.segSeq+1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o666)
+	if err != nil {
+		return fmt.Errorf("creating write-ahead log segment: %w", err)
+	}
+	w.segSeq++
+	w.seg, w.w, w.segSize = f, bufio.NewWriterSize(f, 64*1024), 0
+	return syncDir(w.dir)
+}
+
+func (w *WAL) closeSegment() error {
+	if w.seg == nil {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("flushing write-ahead log: %w", err)
+	}
+	if err := w.seg.Sync(); err != nil {
+		return fmt.Errorf("syncing write-ahead log: %w", err)
+	}
+	err := w.seg.Close()
+	w.seg, w.w, w.dirty = nil, nil, false
+	return err
+}
+
+func (w *WAL) sync() error {
+	if w.seg == nil || !w.dirty {
+		return nil
+	}
+	if err := w.seg.Sync(); err != nil {
+		return fmt.Errorf("syncing write-ahead log: %w", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mtx.Lock()
+			w.sync()
+			w.mtx.Unlock()
+		}
+	}
+}
+
+// Close flushes, fsyncs and closes the log.
+func (w *WAL) Close() error {
+	w.mtx.Lock()
+	if w.closed {
+		w.mtx.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.closeSegment()
+	w.mtx.Unlock()
+
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	return err
+}
+
+// SegmentName returns the path of segment seq within dir.
+func SegmentName(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d", seq))
+}
+
+// Segments returns the first and last sequence numbers of the segments in
+// dir, or 0 and 0 if there are none.
+func Segments(dir string) (first, last int, err error) {
+	seqs, err := listSegments(dir)
+	if err != nil || len(seqs) == 0 {
+		return 0, 0, err
+	}
+	return seqs[0], seqs[len(seqs)-1], nil
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listing write-ahead log segments: %w", err)
+	}
+
+	var seqs []int
+	for _, e := range entries {
+		seq, err := strconv.Atoi(e.Name())
+		if err != nil || e.IsDir() {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// syncDir fsyncs a directory so that entries created within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening directory to sync: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing directory: %w", err)
+	}
+	return nil
+}
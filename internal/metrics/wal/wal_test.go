@@ -0,0 +1,212 @@
+package wal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func replayAll(t *testing.T, dir string) ([][]byte, bool) {
+	t.Helper()
+
+	var recs [][]byte
+	torn, err := Replay(dir, 0, func(rec []byte) error {
+		recs = append(recs, append([]byte(nil), rec...))
+		return nil
+	})
+	require.NoError(t, err)
+	return recs, torn
+}
+
+func Test_LogReplay(t *testing.T) {
+	series := []RefSeries{{
+		Ref:      1,
+		Def:      metrics.MetricDefinition{Name: "http_requests_total", Type: "counter", Help: "Total requests."},
+		LabelSet: map[string]string{"method": "get", "code": "200"},
+	}}
+	samples := []RefSample{{Ref: 1, Time: 978595200, Value: 1027}, {Ref: 1, Time: 978595260, Value: -1.5}}
+
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 100})
+	require.NoError(t, err)
+	require.NoError(t, w.Log(EncodeSeries(series), EncodeSamples(samples)))
+	require.NoError(t, w.Close())
+
+	// A small segment size forces each record into its own segment.
+	first, last, err := Segments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, first)
+	assert.Equal(t, 2, last)
+
+	recs, torn := replayAll(t, dir)
+	assert.False(t, torn)
+	require.Len(t, recs, 2)
+
+	decodedSeries, err := DecodeSeries(recs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, series, decodedSeries)
+
+	decodedSamples, err := DecodeSamples(recs[1])
+	assert.NoError(t, err)
+	assert.Equal(t, samples, decodedSamples)
+}
+
+func Test_HistogramSamples(t *testing.T) {
+	h := &metrics.Histogram{
+		Schema:          1,
+		ZeroThreshold:   0.001,
+		ZeroCount:       2,
+		Count:           9,
+		Sum:             12.5,
+		PositiveSpans:   []metrics.Span{{Offset: -1, Length: 2}, {Offset: 3, Length: 1}},
+		PositiveBuckets: []float64{1, 3, 2},
+		NegativeSpans:   []metrics.Span{{Offset: 0, Length: 1}},
+		NegativeBuckets: []float64{1},
+	}
+	samples := []RefSample{{Ref: 1, Time: 978595200, Histogram: h}, {Ref: 2, Time: 978595260, Histogram: &metrics.Histogram{}}}
+
+	for _, rec := range [][]byte{EncodeHistogramSamples(samples), EncodeOOOHistogramSamples(samples)} {
+		decoded, err := DecodeSamples(rec)
+		assert.NoError(t, err)
+		assert.Equal(t, samples[0], decoded[0])
+		assert.True(t, samples[1].Histogram.Equals(decoded[1].Histogram))
+
+		_, err = DecodeSamples(rec[:len(rec)-4])
+		assert.ErrorIs(t, err, ErrCorrupted)
+	}
+}
+
+func Test_ReplayTornTail(t *testing.T) {
+	type Test struct {
+		desc        string
+		corrupt     func(b []byte) []byte
+		expectedLen int
+	}
+
+	tests := []Test{
+		{
+			desc:        "[POSITIVE] incomplete trailing record is truncated",
+			corrupt:     func(b []byte) []byte { return b[:len(b)-3] },
+			expectedLen: 2,
+		},
+		{
+			desc: "[POSITIVE] corrupted trailing record is truncated",
+			corrupt: func(b []byte) []byte {
+				b[len(b)-1] ^= 0xff
+				return b
+			},
+			expectedLen: 2,
+		},
+		{
+			desc:        "[POSITIVE] incomplete trailing header is truncated",
+			corrupt:     func(b []byte) []byte { return append(b, 0, 0, 1) },
+			expectedLen: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := Open(dir, Options{})
+			require.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				require.NoError(t, w.Log(EncodeSamples([]RefSample{{Ref: 1, Time: int64(i)}})))
+			}
+			require.NoError(t, w.Close())
+
+			path := SegmentName(dir, 1)
+			b, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(path, tc.corrupt(b), 0o666))
+
+			recs, torn := replayAll(t, dir)
+			assert.True(t, torn)
+			assert.Len(t, recs, tc.expectedLen)
+
+			// The torn tail has been truncated away.
+			recs, torn = replayAll(t, dir)
+			assert.False(t, torn)
+			assert.Len(t, recs, tc.expectedLen)
+		})
+	}
+}
+
+func Test_ReplayCorruptedSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 32})
+	require.NoError(t, err)
+	require.NoError(t, w.Log(EncodeSamples([]RefSample{{Ref: 1}}), EncodeSamples([]RefSample{{Ref: 2}})))
+	require.NoError(t, w.Close())
+
+	path := SegmentName(dir, 1)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0o666))
+
+	_, err = Replay(dir, 0, func(rec []byte) error { return nil })
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func Test_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, Options{})
+	require.NoError(t, err)
+
+	series := []RefSeries{
+		{Ref: 1, Def: metrics.MetricDefinition{Name: "active"}, LabelSet: map[string]string{}},
+		{Ref: 2, Def: metrics.MetricDefinition{Name: "gone"}, LabelSet: map[string]string{}},
+	}
+	require.NoError(t, w.Log(EncodeSeries(series)))
+	require.NoError(t, w.Log(EncodeSamples([]RefSample{{Ref: 1, Time: 10}, {Ref: 2, Time: 10}, {Ref: 1, Time: 20}})))
+
+	last, err := w.NextSegment()
+	require.NoError(t, err)
+	assert.Equal(t, 1, last)
+	require.NoError(t, w.Log(EncodeSamples([]RefSample{{Ref: 1, Time: 30}})))
+
+	keep := func(ref uint64) bool { return ref == 1 }
+	stats, err := Checkpoint(dir, last, keep, 20)
+	require.NoError(t, err)
+	assert.Equal(t, &CheckpointStats{DroppedSeries: 1, DroppedSamples: 2, TotalSeries: 2, TotalSamples: 3}, stats)
+	require.NoError(t, Truncate(dir, last))
+	require.NoError(t, w.Close())
+
+	first, _, err := Segments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 2, first)
+
+	var (
+		replayedSeries  []RefSeries
+		replayedSamples []RefSample
+	)
+	_, err = ReplayCheckpointed(dir, func(rec []byte) error {
+		switch Type(rec) {
+		case RecordSeries:
+			s, err := DecodeSeries(rec)
+			replayedSeries = append(replayedSeries, s...)
+			return err
+		case RecordSamples:
+			s, err := DecodeSamples(rec)
+			replayedSamples = append(replayedSamples, s...)
+			return err
+		}
+		return ErrUnknownRecord
+	})
+	require.NoError(t, err)
+	assert.Equal(t, series[:1], replayedSeries)
+	assert.Equal(t, []RefSample{{Ref: 1, Time: 20}, {Ref: 1, Time: 30}}, replayedSamples)
+
+	// Numbering continues after the checkpoint once all segments are gone.
+	require.NoError(t, Truncate(dir, 2))
+	w, err = Open(dir, Options{})
+	require.NoError(t, err)
+	require.NoError(t, w.Log(EncodeSamples([]RefSample{{Ref: 1, Time: 40}})))
+	require.NoError(t, w.Close())
+	_, lastSeq, err := Segments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 2, lastSeq)
+}
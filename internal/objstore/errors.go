@@ -0,0 +1,9 @@
+package objstore
+
+import "errors"
+
+var (
+	ErrObjectNotFound = errors.New("object not found")
+	ErrInvalidName    = errors.New("invalid object name")
+	ErrInvalidRange   = errors.New("invalid object range")
+)
@@ -0,0 +1,27 @@
+package objstore
+
+import (
+	"net/http"
+	"time"
+)
+
+// VerifySignature reports whether r, as received by a server, is signed
+// with AWS Signature Version 4 by the given credentials.
+func VerifySignature(r *http.Request, accessKeyID, secretAccessKey, region string) bool {
+	now, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	u := *r.URL
+	u.Host = r.Host
+	signed := &http.Request{Method: r.Method, URL: &u, Header: http.Header{}}
+	for k, vs := range r.Header {
+		if k == "Range" || len(k) > 6 && k[:6] == "X-Amz-" {
+			signed.Header[k] = vs
+		}
+	}
+
+	c := credentials{accessKeyID: accessKeyID, secretAccessKey: secretAccessKey, region: region}
+	signV4(signed, c, r.Header.Get("X-Amz-Content-Sha256"), now)
+	return signed.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
@@ -0,0 +1,194 @@
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tmpSuffix marks an object which is still being written.
+const tmpSuffix = ".tmp"
+
+// Filesystem is a Bucket storing each object as a file under a directory,
+// for tests and development.
+type Filesystem struct {
+	dir string
+}
+
+var _ Bucket = (*Filesystem)(nil)
+
+// NewFilesystem returns a Bucket storing objects under dir, which is created
+// if it does not exist.
+func NewFilesystem(dir string) (*Filesystem, error) {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, fmt.Errorf("creating bucket directory: %w", err)
+	}
+	return &Filesystem{dir: filepath.Clean(dir)}, nil
+}
+
+// path returns the file an object is stored in.
+func (b *Filesystem) path(name string) (string, error) {
+	if name == "" || path.Clean(name) != name || strings.HasPrefix(name, "/") ||
+		name == ".." || strings.HasPrefix(name, "../") || strings.HasSuffix(name, tmpSuffix) {
+		return "", fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	return filepath.Join(b.dir, filepath.FromSlash(name)), nil
+}
+
+// Put writes the object to a temporary file which is renamed into place
+// once complete.
+func (b *Filesystem) Put(ctx context.Context, name string, r io.Reader) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o777); err != nil {
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+
+	tmp := p + tmpSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+	if _, err := io.Copy(f, &ctxReader{ctx: ctx, r: r}); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+	return nil
+}
+
+func (b *Filesystem) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.GetRange(ctx, name, 0, -1)
+}
+
+func (b *Filesystem) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("offset %d: %w", off, ErrInvalidRange)
+	}
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("getting %s: %w", name, err)
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+	}
+
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("getting %s: %w", name, err)
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+func (b *Filesystem) Size(ctx context.Context, name string) (int64, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+		}
+		return 0, fmt.Errorf("getting size of %s: %w", name, err)
+	}
+	if info.IsDir() {
+		return 0, fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+	}
+	return info.Size(), nil
+}
+
+func (b *Filesystem) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(b.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, tmpSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(b.dir, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %q: %w", prefix, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete removes the object's file, and any directories left empty.
+func (b *Filesystem) Delete(ctx context.Context, name string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	for dir := filepath.Dir(p); dir != b.dir; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// ctxReader stops reading once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
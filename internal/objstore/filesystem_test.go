@@ -0,0 +1,46 @@
+package objstore_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/mikanmekan/koalemos/internal/objstore/objstoretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Filesystem(t *testing.T) {
+	objstoretest.TestBucket(t, func(t *testing.T) objstore.Bucket {
+		b, err := objstore.NewFilesystem(t.TempDir())
+		require.NoError(t, err)
+		return b
+	})
+}
+
+func Test_FilesystemInvalidNames(t *testing.T) {
+	b, err := objstore.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	for _, name := range []string{"", "/abs", "../escape", "a/../../b", "a//b", "a/", "object.tmp"} {
+		err := b.Put(context.Background(), name, strings.NewReader("x"))
+		assert.ErrorIs(t, err, objstore.ErrInvalidName, name)
+	}
+}
+
+func Test_FilesystemDeleteRemovesEmptyDirs(t *testing.T) {
+	dir := t.TempDir()
+	b, err := objstore.NewFilesystem(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Put(context.Background(), "a/b/c", strings.NewReader("x")))
+	require.NoError(t, b.Delete(context.Background(), "a/b/c"))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.DirExists(t, filepath.Clean(dir), "the bucket's own directory is kept")
+}
@@ -0,0 +1,34 @@
+// Package objstore provides access to object storage buckets, such as S3,
+// holding persisted blocks.
+package objstore
+
+import (
+	"context"
+	"io"
+)
+
+// Bucket is a flat namespace of objects addressed by name. Names use / to
+// separate path segments, e.g. "01HGW2N7Z3Q5X0K9J8R6T4V2B1/meta.json".
+type Bucket interface {
+	// Put writes the contents of r to the named object, replacing any
+	// object of that name. Readers never observe a partially written
+	// object.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// Get returns a reader of the named object's contents, or
+	// ErrObjectNotFound. The reader must be closed.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// GetRange returns a reader of length bytes of the named object's
+	// contents starting at off, or ErrObjectNotFound. Fewer bytes are
+	// returned if the object ends first; a negative length reads to the end.
+	// The reader must be closed.
+	GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error)
+	// Size returns the size in bytes of the named object, or
+	// ErrObjectNotFound.
+	Size(ctx context.Context, name string) (int64, error)
+	// List returns the sorted names of the objects whose names start with
+	// prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the named object. Deleting an object which does not
+	// exist is not an error.
+	Delete(ctx context.Context, name string) error
+}
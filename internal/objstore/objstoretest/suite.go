@@ -0,0 +1,165 @@
+// Package objstoretest provides the test suite every objstore.Bucket
+// implementation must pass.
+package objstoretest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBucket runs the test suite against empty buckets returned by
+// newBucket.
+func TestBucket(t *testing.T, newBucket func(t *testing.T) objstore.Bucket) {
+	ctx := context.Background()
+
+	t.Run("put and get", func(t *testing.T) {
+		b := newBucket(t)
+		require.NoError(t, b.Put(ctx, "a/b", strings.NewReader("hello")))
+		assert.Equal(t, "hello", get(t, b, "a/b"))
+
+		require.NoError(t, b.Put(ctx, "a/b", strings.NewReader("bye")), "overwriting an object")
+		assert.Equal(t, "bye", get(t, b, "a/b"))
+
+		require.NoError(t, b.Put(ctx, "empty", bytes.NewReader(nil)))
+		assert.Equal(t, "", get(t, b, "empty"))
+
+		// Readers which cannot seek, so have no known size.
+		require.NoError(t, b.Put(ctx, "unsized", io.MultiReader(strings.NewReader("un"), strings.NewReader("sized"))))
+		assert.Equal(t, "unsized", get(t, b, "unsized"))
+	})
+
+	t.Run("names", func(t *testing.T) {
+		b := newBucket(t)
+		for _, name := range []string{"with space", "with+plus", "unicode/ü", "a=b&c", "tilde~/dots.json"} {
+			require.NoError(t, b.Put(ctx, name, strings.NewReader(name)), name)
+			assert.Equal(t, name, get(t, b, name), name)
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		b := newBucket(t)
+		require.NoError(t, b.Put(ctx, "a/b", strings.NewReader("hello")))
+		require.NoError(t, b.Put(ctx, "empty", bytes.NewReader(nil)))
+
+		size, err := b.Size(ctx, "a/b")
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), size)
+		size, err = b.Size(ctx, "empty")
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), size)
+		_, err = b.Size(ctx, "missing")
+		assert.ErrorIs(t, err, objstore.ErrObjectNotFound)
+		_, err = b.Size(ctx, "a")
+		assert.ErrorIs(t, err, objstore.ErrObjectNotFound, "a prefix is not an object")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		b := newBucket(t)
+		_, err := b.Get(ctx, "missing")
+		assert.ErrorIs(t, err, objstore.ErrObjectNotFound)
+		_, err = b.GetRange(ctx, "missing", 1, 2)
+		assert.ErrorIs(t, err, objstore.ErrObjectNotFound)
+
+		require.NoError(t, b.Put(ctx, "dir/object", strings.NewReader("x")))
+		_, err = b.Get(ctx, "dir")
+		assert.ErrorIs(t, err, objstore.ErrObjectNotFound, "a prefix is not an object")
+	})
+
+	t.Run("get range", func(t *testing.T) {
+		b := newBucket(t)
+		require.NoError(t, b.Put(ctx, "object", strings.NewReader("0123456789")))
+
+		tcs := []struct {
+			desc     string
+			off, len int64
+			expected string
+		}{
+			{desc: "[POSITIVE] middle of the object", off: 2, len: 3, expected: "234"},
+			{desc: "[POSITIVE] start of the object", off: 0, len: 4, expected: "0123"},
+			{desc: "[POSITIVE] negative length reads to the end", off: 7, len: -1, expected: "789"},
+			{desc: "[POSITIVE] whole object", off: 0, len: -1, expected: "0123456789"},
+			{desc: "[POSITIVE] range past the end is cut short", off: 8, len: 5, expected: "89"},
+			{desc: "[POSITIVE] range starting at the end is empty", off: 10, len: 5, expected: ""},
+			{desc: "[POSITIVE] range starting past the end is empty", off: 20, len: -1, expected: ""},
+			{desc: "[POSITIVE] zero length is empty", off: 3, len: 0, expected: ""},
+		}
+		for _, tc := range tcs {
+			t.Run(tc.desc, func(t *testing.T) {
+				r, err := b.GetRange(ctx, "object", tc.off, tc.len)
+				require.NoError(t, err)
+				defer r.Close()
+				got, err := io.ReadAll(r)
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, string(got))
+			})
+		}
+
+		_, err := b.GetRange(ctx, "object", -1, 2)
+		assert.ErrorIs(t, err, objstore.ErrInvalidRange)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		b := newBucket(t)
+		names, err := b.List(ctx, "")
+		require.NoError(t, err)
+		assert.Empty(t, names)
+
+		for _, name := range []string{"b/2", "a/1", "b/1", "b/sub/3", "ba"} {
+			require.NoError(t, b.Put(ctx, name, strings.NewReader(name)))
+		}
+
+		tcs := []struct {
+			desc     string
+			prefix   string
+			expected []string
+		}{
+			{desc: "[POSITIVE] everything, sorted", prefix: "", expected: []string{"a/1", "b/1", "b/2", "b/sub/3", "ba"}},
+			{desc: "[POSITIVE] directory prefix includes nested objects", prefix: "b/", expected: []string{"b/1", "b/2", "b/sub/3"}},
+			{desc: "[POSITIVE] prefix need not end at a separator", prefix: "b", expected: []string{"b/1", "b/2", "b/sub/3", "ba"}},
+			{desc: "[POSITIVE] full name", prefix: "a/1", expected: []string{"a/1"}},
+			{desc: "[NEGATIVE] no matches", prefix: "c", expected: nil},
+		}
+		for _, tc := range tcs {
+			t.Run(tc.desc, func(t *testing.T) {
+				names, err := b.List(ctx, tc.prefix)
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, names)
+			})
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		b := newBucket(t)
+		require.NoError(t, b.Put(ctx, "dir/a", strings.NewReader("a")))
+		require.NoError(t, b.Put(ctx, "dir/b", strings.NewReader("b")))
+
+		require.NoError(t, b.Delete(ctx, "dir/a"))
+		_, err := b.Get(ctx, "dir/a")
+		assert.ErrorIs(t, err, objstore.ErrObjectNotFound)
+		assert.Equal(t, "b", get(t, b, "dir/b"), "other objects are kept")
+
+		require.NoError(t, b.Delete(ctx, "dir/a"), "deleting a missing object")
+		require.NoError(t, b.Delete(ctx, "dir/b"))
+		names, err := b.List(ctx, "")
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+}
+
+// get returns the named object's contents.
+func get(t *testing.T, b objstore.Bucket, name string) string {
+	t.Helper()
+	r, err := b.Get(context.Background(), name)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
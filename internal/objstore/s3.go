@@ -0,0 +1,300 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3 compatible bucket.
+type S3Config struct {
+	// Endpoint is the base URL of the S3 API, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	// Bucket is the name of the bucket.
+	Bucket string
+	// Region is the region requests are signed for. Defaults to us-east-1.
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3 is a Bucket backed by an S3 compatible object store. Buckets are
+// addressed in path style, i.e. as <endpoint>/<bucket>/<object>, and
+// requests are signed with AWS Signature Version 4.
+type S3 struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	creds    credentials
+}
+
+var _ Bucket = (*S3)(nil)
+
+// NewS3 returns a Bucket for the S3 bucket cfg describes, making requests
+// with client, or http.DefaultClient if nil.
+func NewS3(cfg S3Config, client *http.Client) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket given")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{
+		client:   client,
+		endpoint: endpoint,
+		bucket:   cfg.Bucket,
+		creds: credentials{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			region:          cfg.Region,
+		},
+	}, nil
+}
+
+// newRequest returns a signed request for the named object, or for the
+// bucket itself if name is empty.
+func (b *S3) newRequest(ctx context.Context, method, name string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Request, error) {
+	p := strings.TrimSuffix(b.endpoint.Path, "/") + "/" + b.bucket
+	if name != "" {
+		p += "/" + name
+	}
+	u := *b.endpoint
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			// Otherwise an empty body is sent chunked, of unknown length.
+			req.Body = http.NoBody
+		}
+		payloadHash = unsignedPayload
+	}
+	signV4(req, b.creds, payloadHash, time.Now())
+	return req, nil
+}
+
+// do sends req, returning an error for responses other than 2xx.
+func (b *S3) do(req *http.Request, name string) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	return nil, responseError(req, resp, name)
+}
+
+// responseError closes the unsuccessful resp and returns the error it
+// describes.
+func responseError(req *http.Request, resp *http.Response, name string) error {
+	defer resp.Body.Close()
+
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, &s3Err)
+	if resp.StatusCode == http.StatusNotFound && s3Err.Code != "NoSuchBucket" {
+		return fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+	}
+	return fmt.Errorf("%s %s: %s: %s %s", req.Method, name, resp.Status, s3Err.Code, s3Err.Message)
+}
+
+// Put uploads the object in a single request. Readers which are not seekable
+// are buffered in memory to learn their size.
+func (b *S3) Put(ctx context.Context, name string, r io.Reader) error {
+	size, err := readerSize(r)
+	if err != nil {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("putting %s: %w", name, err)
+		}
+		r, size = bytes.NewReader(buf), int64(len(buf))
+	}
+
+	req, err := b.newRequest(ctx, http.MethodPut, name, nil, io.NopCloser(r), size, nil)
+	if err != nil {
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+	resp, err := b.do(req, name)
+	if err != nil {
+		return fmt.Errorf("putting %s: %w", name, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// readerSize returns the number of bytes left to read from r if it is
+// seekable.
+func readerSize(r io.Reader) (int64, error) {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("reader is not seekable")
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+func (b *S3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.GetRange(ctx, name, 0, -1)
+}
+
+func (b *S3) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("offset %d: %w", off, ErrInvalidRange)
+	}
+	header := http.Header{}
+	switch {
+	case length < 0 && off > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	case length == 0:
+		// An empty range cannot be requested, so a single byte is, to
+		// learn whether the object exists.
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off))
+	}
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, nil, nil, 0, header)
+	if err != nil {
+		return nil, fmt.Errorf("getting %s: %w", name, err)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting %s: %w", name, err)
+	}
+	// A range starting beyond the end of the object is not satisfiable,
+	// which is read as the object ending first.
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if resp.StatusCode/100 != 2 {
+		err := responseError(req, resp, name)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("getting %s: %w", name, err)
+	}
+	if length == 0 {
+		return &limitedReadCloser{Reader: io.LimitReader(resp.Body, 0), Closer: resp.Body}, nil
+	}
+	return resp.Body, nil
+}
+
+func (b *S3) Size(ctx context.Context, name string) (int64, error) {
+	req, err := b.newRequest(ctx, http.MethodHead, name, nil, nil, 0, nil)
+	if err != nil {
+		return 0, fmt.Errorf("getting size of %s: %w", name, err)
+	}
+	resp, err := b.do(req, name)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("getting size of %s: %w", name, err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("getting size of %s: no Content-Length in response", name)
+	}
+	return resp.ContentLength, nil
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		names []string
+		token string
+	)
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := b.newRequest(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, fmt.Errorf("listing %q: %w", prefix, err)
+		}
+		resp, err := b.do(req, b.bucket)
+		if err != nil {
+			return nil, fmt.Errorf("listing %q: %w", prefix, err)
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing %q: decoding response: %w", prefix, err)
+		}
+
+		for _, c := range res.Contents {
+			names = append(names, c.Key)
+		}
+		if !res.IsTruncated {
+			// Keys are listed in UTF-8 binary order, i.e. sorted.
+			return names, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (b *S3) Delete(ctx context.Context, name string) error {
+	req, err := b.newRequest(ctx, http.MethodDelete, name, nil, nil, 0, nil)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	resp, err := b.do(req, name)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
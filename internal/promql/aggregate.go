@@ -0,0 +1,238 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// group is a group of samples aggregated together.
+type group struct {
+	metric  Labels
+	samples []Sample
+}
+
+func (ev *evaluator) evalAggregate(e *parser.AggregateExpr, ts int64) (Value, error) {
+	vec, err := ev.evalVector(e.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	var param Value
+	if e.Param != nil {
+		if param, err = ev.eval(e.Param, ts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Native histograms are summed and averaged, and counted, but left out
+	// of other aggregations.
+	switch e.Op {
+	case parser.AggrSum, parser.AggrAvg, parser.AggrCount, parser.AggrGroup:
+	default:
+		vec = floatSamples(vec)
+	}
+
+	if e.Op == parser.AggrCountValues {
+		label := param.(String).V
+		if !isLabelName(label) {
+			return nil, fmt.Errorf("count_values label %q: %w", label, ErrInvalidExpression)
+		}
+		// Samples are grouped by their value as well.
+		withValues := make(Vector, 0, len(vec))
+		for _, s := range vec {
+			withValues = append(withValues, Sample{Metric: s.Metric.Set(label, formatFloat(s.F)), T: s.T, F: s.F})
+		}
+		vec = withValues
+		if !e.Without {
+			e = &parser.AggregateExpr{Op: e.Op, Expr: e.Expr, Grouping: append([]string{label}, e.Grouping...)}
+		}
+	}
+
+	var res Vector
+	for _, g := range groupSamples(vec, e) {
+		switch e.Op {
+		case parser.AggrTopK, parser.AggrBottomK:
+			res = append(res, topK(g.samples, param.(Scalar).V, e.Op == parser.AggrTopK, ts)...)
+		case parser.AggrQuantile:
+			values := make([]float64, 0, len(g.samples))
+			for _, s := range g.samples {
+				values = append(values, s.F)
+			}
+			res = append(res, Sample{Metric: g.metric, T: ts, F: quantile(param.(Scalar).V, values)})
+		case parser.AggrSum, parser.AggrAvg:
+			if h, ok := aggregateHistograms(e.Op, g.samples); ok {
+				if h != nil {
+					res = append(res, Sample{Metric: g.metric, T: ts, H: h})
+				}
+				continue
+			}
+			res = append(res, Sample{Metric: g.metric, T: ts, F: aggregate(e.Op, g.samples)})
+		default:
+			res = append(res, Sample{Metric: g.metric, T: ts, F: aggregate(e.Op, g.samples)})
+		}
+	}
+	return res, nil
+}
+
+// groupSamples groups the samples of vec by the grouping of e, in the order
+// groups are first seen.
+func groupSamples(vec Vector, e *parser.AggregateExpr) []*group {
+	var groups []*group
+	byKey := map[string]*group{}
+	for _, s := range vec {
+		var metric Labels
+		if e.Without {
+			metric = s.Metric.Without(append([]string{metrics.MetricNameLabel}, e.Grouping...)...)
+		} else {
+			metric = s.Metric.Keep(e.Grouping...)
+		}
+		key := metric.String()
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{metric: metric}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.samples = append(g.samples, s)
+	}
+	return groups
+}
+
+// aggregate returns the aggregate op of samples.
+func aggregate(op parser.AggregateOp, samples []Sample) float64 {
+	switch op {
+	case parser.AggrSum:
+		var sum float64
+		for _, s := range samples {
+			sum += s.F
+		}
+		return sum
+	case parser.AggrAvg:
+		var sum float64
+		for _, s := range samples {
+			sum += s.F
+		}
+		return sum / float64(len(samples))
+	case parser.AggrCount, parser.AggrCountValues:
+		return float64(len(samples))
+	case parser.AggrGroup:
+		return 1
+	case parser.AggrMin, parser.AggrMax:
+		// NaN is only returned if every value is NaN.
+		res := math.NaN()
+		for _, s := range samples {
+			if math.IsNaN(res) || op == parser.AggrMin && s.F < res || op == parser.AggrMax && s.F > res {
+				res = s.F
+			}
+		}
+		return res
+	case parser.AggrStddev, parser.AggrStdvar:
+		var sum float64
+		for _, s := range samples {
+			sum += s.F
+		}
+		mean := sum / float64(len(samples))
+		var variance float64
+		for _, s := range samples {
+			variance += (s.F - mean) * (s.F - mean)
+		}
+		variance /= float64(len(samples))
+		if op == parser.AggrStddev {
+			return math.Sqrt(variance)
+		}
+		return variance
+	}
+	panic(fmt.Sprintf("promql: invalid aggregation %q", op))
+}
+
+// aggregateHistograms returns the sum or average of samples if any are
+// native histograms, and false otherwise. Groups mixing native histograms
+// and floats have no sum or average, and a nil histogram is returned.
+func aggregateHistograms(op parser.AggregateOp, samples []Sample) (*metrics.Histogram, bool) {
+	var sum *metrics.Histogram
+	for _, s := range samples {
+		switch {
+		case s.H == nil:
+			continue
+		case sum == nil:
+			sum = s.H
+		default:
+			sum = sum.Add(s.H)
+		}
+	}
+	if sum == nil {
+		return nil, false
+	}
+	for _, s := range samples {
+		if s.H == nil {
+			return nil, true
+		}
+	}
+	if op == parser.AggrAvg {
+		sum = sum.Mul(1 / float64(len(samples)))
+	}
+	return sum, true
+}
+
+// topK returns the k largest samples, or the k smallest if !largest, largest
+// or smallest first. NaN values come last.
+func topK(samples []Sample, k float64, largest bool, ts int64) Vector {
+	if k < 1 || math.IsNaN(k) {
+		return nil
+	}
+	sorted := append(Vector(nil), samples...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].F, sorted[j].F
+		if math.IsNaN(b) {
+			return !math.IsNaN(a)
+		}
+		if largest {
+			return a > b
+		}
+		return a < b
+	})
+	if k < float64(len(sorted)) {
+		sorted = sorted[:int(k)]
+	}
+	for i := range sorted {
+		sorted[i].T = ts
+	}
+	return sorted
+}
+
+// quantile returns the φ-quantile of values, interpolating linearly between
+// the values either side of it. φ below 0 returns -Inf, and above 1 +Inf.
+func quantile(φ float64, values []float64) float64 {
+	switch {
+	case len(values) == 0 || math.IsNaN(φ):
+		return math.NaN()
+	case φ < 0:
+		return math.Inf(-1)
+	case φ > 1:
+		return math.Inf(1)
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := φ * float64(len(sorted)-1)
+	lower := math.Floor(rank)
+	upper := math.Min(lower+1, float64(len(sorted)-1))
+	weight := rank - lower
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
+
+// isLabelName reports whether s is a valid label name.
+func isLabelName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
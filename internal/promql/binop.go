@@ -0,0 +1,276 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+func (ev *evaluator) evalBinary(e *parser.BinaryExpr, ts int64) (Value, error) {
+	lhs, err := ev.eval(e.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(e.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			v, keep := binop(e.Op, l.V, r.V)
+			if e.Op.IsComparison() {
+				v = boolValue(keep)
+			}
+			return Scalar{T: ts, V: v}, nil
+		case Vector:
+			return vectorScalarBinop(e, r, l.V, true, ts), nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			return vectorScalarBinop(e, l, r.V, false, ts), nil
+		case Vector:
+			switch e.Op {
+			case parser.OpAnd:
+				return vectorAnd(l, r, e.VectorMatching, ts), nil
+			case parser.OpOr:
+				return vectorOr(l, r, e.VectorMatching, ts), nil
+			case parser.OpUnless:
+				return vectorUnless(l, r, e.VectorMatching, ts), nil
+			}
+			return vectorBinop(e, l, r, ts)
+		}
+	}
+	return nil, fmt.Errorf("binary expression between %s and %s: %w", lhs.Type(), rhs.Type(), ErrInvalidExpression)
+}
+
+// binop applies op to l and r. For comparisons, keep reports whether the
+// comparison holds and v is l; otherwise keep is true.
+func binop(op parser.Operator, l, r float64) (v float64, keep bool) {
+	switch op {
+	case parser.OpAdd:
+		return l + r, true
+	case parser.OpSub:
+		return l - r, true
+	case parser.OpMul:
+		return l * r, true
+	case parser.OpDiv:
+		return l / r, true
+	case parser.OpMod:
+		return math.Mod(l, r), true
+	case parser.OpPow:
+		return math.Pow(l, r), true
+	case parser.OpAtan2:
+		return math.Atan2(l, r), true
+	case parser.OpEql:
+		return l, l == r
+	case parser.OpNeq:
+		return l, l != r
+	case parser.OpLss:
+		return l, l < r
+	case parser.OpLte:
+		return l, l <= r
+	case parser.OpGtr:
+		return l, l > r
+	case parser.OpGte:
+		return l, l >= r
+	}
+	panic(fmt.Sprintf("promql: invalid binary operator %q", op))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// dropsMetricName reports whether the result of the binary operation e no
+// longer has the metric name of its operands: that of arithmetic, and of
+// comparisons returning bool.
+func dropsMetricName(e *parser.BinaryExpr) bool {
+	return !e.Op.IsComparison() || e.ReturnBool
+}
+
+// vectorScalarBinop applies e between each sample of vec and s, with s on
+// the left if swap is set. Comparisons filter by, or return, whether they
+// hold, keeping the value of the vector's sample.
+func vectorScalarBinop(e *parser.BinaryExpr, vec Vector, s float64, swap bool, ts int64) Vector {
+	res := make(Vector, 0, len(vec))
+	for _, sample := range floatSamples(vec) {
+		l, r := sample.F, s
+		if swap {
+			l, r = r, l
+		}
+		v, keep := binop(e.Op, l, r)
+		switch {
+		case e.Op.IsComparison() && e.ReturnBool:
+			v = boolValue(keep)
+		case e.Op.IsComparison() && !keep:
+			continue
+		case e.Op.IsComparison():
+			v = sample.F
+		}
+		metric := sample.Metric
+		if dropsMetricName(e) {
+			metric = dropMetricName(metric)
+		}
+		res = append(res, Sample{Metric: metric, T: ts, F: v})
+	}
+	return res
+}
+
+// signature returns the key series are matched by: their labels named by
+// vm if it matches on labels, otherwise their labels other than those and
+// the metric name.
+func signature(ls Labels, vm *parser.VectorMatching) string {
+	if vm.On {
+		return ls.Keep(vm.MatchingLabels...).String()
+	}
+	return ls.Without(append([]string{metrics.MetricNameLabel}, vm.MatchingLabels...)...).String()
+}
+
+// vectorBinop applies e between the samples of lhs and rhs matched by its
+// vector matching.
+func vectorBinop(e *parser.BinaryExpr, lhs, rhs Vector, ts int64) (Vector, error) {
+	vm := e.VectorMatching
+	// The "one" side of the match is indexed, and the "many" side, or the
+	// left for one-to-one matches, looked up in it.
+	one, many := rhs, lhs
+	if vm.Card == parser.CardOneToMany {
+		one, many = lhs, rhs
+	}
+	one, many = floatSamples(one), floatSamples(many)
+	oneBySig := make(map[string]Sample, len(one))
+	for _, s := range one {
+		sig := signature(s.Metric, vm)
+		if dup, ok := oneBySig[sig]; ok {
+			return nil, fmt.Errorf("%w: found duplicate series for the match group %s on the %s side: %s and %s",
+				ErrMatchConflict, sig, oneSide(vm), dup.Metric, s.Metric)
+		}
+		oneBySig[sig] = s
+	}
+
+	// matched records, for one-to-one matches, which series of the "one"
+	// side were matched, and otherwise the result series produced.
+	matched := map[string]Labels{}
+	var res Vector
+	for _, ms := range many {
+		sig := signature(ms.Metric, vm)
+		os, ok := oneBySig[sig]
+		if !ok {
+			continue
+		}
+		l, r := ms, os
+		if vm.Card == parser.CardOneToMany {
+			l, r = os, ms
+		}
+		v, keep := binop(e.Op, l.F, r.F)
+		switch {
+		case e.ReturnBool:
+			v = boolValue(keep)
+		case !keep:
+			continue
+		}
+
+		metric := resultMetric(e, ms.Metric, os.Metric)
+		if vm.Card == parser.CardOneToOne {
+			if prev, ok := matched[sig]; ok {
+				return nil, fmt.Errorf("%w: multiple matches for labels %s: %s and %s, many-to-one matching must be explicit (group_left/group_right)",
+					ErrMatchConflict, sig, prev, ms.Metric)
+			}
+			matched[sig] = ms.Metric
+		} else {
+			key := metric.String()
+			if prev, ok := matched[key]; ok {
+				return nil, fmt.Errorf("%w: multiple matches for labels %s: %s and %s, grouping labels must ensure unique matches",
+					ErrMatchConflict, key, prev, ms.Metric)
+			}
+			matched[key] = ms.Metric
+		}
+		res = append(res, Sample{Metric: metric, T: ts, F: v})
+	}
+	return res, nil
+}
+
+func oneSide(vm *parser.VectorMatching) string {
+	if vm.Card == parser.CardOneToMany {
+		return "left"
+	}
+	return "right"
+}
+
+// resultMetric returns the labels of the result of matching the sample of
+// the "many" side with labels many to that of the "one" side with labels
+// one.
+func resultMetric(e *parser.BinaryExpr, many, one Labels) Labels {
+	vm := e.VectorMatching
+	metric := many
+	if dropsMetricName(e) {
+		metric = dropMetricName(metric)
+	}
+	if vm.Card == parser.CardOneToOne {
+		if vm.On {
+			return metric.Keep(vm.MatchingLabels...)
+		}
+		return metric.Without(vm.MatchingLabels...)
+	}
+	for _, name := range vm.Include {
+		metric = metric.Set(name, one.Get(name))
+	}
+	return metric
+}
+
+// setSignatures returns the signatures of the samples of vec.
+func setSignatures(vec Vector, vm *parser.VectorMatching) map[string]struct{} {
+	sigs := make(map[string]struct{}, len(vec))
+	for _, s := range vec {
+		sigs[signature(s.Metric, vm)] = struct{}{}
+	}
+	return sigs
+}
+
+// vectorAnd returns the samples of lhs matching a sample of rhs.
+func vectorAnd(lhs, rhs Vector, vm *parser.VectorMatching, ts int64) Vector {
+	sigs := setSignatures(rhs, vm)
+	var res Vector
+	for _, s := range lhs {
+		if _, ok := sigs[signature(s.Metric, vm)]; ok {
+			res = append(res, Sample{Metric: s.Metric, T: ts, F: s.F, H: s.H})
+		}
+	}
+	return res
+}
+
+// vectorOr returns the samples of lhs, and those of rhs matching no sample
+// of lhs.
+func vectorOr(lhs, rhs Vector, vm *parser.VectorMatching, ts int64) Vector {
+	sigs := setSignatures(lhs, vm)
+	res := make(Vector, 0, len(lhs)+len(rhs))
+	for _, s := range lhs {
+		res = append(res, Sample{Metric: s.Metric, T: ts, F: s.F, H: s.H})
+	}
+	for _, s := range rhs {
+		if _, ok := sigs[signature(s.Metric, vm)]; !ok {
+			res = append(res, Sample{Metric: s.Metric, T: ts, F: s.F, H: s.H})
+		}
+	}
+	return res
+}
+
+// vectorUnless returns the samples of lhs matching no sample of rhs.
+func vectorUnless(lhs, rhs Vector, vm *parser.VectorMatching, ts int64) Vector {
+	sigs := setSignatures(rhs, vm)
+	var res Vector
+	for _, s := range lhs {
+		if _, ok := sigs[signature(s.Metric, vm)]; !ok {
+			res = append(res, Sample{Metric: s.Metric, T: ts, F: s.F, H: s.H})
+		}
+	}
+	return res
+}
@@ -0,0 +1,450 @@
+// Package promql evaluates queries parsed by the parser package over the
+// series of a store.
+package promql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// DefaultLookbackDelta is how far, in seconds, back from the evaluation time
+// a vector selector looks for the latest sample of a series by default.
+const DefaultLookbackDelta = 5 * 60
+
+// Queryable provides Queriers over stored series.
+type Queryable interface {
+	Querier() (metrics.Querier, error)
+}
+
+// DownsampledQueryable is a Queryable which also holds series downsampled to
+// coarser resolutions, such as a store. Range queries over it read each block
+// at the coarsest resolution suited to their range and step.
+type DownsampledQueryable interface {
+	Queryable
+	QuerierFor(mint, maxt int64, opts store.QueryOptions) (metrics.Querier, error)
+}
+
+// QueryOptions configures a range query.
+type QueryOptions struct {
+	// Raw forces raw samples to be read, even where the queryable holds
+	// series downsampled to a resolution suited to the query.
+	Raw bool
+}
+
+// Options configures an Engine.
+type Options struct {
+	// LookbackDelta is how far, in seconds, back from the evaluation time a
+	// vector selector looks for the latest sample of a series. Series
+	// without a sample that recent are stale and left out. Defaults to
+	// DefaultLookbackDelta.
+	LookbackDelta int64
+}
+
+// Engine evaluates queries. Timestamps and durations are in seconds.
+type Engine struct {
+	lookbackDelta int64
+}
+
+// NewEngine returns an Engine configured by opts.
+func NewEngine(opts Options) *Engine {
+	if opts.LookbackDelta <= 0 {
+		opts.LookbackDelta = DefaultLookbackDelta
+	}
+	return &Engine{lookbackDelta: opts.LookbackDelta}
+}
+
+// InstantQuery evaluates the query at ts. Parse errors are returned as
+// *parser.ParseError.
+func (ng *Engine) InstantQuery(ctx context.Context, q Queryable, query string, ts int64) (Value, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	querier, err := q.Querier()
+	if err != nil {
+		return nil, fmt.Errorf("opening querier: %w", err)
+	}
+	defer querier.Close()
+
+	ev, err := ng.newEvaluator(ctx, querier, expr, ts, ts)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ev.eval(expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	if vec, ok := v.(Vector); ok {
+		if err := checkUnique(vec); err != nil {
+			return nil, err
+		}
+		if !isOrdered(expr) {
+			sort.Slice(vec, func(i, j int) bool { return vec[i].Metric.Compare(vec[j].Metric) < 0 })
+		}
+	}
+	return v, nil
+}
+
+// RangeQuery evaluates the query at every step from start to end, returning
+// the samples of each series at the times it had one. Series are read
+// downsampled if q holds them at a resolution suited to the query, unless
+// opts force raw samples. Parse errors are returned as *parser.ParseError.
+func (ng *Engine) RangeQuery(ctx context.Context, q Queryable, query string, start, end, step int64, opts QueryOptions) (Matrix, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step %d: %w", step, ErrInvalidQueryRange)
+	}
+	if end < start {
+		return nil, fmt.Errorf("end %d before start %d: %w", end, start, ErrInvalidQueryRange)
+	}
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	if t := expr.Type(); t != parser.ValueTypeScalar && t != parser.ValueTypeVector {
+		return nil, fmt.Errorf("range query of type %s, must be scalar or vector: %w", t, ErrInvalidExpression)
+	}
+	querier, err := rangeQuerier(q, start, end, step, opts)
+	if err != nil {
+		return nil, fmt.Errorf("opening querier: %w", err)
+	}
+	defer querier.Close()
+
+	ev, err := ng.newEvaluator(ctx, querier, expr, start, end)
+	if err != nil {
+		return nil, err
+	}
+	series := map[string]*Series{}
+	for ts := start; ts <= end; ts += step {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("evaluating query: %w", err)
+		}
+		v, err := ev.eval(expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		vec, ok := v.(Vector)
+		if s, isScalar := v.(Scalar); isScalar {
+			vec, ok = Vector{{T: ts, F: s.V}}, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("range query of type %s: %w", v.Type(), ErrInvalidExpression)
+		}
+		if err := checkUnique(vec); err != nil {
+			return nil, err
+		}
+		for _, s := range vec {
+			key := s.Metric.String()
+			if series[key] == nil {
+				series[key] = &Series{Metric: s.Metric}
+			}
+			series[key].Points = append(series[key].Points, Point{T: ts, F: s.F, H: s.H})
+		}
+	}
+
+	m := make(Matrix, 0, len(series))
+	for _, s := range series {
+		m = append(m, *s)
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].Metric.Compare(m[j].Metric) < 0 })
+	return m, nil
+}
+
+// newEvaluator returns an evaluator of expr from start to end, selecting
+// the series of its selectors from q.
+// rangeQuerier returns a Querier of q for a range query over [start, end]
+// evaluated every step seconds.
+func rangeQuerier(q Queryable, start, end, step int64, opts QueryOptions) (metrics.Querier, error) {
+	if dq, ok := q.(DownsampledQueryable); ok {
+		return dq.QuerierFor(start, end, store.QueryOptions{Step: step, Raw: opts.Raw})
+	}
+	return q.Querier()
+}
+
+func (ng *Engine) newEvaluator(ctx context.Context, q metrics.Querier, expr parser.Expr, start, end int64) (*evaluator, error) {
+	ev := &evaluator{
+		ctx:           ctx,
+		lookbackDelta: ng.lookbackDelta,
+		series:        map[*parser.VectorSelector][]storedSeries{},
+	}
+	if err := ev.load(q, expr, start, end); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// isOrdered reports whether the result of expr is in an order of its own,
+// which is kept: that of sort, sort_desc, topk and bottomk.
+func isOrdered(expr parser.Expr) bool {
+	for {
+		switch e := expr.(type) {
+		case *parser.ParenExpr:
+			expr = e.Expr
+		case *parser.Call:
+			return e.Func.Name == "sort" || e.Func.Name == "sort_desc"
+		case *parser.AggregateExpr:
+			return e.Op == parser.AggrTopK || e.Op == parser.AggrBottomK
+		default:
+			return false
+		}
+	}
+}
+
+// checkUnique returns an error if two samples of vec have the same labels.
+func checkUnique(vec Vector) error {
+	seen := make(map[string]struct{}, len(vec))
+	for _, s := range vec {
+		key := s.Metric.String()
+		if _, ok := seen[key]; ok {
+			return fmt.Errorf("%w: %s", ErrDuplicateSeries, key)
+		}
+		seen[key] = struct{}{}
+	}
+	return nil
+}
+
+// storedSeries holds the samples of a series selected by a query.
+type storedSeries struct {
+	metric Labels
+	points []Point
+}
+
+// evaluator evaluates an expression at given times over the series its
+// selectors selected.
+type evaluator struct {
+	ctx           context.Context
+	lookbackDelta int64
+	series        map[*parser.VectorSelector][]storedSeries
+}
+
+// seconds converts a duration of a query to seconds.
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// load selects the series of every selector in expr, with the samples
+// needed to evaluate it from start to end.
+func (ev *evaluator) load(q metrics.Querier, expr parser.Expr, start, end int64) error {
+	var err error
+	walk(expr, func(e parser.Expr) {
+		if err != nil {
+			return
+		}
+		var (
+			vs     *parser.VectorSelector
+			window int64
+		)
+		switch e := e.(type) {
+		case *parser.MatrixSelector:
+			vs, window = e.VectorSelector, seconds(e.Range)
+		case *parser.VectorSelector:
+			if _, ok := ev.series[e]; ok {
+				// Already loaded as part of a matrix selector.
+				return
+			}
+			vs, window = e, ev.lookbackDelta
+		default:
+			return
+		}
+		offset := seconds(vs.Offset)
+		err = ev.selectSeries(q, vs, start-offset-window+1, end-offset)
+	})
+	return err
+}
+
+func (ev *evaluator) selectSeries(q metrics.Querier, vs *parser.VectorSelector, mint, maxt int64) error {
+	set := q.Select(mint, maxt, vs.LabelMatchers...)
+	var series []storedSeries
+	for set.Next() {
+		if err := ev.ctx.Err(); err != nil {
+			return fmt.Errorf("selecting series: %w", err)
+		}
+		s := set.At()
+		ss := storedSeries{metric: LabelsFromMap(metrics.LabelsWithName(s))}
+		it := s.Iterator()
+		for it.Next() {
+			sample := it.At()
+			ss.points = append(ss.points, Point{T: sample.Time, F: sample.Value, H: sample.Histogram})
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("selecting series: %w", err)
+		}
+		series = append(series, ss)
+	}
+	if err := set.Err(); err != nil {
+		return fmt.Errorf("selecting series: %w", err)
+	}
+	ev.series[vs] = series
+	return nil
+}
+
+// walk calls f for e and every expression within it, parents first.
+func walk(e parser.Expr, f func(parser.Expr)) {
+	f(e)
+	switch e := e.(type) {
+	case *parser.MatrixSelector:
+		walk(e.VectorSelector, f)
+	case *parser.ParenExpr:
+		walk(e.Expr, f)
+	case *parser.UnaryExpr:
+		walk(e.Expr, f)
+	case *parser.BinaryExpr:
+		walk(e.LHS, f)
+		walk(e.RHS, f)
+	case *parser.AggregateExpr:
+		if e.Param != nil {
+			walk(e.Param, f)
+		}
+		walk(e.Expr, f)
+	case *parser.Call:
+		for _, arg := range e.Args {
+			walk(arg, f)
+		}
+	}
+}
+
+// eval evaluates e at ts.
+func (ev *evaluator) eval(e parser.Expr, ts int64) (Value, error) {
+	switch e := e.(type) {
+	case *parser.NumberLiteral:
+		return Scalar{T: ts, V: e.Val}, nil
+	case *parser.StringLiteral:
+		return String{T: ts, V: e.Val}, nil
+	case *parser.ParenExpr:
+		return ev.eval(e.Expr, ts)
+	case *parser.VectorSelector:
+		vec := ev.selectVector(e, ts)
+		for i := range vec {
+			vec[i].T = ts
+		}
+		return vec, nil
+	case *parser.MatrixSelector:
+		return ev.selectMatrix(e, ts), nil
+	case *parser.UnaryExpr:
+		return ev.evalUnary(e, ts)
+	case *parser.BinaryExpr:
+		return ev.evalBinary(e, ts)
+	case *parser.AggregateExpr:
+		return ev.evalAggregate(e, ts)
+	case *parser.Call:
+		f, ok := functions[e.Func.Name]
+		if !ok {
+			return nil, fmt.Errorf("function %q: %w", e.Func.Name, ErrUnsupported)
+		}
+		return f(ev, e, ts)
+	}
+	return nil, fmt.Errorf("expression %T: %w", e, ErrUnsupported)
+}
+
+// evalVector evaluates e, which must be of type vector, at ts.
+func (ev *evaluator) evalVector(e parser.Expr, ts int64) (Vector, error) {
+	v, err := ev.eval(e, ts)
+	if err != nil {
+		return nil, err
+	}
+	return v.(Vector), nil
+}
+
+// evalScalar evaluates e, which must be of type scalar, at ts.
+func (ev *evaluator) evalScalar(e parser.Expr, ts int64) (float64, error) {
+	v, err := ev.eval(e, ts)
+	if err != nil {
+		return 0, err
+	}
+	return v.(Scalar).V, nil
+}
+
+// selectVector returns the latest sample within the lookback delta of ts of
+// each series selected by vs, at the time of the sample.
+func (ev *evaluator) selectVector(vs *parser.VectorSelector, ts int64) Vector {
+	t := ts - seconds(vs.Offset)
+	var vec Vector
+	for _, s := range ev.series[vs] {
+		i := sort.Search(len(s.points), func(i int) bool { return s.points[i].T > t }) - 1
+		if i < 0 || s.points[i].T <= t-ev.lookbackDelta || isStale(s.points[i]) {
+			continue
+		}
+		vec = append(vec, Sample{Metric: s.metric, T: s.points[i].T, F: s.points[i].F, H: s.points[i].H})
+	}
+	return vec
+}
+
+// selectMatrix returns the samples within the range of ms before ts of each
+// series it selects.
+func (ev *evaluator) selectMatrix(ms *parser.MatrixSelector, ts int64) Matrix {
+	t := ts - seconds(ms.VectorSelector.Offset)
+	mint := t - seconds(ms.Range)
+	var m Matrix
+	for _, s := range ev.series[ms.VectorSelector] {
+		lo := sort.Search(len(s.points), func(i int) bool { return s.points[i].T > mint })
+		hi := sort.Search(len(s.points), func(i int) bool { return s.points[i].T > t })
+		if points := withoutStaleMarkers(s.points[lo:hi]); len(points) > 0 {
+			m = append(m, Series{Metric: s.metric, Points: points})
+		}
+	}
+	return m
+}
+
+// isStale reports whether p is a staleness marker, ending its series.
+func isStale(p Point) bool {
+	return p.H == nil && metrics.IsStaleNaN(p.F)
+}
+
+// withoutStaleMarkers returns the points which are not staleness markers.
+func withoutStaleMarkers(points []Point) []Point {
+	stale := 0
+	for _, p := range points {
+		if isStale(p) {
+			stale++
+		}
+	}
+	if stale == 0 {
+		return points
+	}
+	res := make([]Point, 0, len(points)-stale)
+	for _, p := range points {
+		if !isStale(p) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func (ev *evaluator) evalUnary(e *parser.UnaryExpr, ts int64) (Value, error) {
+	v, err := ev.eval(e.Expr, ts)
+	if err != nil || e.Op == parser.OpAdd {
+		return v, err
+	}
+	switch v := v.(type) {
+	case Scalar:
+		return Scalar{T: ts, V: -v.V}, nil
+	case Vector:
+		res := make(Vector, 0, len(v))
+		for _, s := range floatSamples(v) {
+			res = append(res, Sample{Metric: dropMetricName(s.Metric), T: ts, F: -s.F})
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unary expression of type %s: %w", v.Type(), ErrInvalidExpression)
+}
+
+func dropMetricName(ls Labels) Labels {
+	return ls.Without(metrics.MetricNameLabel)
+}
+
+// floatSamples returns the samples of vec which are not native histograms,
+// the only samples arithmetic is defined for.
+func floatSamples(vec Vector) Vector {
+	res := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		if s.H == nil {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,542 @@
+package promql
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test_Golden runs the scripts of testdata/*.test. Each script loads
+// synthetic series into a store and evaluates queries over them:
+//
+//	load <step>
+//	  <series> <values>...
+//
+//	eval[_ordered] instant at <time> <query>
+//	  <series> <value>
+//
+//	eval range from <start> to <end> step <step> <query>
+//	  <series> <values>...
+//
+//	eval_fail instant at <time> <query>
+//
+// Values are numbers, _ for a missing sample, or a+bxn for the n+1 values
+// from a in steps of b. Loaded series have a sample every step from time 0.
+// Expected samples are compared regardless of order unless eval_ordered.
+func Test_Golden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.test")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			runScript(t, file)
+		})
+	}
+}
+
+func Test_QueryCancelled(t *testing.T) {
+	ims := openStore(t)
+	loadSeries(t, ims, 10, []string{`up{job="a"} 1+1x10`})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ng := NewEngine(Options{})
+	_, err := ng.RangeQuery(ctx, ims, "up", 0, 100, 10, QueryOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = ng.InstantQuery(ctx, ims, "up", 100)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_RangeQueryErrors(t *testing.T) {
+	ims := openStore(t)
+	ng := NewEngine(Options{})
+
+	tcs := []struct {
+		desc             string
+		query            string
+		start, end, step int64
+		expected         error
+	}{
+		{desc: "[NEGATIVE] zero step", query: "up", start: 0, end: 10, expected: ErrInvalidQueryRange},
+		{desc: "[NEGATIVE] end before start", query: "up", start: 10, end: 0, step: 1, expected: ErrInvalidQueryRange},
+		{desc: "[NEGATIVE] matrix query", query: "up[5m]", start: 0, end: 10, step: 1, expected: ErrInvalidExpression},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := ng.RangeQuery(context.Background(), ims, tc.query, tc.start, tc.end, tc.step, QueryOptions{})
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+
+	_, err := ng.RangeQuery(context.Background(), ims, "up{", 0, 10, 1, QueryOptions{})
+	var pe *parser.ParseError
+	assert.ErrorAs(t, err, &pe)
+}
+
+func Test_FunctionsImplemented(t *testing.T) {
+	for name := range parser.Functions {
+		assert.Contains(t, functions, name)
+	}
+}
+
+func Test_NativeHistograms(t *testing.T) {
+	type Test struct {
+		desc     string
+		query    string
+		expected map[string]float64
+	}
+
+	tests := []Test{
+		{
+			desc:     "[POSITIVE] count and sum",
+			query:    `histogram_count(http_request_duration_seconds) + histogram_sum(http_request_duration_seconds) / 1000`,
+			expected: map[string]float64{`{instance="0", job="api"}`: 40.06, `{instance="1", job="api"}`: 20.03},
+		},
+		{
+			desc:     "[POSITIVE] quantile interpolated within its bucket",
+			query:    `histogram_quantile(0.5, http_request_duration_seconds{instance="0"})`,
+			expected: map[string]float64{`{instance="0", job="api"}`: 1.5},
+		},
+		{
+			desc:     "[POSITIVE] fraction",
+			query:    `histogram_fraction(0, 1, http_request_duration_seconds{instance="0"})`,
+			expected: map[string]float64{`{instance="0", job="api"}`: 0.25},
+		},
+		{
+			desc:     "[POSITIVE] quantile of a rate",
+			query:    `histogram_quantile(0.5, rate(http_request_duration_seconds{instance="0"}[5m]))`,
+			expected: map[string]float64{`{instance="0", job="api"}`: 1.5},
+		},
+		{
+			desc:     "[POSITIVE] rate",
+			query:    `histogram_count(rate(http_request_duration_seconds{instance="0"}[5m]))`,
+			expected: map[string]float64{`{instance="0", job="api"}`: 4.0 / 60},
+		},
+		{
+			desc:     "[POSITIVE] sum of histograms of different schemas",
+			query:    `histogram_quantile(0.25, sum(http_request_duration_seconds))`,
+			expected: map[string]float64{`{}`: 1.125},
+		},
+		{
+			desc:     "[POSITIVE] average",
+			query:    `histogram_count(avg by (job) (http_request_duration_seconds))`,
+			expected: map[string]float64{`{job="api"}`: 30},
+		},
+		{
+			desc:     "[POSITIVE] histograms are counted",
+			query:    `count(http_request_duration_seconds)`,
+			expected: map[string]float64{`{}`: 2},
+		},
+		{
+			desc:     "[POSITIVE] increase across a counter reset",
+			query:    `histogram_count(increase(resetting_histogram[5m]))`,
+			expected: map[string]float64{`{}`: 43.75},
+		},
+		{
+			desc:     "[NEGATIVE] no arithmetic on histograms",
+			query:    `http_request_duration_seconds * 2`,
+			expected: map[string]float64{},
+		},
+		{
+			desc:     "[NEGATIVE] no sum of histograms and floats",
+			query:    `sum(http_request_duration_seconds or vector(1))`,
+			expected: map[string]float64{},
+		},
+	}
+
+	ims := openStore(t)
+	var fast, slow, resetting []*metrics.Histogram
+	for i := 0.0; i <= 10; i++ {
+		// Buckets (0.5,1], (1,2] and (2,4].
+		fast = append(fast, &metrics.Histogram{
+			Count:           4 * i,
+			Sum:             6 * i,
+			PositiveSpans:   []metrics.Span{{Offset: 0, Length: 3}},
+			PositiveBuckets: []float64{i, 2 * i, i},
+		})
+		// Buckets (1,√2] and (√2,2].
+		slow = append(slow, &metrics.Histogram{
+			Schema:          1,
+			Count:           2 * i,
+			Sum:             3 * i,
+			PositiveSpans:   []metrics.Span{{Offset: 1, Length: 2}},
+			PositiveBuckets: []float64{i, i},
+		})
+	}
+	for _, c := range []float64{10, 20, 30, 5, 15} {
+		resetting = append(resetting, &metrics.Histogram{
+			Count:           c,
+			PositiveSpans:   []metrics.Span{{Offset: 0, Length: 1}},
+			PositiveBuckets: []float64{c},
+		})
+	}
+	loadHistograms(t, ims, "http_request_duration_seconds", map[string]string{"job": "api", "instance": "0"}, fast)
+	loadHistograms(t, ims, "http_request_duration_seconds", map[string]string{"job": "api", "instance": "1"}, slow)
+	loadHistograms(t, ims, "resetting_histogram", map[string]string{}, resetting)
+
+	ng := NewEngine(Options{})
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			ts := int64(600)
+			if strings.Contains(tc.query, "resetting") {
+				ts = 240
+			}
+			v, err := ng.InstantQuery(context.Background(), ims, tc.query, ts)
+			require.NoError(t, err)
+			vec := v.(Vector)
+			require.Len(t, vec, len(tc.expected))
+			for _, s := range vec {
+				expected, ok := tc.expected[s.Metric.String()]
+				require.True(t, ok, "unexpected series %s", s.Metric)
+				assertFloat(t, expected, s.F, tc.query)
+			}
+		})
+	}
+}
+
+// loadHistograms loads a series of native histograms, one a minute from
+// time 0.
+func loadHistograms(t *testing.T, ims *store.IMSImpl, name string, labelSet map[string]string, hs []*metrics.Histogram) {
+	t.Helper()
+	mf := metrics.NewMetricFamily(metrics.MetricDefinition{Name: name, Type: "histogram"})
+	for i, h := range hs {
+		mp := &metrics.MetricPoint{Name: name, LabelSet: labelSet, Time: int64(i) * 60, Histogram: h}
+		hash, err := metrics.HashMetric(mp)
+		require.NoError(t, err)
+		mp.Hash = hash
+		mf.HashedMetrics[hash] = append(mf.HashedMetrics[hash], mp)
+	}
+	mfs := metrics.NewMetricFamiliesTimeGroup()
+	require.NoError(t, mfs.AddMetricFamily(&mf))
+	require.NoError(t, ims.AddMetricFamiliesTimeGroup(mfs))
+}
+
+func openStore(t *testing.T) *store.IMSImpl {
+	t.Helper()
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	t.Cleanup(func() { ims.Close() })
+	return ims
+}
+
+// loadSeries adds the series described by lines, with samples every step.
+func loadSeries(t *testing.T, ims *store.IMSImpl, step int64, lines []string) {
+	t.Helper()
+	families := map[string]*metrics.MetricFamily{}
+	for _, line := range lines {
+		metric, values := parseSeries(t, line)
+		name := metric.Get(metrics.MetricNameLabel)
+		mf, ok := families[name]
+		if !ok {
+			f := metrics.NewMetricFamily(metrics.MetricDefinition{Name: name, Type: "gauge"})
+			mf = &f
+			families[name] = mf
+		}
+		var points []*metrics.MetricPoint
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			mp := &metrics.MetricPoint{Name: name, LabelSet: metric.Without(metrics.MetricNameLabel).Map(), Time: int64(i) * step, Value: *v}
+			hash, err := metrics.HashMetric(mp)
+			require.NoError(t, err)
+			mp.Hash = hash
+			points = append(points, mp)
+		}
+		if len(points) > 0 {
+			mf.HashedMetrics[points[0].Hash] = points
+		}
+	}
+	mfs := metrics.NewMetricFamiliesTimeGroup()
+	for _, mf := range families {
+		require.NoError(t, mfs.AddMetricFamily(mf))
+	}
+	require.NoError(t, ims.AddMetricFamiliesTimeGroup(mfs))
+}
+
+// parseSeries parses a series and its values, nil where missing.
+func parseSeries(t *testing.T, line string) (Labels, []*float64) {
+	t.Helper()
+	metric, rest := splitSeries(t, line)
+	var values []*float64
+	for _, field := range strings.Fields(rest) {
+		values = append(values, parseValues(t, field)...)
+	}
+	return metric, values
+}
+
+// splitSeries splits a line into the labels of the series it starts with
+// and the rest of the line.
+func splitSeries(t *testing.T, line string) (Labels, string) {
+	t.Helper()
+	end := strings.IndexAny(line, " \t")
+	if i := strings.LastIndex(line, "}"); i >= 0 {
+		end = i + 1
+	}
+	if end < 0 {
+		end = len(line)
+	}
+	selector, rest := line[:end], line[end:]
+	if selector == "{}" {
+		return nil, rest
+	}
+	matchers, err := parser.ParseMetricSelector(selector)
+	require.NoError(t, err, "parsing series %q", selector)
+	var metric Labels
+	for _, m := range matchers {
+		require.Equal(t, metrics.MatchEqual, m.Type, "series %q must only match for equality", selector)
+		metric = metric.Set(m.Name, m.Value)
+	}
+	return metric, rest
+}
+
+func parseValues(t *testing.T, field string) []*float64 {
+	t.Helper()
+	if field == "_" {
+		return []*float64{nil}
+	}
+	i := strings.LastIndex(field, "x")
+	if i < 0 {
+		v := parseFloat(t, field)
+		return []*float64{&v}
+	}
+	n, err := strconv.Atoi(field[i+1:])
+	require.NoError(t, err, "parsing %q", field)
+	expr := field[:i]
+	// The sign of the increment may be the first after the start's own.
+	j := strings.LastIndexAny(expr, "+-")
+	require.Positive(t, j, "parsing %q", field)
+	start, inc := parseFloat(t, expr[:j]), parseFloat(t, expr[j:])
+	var res []*float64
+	for k := 0; k <= n; k++ {
+		v := start + float64(k)*inc
+		res = append(res, &v)
+	}
+	return res
+}
+
+func parseFloat(t *testing.T, s string) float64 {
+	t.Helper()
+	v, err := strconv.ParseFloat(s, 64)
+	require.NoError(t, err, "parsing %q", s)
+	return v
+}
+
+// parseTime parses a time or duration of a script in seconds, e.g. 50 or
+// 5m.
+func parseTime(t *testing.T, s string) int64 {
+	t.Helper()
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v
+	}
+	d, err := time.ParseDuration(s)
+	require.NoError(t, err, "parsing %q", s)
+	return seconds(d)
+}
+
+// command is a command of a script, and the lines indented below it.
+type command struct {
+	line  int
+	text  string
+	lines []string
+}
+
+func readScript(t *testing.T, file string) []*command {
+	t.Helper()
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var cmds []*command
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case line[0] == ' ' || line[0] == '\t':
+			require.NotEmpty(t, cmds, "%s:%d: indented line outside a command", file, n)
+			cmds[len(cmds)-1].lines = append(cmds[len(cmds)-1].lines, trimmed)
+		default:
+			cmds = append(cmds, &command{line: n, text: trimmed})
+		}
+	}
+	require.NoError(t, sc.Err())
+	return cmds
+}
+
+func runScript(t *testing.T, file string) {
+	ims := openStore(t)
+	ng := NewEngine(Options{})
+	for _, cmd := range readScript(t, file) {
+		at := fmt.Sprintf("%s:%d", file, cmd.line)
+		fields := strings.Fields(cmd.text)
+		switch fields[0] {
+		case "load":
+			require.Len(t, fields, 2, at)
+			loadSeries(t, ims, parseTime(t, fields[1]), cmd.lines)
+		case "eval", "eval_ordered", "eval_fail":
+			switch fields[1] {
+			case "instant":
+				require.Equal(t, "at", fields[2], at)
+				ts := parseTime(t, fields[3])
+				query := strings.Join(fields[4:], " ")
+				v, err := ng.InstantQuery(context.Background(), ims, query, ts)
+				if fields[0] == "eval_fail" {
+					assert.Error(t, err, "%s: %s", at, query)
+					continue
+				}
+				require.NoError(t, err, "%s: %s", at, query)
+				assertInstant(t, at+": "+query, v, cmd.lines, fields[0] == "eval_ordered")
+			case "range":
+				require.True(t, fields[2] == "from" && fields[4] == "to" && fields[6] == "step", at)
+				start, end, step := parseTime(t, fields[3]), parseTime(t, fields[5]), parseTime(t, fields[7])
+				query := strings.Join(fields[8:], " ")
+				m, err := ng.RangeQuery(context.Background(), ims, query, start, end, step, QueryOptions{})
+				if fields[0] == "eval_fail" {
+					assert.Error(t, err, "%s: %s", at, query)
+					continue
+				}
+				require.NoError(t, err, "%s: %s", at, query)
+				assertRange(t, at+": "+query, m, start, step, cmd.lines)
+			default:
+				t.Fatalf("%s: unknown evaluation %q", at, fields[1])
+			}
+		default:
+			t.Fatalf("%s: unknown command %q", at, fields[0])
+		}
+	}
+}
+
+// assertInstant compares the result of an instant query to the expected
+// lines: a value for a scalar, or a series and value per sample.
+func assertInstant(t *testing.T, at string, v Value, lines []string, ordered bool) {
+	t.Helper()
+	switch v := v.(type) {
+	case Scalar:
+		require.Len(t, lines, 1, at)
+		assertFloat(t, parseFloat(t, lines[0]), v.V, at)
+	case String:
+		require.Len(t, lines, 1, at)
+		assert.Equal(t, lines[0], strconv.Quote(v.V), at)
+	case Vector:
+		var expected Vector
+		for _, line := range lines {
+			metric, values := parseSeries(t, line)
+			require.Len(t, values, 1, "%s: %s", at, line)
+			expected = append(expected, Sample{Metric: metric, F: *values[0]})
+		}
+		if !ordered {
+			sortVector(expected)
+			sortVector(v)
+		}
+		require.Equal(t, len(expected), len(v), "%s: got\n%s", at, v)
+		for i := range v {
+			assert.Equal(t, expected[i].Metric.String(), v[i].Metric.String(), at)
+			assertFloat(t, expected[i].F, v[i].F, at)
+		}
+	default:
+		t.Fatalf("%s: unexpected result of type %s", at, v.Type())
+	}
+}
+
+// assertRange compares the result of a range query to the expected lines:
+// a series and its value at each step, or _ if it had none.
+func assertRange(t *testing.T, at string, m Matrix, start, step int64, lines []string) {
+	t.Helper()
+	var expected Matrix
+	for _, line := range lines {
+		metric, values := parseSeries(t, line)
+		s := Series{Metric: metric}
+		for i, v := range values {
+			if v != nil {
+				s.Points = append(s.Points, Point{T: start + int64(i)*step, F: *v})
+			}
+		}
+		expected = append(expected, s)
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i].Metric.Compare(expected[j].Metric) < 0 })
+
+	require.Equal(t, len(expected), len(m), "%s: got\n%s", at, m)
+	for i := range m {
+		assert.Equal(t, expected[i].Metric.String(), m[i].Metric.String(), at)
+		require.Equal(t, len(expected[i].Points), len(m[i].Points), "%s: got\n%s", at, m[i].Points)
+		for j, p := range m[i].Points {
+			assert.Equal(t, expected[i].Points[j].T, p.T, at)
+			assertFloat(t, expected[i].Points[j].F, p.F, at)
+		}
+	}
+}
+
+func sortVector(vec Vector) {
+	sort.Slice(vec, func(i, j int) bool { return vec[i].Metric.Compare(vec[j].Metric) < 0 })
+}
+
+// assertFloat compares floats to within a small relative error, with NaN
+// equal to itself.
+func assertFloat(t *testing.T, expected, actual float64, at string) {
+	t.Helper()
+	switch {
+	case math.IsNaN(expected):
+		assert.True(t, math.IsNaN(actual), "%s: expected NaN, got %v", at, actual)
+	case math.IsInf(expected, 0) || expected == 0:
+		assert.Equal(t, expected, actual, at)
+	default:
+		assert.InEpsilon(t, expected, actual, 1e-9, at)
+	}
+}
+
+func Test_RangeQueryDownsampled(t *testing.T) {
+	dir := t.TempDir()
+	day := int64(86400)
+	series := &metrics.ListSeries{
+		Def:    metrics.MetricDefinition{Name: "requests_total", Type: "counter"},
+		Labels: map[string]string{},
+	}
+	for ts := int64(0); ts < day; ts += 60 {
+		series.Samples = append(series.Samples, metrics.Sample{Time: ts, Value: float64(ts)})
+	}
+	// A day long block is downsampled to every resolution.
+	_, err := block.Write(dir, 0, day, metrics.NewListSeriesSet([]metrics.Series{series}))
+	require.NoError(t, err)
+	ims, err := store.Open(log.NewLogger(), store.Options{DataDir: dir, Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+	require.NoError(t, ims.Downsample())
+
+	ng := NewEngine(Options{})
+	counts := func(step int64, opts QueryOptions) []float64 {
+		m, err := ng.RangeQuery(context.Background(), ims, "count_over_time(requests_total[6h])", 6*3600, day-3600, step, opts)
+		require.NoError(t, err)
+		require.Len(t, m, 1)
+		var res []float64
+		for _, p := range m[0].Points {
+			res = append(res, p.F)
+		}
+		return res
+	}
+	// Six hour steps read the hourly aggregates, unless forced to read the
+	// samples of every minute.
+	assert.Equal(t, []float64{6, 6, 6}, counts(6*3600, QueryOptions{}))
+	assert.Equal(t, []float64{360, 360, 360}, counts(6*3600, QueryOptions{Raw: true}))
+	// Finer steps read finer resolutions.
+	assert.Equal(t, 72.0, counts(3600, QueryOptions{})[0])
+	assert.Equal(t, 360.0, counts(600, QueryOptions{})[0])
+}
@@ -0,0 +1,13 @@
+package promql
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidQueryRange = errors.New("invalid query range")
+	ErrInvalidExpression = errors.New("invalid expression")
+	ErrUnsupported       = errors.New("not supported")
+	ErrDuplicateSeries   = errors.New("vector cannot contain metrics with the same labelset")
+	ErrMatchConflict     = errors.New("conflicting series in vector matching")
+)
@@ -0,0 +1,99 @@
+package promql
+
+import (
+	"fmt"
+
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// deriv returns the per-second derivative of a gauge, the slope of the
+// least-squares line through its samples.
+func deriv(points []Point, _, _ int64) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	slope, _ := linearRegression(points, points[0].T)
+	return slope, true
+}
+
+// funcPredictLinear predicts the value of each series of a range vector its
+// second argument of seconds after the evaluation time, by the least-squares
+// line through its samples.
+func funcPredictLinear(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	duration, err := ev.evalScalar(call.Args[1], ts)
+	if err != nil {
+		return nil, err
+	}
+	return rangeFunction(func(points []Point, _, _ int64) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+		slope, intercept := linearRegression(points, ts)
+		return intercept + slope*duration, true
+	})(ev, call, ts)
+}
+
+// linearRegression returns the slope and the intercept at interceptTime of
+// the least-squares line through points. Times and values are taken relative
+// to their means, so that the sums of their squares do not lose precision
+// to large timestamps or offsets. A series of constant values has a slope of
+// exactly 0.
+func linearRegression(points []Point, interceptTime int64) (slope, intercept float64) {
+	n := float64(len(points))
+	var sumT, sumV kahanSum
+	for _, p := range points {
+		sumT.add(float64(p.T - interceptTime))
+		sumV.add(p.F)
+	}
+	meanT, meanV := sumT.value()/n, sumV.value()/n
+
+	var covTV, varT kahanSum
+	constant := true
+	for _, p := range points {
+		dt, dv := float64(p.T-interceptTime)-meanT, p.F-meanV
+		covTV.add(dt * dv)
+		varT.add(dt * dt)
+		constant = constant && p.F == points[0].F
+	}
+	if constant {
+		return 0, points[0].F
+	}
+	slope = covTV.value() / varT.value()
+	return slope, meanV - slope*meanT
+}
+
+// funcHoltWinters smooths each series of a range vector by double
+// exponential smoothing, returning the smoothed value at its last sample.
+// The smoothing factor, its second argument, weighs recent samples against
+// older ones, and the trend factor, its third, recent trends against older
+// ones. Both must be strictly between 0 and 1.
+func funcHoltWinters(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	sf, err := ev.evalScalar(call.Args[1], ts)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := ev.evalScalar(call.Args[2], ts)
+	if err != nil {
+		return nil, err
+	}
+	if !(sf > 0 && sf < 1) {
+		return nil, fmt.Errorf("holt_winters smoothing factor %v, must be between 0 and 1: %w", sf, ErrInvalidExpression)
+	}
+	if !(tf > 0 && tf < 1) {
+		return nil, fmt.Errorf("holt_winters trend factor %v, must be between 0 and 1: %w", tf, ErrInvalidExpression)
+	}
+	return rangeFunction(func(points []Point, _, _ int64) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+		// The level starts at the first value, and the trend at the
+		// difference between the first two.
+		level, trend := points[0].F, points[1].F-points[0].F
+		for _, p := range points[1:] {
+			prev := level
+			level = sf*p.F + (1-sf)*(level+trend)
+			trend = tf*(level-prev) + (1-tf)*trend
+		}
+		return level, true
+	})(ev, call, ts)
+}
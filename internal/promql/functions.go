@@ -0,0 +1,324 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// function evaluates a call at ts.
+type function func(ev *evaluator, call *parser.Call, ts int64) (Value, error)
+
+// functions implements the functions of parser.Functions, by name. It is
+// set by init as functions evaluate their arguments through it.
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"abs":           mathFunction(math.Abs),
+		"ceil":          mathFunction(math.Ceil),
+		"exp":           mathFunction(math.Exp),
+		"floor":         mathFunction(math.Floor),
+		"ln":            mathFunction(math.Log),
+		"log2":          mathFunction(math.Log2),
+		"log10":         mathFunction(math.Log10),
+		"sgn":           mathFunction(sgn),
+		"sqrt":          mathFunction(math.Sqrt),
+		"sort":          sortFunction(false),
+		"sort_desc":     sortFunction(true),
+		"timestamp":     funcTimestamp,
+		"absent":        funcAbsent,
+		"rate":          extrapolatedFunction(true),
+		"irate":         rangeFunction(irate),
+		"increase":      extrapolatedFunction(false),
+		"resets":        rangeFunction(resets),
+		"clamp":         funcClamp,
+		"clamp_max":     funcClampMax,
+		"clamp_min":     funcClampMin,
+		"round":         funcRound,
+		"scalar":        funcScalar,
+		"vector":        funcVector,
+		"time":          funcTime,
+		"label_join":    funcLabelJoin,
+		"label_replace": funcLabelReplace,
+
+		"histogram_quantile": histogramFunction(funcHistogramQuantile, nativeHistogramQuantile),
+		"histogram_fraction": histogramFunction(funcHistogramFraction, nativeHistogramFraction),
+		"histogram_count":    histogramFunction(funcHistogramCount, nativeHistogramCount),
+		"histogram_sum":      histogramFunction(funcHistogramSum, nativeHistogramSum),
+
+		"deriv":          rangeFunction(deriv),
+		"predict_linear": funcPredictLinear,
+		"holt_winters":   funcHoltWinters,
+
+		"avg_over_time":      rangeFunction(avgOverTime),
+		"min_over_time":      rangeFunction(extremeOverTime(false)),
+		"max_over_time":      rangeFunction(extremeOverTime(true)),
+		"sum_over_time":      rangeFunction(sumOverTime),
+		"count_over_time":    rangeFunction(countOverTime),
+		"stddev_over_time":   rangeFunction(varianceOverTime(true)),
+		"stdvar_over_time":   rangeFunction(varianceOverTime(false)),
+		"quantile_over_time": funcQuantileOverTime,
+		"last_over_time":     funcLastOverTime,
+		"present_over_time":  funcPresentOverTime,
+	}
+}
+
+func sgn(v float64) float64 {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return v
+}
+
+// mapVector applies f to the value of each sample of the vector argument of
+// call, dropping the metric name.
+func mapVector(ev *evaluator, call *parser.Call, ts int64, f func(float64) float64) (Value, error) {
+	vec, err := ev.evalVector(call.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	res := make(Vector, 0, len(vec))
+	for _, s := range floatSamples(vec) {
+		res = append(res, Sample{Metric: dropMetricName(s.Metric), T: ts, F: f(s.F)})
+	}
+	return res, nil
+}
+
+// mathFunction returns a function applying f to each sample of a vector.
+func mathFunction(f func(float64) float64) function {
+	return func(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+		return mapVector(ev, call, ts, f)
+	}
+}
+
+// sortFunction returns a function sorting a vector by value, NaN last.
+func sortFunction(desc bool) function {
+	return func(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+		vec, err := ev.evalVector(call.Args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(vec, func(i, j int) bool {
+			a, b := vec[i].F, vec[j].F
+			if math.IsNaN(b) {
+				return !math.IsNaN(a)
+			}
+			if desc {
+				return a > b
+			}
+			return a < b
+		})
+		return vec, nil
+	}
+}
+
+func funcTimestamp(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	arg := call.Args[0]
+	for {
+		paren, ok := arg.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		arg = paren.Expr
+	}
+	// The samples of a selector are at the evaluation time once evaluated,
+	// so are selected directly for the times they were taken.
+	var vec Vector
+	if vs, ok := arg.(*parser.VectorSelector); ok {
+		vec = ev.selectVector(vs, ts)
+	} else {
+		var err error
+		if vec, err = ev.evalVector(arg, ts); err != nil {
+			return nil, err
+		}
+	}
+	res := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		res = append(res, Sample{Metric: dropMetricName(s.Metric), T: ts, F: float64(s.T)})
+	}
+	return res, nil
+}
+
+// funcAbsent returns a sample valued 1 if its argument is empty, labelled
+// by the equality matchers of the argument if it is a selector.
+func funcAbsent(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	vec, err := ev.evalVector(call.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vec) > 0 {
+		return Vector{}, nil
+	}
+	var metric Labels
+	if vs, ok := call.Args[0].(*parser.VectorSelector); ok {
+		seen := map[string]bool{}
+		for _, m := range vs.LabelMatchers {
+			if m.Name == metrics.MetricNameLabel {
+				continue
+			}
+			// A label matched for equality more than once can't be set.
+			if m.Type == metrics.MatchEqual && !seen[m.Name] {
+				metric = metric.Set(m.Name, m.Value)
+			} else {
+				metric = metric.Without(m.Name)
+			}
+			seen[m.Name] = true
+		}
+	}
+	return Vector{{Metric: metric, T: ts, F: 1}}, nil
+}
+
+func funcClamp(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	min, err := ev.evalScalar(call.Args[1], ts)
+	if err != nil {
+		return nil, err
+	}
+	max, err := ev.evalScalar(call.Args[2], ts)
+	if err != nil {
+		return nil, err
+	}
+	if min > max {
+		return Vector{}, nil
+	}
+	return mapVector(ev, call, ts, func(v float64) float64 {
+		return math.Max(min, math.Min(max, v))
+	})
+}
+
+func funcClampMax(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	max, err := ev.evalScalar(call.Args[1], ts)
+	if err != nil {
+		return nil, err
+	}
+	return mapVector(ev, call, ts, func(v float64) float64 { return math.Min(max, v) })
+}
+
+func funcClampMin(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	min, err := ev.evalScalar(call.Args[1], ts)
+	if err != nil {
+		return nil, err
+	}
+	return mapVector(ev, call, ts, func(v float64) float64 { return math.Max(min, v) })
+}
+
+// funcRound rounds to the nearest multiple of its optional second argument,
+// 1 by default, rounding halves up.
+func funcRound(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	toNearest := 1.0
+	if len(call.Args) > 1 {
+		var err error
+		if toNearest, err = ev.evalScalar(call.Args[1], ts); err != nil {
+			return nil, err
+		}
+	}
+	// Dividing by the inverse keeps multiples such as 0.1 exact.
+	inverse := 1 / toNearest
+	return mapVector(ev, call, ts, func(v float64) float64 {
+		return math.Floor(v*inverse+0.5) / inverse
+	})
+}
+
+// funcScalar returns the value of the single sample of its argument, or NaN
+// if it hasn't exactly one float sample.
+func funcScalar(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	vec, err := ev.evalVector(call.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vec) != 1 || vec[0].H != nil {
+		return Scalar{T: ts, V: math.NaN()}, nil
+	}
+	return Scalar{T: ts, V: vec[0].F}, nil
+}
+
+func funcVector(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	v, err := ev.evalScalar(call.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	return Vector{{T: ts, F: v}}, nil
+}
+
+func funcTime(_ *evaluator, _ *parser.Call, ts int64) (Value, error) {
+	return Scalar{T: ts, V: float64(ts)}, nil
+}
+
+// stringArgs evaluates the string arguments of call from the first.
+func stringArgs(ev *evaluator, call *parser.Call, first int, ts int64) ([]string, error) {
+	var res []string
+	for _, arg := range call.Args[first:] {
+		v, err := ev.eval(arg, ts)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v.(String).V)
+	}
+	return res, nil
+}
+
+// funcLabelJoin sets a label to the values of source labels joined by a
+// separator: label_join(v, dst, separator, src...).
+func funcLabelJoin(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	vec, err := ev.evalVector(call.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	args, err := stringArgs(ev, call, 1, ts)
+	if err != nil {
+		return nil, err
+	}
+	dst, sep, srcs := args[0], args[1], args[2:]
+	if !isLabelName(dst) {
+		return nil, fmt.Errorf("label_join destination label %q: %w", dst, ErrInvalidExpression)
+	}
+	res := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		values := make([]string, 0, len(srcs))
+		for _, src := range srcs {
+			values = append(values, s.Metric.Get(src))
+		}
+		res = append(res, Sample{Metric: s.Metric.Set(dst, strings.Join(values, sep)), T: ts, F: s.F, H: s.H})
+	}
+	return res, nil
+}
+
+// funcLabelReplace sets a label to the expansion of a replacement if the
+// value of a source label matches a regular expression:
+// label_replace(v, dst, replacement, src, regex).
+func funcLabelReplace(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	vec, err := ev.evalVector(call.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	args, err := stringArgs(ev, call, 1, ts)
+	if err != nil {
+		return nil, err
+	}
+	dst, replacement, src, expr := args[0], args[1], args[2], args[3]
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("label_replace regular expression %q: %w", expr, ErrInvalidExpression)
+	}
+	if !isLabelName(dst) {
+		return nil, fmt.Errorf("label_replace destination label %q: %w", dst, ErrInvalidExpression)
+	}
+	res := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		metric := s.Metric
+		value := s.Metric.Get(src)
+		if match := re.FindStringSubmatchIndex(value); match != nil {
+			metric = metric.Set(dst, string(re.ExpandString(nil, replacement, value, match)))
+		}
+		res = append(res, Sample{Metric: metric, T: ts, F: s.F, H: s.H})
+	}
+	return res, nil
+}
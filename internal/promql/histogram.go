@@ -0,0 +1,326 @@
+package promql
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// bucketLabel is the label holding the upper bound of a bucket of a classic
+// histogram, e.g. http_request_duration_seconds_bucket{le="0.5"}.
+const bucketLabel = "le"
+
+// bucket is a bucket of a classic histogram: the number of observations at
+// most its upper bound.
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogram is a classic histogram made up of the buckets of a set of series
+// with the same labels but for le.
+type histogram struct {
+	metric  Labels
+	buckets []bucket
+}
+
+// histograms groups the samples of vec into the histograms they are buckets
+// of, in the order first seen, leaving out native histograms and samples
+// without a valid le label. The buckets of each are normalized.
+func histograms(vec Vector) []*histogram {
+	var hs []*histogram
+	byKey := map[string]*histogram{}
+	for _, s := range floatSamples(vec) {
+		upperBound, err := strconv.ParseFloat(s.Metric.Get(bucketLabel), 64)
+		if err != nil {
+			continue
+		}
+		metric := dropMetricName(s.Metric).Without(bucketLabel)
+		key := metric.String()
+		h, ok := byKey[key]
+		if !ok {
+			h = &histogram{metric: metric}
+			byKey[key] = h
+			hs = append(hs, h)
+		}
+		h.buckets = append(h.buckets, bucket{upperBound: upperBound, count: s.F})
+	}
+	for _, h := range hs {
+		h.buckets = normalizeBuckets(h.buckets)
+	}
+	return hs
+}
+
+// normalizeBuckets sorts buckets by their upper bounds, merging buckets with
+// the same bound, such as those of le="1" and le="1.0", by adding their
+// counts. Counts which decrease from one bucket to the next, as they may
+// where histograms with different bucket bounds were added together, are
+// raised to the count of the bucket before.
+func normalizeBuckets(buckets []bucket) []bucket {
+	sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	res := buckets[:0]
+	for _, b := range buckets {
+		if n := len(res); n > 0 && res[n-1].upperBound == b.upperBound {
+			res[n-1].count += b.count
+			continue
+		}
+		res = append(res, b)
+	}
+	for i := 1; i < len(res); i++ {
+		res[i].count = math.Max(res[i].count, res[i-1].count)
+	}
+	return res
+}
+
+// validBuckets reports whether the buckets make up a histogram the histogram
+// functions are defined for: at least two buckets, the last of them +Inf.
+func validBuckets(buckets []bucket) bool {
+	return len(buckets) >= 2 && math.IsInf(buckets[len(buckets)-1].upperBound, 1)
+}
+
+// lowerBound returns the lower bound of the ith bucket: the upper bound of
+// the bucket before, or for the first bucket 0 if its upper bound is
+// positive and otherwise its upper bound.
+func lowerBound(buckets []bucket, i int) float64 {
+	if i > 0 {
+		return buckets[i-1].upperBound
+	}
+	return math.Min(0, buckets[0].upperBound)
+}
+
+// bucketQuantile returns the φ-quantile of the observations of the buckets as
+// Prometheus estimates it, interpolating linearly within the bucket it falls
+// in. Quantiles in the +Inf bucket are the upper bound of the bucket before.
+func bucketQuantile(φ float64, buckets []bucket) float64 {
+	switch {
+	case math.IsNaN(φ):
+		return math.NaN()
+	case φ < 0:
+		return math.Inf(-1)
+	case φ > 1:
+		return math.Inf(1)
+	case !validBuckets(buckets):
+		return math.NaN()
+	}
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := φ * observations
+	i := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	if i == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if i == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+	start, end, count := lowerBound(buckets, i), buckets[i].upperBound, buckets[i].count
+	if i > 0 {
+		rank -= buckets[i-1].count
+		count -= buckets[i-1].count
+	}
+	return start + (end-start)*(rank/count)
+}
+
+// bucketRank returns the estimated number of observations of the buckets at
+// most v, interpolating linearly within the bucket v falls in.
+func bucketRank(v float64, buckets []bucket) float64 {
+	var below float64
+	for i, b := range buckets {
+		if v >= b.upperBound {
+			below = b.count
+			continue
+		}
+		start := lowerBound(buckets, i)
+		if math.IsInf(b.upperBound, 1) || v <= start || start == b.upperBound {
+			return below
+		}
+		return below + (b.count-below)*(v-start)/(b.upperBound-start)
+	}
+	return below
+}
+
+// bucketFraction returns the estimated fraction of the observations of the
+// buckets between lower and upper.
+func bucketFraction(lower, upper float64, buckets []bucket) float64 {
+	if !validBuckets(buckets) || buckets[len(buckets)-1].count == 0 || math.IsNaN(lower) || math.IsNaN(upper) {
+		return math.NaN()
+	}
+	if lower >= upper {
+		return 0
+	}
+	return (bucketRank(upper, buckets) - bucketRank(lower, buckets)) / buckets[len(buckets)-1].count
+}
+
+// bucketSum returns the estimated sum of the observations of the buckets,
+// taking those of each bucket to be at its midpoint, and those of the +Inf
+// bucket at its lower bound.
+func bucketSum(buckets []bucket) float64 {
+	if !validBuckets(buckets) {
+		return math.NaN()
+	}
+	var sum, below float64
+	for i, b := range buckets {
+		at := (lowerBound(buckets, i) + b.upperBound) / 2
+		if math.IsInf(b.upperBound, 1) {
+			at = lowerBound(buckets, i)
+		}
+		if n := b.count - below; n > 0 {
+			sum += n * at
+		}
+		below = b.count
+	}
+	return sum
+}
+
+// histogramFunction returns a function applying f to each classic histogram
+// of the buckets in its last argument, and native to each native histogram
+// in it, with its scalar arguments before that.
+func histogramFunction(f func(args []float64, buckets []bucket) float64, native func(args []float64, h *metrics.Histogram) float64) function {
+	return func(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+		args := make([]float64, 0, len(call.Args)-1)
+		for _, arg := range call.Args[:len(call.Args)-1] {
+			v, err := ev.evalScalar(arg, ts)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+		}
+		vec, err := ev.evalVector(call.Args[len(call.Args)-1], ts)
+		if err != nil {
+			return nil, err
+		}
+		hs := histograms(vec)
+		res := make(Vector, 0, len(hs))
+		for _, s := range vec {
+			if s.H != nil {
+				res = append(res, Sample{Metric: dropMetricName(s.Metric), T: ts, F: native(args, s.H)})
+			}
+		}
+		for _, h := range hs {
+			res = append(res, Sample{Metric: h.metric, T: ts, F: f(args, h.buckets)})
+		}
+		return res, nil
+	}
+}
+
+func funcHistogramQuantile(args []float64, buckets []bucket) float64 {
+	return bucketQuantile(args[0], buckets)
+}
+
+func funcHistogramFraction(args []float64, buckets []bucket) float64 {
+	return bucketFraction(args[0], args[1], buckets)
+}
+
+// funcHistogramCount returns the number of observations, the count of the
+// +Inf bucket.
+func funcHistogramCount(_ []float64, buckets []bucket) float64 {
+	if !validBuckets(buckets) {
+		return math.NaN()
+	}
+	return buckets[len(buckets)-1].count
+}
+
+func funcHistogramSum(_ []float64, buckets []bucket) float64 {
+	return bucketSum(buckets)
+}
+
+// nativeBuckets returns the buckets of h, narrowing its zero bucket to
+// [0, ZeroThreshold] or [-ZeroThreshold, 0] if h has no negative or no
+// positive observations respectively.
+func nativeBuckets(h *metrics.Histogram) []metrics.HistogramBucket {
+	buckets := h.Buckets()
+	// Only the zero bucket includes both its bounds.
+	isZero := func(b metrics.HistogramBucket) bool { return b.LowerInclusive && b.UpperInclusive }
+	var negative, positive bool
+	for _, b := range buckets {
+		if b.Count > 0 && !isZero(b) {
+			negative = negative || b.Upper <= 0
+			positive = positive || b.Lower >= 0
+		}
+	}
+	for i, b := range buckets {
+		if isZero(b) {
+			if !negative {
+				buckets[i].Lower = 0
+			}
+			if !positive {
+				buckets[i].Upper = 0
+			}
+		}
+	}
+	return buckets
+}
+
+// nativeHistogramQuantile returns the φ-quantile of the observations of a
+// native histogram, interpolating linearly within the bucket it falls in.
+func nativeHistogramQuantile(args []float64, h *metrics.Histogram) float64 {
+	φ := args[0]
+	switch {
+	case math.IsNaN(φ):
+		return math.NaN()
+	case φ < 0:
+		return math.Inf(-1)
+	case φ > 1:
+		return math.Inf(1)
+	case h.Count == 0:
+		return math.NaN()
+	}
+	rank := φ * h.Count
+	var below float64
+	var last metrics.HistogramBucket
+	for _, b := range nativeBuckets(h) {
+		if b.Count == 0 {
+			continue
+		}
+		if below+b.Count >= rank {
+			return b.Lower + (b.Upper-b.Lower)*((rank-below)/b.Count)
+		}
+		below += b.Count
+		last = b
+	}
+	// Observations of NaN are counted but in no bucket.
+	if below == 0 {
+		return math.NaN()
+	}
+	return last.Upper
+}
+
+// nativeHistogramRank returns the estimated number of observations of a
+// native histogram at most v, interpolating linearly within the bucket v
+// falls in.
+func nativeHistogramRank(v float64, buckets []metrics.HistogramBucket) float64 {
+	var rank float64
+	for _, b := range buckets {
+		switch {
+		case v >= b.Upper:
+			rank += b.Count
+		case v > b.Lower:
+			rank += b.Count * (v - b.Lower) / (b.Upper - b.Lower)
+		}
+	}
+	return rank
+}
+
+func nativeHistogramFraction(args []float64, h *metrics.Histogram) float64 {
+	lower, upper := args[0], args[1]
+	if h.Count == 0 || math.IsNaN(lower) || math.IsNaN(upper) {
+		return math.NaN()
+	}
+	if lower >= upper {
+		return 0
+	}
+	buckets := nativeBuckets(h)
+	return (nativeHistogramRank(upper, buckets) - nativeHistogramRank(lower, buckets)) / h.Count
+}
+
+func nativeHistogramCount(_ []float64, h *metrics.Histogram) float64 {
+	return h.Count
+}
+
+func nativeHistogramSum(_ []float64, h *metrics.Histogram) float64 {
+	return h.Sum
+}
@@ -0,0 +1,146 @@
+package promql
+
+import (
+	"math"
+
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// kahanSum is a sum of floats compensated for the precision lost in each
+// addition, by Neumaier's variant of Kahan summation.
+type kahanSum struct {
+	sum, c float64
+}
+
+func (k *kahanSum) add(v float64) {
+	t := k.sum + v
+	switch {
+	case math.IsInf(t, 0):
+		// The compensation of an infinite sum is NaN, so is not kept.
+		k.c = 0
+	case math.Abs(k.sum) >= math.Abs(v):
+		k.c += (k.sum - t) + v
+	default:
+		k.c += (v - t) + k.sum
+	}
+	k.sum = t
+}
+
+func (k *kahanSum) value() float64 {
+	if math.IsInf(k.sum, 0) {
+		return k.sum
+	}
+	return k.sum + k.c
+}
+
+// sumOverTime returns the sum of the values of a series.
+func sumOverTime(points []Point, _, _ int64) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+	var sum kahanSum
+	for _, p := range points {
+		sum.add(p.F)
+	}
+	return sum.value(), true
+}
+
+// avgOverTime returns the mean of the values of a series.
+func avgOverTime(points []Point, start, end int64) (float64, bool) {
+	sum, ok := sumOverTime(points, start, end)
+	return sum / float64(len(points)), ok
+}
+
+// countOverTime returns the number of float samples of a series.
+func countOverTime(points []Point, _, _ int64) (float64, bool) {
+	return float64(len(points)), len(points) > 0
+}
+
+// extremeOverTime returns a function returning the largest value of a
+// series if largest, and otherwise its smallest. NaN is only returned if
+// every value is NaN.
+func extremeOverTime(largest bool) func(points []Point, start, end int64) (float64, bool) {
+	return func(points []Point, _, _ int64) (float64, bool) {
+		if len(points) == 0 {
+			return 0, false
+		}
+		res := math.NaN()
+		for _, p := range points {
+			if math.IsNaN(res) || largest && p.F > res || !largest && p.F < res {
+				res = p.F
+			}
+		}
+		return res, true
+	}
+}
+
+// varianceOverTime returns a function returning the population standard
+// deviation of the values of a series if stddev, and otherwise their
+// variance. They are computed by Welford's online algorithm, which does not
+// lose precision to values far from zero as the sum of their squares does.
+func varianceOverTime(stddev bool) func(points []Point, start, end int64) (float64, bool) {
+	return func(points []Point, _, _ int64) (float64, bool) {
+		if len(points) == 0 {
+			return 0, false
+		}
+		var mean, m2 float64
+		for i, p := range points {
+			delta := p.F - mean
+			mean += delta / float64(i+1)
+			m2 += delta * (p.F - mean)
+		}
+		variance := m2 / float64(len(points))
+		if stddev {
+			return math.Sqrt(variance), true
+		}
+		return variance, true
+	}
+}
+
+// funcQuantileOverTime returns the φ-quantile, its first argument, of the
+// values of each series of a range vector, as the quantile aggregation
+// does.
+func funcQuantileOverTime(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	φ, err := ev.evalScalar(call.Args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	return rangeFunction(func(points []Point, _, _ int64) (float64, bool) {
+		if len(points) == 0 {
+			return 0, false
+		}
+		values := make([]float64, len(points))
+		for i, p := range points {
+			values[i] = p.F
+		}
+		return quantile(φ, values), true
+	})(ev, call, ts)
+}
+
+// funcLastOverTime returns the last sample of each series of a range
+// vector, float or native histogram.
+func funcLastOverTime(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	m, _, _ := ev.evalRange(call, ts)
+	res := make(Vector, 0, len(m))
+	for _, s := range m {
+		if len(s.Points) == 0 {
+			continue
+		}
+		last := s.Points[len(s.Points)-1]
+		res = append(res, Sample{Metric: dropMetricName(s.Metric), T: ts, F: last.F, H: last.H})
+	}
+	return res, nil
+}
+
+// funcPresentOverTime returns 1 for each series of a range vector with any
+// sample, float or native histogram.
+func funcPresentOverTime(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+	m, _, _ := ev.evalRange(call, ts)
+	res := make(Vector, 0, len(m))
+	for _, s := range m {
+		if len(s.Points) > 0 {
+			res = append(res, Sample{Metric: dropMetricName(s.Metric), T: ts, F: 1})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,227 @@
+// Package parser parses queries written in a PromQL compatible query
+// language into an abstract syntax tree, and prints trees back as queries.
+package parser
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// ValueType is the type of value an expression evaluates to.
+type ValueType string
+
+const (
+	ValueTypeNone   ValueType = "none"
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// Expr is a node of the syntax tree of a query. Its String method prints it
+// as a query which parses back to an equal tree.
+type Expr interface {
+	fmt.Stringer
+	// Type returns the type of value the expression evaluates to.
+	Type() ValueType
+}
+
+// Operator is a binary operator, or a unary one for the arithmetic operators
+// OpAdd and OpSub.
+type Operator string
+
+const (
+	OpAdd    Operator = "+"
+	OpSub    Operator = "-"
+	OpMul    Operator = "*"
+	OpDiv    Operator = "/"
+	OpMod    Operator = "%"
+	OpPow    Operator = "^"
+	OpAtan2  Operator = "atan2"
+	OpEql    Operator = "=="
+	OpNeq    Operator = "!="
+	OpLss    Operator = "<"
+	OpLte    Operator = "<="
+	OpGtr    Operator = ">"
+	OpGte    Operator = ">="
+	OpAnd    Operator = "and"
+	OpOr     Operator = "or"
+	OpUnless Operator = "unless"
+)
+
+// precedence returns the binding power of a binary operator; operators of
+// greater precedence bind more tightly.
+func (op Operator) precedence() int {
+	switch op {
+	case OpOr:
+		return 1
+	case OpAnd, OpUnless:
+		return 2
+	case OpEql, OpNeq, OpLss, OpLte, OpGtr, OpGte:
+		return 3
+	case OpAdd, OpSub:
+		return 4
+	case OpMul, OpDiv, OpMod, OpAtan2:
+		return 5
+	case OpPow:
+		return 6
+	}
+	return 0
+}
+
+// IsComparison reports whether op compares its operands.
+func (op Operator) IsComparison() bool {
+	return op.precedence() == 3
+}
+
+// IsSetOperator reports whether op is one of the set operators, which match
+// series of two vectors by their labels alone.
+func (op Operator) IsSetOperator() bool {
+	return op == OpAnd || op == OpOr || op == OpUnless
+}
+
+// AggregateOp is an aggregation operator.
+type AggregateOp string
+
+const (
+	AggrSum         AggregateOp = "sum"
+	AggrMin         AggregateOp = "min"
+	AggrMax         AggregateOp = "max"
+	AggrAvg         AggregateOp = "avg"
+	AggrGroup       AggregateOp = "group"
+	AggrStddev      AggregateOp = "stddev"
+	AggrStdvar      AggregateOp = "stdvar"
+	AggrCount       AggregateOp = "count"
+	AggrCountValues AggregateOp = "count_values"
+	AggrBottomK     AggregateOp = "bottomk"
+	AggrTopK        AggregateOp = "topk"
+	AggrQuantile    AggregateOp = "quantile"
+)
+
+// aggregateOps maps the aggregation operators to the type of their
+// parameter, or ValueTypeNone if they take none.
+var aggregateOps = map[AggregateOp]ValueType{
+	AggrSum:         ValueTypeNone,
+	AggrMin:         ValueTypeNone,
+	AggrMax:         ValueTypeNone,
+	AggrAvg:         ValueTypeNone,
+	AggrGroup:       ValueTypeNone,
+	AggrStddev:      ValueTypeNone,
+	AggrStdvar:      ValueTypeNone,
+	AggrCount:       ValueTypeNone,
+	AggrCountValues: ValueTypeString,
+	AggrBottomK:     ValueTypeScalar,
+	AggrTopK:        ValueTypeScalar,
+	AggrQuantile:    ValueTypeScalar,
+}
+
+// Cardinality is how many series on each side of a binary operation a series
+// on the other side may match.
+type Cardinality int
+
+const (
+	CardOneToOne Cardinality = iota
+	CardManyToOne
+	CardOneToMany
+	CardManyToMany
+)
+
+// VectorMatching describes how the series of the operands of a binary
+// operation between two vectors are matched.
+type VectorMatching struct {
+	Card Cardinality
+	// On is set if series are matched on MatchingLabels alone, rather than
+	// on every label but MatchingLabels.
+	On             bool
+	MatchingLabels []string
+	// Include are the labels of the "one" side copied to the result of a
+	// many-to-one or one-to-many match.
+	Include []string
+}
+
+// NumberLiteral is a literal number, e.g. 1.5.
+type NumberLiteral struct {
+	Val float64
+}
+
+// StringLiteral is a literal string, e.g. "foo".
+type StringLiteral struct {
+	Val string
+}
+
+// VectorSelector selects the latest sample of each series matching its
+// matchers, e.g. up{job="api"}.
+type VectorSelector struct {
+	// Name is the metric name the selector was written with, if any. It is
+	// also matched by one of LabelMatchers.
+	Name          string
+	LabelMatchers []*metrics.Matcher
+	// Offset shifts the time the selector is evaluated at back.
+	Offset time.Duration
+}
+
+// MatrixSelector selects the samples within Range of each series selected
+// by VectorSelector, e.g. up[5m].
+type MatrixSelector struct {
+	VectorSelector *VectorSelector
+	Range          time.Duration
+}
+
+// ParenExpr is a parenthesised expression.
+type ParenExpr struct {
+	Expr Expr
+}
+
+// UnaryExpr negates an expression, or leaves it be for OpAdd.
+type UnaryExpr struct {
+	Op   Operator
+	Expr Expr
+}
+
+// BinaryExpr is a binary operation, e.g. a + on(job) b.
+type BinaryExpr struct {
+	Op       Operator
+	LHS, RHS Expr
+	// VectorMatching is set for operations between two vectors.
+	VectorMatching *VectorMatching
+	// ReturnBool is set for comparisons which return 0 or 1 rather than
+	// filtering.
+	ReturnBool bool
+}
+
+// AggregateExpr aggregates the series of a vector, e.g.
+// sum by (job) (rate(x[5m])).
+type AggregateExpr struct {
+	Op   AggregateOp
+	Expr Expr
+	// Param is the parameter of operators taking one, e.g. k of topk.
+	Param Expr
+	// Grouping are the labels series are grouped by, or, if Without is
+	// set, the labels dropped to group them.
+	Grouping []string
+	Without  bool
+}
+
+// Call is a function call, e.g. abs(x).
+type Call struct {
+	Func *Function
+	Args []Expr
+}
+
+func (e *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (e *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (e *ParenExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *UnaryExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (e *Call) Type() ValueType           { return e.Func.ReturnType }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
@@ -0,0 +1,28 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseError is an error in the syntax or types of a query.
+type ParseError struct {
+	// Pos is the byte offset within the query the error was found at.
+	Pos int
+	// Line and Column locate Pos, counting from 1. Columns count bytes.
+	Line, Column int
+	Msg          string
+}
+
+func newParseError(input string, pos int, msg string) *ParseError {
+	line := 1 + strings.Count(input[:pos], "\n")
+	col := pos + 1
+	if i := strings.LastIndexByte(input[:pos], '\n'); i >= 0 {
+		col = pos - i
+	}
+	return &ParseError{Pos: pos, Line: line, Column: col, Msg: msg}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at %d:%d: %s", e.Line, e.Column, e.Msg)
+}
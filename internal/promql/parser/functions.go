@@ -0,0 +1,86 @@
+package parser
+
+// Function describes the signature of a function queries may call.
+type Function struct {
+	Name     string
+	ArgTypes []ValueType
+	// Variadic is the number of trailing arguments which may be left out,
+	// or -1 if the last argument may be repeated any number of times.
+	Variadic   int
+	ReturnType ValueType
+}
+
+// Functions are the functions queries may call, by name.
+var Functions = map[string]*Function{
+	"abs":        vectorFunction("abs"),
+	"ceil":       vectorFunction("ceil"),
+	"exp":        vectorFunction("exp"),
+	"floor":      vectorFunction("floor"),
+	"ln":         vectorFunction("ln"),
+	"log2":       vectorFunction("log2"),
+	"log10":      vectorFunction("log10"),
+	"sgn":        vectorFunction("sgn"),
+	"sqrt":       vectorFunction("sqrt"),
+	"sort":       vectorFunction("sort"),
+	"sort_desc":  vectorFunction("sort_desc"),
+	"timestamp":  vectorFunction("timestamp"),
+	"absent":     vectorFunction("absent"),
+	"rate":       matrixFunction("rate"),
+	"irate":      matrixFunction("irate"),
+	"increase":   matrixFunction("increase"),
+	"resets":     matrixFunction("resets"),
+	"clamp":      {Name: "clamp", ArgTypes: []ValueType{ValueTypeVector, ValueTypeScalar, ValueTypeScalar}, ReturnType: ValueTypeVector},
+	"clamp_max":  {Name: "clamp_max", ArgTypes: []ValueType{ValueTypeVector, ValueTypeScalar}, ReturnType: ValueTypeVector},
+	"clamp_min":  {Name: "clamp_min", ArgTypes: []ValueType{ValueTypeVector, ValueTypeScalar}, ReturnType: ValueTypeVector},
+	"round":      {Name: "round", ArgTypes: []ValueType{ValueTypeVector, ValueTypeScalar}, Variadic: 1, ReturnType: ValueTypeVector},
+	"scalar":     {Name: "scalar", ArgTypes: []ValueType{ValueTypeVector}, ReturnType: ValueTypeScalar},
+	"vector":     {Name: "vector", ArgTypes: []ValueType{ValueTypeScalar}, ReturnType: ValueTypeVector},
+	"time":       {Name: "time", ReturnType: ValueTypeScalar},
+	"label_join": {Name: "label_join", ArgTypes: []ValueType{ValueTypeVector, ValueTypeString, ValueTypeString, ValueTypeString}, Variadic: -1, ReturnType: ValueTypeVector},
+	"label_replace": {
+		Name:       "label_replace",
+		ArgTypes:   []ValueType{ValueTypeVector, ValueTypeString, ValueTypeString, ValueTypeString, ValueTypeString},
+		ReturnType: ValueTypeVector,
+	},
+	"histogram_quantile": {
+		Name:       "histogram_quantile",
+		ArgTypes:   []ValueType{ValueTypeScalar, ValueTypeVector},
+		ReturnType: ValueTypeVector,
+	},
+	"histogram_fraction": {
+		Name:       "histogram_fraction",
+		ArgTypes:   []ValueType{ValueTypeScalar, ValueTypeScalar, ValueTypeVector},
+		ReturnType: ValueTypeVector,
+	},
+	"histogram_count": vectorFunction("histogram_count"),
+	"histogram_sum":   vectorFunction("histogram_sum"),
+
+	"deriv":          matrixFunction("deriv"),
+	"predict_linear": {Name: "predict_linear", ArgTypes: []ValueType{ValueTypeMatrix, ValueTypeScalar}, ReturnType: ValueTypeVector},
+	"holt_winters": {
+		Name:       "holt_winters",
+		ArgTypes:   []ValueType{ValueTypeMatrix, ValueTypeScalar, ValueTypeScalar},
+		ReturnType: ValueTypeVector,
+	},
+
+	"avg_over_time":      matrixFunction("avg_over_time"),
+	"min_over_time":      matrixFunction("min_over_time"),
+	"max_over_time":      matrixFunction("max_over_time"),
+	"sum_over_time":      matrixFunction("sum_over_time"),
+	"count_over_time":    matrixFunction("count_over_time"),
+	"stddev_over_time":   matrixFunction("stddev_over_time"),
+	"stdvar_over_time":   matrixFunction("stdvar_over_time"),
+	"last_over_time":     matrixFunction("last_over_time"),
+	"present_over_time":  matrixFunction("present_over_time"),
+	"quantile_over_time": {Name: "quantile_over_time", ArgTypes: []ValueType{ValueTypeScalar, ValueTypeMatrix}, ReturnType: ValueTypeVector},
+}
+
+// vectorFunction returns a function taking and returning a vector.
+func vectorFunction(name string) *Function {
+	return &Function{Name: name, ArgTypes: []ValueType{ValueTypeVector}, ReturnType: ValueTypeVector}
+}
+
+// matrixFunction returns a function taking a matrix and returning a vector.
+func matrixFunction(name string) *Function {
+	return &Function{Name: name, ArgTypes: []ValueType{ValueTypeMatrix}, ReturnType: ValueTypeVector}
+}
@@ -0,0 +1,300 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// itemType is the kind of a lexed token.
+type itemType int
+
+const (
+	itemEOF itemType = iota
+	itemIdentifier
+	itemNumber
+	itemDuration
+	itemString
+
+	itemLeftParen
+	itemRightParen
+	itemLeftBrace
+	itemRightBrace
+	itemLeftBracket
+	itemRightBracket
+	itemComma
+
+	// itemOperator covers binary, unary and label matching operators, which
+	// are told apart by the parser.
+	itemOperator
+)
+
+func (t itemType) String() string {
+	switch t {
+	case itemEOF:
+		return "end of input"
+	case itemIdentifier:
+		return "identifier"
+	case itemNumber:
+		return "number"
+	case itemDuration:
+		return "duration"
+	case itemString:
+		return "string"
+	case itemLeftParen:
+		return `"("`
+	case itemRightParen:
+		return `")"`
+	case itemLeftBrace:
+		return `"{"`
+	case itemRightBrace:
+		return `"}"`
+	case itemLeftBracket:
+		return `"["`
+	case itemRightBracket:
+		return `"]"`
+	case itemComma:
+		return `","`
+	case itemOperator:
+		return "operator"
+	}
+	return fmt.Sprintf("itemType(%d)", int(t))
+}
+
+// item is a token of a query and its byte offset within the query.
+type item struct {
+	typ itemType
+	pos int
+	val string
+}
+
+func (i item) String() string {
+	switch i.typ {
+	case itemEOF:
+		return i.typ.String()
+	case itemIdentifier, itemNumber, itemDuration, itemString, itemOperator:
+		return fmt.Sprintf("%s %q", i.typ, i.val)
+	}
+	return i.typ.String()
+}
+
+// operators are the operator tokens, longest first so that e.g. "==" is not
+// lexed as two "=".
+var operators = []string{
+	"==", "!=", "=~", "!~", "<=", ">=",
+	"<", ">", "=", "+", "-", "*", "/", "%", "^",
+}
+
+// durationUnits are the units a duration may be written in.
+var durationUnits = []string{"ms", "s", "m", "h", "d", "w", "y"}
+
+// lex splits a query into tokens, ending with an itemEOF.
+func lex(input string) ([]item, error) {
+	l := &lexer{input: input}
+	for {
+		it, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		l.items = append(l.items, it)
+		if it.typ == itemEOF {
+			return l.items, nil
+		}
+	}
+}
+
+type lexer struct {
+	input string
+	pos   int
+	items []item
+}
+
+func (l *lexer) errorf(pos int, format string, args ...any) error {
+	return newParseError(l.input, pos, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) next() (item, error) {
+	l.skipSpaceAndComments()
+	if l.pos >= len(l.input) {
+		return item{typ: itemEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.input[l.pos]
+	switch {
+	case isIdentStart(c):
+		for l.pos < len(l.input) && isIdentChar(l.input[l.pos]) {
+			l.pos++
+		}
+		return item{typ: itemIdentifier, pos: start, val: l.input[start:l.pos]}, nil
+	case isDigit(c) || c == '.' && l.pos+1 < len(l.input) && isDigit(l.input[l.pos+1]):
+		return l.number()
+	case c == '"' || c == '\'' || c == '`':
+		return l.string()
+	}
+
+	punctuation := map[byte]itemType{
+		'(': itemLeftParen, ')': itemRightParen,
+		'{': itemLeftBrace, '}': itemRightBrace,
+		'[': itemLeftBracket, ']': itemRightBracket,
+		',': itemComma,
+	}
+	if t, ok := punctuation[c]; ok {
+		l.pos++
+		return item{typ: t, pos: start, val: string(c)}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return item{typ: itemOperator, pos: start, val: op}, nil
+		}
+	}
+	return item{}, l.errorf(start, "unexpected character %q", c)
+}
+
+func (l *lexer) skipSpaceAndComments() {
+	for l.pos < len(l.input) {
+		switch c := l.input[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// number lexes a number, e.g. 1, 0.5, 1e-3 or 0x1f, or a duration, e.g. 5m
+// or 1h30m.
+func (l *lexer) number() (item, error) {
+	start := l.pos
+	if strings.HasPrefix(l.input[l.pos:], "0x") || strings.HasPrefix(l.input[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.input) && isHexDigit(l.input[l.pos]) {
+			l.pos++
+		}
+		return l.endNumber(start, itemNumber)
+	}
+
+	l.digits()
+	if l.pos < len(l.input) && isDurationUnit(l.input[l.pos]) {
+		// A duration is a sequence of integers each followed by a unit.
+		for {
+			unit := l.unit()
+			if unit == "" {
+				return item{}, l.errorf(start, "bad duration %q", l.input[start:l.pos])
+			}
+			l.pos += len(unit)
+			if l.pos >= len(l.input) || !isDigit(l.input[l.pos]) {
+				break
+			}
+			l.digits()
+		}
+		return l.endNumber(start, itemDuration)
+	}
+
+	if l.pos < len(l.input) && l.input[l.pos] == '.' {
+		l.pos++
+		l.digits()
+	}
+	if l.exponentAhead() {
+		l.pos++
+		if l.input[l.pos] == '+' || l.input[l.pos] == '-' {
+			l.pos++
+		}
+		l.digits()
+	}
+	return l.endNumber(start, itemNumber)
+}
+
+// endNumber ends a number or duration started at start, which must not run
+// into an identifier.
+func (l *lexer) endNumber(start int, t itemType) (item, error) {
+	if l.pos < len(l.input) && (isIdentChar(l.input[l.pos]) || l.input[l.pos] == '.') {
+		for l.pos < len(l.input) && (isIdentChar(l.input[l.pos]) || l.input[l.pos] == '.') {
+			l.pos++
+		}
+		return item{}, l.errorf(start, "bad number or duration %q", l.input[start:l.pos])
+	}
+	return item{typ: t, pos: start, val: l.input[start:l.pos]}, nil
+}
+
+func (l *lexer) digits() {
+	for l.pos < len(l.input) && isDigit(l.input[l.pos]) {
+		l.pos++
+	}
+}
+
+// exponentAhead reports whether an exponent, e.g. e-3, starts at the current
+// position.
+func (l *lexer) exponentAhead() bool {
+	rest := l.input[l.pos:]
+	if len(rest) < 2 || rest[0] != 'e' && rest[0] != 'E' {
+		return false
+	}
+	if rest[1] == '+' || rest[1] == '-' {
+		return len(rest) > 2 && isDigit(rest[2])
+	}
+	return isDigit(rest[1])
+}
+
+// unit returns the duration unit at the current position, or the empty
+// string if there is none.
+func (l *lexer) unit() string {
+	// "ms" is checked before "m".
+	for _, u := range durationUnits {
+		if strings.HasPrefix(l.input[l.pos:], u) {
+			return u
+		}
+	}
+	return ""
+}
+
+// string lexes a string quoted with double quotes, single quotes or
+// backquotes. Escape sequences are only interpreted within the first two.
+func (l *lexer) string() (item, error) {
+	start := l.pos
+	quote := l.input[l.pos]
+	l.pos++
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case c == quote:
+			l.pos++
+			return item{typ: itemString, pos: start, val: l.input[start:l.pos]}, nil
+		case c == '\\' && quote != '`':
+			l.pos += 2
+		case c == '\n' && quote != '`':
+			return item{}, l.errorf(start, "unterminated string")
+		default:
+			l.pos++
+		}
+	}
+	return item{}, l.errorf(start, "unterminated string")
+}
+
+func isIdentStart(c byte) bool {
+	return isLetter(c) || c == '_' || c == ':'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isDurationUnit(c byte) bool {
+	return strings.IndexByte("smhdwy", c) >= 0
+}
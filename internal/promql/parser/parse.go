@@ -0,0 +1,643 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+// keywords are the identifiers which cannot be used as metric names.
+var keywords = map[string]bool{
+	"and": true, "or": true, "unless": true, "atan2": true,
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true, "bool": true, "offset": true,
+}
+
+// ParseExpr parses a query into its syntax tree. The returned error is a
+// *ParseError.
+func ParseExpr(input string) (Expr, error) {
+	items, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{input: input, items: items}
+	e, err := p.expr(1)
+	if err != nil {
+		return nil, err
+	}
+	if it := p.peek(); it.typ != itemEOF {
+		return nil, p.unexpected(it, "")
+	}
+	return e, nil
+}
+
+// ParseMetricSelector parses a series selector, e.g. up{job="api"}, into its
+// label matchers.
+func ParseMetricSelector(input string) ([]*metrics.Matcher, error) {
+	e, err := ParseExpr(input)
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := e.(*VectorSelector)
+	if !ok || vs.Offset != 0 {
+		return nil, newParseError(input, 0, "expected a series selector")
+	}
+	return vs.LabelMatchers, nil
+}
+
+type parser struct {
+	input string
+	items []item
+	pos   int
+}
+
+func (p *parser) peek() item {
+	return p.items[p.pos]
+}
+
+// peekAt returns the item n items ahead.
+func (p *parser) peekAt(n int) item {
+	if p.pos+n >= len(p.items) {
+		return p.items[len(p.items)-1]
+	}
+	return p.items[p.pos+n]
+}
+
+func (p *parser) next() item {
+	it := p.items[p.pos]
+	if it.typ != itemEOF {
+		p.pos++
+	}
+	return it
+}
+
+// isIdent reports whether the next item is the identifier name.
+func (p *parser) isIdent(name string) bool {
+	it := p.peek()
+	return it.typ == itemIdentifier && it.val == name
+}
+
+func (p *parser) expect(t itemType, context string) (item, error) {
+	it := p.next()
+	if it.typ != t {
+		return it, p.unexpected(it, context)
+	}
+	return it, nil
+}
+
+func (p *parser) errorf(pos int, format string, args ...any) error {
+	return newParseError(p.input, pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) unexpected(it item, context string) error {
+	if context == "" {
+		return p.errorf(it.pos, "unexpected %s", it)
+	}
+	return p.errorf(it.pos, "unexpected %s in %s", it, context)
+}
+
+// binaryOp returns the binary operator the next item is, if any.
+func (p *parser) binaryOp() (Operator, bool) {
+	it := p.peek()
+	if it.typ != itemOperator && it.typ != itemIdentifier {
+		return "", false
+	}
+	op := Operator(it.val)
+	if op.precedence() == 0 || it.typ == itemIdentifier && !keywords[it.val] {
+		return "", false
+	}
+	return op, true
+}
+
+// expr parses an expression of binary operators binding at least as
+// tightly as minPrec.
+func (p *parser) expr(minPrec int) (Expr, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.binaryOp()
+		if !ok || op.precedence() < minPrec {
+			return lhs, nil
+		}
+		opItem := p.next()
+		be := &BinaryExpr{Op: op, LHS: lhs}
+		vm, err := p.binaryModifiers(be)
+		if err != nil {
+			return nil, err
+		}
+
+		// Operators associate to the left, except ^.
+		nextPrec := op.precedence() + 1
+		if op == OpPow {
+			nextPrec = op.precedence()
+		}
+		if be.RHS, err = p.expr(nextPrec); err != nil {
+			return nil, err
+		}
+		if err := p.checkBinary(be, vm, opItem.pos); err != nil {
+			return nil, err
+		}
+		lhs = be
+	}
+}
+
+// binaryModifiers parses the bool, on, ignoring, group_left and group_right
+// modifiers following a binary operator, returning the vector matching they
+// describe or nil if there are none.
+func (p *parser) binaryModifiers(be *BinaryExpr) (*VectorMatching, error) {
+	if p.isIdent("bool") {
+		it := p.next()
+		if !be.Op.IsComparison() {
+			return nil, p.errorf(it.pos, "bool modifier can only be used on comparison operators")
+		}
+		be.ReturnBool = true
+	}
+
+	if !p.isIdent("on") && !p.isIdent("ignoring") {
+		return nil, nil
+	}
+	vm := &VectorMatching{Card: CardOneToOne, On: p.next().val == "on"}
+	var err error
+	if vm.MatchingLabels, err = p.labelList(); err != nil {
+		return nil, err
+	}
+
+	if p.isIdent("group_left") || p.isIdent("group_right") {
+		it := p.next()
+		if be.Op.IsSetOperator() {
+			return nil, p.errorf(it.pos, "no grouping allowed for %q operation", be.Op)
+		}
+		vm.Card = CardManyToOne
+		if it.val == "group_right" {
+			vm.Card = CardOneToMany
+		}
+		if p.peek().typ == itemLeftParen {
+			if vm.Include, err = p.labelList(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vm, nil
+}
+
+// checkBinary checks the types of the operands of be, setting its vector
+// matching to vm, or the default, if both are vectors.
+func (p *parser) checkBinary(be *BinaryExpr, vm *VectorMatching, pos int) error {
+	lt, rt := be.LHS.Type(), be.RHS.Type()
+	for _, t := range []ValueType{lt, rt} {
+		if t != ValueTypeScalar && t != ValueTypeVector {
+			return p.errorf(pos, "binary expression must contain only scalar and instant vector types, got %s", t)
+		}
+	}
+
+	if lt != ValueTypeVector || rt != ValueTypeVector {
+		if vm != nil {
+			return p.errorf(pos, "vector matching only allowed between instant vectors")
+		}
+		if be.Op.IsSetOperator() {
+			return p.errorf(pos, "set operator %q not allowed in binary scalar expression", be.Op)
+		}
+		if lt == ValueTypeScalar && rt == ValueTypeScalar && be.Op.IsComparison() && !be.ReturnBool {
+			return p.errorf(pos, "comparisons between scalars must use bool modifier")
+		}
+		return nil
+	}
+
+	if vm == nil {
+		vm = &VectorMatching{Card: CardOneToOne}
+	}
+	if be.Op.IsSetOperator() {
+		vm.Card = CardManyToMany
+	}
+	be.VectorMatching = vm
+	return nil
+}
+
+// unary parses an expression optionally preceded by a unary operator, which
+// binds less tightly than ^.
+func (p *parser) unary() (Expr, error) {
+	it := p.peek()
+	if it.typ != itemOperator || (it.val != string(OpAdd) && it.val != string(OpSub)) {
+		return p.primary()
+	}
+	p.next()
+
+	e, err := p.expr(OpPow.precedence())
+	if err != nil {
+		return nil, err
+	}
+	if t := e.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+		return nil, p.errorf(it.pos, "unary expression only allowed on expressions of type scalar or instant vector, got %s", t)
+	}
+	if n, ok := e.(*NumberLiteral); ok {
+		if it.val == string(OpSub) {
+			n.Val = -n.Val
+		}
+		return n, nil
+	}
+	return &UnaryExpr{Op: Operator(it.val), Expr: e}, nil
+}
+
+// primary parses a literal, selector, parenthesised expression, aggregation
+// or function call, followed by any range and offset.
+func (p *parser) primary() (Expr, error) {
+	it := p.peek()
+	var (
+		e   Expr
+		err error
+	)
+	switch {
+	case it.typ == itemNumber:
+		e, err = p.number(p.next())
+	case it.typ == itemString:
+		p.next()
+		var s string
+		s, err = p.unquote(it)
+		e = &StringLiteral{Val: s}
+	case it.typ == itemLeftParen:
+		p.next()
+		var inner Expr
+		if inner, err = p.expr(1); err == nil {
+			_, err = p.expect(itemRightParen, "parenthesised expression")
+		}
+		e = &ParenExpr{Expr: inner}
+	case it.typ == itemLeftBrace:
+		e, err = p.vectorSelector("", it.pos)
+	case it.typ == itemIdentifier && (strings.EqualFold(it.val, "inf") || strings.EqualFold(it.val, "nan")):
+		e, err = p.number(p.next())
+	case it.typ == itemIdentifier && keywords[it.val]:
+		return nil, p.errorf(it.pos, "unexpected keyword %q", it.val)
+	case it.typ == itemIdentifier && p.isAggregation():
+		e, err = p.aggregation()
+	case it.typ == itemIdentifier && p.peekAt(1).typ == itemLeftParen:
+		e, err = p.call()
+	case it.typ == itemIdentifier:
+		p.next()
+		e, err = p.vectorSelector(it.val, it.pos)
+	default:
+		return nil, p.unexpected(it, "expression")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.selectorSuffix(e)
+}
+
+func (p *parser) number(it item) (Expr, error) {
+	var (
+		v   float64
+		err error
+	)
+	if strings.HasPrefix(it.val, "0x") || strings.HasPrefix(it.val, "0X") {
+		var n uint64
+		n, err = strconv.ParseUint(it.val[2:], 16, 64)
+		v = float64(n)
+	} else {
+		v, err = strconv.ParseFloat(it.val, 64)
+	}
+	if err != nil {
+		return nil, p.errorf(it.pos, "invalid number %q", it.val)
+	}
+	return &NumberLiteral{Val: v}, nil
+}
+
+// unquote returns the value of a string item.
+func (p *parser) unquote(it item) (string, error) {
+	quote := it.val[0]
+	body := it.val[1 : len(it.val)-1]
+	if quote == '`' {
+		return body, nil
+	}
+	var sb strings.Builder
+	for len(body) > 0 {
+		r, multibyte, tail, err := strconv.UnquoteChar(body, quote)
+		if err != nil {
+			return "", p.errorf(it.pos, "invalid escape sequence in string %s", it.val)
+		}
+		if multibyte {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte(byte(r))
+		}
+		body = tail
+	}
+	return sb.String(), nil
+}
+
+// selectorSuffix parses the range and offset which may follow e.
+func (p *parser) selectorSuffix(e Expr) (Expr, error) {
+	if it := p.peek(); it.typ == itemLeftBracket {
+		vs, ok := e.(*VectorSelector)
+		if !ok {
+			return nil, p.errorf(it.pos, "ranges only allowed for vector selectors")
+		}
+		p.next()
+		d, err := p.duration("range")
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, p.errorf(it.pos, "range must be positive")
+		}
+		if _, err := p.expect(itemRightBracket, "range"); err != nil {
+			return nil, err
+		}
+		e = &MatrixSelector{VectorSelector: vs, Range: d}
+	}
+
+	if !p.isIdent("offset") {
+		return e, nil
+	}
+	it := p.next()
+	var vs *VectorSelector
+	switch e := e.(type) {
+	case *VectorSelector:
+		vs = e
+	case *MatrixSelector:
+		vs = e.VectorSelector
+	default:
+		return nil, p.errorf(it.pos, "offset modifier must be preceded by an instant or range selector")
+	}
+	negative := false
+	if next := p.peek(); next.typ == itemOperator && next.val == string(OpSub) {
+		p.next()
+		negative = true
+	}
+	d, err := p.duration("offset")
+	if err != nil {
+		return nil, err
+	}
+	if negative {
+		d = -d
+	}
+	vs.Offset = d
+	return e, nil
+}
+
+func (p *parser) duration(context string) (time.Duration, error) {
+	it, err := p.expect(itemDuration, context)
+	if err != nil {
+		return 0, err
+	}
+	d, err := ParseDuration(it.val)
+	if err != nil {
+		return 0, p.errorf(it.pos, "%s", err)
+	}
+	return d, nil
+}
+
+// unitDurations are the lengths of the duration units.
+var unitDurations = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// ParseDuration parses a duration as lexed, e.g. 1h30m.
+func ParseDuration(s string) (time.Duration, error) {
+	orig := s
+	var d time.Duration
+	for s != "" {
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		s = s[i:]
+		if s == "" {
+			return 0, fmt.Errorf("missing unit in duration %q", orig)
+		}
+		unit := s[:1]
+		if strings.HasPrefix(s, "ms") {
+			unit = "ms"
+		}
+		if _, ok := unitDurations[unit]; !ok {
+			return 0, fmt.Errorf("unknown unit %q in duration %q", unit, orig)
+		}
+		s = s[len(unit):]
+		if n > int64(1<<63-1)/int64(unitDurations[unit]) {
+			return 0, fmt.Errorf("duration %q out of range", orig)
+		}
+		d += time.Duration(n) * unitDurations[unit]
+	}
+	return d, nil
+}
+
+// vectorSelector parses the label matchers, if any, of a vector selector of
+// the metric name, starting at pos.
+func (p *parser) vectorSelector(name string, pos int) (Expr, error) {
+	vs := &VectorSelector{Name: name}
+	if name != "" {
+		vs.LabelMatchers = append(vs.LabelMatchers, metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, name))
+	}
+
+	if p.peek().typ == itemLeftBrace {
+		p.next()
+		for p.peek().typ != itemRightBrace {
+			m, err := p.labelMatcher()
+			if err != nil {
+				return nil, err
+			}
+			if m.Name == metrics.MetricNameLabel && name != "" {
+				return nil, p.errorf(pos, "metric name must not be set twice: %q or %q", name, m.Value)
+			}
+			vs.LabelMatchers = append(vs.LabelMatchers, m)
+			if p.peek().typ != itemComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(itemRightBrace, "label matching"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range vs.LabelMatchers {
+		if !m.Matches("") {
+			return vs, nil
+		}
+	}
+	return nil, p.errorf(pos, "vector selector must contain at least one non-empty matcher")
+}
+
+func (p *parser) labelMatcher() (*metrics.Matcher, error) {
+	name, err := p.labelName("label matching")
+	if err != nil {
+		return nil, err
+	}
+	opItem := p.next()
+	t, err := metrics.ParseMatchType(opItem.val)
+	if opItem.typ != itemOperator || err != nil {
+		return nil, p.unexpected(opItem, "label matching")
+	}
+	valItem, err := p.expect(itemString, "label matching")
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.unquote(valItem)
+	if err != nil {
+		return nil, err
+	}
+	m, err := metrics.NewMatcher(t, name, v)
+	if err != nil {
+		return nil, p.errorf(valItem.pos, "%s", err)
+	}
+	return m, nil
+}
+
+// labelName parses a label name, which may be a keyword.
+func (p *parser) labelName(context string) (string, error) {
+	it := p.next()
+	if it.typ != itemIdentifier || strings.Contains(it.val, ":") {
+		return "", p.unexpected(it, context)
+	}
+	return it.val, nil
+}
+
+// labelList parses a parenthesised, comma separated list of label names.
+// An empty list is returned as nil.
+func (p *parser) labelList() ([]string, error) {
+	if _, err := p.expect(itemLeftParen, "label list"); err != nil {
+		return nil, err
+	}
+	var labels []string
+	for p.peek().typ != itemRightParen {
+		name, err := p.labelName("label list")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, name)
+		if p.peek().typ != itemComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(itemRightParen, "label list"); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// isAggregation reports whether an aggregation starts at the next item: an
+// aggregation operator followed by its arguments or grouping.
+func (p *parser) isAggregation() bool {
+	if _, ok := aggregateOps[AggregateOp(p.peek().val)]; !ok {
+		return false
+	}
+	next := p.peekAt(1)
+	return next.typ == itemLeftParen || next.typ == itemIdentifier && (next.val == "by" || next.val == "without")
+}
+
+func (p *parser) aggregation() (Expr, error) {
+	it := p.next()
+	ae := &AggregateExpr{Op: AggregateOp(it.val)}
+	context := fmt.Sprintf("aggregation %q", ae.Op)
+
+	grouped := false
+	if p.isIdent("by") || p.isIdent("without") {
+		if err := p.grouping(ae); err != nil {
+			return nil, err
+		}
+		grouped = true
+	}
+
+	if _, err := p.expect(itemLeftParen, context); err != nil {
+		return nil, err
+	}
+	paramType := aggregateOps[ae.Op]
+	var err error
+	if paramType != ValueTypeNone {
+		paramPos := p.peek().pos
+		if ae.Param, err = p.expr(1); err != nil {
+			return nil, err
+		}
+		if t := ae.Param.Type(); t != paramType {
+			return nil, p.errorf(paramPos, "expected type %s in %s parameter, got %s", paramType, context, t)
+		}
+		if _, err := p.expect(itemComma, context); err != nil {
+			return nil, err
+		}
+	}
+	exprPos := p.peek().pos
+	if ae.Expr, err = p.expr(1); err != nil {
+		return nil, err
+	}
+	if t := ae.Expr.Type(); t != ValueTypeVector {
+		return nil, p.errorf(exprPos, "expected type %s in %s, got %s", ValueTypeVector, context, t)
+	}
+	if _, err := p.expect(itemRightParen, context); err != nil {
+		return nil, err
+	}
+
+	if !grouped && (p.isIdent("by") || p.isIdent("without")) {
+		if err := p.grouping(ae); err != nil {
+			return nil, err
+		}
+	}
+	return ae, nil
+}
+
+// grouping parses the by or without clause of an aggregation.
+func (p *parser) grouping(ae *AggregateExpr) error {
+	ae.Without = p.next().val == "without"
+	var err error
+	ae.Grouping, err = p.labelList()
+	return err
+}
+
+func (p *parser) call() (Expr, error) {
+	it := p.next()
+	f, ok := Functions[it.val]
+	if !ok {
+		return nil, p.errorf(it.pos, "unknown function %q", it.val)
+	}
+	context := fmt.Sprintf("call to function %q", f.Name)
+	p.next()
+
+	c := &Call{Func: f}
+	var positions []int
+	for p.peek().typ != itemRightParen {
+		positions = append(positions, p.peek().pos)
+		arg, err := p.expr(1)
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, arg)
+		if p.peek().typ != itemComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(itemRightParen, context); err != nil {
+		return nil, err
+	}
+
+	n := len(f.ArgTypes)
+	switch {
+	case f.Variadic == 0 && len(c.Args) != n:
+		return nil, p.errorf(it.pos, "expected %d argument(s) in %s, got %d", n, context, len(c.Args))
+	case f.Variadic > 0 && (len(c.Args) < n-f.Variadic || len(c.Args) > n):
+		return nil, p.errorf(it.pos, "expected %d to %d argument(s) in %s, got %d", n-f.Variadic, n, context, len(c.Args))
+	case f.Variadic < 0 && len(c.Args) < n-1:
+		return nil, p.errorf(it.pos, "expected at least %d argument(s) in %s, got %d", n-1, context, len(c.Args))
+	}
+	for i, arg := range c.Args {
+		want := f.ArgTypes[min(i, n-1)]
+		if t := arg.Type(); t != want {
+			return nil, p.errorf(positions[i], "expected type %s in %s, got %s", want, context, t)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,177 @@
+package parser
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selector returns a vector selector of the metric name with the matchers.
+func selector(name string, matchers ...*metrics.Matcher) *VectorSelector {
+	vs := &VectorSelector{Name: name}
+	if name != "" {
+		vs.LabelMatchers = append(vs.LabelMatchers, metrics.MustNewMatcher(metrics.MatchEqual, metrics.MetricNameLabel, name))
+	}
+	vs.LabelMatchers = append(vs.LabelMatchers, matchers...)
+	return vs
+}
+
+func number(v float64) *NumberLiteral {
+	return &NumberLiteral{Val: v}
+}
+
+func Test_ParseExpr(t *testing.T) {
+	tcs := []struct {
+		desc     string
+		input    string
+		expected Expr
+	}{
+		{desc: "[POSITIVE] number", input: "1.5e3", expected: number(1500)},
+		{desc: "[POSITIVE] hexadecimal number", input: "0x1f", expected: number(31)},
+		{desc: "[POSITIVE] negative number", input: "-Inf", expected: number(math.Inf(-1))},
+		{desc: "[POSITIVE] string", input: `'it\'s'`, expected: &StringLiteral{Val: "it's"}},
+		{desc: "[POSITIVE] raw string", input: "`a\\b`", expected: &StringLiteral{Val: `a\b`}},
+		{desc: "[POSITIVE] metric name", input: "up", expected: selector("up")},
+		{
+			desc:  "[POSITIVE] label matchers",
+			input: `http_requests_total{job=~"api.*", code!="500", env!~"dev|test", path="/"}`,
+			expected: selector("http_requests_total",
+				metrics.MustNewMatcher(metrics.MatchRegexp, "job", "api.*"),
+				metrics.MustNewMatcher(metrics.MatchNotEqual, "code", "500"),
+				metrics.MustNewMatcher(metrics.MatchNotRegexp, "env", "dev|test"),
+				metrics.MustNewMatcher(metrics.MatchEqual, "path", "/"),
+			),
+		},
+		{
+			desc:     "[POSITIVE] matchers without a metric name",
+			input:    `{__name__=~"job:.*", on="x",}`,
+			expected: selector("", metrics.MustNewMatcher(metrics.MatchRegexp, "__name__", "job:.*"), metrics.MustNewMatcher(metrics.MatchEqual, "on", "x")),
+		},
+		{
+			desc:     "[POSITIVE] range and offset",
+			input:    "up[1h30m] offset -5m",
+			expected: &MatrixSelector{VectorSelector: &VectorSelector{Name: "up", LabelMatchers: selector("up").LabelMatchers, Offset: -5 * time.Minute}, Range: 90 * time.Minute},
+		},
+		{
+			desc:  "[POSITIVE] precedence",
+			input: "1 + 2 * 3 ^ 2 ^ 0.5 > bool 4 == bool 5",
+			expected: &BinaryExpr{
+				Op: OpEql,
+				LHS: &BinaryExpr{
+					Op: OpGtr,
+					LHS: &BinaryExpr{Op: OpAdd, LHS: number(1), RHS: &BinaryExpr{
+						Op:  OpMul,
+						LHS: number(2),
+						RHS: &BinaryExpr{Op: OpPow, LHS: number(3), RHS: &BinaryExpr{Op: OpPow, LHS: number(2), RHS: number(0.5)}},
+					}},
+					RHS:        number(4),
+					ReturnBool: true,
+				},
+				RHS:        number(5),
+				ReturnBool: true,
+			},
+		},
+		{
+			desc:  "[POSITIVE] unary minus binds less tightly than ^",
+			input: "-a ^ 2 - b",
+			expected: &BinaryExpr{
+				Op:             OpSub,
+				LHS:            &UnaryExpr{Op: OpSub, Expr: &BinaryExpr{Op: OpPow, LHS: selector("a"), RHS: number(2)}},
+				RHS:            selector("b"),
+				VectorMatching: &VectorMatching{Card: CardOneToOne},
+			},
+		},
+		{
+			desc:  "[POSITIVE] vector matching",
+			input: "a / on(job, instance) group_left(team) b and ignoring(x) c",
+			expected: &BinaryExpr{
+				Op: OpAnd,
+				LHS: &BinaryExpr{
+					Op:             OpDiv,
+					LHS:            selector("a"),
+					RHS:            selector("b"),
+					VectorMatching: &VectorMatching{Card: CardManyToOne, On: true, MatchingLabels: []string{"job", "instance"}, Include: []string{"team"}},
+				},
+				RHS:            selector("c"),
+				VectorMatching: &VectorMatching{Card: CardManyToMany, MatchingLabels: []string{"x"}},
+			},
+		},
+		{
+			desc:     "[POSITIVE] aggregation with grouping first",
+			input:    "sum by (job) (a)",
+			expected: &AggregateExpr{Op: AggrSum, Expr: selector("a"), Grouping: []string{"job"}},
+		},
+		{
+			desc:     "[POSITIVE] aggregation with grouping last and a parameter",
+			input:    "topk(3, a) without (instance)",
+			expected: &AggregateExpr{Op: AggrTopK, Param: number(3), Expr: selector("a"), Grouping: []string{"instance"}, Without: true},
+		},
+		{
+			desc:     "[POSITIVE] aggregation operator as a metric name",
+			input:    "count + 1",
+			expected: &BinaryExpr{Op: OpAdd, LHS: selector("count"), RHS: number(1)},
+		},
+		{
+			desc:  "[POSITIVE] function with optional arguments and comments",
+			input: "round(\n\t(a), # to the nearest 5\n\t5\n)",
+			expected: &Call{Func: Functions["round"], Args: []Expr{
+				&ParenExpr{Expr: selector("a")},
+				number(5),
+			}},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			e, err := ParseExpr(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, e)
+		})
+	}
+}
+
+func Test_ParseExprErrors(t *testing.T) {
+	tcs := []struct {
+		desc     string
+		input    string
+		expected string
+	}{
+		{desc: "[NEGATIVE] unexpected token", input: "sum(a) )", expected: `parse error at 1:8: unexpected ")"`},
+		{desc: "[NEGATIVE] unterminated string", input: `a{b="c}`, expected: "parse error at 1:5: unterminated string"},
+		{desc: "[NEGATIVE] position on a later line", input: "a +\n  b{", expected: "parse error at 2:5: unexpected end of input in label matching"},
+		{desc: "[NEGATIVE] bad duration", input: "a[5x]", expected: `parse error at 1:3: bad number or duration "5x"`},
+		{desc: "[NEGATIVE] empty matchers", input: `{a=""}`, expected: "parse error at 1:1: vector selector must contain at least one non-empty matcher"},
+		{desc: "[NEGATIVE] invalid regexp", input: `a{b=~"("}`, expected: "parse error at 1:6: compiling matcher regexp: error parsing regexp: missing closing ): `^(?:()$`"},
+		{desc: "[NEGATIVE] metric name set twice", input: `a{__name__="b"}`, expected: `parse error at 1:1: metric name must not be set twice: "a" or "b"`},
+		{desc: "[NEGATIVE] range of an expression", input: "(a)[5m]", expected: "parse error at 1:4: ranges only allowed for vector selectors"},
+		{desc: "[NEGATIVE] matrix in a binary expression", input: "a[5m] + 1", expected: "parse error at 1:7: binary expression must contain only scalar and instant vector types, got matrix"},
+		{desc: "[NEGATIVE] scalar comparison without bool", input: "1 > 2", expected: "parse error at 1:3: comparisons between scalars must use bool modifier"},
+		{desc: "[NEGATIVE] set operator on scalars", input: "a and 1", expected: `parse error at 1:3: set operator "and" not allowed in binary scalar expression`},
+		{desc: "[NEGATIVE] grouping for a set operator", input: "a or on(b) group_left c", expected: `parse error at 1:12: no grouping allowed for "or" operation`},
+		{desc: "[NEGATIVE] unknown function", input: "foo(a)", expected: `parse error at 1:1: unknown function "foo"`},
+		{desc: "[NEGATIVE] wrong number of arguments", input: "abs(a, b)", expected: `parse error at 1:1: expected 1 argument(s) in call to function "abs", got 2`},
+		{desc: "[NEGATIVE] wrong argument type", input: `clamp_min(a, "1")`, expected: `parse error at 1:14: expected type scalar in call to function "clamp_min", got string`},
+		{desc: "[NEGATIVE] aggregation of a scalar", input: "sum(1)", expected: `parse error at 1:5: expected type vector in aggregation "sum", got scalar`},
+		{desc: "[NEGATIVE] keyword as a metric name", input: "by", expected: `parse error at 1:1: unexpected keyword "by"`},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := ParseExpr(tc.input)
+			var pe *ParseError
+			require.ErrorAs(t, err, &pe)
+			assert.Equal(t, tc.expected, err.Error())
+		})
+	}
+}
+
+func Test_ParseMetricSelector(t *testing.T) {
+	matchers, err := ParseMetricSelector(`up{job="api"}`)
+	require.NoError(t, err)
+	assert.Equal(t, selector("up", metrics.MustNewMatcher(metrics.MatchEqual, "job", "api")).LabelMatchers, matchers)
+
+	_, err = ParseMetricSelector("up[5m]")
+	assert.EqualError(t, err, "parse error at 1:1: expected a series selector")
+}
@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+)
+
+func (e *NumberLiteral) String() string {
+	switch {
+	case math.IsInf(e.Val, 1):
+		return "+Inf"
+	case math.IsInf(e.Val, -1):
+		return "-Inf"
+	case math.IsNaN(e.Val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(e.Val, 'g', -1, 64)
+}
+
+func (e *StringLiteral) String() string {
+	return strconv.Quote(e.Val)
+}
+
+func (e *VectorSelector) String() string {
+	return e.selector() + offsetString(e.Offset)
+}
+
+// selector prints the metric name and label matchers of the selector,
+// without its offset.
+func (e *VectorSelector) selector() string {
+	var matchers []string
+	for _, m := range e.LabelMatchers {
+		// The metric name is printed as the name alone.
+		if e.Name != "" && m.Name == metrics.MetricNameLabel && m.Type == metrics.MatchEqual && m.Value == e.Name {
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+	if len(matchers) == 0 {
+		return e.Name
+	}
+	return e.Name + "{" + strings.Join(matchers, ", ") + "}"
+}
+
+func (e *MatrixSelector) String() string {
+	return e.VectorSelector.selector() + "[" + FormatDuration(e.Range) + "]" + offsetString(e.VectorSelector.Offset)
+}
+
+func offsetString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	if d < 0 {
+		return " offset -" + FormatDuration(-d)
+	}
+	return " offset " + FormatDuration(d)
+}
+
+func (e *ParenExpr) String() string {
+	return "(" + e.Expr.String() + ")"
+}
+
+func (e *UnaryExpr) String() string {
+	return string(e.Op) + e.Expr.String()
+}
+
+func (e *BinaryExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(e.LHS.String())
+	sb.WriteString(" " + string(e.Op))
+	if e.ReturnBool {
+		sb.WriteString(" bool")
+	}
+	if vm := e.VectorMatching; vm != nil {
+		switch {
+		case vm.On:
+			sb.WriteString(" on(" + strings.Join(vm.MatchingLabels, ", ") + ")")
+		case len(vm.MatchingLabels) > 0 || vm.Card == CardManyToOne || vm.Card == CardOneToMany:
+			sb.WriteString(" ignoring(" + strings.Join(vm.MatchingLabels, ", ") + ")")
+		}
+		switch vm.Card {
+		case CardManyToOne:
+			sb.WriteString(" group_left(" + strings.Join(vm.Include, ", ") + ")")
+		case CardOneToMany:
+			sb.WriteString(" group_right(" + strings.Join(vm.Include, ", ") + ")")
+		}
+	}
+	sb.WriteString(" " + e.RHS.String())
+	return sb.String()
+}
+
+func (e *AggregateExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(string(e.Op))
+	switch {
+	case e.Without:
+		sb.WriteString(" without (" + strings.Join(e.Grouping, ", ") + ") ")
+	case len(e.Grouping) > 0:
+		sb.WriteString(" by (" + strings.Join(e.Grouping, ", ") + ") ")
+	}
+	sb.WriteString("(")
+	if e.Param != nil {
+		sb.WriteString(e.Param.String() + ", ")
+	}
+	sb.WriteString(e.Expr.String() + ")")
+	return sb.String()
+}
+
+func (e *Call) String() string {
+	args := make([]string, 0, len(e.Args))
+	for _, arg := range e.Args {
+		args = append(args, arg.String())
+	}
+	return e.Func.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// durationUnitsDesc are the duration units, longest first.
+var durationUnitsDesc = []string{"y", "w", "d", "h", "m", "s", "ms"}
+
+// FormatDuration prints a duration as queries write it, e.g. 1h30m.
+// Durations are truncated to milliseconds.
+func FormatDuration(d time.Duration) string {
+	if d < time.Millisecond {
+		return "0s"
+	}
+	var sb strings.Builder
+	for _, u := range durationUnitsDesc {
+		if n := d / unitDurations[u]; n > 0 {
+			sb.WriteString(strconv.FormatInt(int64(n), 10) + u)
+			d -= n * unitDurations[u]
+		}
+	}
+	return sb.String()
+}
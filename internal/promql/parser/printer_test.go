@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Printer(t *testing.T) {
+	tcs := []struct {
+		desc     string
+		input    string
+		expected string
+	}{
+		{desc: "[POSITIVE] numbers", input: "0x10 + -1.5e-3 * +Inf", expected: "16 + -0.0015 * +Inf"},
+		{desc: "[POSITIVE] strings are double quoted", input: "label_replace(a, 'dst', `\\d`, \"src\", \"(.*)\")", expected: `label_replace(a, "dst", "\\d", "src", "(.*)")`},
+		{desc: "[POSITIVE] selectors", input: `a{b="c",d=~'e\n'}[90s] offset 1w`, expected: `a{b="c", d=~"e\n"}[1m30s] offset 1w`},
+		{desc: "[POSITIVE] nameless selector", input: `{__name__=~"a.+"}  offset -1h`, expected: `{__name__=~"a.+"} offset -1h`},
+		{desc: "[POSITIVE] parentheses are kept", input: "-(a+b)^2", expected: "-(a + b) ^ 2"},
+		{desc: "[POSITIVE] vector matching", input: "a>bool ignoring(x)group_right b", expected: "a > bool ignoring(x) group_right() b"},
+		{desc: "[POSITIVE] empty on", input: "a unless on() b", expected: "a unless on() b"},
+		{desc: "[POSITIVE] aggregations", input: "count_values without() ('v', a) + sum(a) by (x,y)", expected: `count_values without () ("v", a) + sum by (x, y) (a)`},
+		{desc: "[POSITIVE] functions", input: "round(a,0.5) - time()", expected: "round(a, 0.5) - time()"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			e, err := ParseExpr(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, e.String())
+
+			// The printed query parses back to the same tree.
+			reparsed, err := ParseExpr(e.String())
+			require.NoError(t, err)
+			assert.Equal(t, e, reparsed)
+		})
+	}
+}
+
+func Test_FormatDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		0:                                  "0s",
+		1500 * time.Millisecond:            "1s500ms",
+		90 * time.Minute:                   "1h30m",
+		(365+8)*24*time.Hour + time.Second: "1y1w1d1s",
+	} {
+		assert.Equal(t, expected, FormatDuration(d))
+		if d > 0 {
+			parsed, err := ParseDuration(expected)
+			require.NoError(t, err)
+			assert.Equal(t, d, parsed)
+		}
+	}
+}
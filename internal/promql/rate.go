@@ -0,0 +1,182 @@
+package promql
+
+import (
+	"math"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// evalRange evaluates the range vector argument of call at ts, returning its
+// series and the start and end of its range.
+func (ev *evaluator) evalRange(call *parser.Call, ts int64) (m Matrix, start, end int64) {
+	var ms *parser.MatrixSelector
+	for _, arg := range call.Args {
+		if sel, ok := arg.(*parser.MatrixSelector); ok {
+			ms = sel
+			break
+		}
+	}
+	end = ts - seconds(ms.VectorSelector.Offset)
+	return ev.selectMatrix(ms, ts), end - seconds(ms.Range), end
+}
+
+// rangeFunction returns a function applying f to the float samples of each
+// series of a range vector, leaving out native histograms. Series f returns
+// no value for are left out.
+func rangeFunction(f func(points []Point, start, end int64) (float64, bool)) function {
+	return func(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+		m, start, end := ev.evalRange(call, ts)
+		res := make(Vector, 0, len(m))
+		for _, s := range m {
+			if v, ok := f(floatPoints(s.Points), start, end); ok {
+				res = append(res, Sample{Metric: dropMetricName(s.Metric), T: ts, F: v})
+			}
+		}
+		return res, nil
+	}
+}
+
+// floatPoints returns the points which are not native histograms.
+func floatPoints(points []Point) []Point {
+	floats := 0
+	for _, p := range points {
+		if p.H == nil {
+			floats++
+		}
+	}
+	if floats == len(points) {
+		return points
+	}
+	res := make([]Point, 0, floats)
+	for _, p := range points {
+		if p.H == nil {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// extrapolatedFunction returns a function returning the extrapolated rate of
+// each series of a range vector if isRate, and otherwise its increase, of
+// floats or native histograms alike. Series mixing the two are left out.
+func extrapolatedFunction(isRate bool) function {
+	return func(ev *evaluator, call *parser.Call, ts int64) (Value, error) {
+		m, start, end := ev.evalRange(call, ts)
+		res := make(Vector, 0, len(m))
+		for _, s := range m {
+			sample := Sample{Metric: dropMetricName(s.Metric), T: ts}
+			var ok bool
+			switch histograms := len(s.Points) - len(floatPoints(s.Points)); histograms {
+			case 0:
+				sample.F, ok = extrapolatedRate(s.Points, start, end, isRate)
+			case len(s.Points):
+				sample.H, ok = extrapolatedHistogramRate(s.Points, start, end, isRate)
+			}
+			if ok {
+				res = append(res, sample)
+			}
+		}
+		return res, nil
+	}
+}
+
+// extrapolatedRate returns the increase of a counter over the range from
+// start to end, or its per-second rate if isRate, as Prometheus calculates
+// it. Decreases are taken as counter resets, after which the counter
+// restarted from zero. The increase between the first and last samples is
+// extrapolated as extrapolation does, and never to before the counter would
+// have been zero.
+func extrapolatedRate(points []Point, start, end int64, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	first, last := points[0], points[len(points)-1]
+	increase := last.F - first.F
+	prev := first.F
+	for _, p := range points[1:] {
+		if p.F < prev {
+			increase += prev
+		}
+		prev = p.F
+	}
+
+	toZero := math.Inf(1)
+	if increase > 0 && first.F >= 0 {
+		toZero = float64(last.T-first.T) * (first.F / increase)
+	}
+	return increase * extrapolation(points, start, end, toZero, isRate), true
+}
+
+// extrapolatedHistogramRate is extrapolatedRate for native histograms. A
+// decrease in any bucket is taken as a counter reset.
+func extrapolatedHistogramRate(points []Point, start, end int64, isRate bool) (*metrics.Histogram, bool) {
+	if len(points) < 2 {
+		return nil, false
+	}
+	first, last := points[0], points[len(points)-1]
+	increase := last.H.Sub(first.H)
+	prev := first.H
+	for _, p := range points[1:] {
+		if p.H.ResetSince(prev) {
+			increase = increase.Add(prev)
+		}
+		prev = p.H
+	}
+	return increase.Mul(extrapolation(points, start, end, math.Inf(1), isRate)), true
+}
+
+// extrapolation returns the factor the increase between the first and last
+// of points is multiplied by to extrapolate it towards the ends of the range
+// from start to end, and divide it by the range's length if isRate. It is
+// extrapolated by up to half the average interval between samples where the
+// series appears to start or end within the range, and by at most toZero
+// before the first sample.
+func extrapolation(points []Point, start, end int64, toZero float64, isRate bool) float64 {
+	first, last := points[0], points[len(points)-1]
+	sampled := float64(last.T - first.T)
+	avgInterval := sampled / float64(len(points)-1)
+	threshold := avgInterval * 1.1
+	toStart, toEnd := float64(first.T-start), float64(end-last.T)
+	if toStart >= threshold {
+		toStart = avgInterval / 2
+	}
+	toStart = math.Min(toStart, toZero)
+	if toEnd >= threshold {
+		toEnd = avgInterval / 2
+	}
+
+	factor := (sampled + toStart + toEnd) / sampled
+	if isRate {
+		factor /= float64(end - start)
+	}
+	return factor
+}
+
+// irate returns the per-second rate of a counter between its last two
+// samples, taking a decrease as a reset to zero.
+func irate(points []Point, _, _ int64) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	prev, last := points[len(points)-2], points[len(points)-1]
+	inc := last.F - prev.F
+	if last.F < prev.F {
+		inc = last.F
+	}
+	return inc / float64(last.T-prev.T), true
+}
+
+// resets returns the number of times a counter decreased.
+func resets(points []Point, _, _ int64) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+	n := 0
+	for i := 1; i < len(points); i++ {
+		if points[i].F < points[i-1].F {
+			n++
+		}
+	}
+	return float64(n), true
+}
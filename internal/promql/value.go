@@ -0,0 +1,220 @@
+package promql
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+// Label is a label name and value.
+type Label struct {
+	Name, Value string
+}
+
+// Labels is a set of labels sorted by name. The metric name is the
+// metrics.MetricNameLabel label.
+type Labels []Label
+
+// LabelsFromMap returns the labels of m.
+func LabelsFromMap(m map[string]string) Labels {
+	ls := make(Labels, 0, len(m))
+	for name, value := range m {
+		ls = append(ls, Label{Name: name, Value: value})
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+	return ls
+}
+
+// Map returns the labels as a map.
+func (ls Labels) Map() map[string]string {
+	m := make(map[string]string, len(ls))
+	for _, l := range ls {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+// Get returns the value of the named label, or the empty string.
+func (ls Labels) Get(name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Without returns the labels other than those named.
+func (ls Labels) Without(names ...string) Labels {
+	res := make(Labels, 0, len(ls))
+	for _, l := range ls {
+		if !contains(names, l.Name) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// Keep returns the labels named.
+func (ls Labels) Keep(names ...string) Labels {
+	res := make(Labels, 0, len(names))
+	for _, l := range ls {
+		if contains(names, l.Name) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// Set returns the labels with the named label set to value, or removed if
+// value is empty.
+func (ls Labels) Set(name, value string) Labels {
+	res := ls.Without(name)
+	if value == "" {
+		return res
+	}
+	i := sort.Search(len(res), func(i int) bool { return res[i].Name >= name })
+	res = append(res, Label{})
+	copy(res[i+1:], res[i:])
+	res[i] = Label{Name: name, Value: value}
+	return res
+}
+
+// Compare orders two label sets by their (name, value) pairs.
+func (ls Labels) Compare(other Labels) int {
+	for i := 0; i < len(ls) && i < len(other); i++ {
+		if c := strings.Compare(ls[i].Name, other[i].Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(ls[i].Value, other[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(ls) - len(other)
+}
+
+// String prints the labels as a series selector, e.g. up{job="api"}, which
+// also serves as a key unique to the label set.
+func (ls Labels) String() string {
+	var sb strings.Builder
+	sb.WriteString(ls.Get(metrics.MetricNameLabel))
+	sb.WriteByte('{')
+	first := true
+	for _, l := range ls {
+		if l.Name == metrics.MetricNameLabel {
+			continue
+		}
+		if !first {
+			sb.WriteString(", ")
+		}
+		first = false
+		sb.WriteString(l.Name + "=" + strconv.Quote(l.Value))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Value is the result of evaluating an expression.
+type Value interface {
+	Type() parser.ValueType
+	String() string
+}
+
+// Scalar is a single number.
+type Scalar struct {
+	T int64
+	V float64
+}
+
+// String is a single string.
+type String struct {
+	T int64
+	V string
+}
+
+// Point is a sample of a series: a native histogram if H is set, and F
+// otherwise.
+type Point struct {
+	T int64
+	F float64
+	H *metrics.Histogram
+}
+
+// Sample is the sample of a series in a Vector: a native histogram if H is
+// set, and F otherwise.
+type Sample struct {
+	Metric Labels
+	T      int64
+	F      float64
+	H      *metrics.Histogram
+}
+
+// Vector holds a sample of each of a set of series, all at the same time.
+type Vector []Sample
+
+// Series is a series and its samples in a Matrix.
+type Series struct {
+	Metric Labels
+	Points []Point
+}
+
+// Matrix holds a range of samples of each of a set of series.
+type Matrix []Series
+
+func (Scalar) Type() parser.ValueType { return parser.ValueTypeScalar }
+func (String) Type() parser.ValueType { return parser.ValueTypeString }
+func (Vector) Type() parser.ValueType { return parser.ValueTypeVector }
+func (Matrix) Type() parser.ValueType { return parser.ValueTypeMatrix }
+
+func (s Scalar) String() string {
+	return "scalar: " + formatFloat(s.V) + " @" + strconv.FormatInt(s.T, 10)
+}
+
+func (s String) String() string {
+	return "string: " + strconv.Quote(s.V) + " @" + strconv.FormatInt(s.T, 10)
+}
+
+func (v Vector) String() string {
+	lines := make([]string, 0, len(v))
+	for _, s := range v {
+		lines = append(lines, s.Metric.String()+" => "+formatValue(s.F, s.H)+" @"+strconv.FormatInt(s.T, 10))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m Matrix) String() string {
+	lines := make([]string, 0, len(m))
+	for _, s := range m {
+		points := make([]string, 0, len(s.Points))
+		for _, p := range s.Points {
+			points = append(points, formatValue(p.F, p.H)+" @"+strconv.FormatInt(p.T, 10))
+		}
+		lines = append(lines, s.Metric.String()+" =>\n"+strings.Join(points, "\n"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatValue prints a sample value, the native histogram h if set.
+func formatValue(f float64, h *metrics.Histogram) string {
+	if h != nil {
+		return h.String()
+	}
+	return formatFloat(f)
+}
+
+// formatFloat prints a sample value, e.g. 1.5, +Inf or NaN.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
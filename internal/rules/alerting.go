@@ -0,0 +1,244 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+)
+
+const (
+	// alertsMetricName is the name of the series recording the pending and
+	// firing alerts of alerting rules, with the value 1.
+	alertsMetricName = "ALERTS"
+	alertNameLabel   = "alertname"
+	alertStateLabel  = "alertstate"
+)
+
+// resendDelay is how long after an alert is sent to the Alertmanager it is
+// sent again, while it fires.
+const resendDelay = time.Minute
+
+// resolvedRetention is how long after an alert resolves it is kept, being
+// sent as resolved to the Alertmanager.
+const resolvedRetention = 15 * time.Minute
+
+// templatePreamble defines $labels and $value in the label and annotation
+// templates of alerting rules, as the labels and value of the series an
+// alert is for.
+const templatePreamble = "{{ $labels := .Labels }}{{ $value := .Value }}"
+
+// AlertState is the state of an alert.
+type AlertState int
+
+const (
+	// StateInactive is the state of an alert which fired and has resolved.
+	StateInactive AlertState = iota
+	// StatePending is the state of an alert which is active, but not yet
+	// for the hold duration of its rule.
+	StatePending
+	// StateFiring is the state of an alert which has been active for the
+	// hold duration of its rule.
+	StateFiring
+)
+
+func (s AlertState) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateFiring:
+		return "firing"
+	default:
+		return "inactive"
+	}
+}
+
+// Alert is an alert of an alerting rule, for one series of the result of
+// its query. Times are in seconds.
+type Alert struct {
+	State       AlertState
+	Labels      map[string]string
+	Annotations map[string]string
+	// Value is the value of the series the alert is for when last active.
+	Value float64
+
+	// ActiveAt is when the alert became pending, FiredAt when it started
+	// firing, and ResolvedAt when it stopped.
+	ActiveAt   int64
+	FiredAt    int64
+	ResolvedAt int64
+	// LastSentAt is when the alert was last sent to the Alertmanager, and
+	// ValidUntil when the Alertmanager should take a firing alert to have
+	// resolved should it not be sent again.
+	LastSentAt int64
+	ValidUntil int64
+}
+
+// needsSending returns whether a at ts is to be sent to the Alertmanager.
+func (a *Alert) needsSending(ts int64) bool {
+	if a.State == StatePending {
+		return false
+	}
+	if a.ResolvedAt > a.LastSentAt {
+		return true
+	}
+	return a.LastSentAt+int64(resendDelay/time.Second) <= ts
+}
+
+// AlertingRule is a rule firing an alert for each series of the result of
+// its query which stays in it for the rule's hold duration.
+type AlertingRule struct {
+	name                string
+	query               string
+	holdDuration        time.Duration
+	labelTemplates      map[string]*template.Template
+	annotationTemplates map[string]*template.Template
+
+	// active are the alerts of the rule, keyed by the string form of their
+	// labels.
+	active map[string]*Alert
+	// series are the label sets of the ALERTS series written by the rule's
+	// last evaluation, keyed by their string form.
+	series map[string]map[string]string
+}
+
+// Name returns the name of the alerts the rule fires.
+func (r *AlertingRule) Name() string {
+	return r.name
+}
+
+// Query returns the query the rule evaluates.
+func (r *AlertingRule) Query() string {
+	return r.query
+}
+
+// HoldDuration returns how long a series must stay in the result of the
+// rule's query before its alert fires.
+func (r *AlertingRule) HoldDuration() time.Duration {
+	return r.holdDuration
+}
+
+func newAlertingRule(name, query, holdDuration string, labels, annotations map[string]string) (*AlertingRule, error) {
+	if !metricNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("alert %q is not a valid alert name: %w", name, ErrInvalidRule)
+	}
+	if err := validateQuery(query); err != nil {
+		return nil, err
+	}
+	if err := validateLabelNames(labels); err != nil {
+		return nil, err
+	}
+	if err := validateLabelNames(annotations); err != nil {
+		return nil, err
+	}
+	r := &AlertingRule{name: name, query: query, active: map[string]*Alert{}}
+	if holdDuration != "" {
+		d, err := parser.ParseDuration(holdDuration)
+		if err != nil {
+			return nil, fmt.Errorf("for %q: %w", holdDuration, ErrInvalidRule)
+		}
+		r.holdDuration = d
+	}
+	var err error
+	if r.labelTemplates, err = parseTemplates(labels); err != nil {
+		return nil, err
+	}
+	if r.annotationTemplates, err = parseTemplates(annotations); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// templateData is what the label and annotation templates of an alert are
+// executed over.
+type templateData struct {
+	Labels map[string]string
+	Value  float64
+}
+
+func parseTemplates(texts map[string]string) (map[string]*template.Template, error) {
+	tmpls := make(map[string]*template.Template, len(texts))
+	for name, text := range texts {
+		t, err := template.New(name).Option("missingkey=zero").Parse(templatePreamble + text)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w: %w", name, ErrInvalidRule, err)
+		}
+		tmpls[name] = t
+	}
+	return tmpls, nil
+}
+
+// expandTemplates executes tmpls over data, keeping the error of any which
+// fail in place of their text.
+func expandTemplates(tmpls map[string]*template.Template, data templateData) map[string]string {
+	texts := make(map[string]string, len(tmpls))
+	for name, t := range tmpls {
+		var sb strings.Builder
+		if err := t.Execute(&sb, data); err != nil {
+			texts[name] = fmt.Sprintf("<error expanding template: %v>", err)
+			continue
+		}
+		texts[name] = sb.String()
+	}
+	return texts
+}
+
+// update updates the alerts of r from vec, the result of its query at ts.
+// An alert becomes pending when its series appears in the result, and
+// fires once it has stayed in it for the rule's hold duration. A pending
+// alert whose series leaves the result is dropped, and a firing one
+// resolves, being kept for resolvedRetention.
+func (r *AlertingRule) update(vec promql.Vector, ts int64) error {
+	results := make(map[string]*Alert, len(vec))
+	for _, s := range vec {
+		if s.H != nil {
+			continue
+		}
+		data := templateData{Labels: s.Metric.Without(metrics.MetricNameLabel).Map(), Value: s.F}
+		labelSet := s.Metric.Without(metrics.MetricNameLabel).Map()
+		for k, v := range expandTemplates(r.labelTemplates, data) {
+			labelSet[k] = v
+		}
+		labelSet[alertNameLabel] = r.name
+		key := promql.LabelsFromMap(labelSet).String()
+		if _, ok := results[key]; ok {
+			return fmt.Errorf("%s: %w", key, ErrDuplicateResult)
+		}
+		results[key] = &Alert{
+			State:       StatePending,
+			Labels:      labelSet,
+			Annotations: expandTemplates(r.annotationTemplates, data),
+			Value:       s.F,
+			ActiveAt:    ts,
+		}
+	}
+
+	for key, result := range results {
+		if a, ok := r.active[key]; ok && a.State != StateInactive {
+			a.Value, a.Annotations = result.Value, result.Annotations
+			continue
+		}
+		r.active[key] = result
+	}
+	for key, a := range r.active {
+		if _, ok := results[key]; !ok {
+			switch {
+			case a.State == StatePending:
+				delete(r.active, key)
+			case a.State == StateFiring:
+				a.State, a.ResolvedAt = StateInactive, ts
+			case ts-a.ResolvedAt > int64(resolvedRetention/time.Second):
+				delete(r.active, key)
+			}
+			continue
+		}
+		if a.State == StatePending && ts-a.ActiveAt >= int64(r.holdDuration/time.Second) {
+			a.State, a.FiredAt = StateFiring, ts
+		}
+	}
+	return nil
+}
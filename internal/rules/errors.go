@@ -0,0 +1,13 @@
+package rules
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidGroup     = errors.New("invalid rule group")
+	ErrInvalidRule      = errors.New("invalid rule")
+	ErrUnexpectedResult = errors.New("unexpected rule result type")
+	ErrDuplicateResult  = errors.New("rule result contains series with the same labels")
+	ErrAlertsRejected   = errors.New("alertmanager rejected alerts")
+)
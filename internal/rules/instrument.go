@@ -0,0 +1,31 @@
+package rules
+
+import "github.com/mikanmekan/koalemos/internal/instrument"
+
+// managerMetrics are the metrics the manager records about the rule groups
+// it evaluates, by group.
+type managerMetrics struct {
+	evaluations          *instrument.Counter
+	evaluationFailures   *instrument.Counter
+	lastDuration         *instrument.Gauge
+	lastEvaluation       *instrument.Gauge
+	alertsSent           *instrument.Counter
+	notificationFailures *instrument.Counter
+}
+
+func newManagerMetrics(r *instrument.Registry) *managerMetrics {
+	return &managerMetrics{
+		evaluations: r.NewCounter("koalemos_rule_group_evaluations_total",
+			"Number of evaluations of the rules of a rule group.", "rule_group"),
+		evaluationFailures: r.NewCounter("koalemos_rule_group_evaluation_failures_total",
+			"Number of rule evaluations of a rule group which failed.", "rule_group"),
+		lastDuration: r.NewGauge("koalemos_rule_group_last_duration_seconds",
+			"Duration of the last evaluation of the rules of a rule group.", "rule_group"),
+		lastEvaluation: r.NewGauge("koalemos_rule_group_last_evaluation_timestamp_seconds",
+			"Time of the last evaluation of the rules of a rule group.", "rule_group"),
+		alertsSent: r.NewCounter("koalemos_rule_group_alerts_sent_total",
+			"Number of alerts of a rule group sent to the Alertmanager.", "rule_group"),
+		notificationFailures: r.NewCounter("koalemos_rule_group_notification_failures_total",
+			"Number of times sending the alerts of a rule group to the Alertmanager failed.", "rule_group"),
+	}
+}
@@ -0,0 +1,249 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"go.uber.org/zap"
+)
+
+// Storage is a store rules are evaluated over and record their results in.
+type Storage interface {
+	store.IMS
+	promql.Queryable
+}
+
+// notifyTimeout is how long sending the alerts of a group's evaluation to
+// the Alertmanager may take.
+const notifyTimeout = 10 * time.Second
+
+// Manager evaluates the rules of rule groups, each group at its own
+// interval, and sends the alerts of their alerting rules to an
+// Alertmanager.
+type Manager struct {
+	logger   log.Logger
+	storage  Storage
+	engine   *promql.Engine
+	groups   []*Group
+	notifier *Notifier
+	metrics  *managerMetrics
+}
+
+// NewManager returns a Manager evaluating the rules of groups over storage
+// with engine and sending alerts with notifier, or not at all if nil. It
+// records metrics about itself in r, or a registry of its own if r is nil.
+func NewManager(l log.Logger, storage Storage, engine *promql.Engine, groups []*Group, notifier *Notifier, r *instrument.Registry) *Manager {
+	if r == nil {
+		r = instrument.NewRegistry()
+	}
+	return &Manager{
+		logger:   l,
+		storage:  storage,
+		engine:   engine,
+		groups:   groups,
+		notifier: notifier,
+		metrics:  newManagerMetrics(r),
+	}
+}
+
+// Run evaluates the rules of every group at its interval until ctx is
+// done.
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, g := range m.groups {
+		wg.Add(1)
+		go func(g *Group) {
+			defer wg.Done()
+			m.runGroup(ctx, g)
+		}(g)
+	}
+	wg.Wait()
+}
+
+func (m *Manager) runGroup(ctx context.Context, g *Group) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			m.EvalGroup(ctx, g, t.Unix())
+		}
+	}
+}
+
+// EvalGroup evaluates the rules of g at ts, in order, recording their
+// results in the store, then sends the alerts of its alerting rules due to
+// be sent. A rule which fails is logged and counted, and does not stop the
+// rules after it from being evaluated.
+func (m *Manager) EvalGroup(ctx context.Context, g *Group, ts int64) {
+	start := time.Now()
+	m.metrics.evaluations.With(g.name).Inc()
+	var alerts []*Alert
+	for _, r := range g.rules {
+		var err error
+		switch r := r.(type) {
+		case *RecordingRule:
+			err = m.evalRecordingRule(ctx, r, ts)
+		case *AlertingRule:
+			var due []*Alert
+			due, err = m.evalAlertingRule(ctx, r, g.interval, ts)
+			alerts = append(alerts, due...)
+		}
+		if err != nil {
+			m.metrics.evaluationFailures.With(g.name).Inc()
+			m.logger.Warn("failed to evaluate rule", zap.String("group", g.name), zap.String("rule", r.Name()), zap.Error(err))
+		}
+	}
+	m.metrics.lastDuration.With(g.name).Set(time.Since(start).Seconds())
+	m.metrics.lastEvaluation.With(g.name).Set(float64(ts))
+
+	if m.notifier != nil && len(alerts) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		defer cancel()
+		m.metrics.alertsSent.With(g.name).Add(float64(len(alerts)))
+		if err := m.notifier.Send(ctx, alerts); err != nil {
+			m.metrics.notificationFailures.With(g.name).Inc()
+			m.logger.Warn("failed to send alerts", zap.String("group", g.name), zap.Error(err))
+		}
+	}
+}
+
+// query evaluates query at ts, returning a scalar result as a vector of one
+// sample without labels.
+func (m *Manager) query(ctx context.Context, query string, ts int64) (promql.Vector, error) {
+	v, err := m.engine.InstantQuery(ctx, m.storage, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case promql.Vector:
+		return v, nil
+	case promql.Scalar:
+		return promql.Vector{{F: v.V}}, nil
+	default:
+		return nil, fmt.Errorf("%s: %w", v.Type(), ErrUnexpectedResult)
+	}
+}
+
+// evalRecordingRule evaluates r at ts and records its result, one series
+// per sample named after the rule, with the rule's labels added.
+func (m *Manager) evalRecordingRule(ctx context.Context, r *RecordingRule, ts int64) error {
+	vec, err := m.query(ctx, r.query, ts)
+	if err != nil {
+		return err
+	}
+	points := make([]metrics.MetricPoint, 0, len(vec))
+	for _, s := range vec {
+		labelSet := s.Metric.Without(metrics.MetricNameLabel).Map()
+		for k, v := range r.labels {
+			labelSet[k] = v
+		}
+		points = append(points, metrics.MetricPoint{LabelSet: labelSet, Value: s.F, Histogram: s.H})
+	}
+	series, err := m.writeSeries(r.record, points, r.series, ts)
+	if err != nil {
+		return err
+	}
+	r.series = series
+	return nil
+}
+
+// evalAlertingRule evaluates r at ts, updating its alerts and recording the
+// pending and firing ones as ALERTS series. It returns the alerts due to be
+// sent to the Alertmanager, taking them to be sent.
+func (m *Manager) evalAlertingRule(ctx context.Context, r *AlertingRule, interval time.Duration, ts int64) ([]*Alert, error) {
+	vec, err := m.query(ctx, r.query, ts)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.update(vec, ts); err != nil {
+		return nil, err
+	}
+
+	// As Prometheus does, firing alerts are valid until a few evaluations
+	// or resends later, so one missed send does not resolve them.
+	validFor := interval
+	if validFor < resendDelay {
+		validFor = resendDelay
+	}
+	var points []metrics.MetricPoint
+	var due []*Alert
+	for _, a := range r.active {
+		if a.State != StateInactive {
+			labelSet := make(map[string]string, len(a.Labels)+1)
+			for k, v := range a.Labels {
+				labelSet[k] = v
+			}
+			labelSet[alertStateLabel] = a.State.String()
+			points = append(points, metrics.MetricPoint{LabelSet: labelSet, Value: 1})
+		}
+		if a.needsSending(ts) {
+			a.LastSentAt, a.ValidUntil = ts, ts+4*int64(validFor/time.Second)
+			due = append(due, a)
+		}
+	}
+	series, err := m.writeSeries(alertsMetricName, points, r.series, ts)
+	if err != nil {
+		return nil, err
+	}
+	r.series = series
+	return due, nil
+}
+
+// writeSeries records points, whose label sets and values are set, as
+// samples of series called name at ts. Series of prev, the label sets
+// written by the last call for the same rule keyed by their string form,
+// which are missing from points are marked stale. It returns the label sets
+// of points, keyed by their string form.
+func (m *Manager) writeSeries(name string, points []metrics.MetricPoint, prev map[string]map[string]string, ts int64) (map[string]map[string]string, error) {
+	mf := metrics.NewMetricFamily(metrics.MetricDefinition{Name: name, Type: "untyped"})
+	mfs := metrics.NewMetricFamiliesTimeGroup()
+	mfs.Time = ts
+	mfs.AddMetricFamily(&mf)
+
+	series := make(map[string]map[string]string, len(points))
+	add := func(mp metrics.MetricPoint) error {
+		key := promql.LabelsFromMap(mp.LabelSet).String()
+		if _, ok := series[key]; ok {
+			return fmt.Errorf("%s: %w", key, ErrDuplicateResult)
+		}
+		series[key] = mp.LabelSet
+		mp.Name, mp.Time = name, ts
+		hash, err := metrics.HashMetric(&mp)
+		if err != nil {
+			return fmt.Errorf("hashing metric: %w", err)
+		}
+		mp.Hash = hash
+		return mfs.AddMetricPoint(&mp)
+	}
+	for _, mp := range points {
+		if err := add(mp); err != nil {
+			return nil, err
+		}
+	}
+	for key, labelSet := range prev {
+		if _, ok := series[key]; !ok {
+			if err := add(metrics.MetricPoint{LabelSet: labelSet, Value: metrics.StaleNaN}); err != nil {
+				return nil, err
+			}
+			delete(series, key)
+		}
+	}
+
+	if len(mf.HashedMetrics) > 0 {
+		if err := m.storage.AddMetricFamiliesTimeGroup(mfs); err != nil {
+			return nil, fmt.Errorf("recording result: %w", err)
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,174 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EvalGroup(t *testing.T) {
+	registry := instrument.NewRegistry()
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+
+	groups, err := Parse([]byte(`
+groups:
+  - name: http
+    rules:
+      - record: job:http_requests:sum
+        expr: sum by (job) (http_requests)
+        labels:
+          team: web
+      - record: job:http_requests:double
+        expr: job:http_requests:sum * 2
+      - record: broken
+        expr: http_requests + on(path) http_requests
+`))
+	require.NoError(t, err)
+	ng := promql.NewEngine(promql.Options{LookbackDelta: 60})
+	m := NewManager(log.NewLogger(), ims, ng, groups, nil, registry)
+
+	// Both jobs have requests at 100, and only job a at 200, beyond the
+	// lookback delta.
+	addSample(t, ims, 100, map[string]string{"job": "a", "path": "/"}, 1)
+	addSample(t, ims, 100, map[string]string{"job": "a", "path": "/x"}, 2)
+	addSample(t, ims, 100, map[string]string{"job": "b", "path": "/"}, 5)
+	m.EvalGroup(context.Background(), groups[0], 100)
+
+	query := func(q string, ts int64) string {
+		t.Helper()
+		v, err := ng.InstantQuery(context.Background(), ims, q, ts)
+		require.NoError(t, err)
+		return v.String()
+	}
+	// Later rules see the results of those before them.
+	assert.Equal(t, `job:http_requests:double{job="a", team="web"} => 6 @100
+job:http_requests:double{job="b", team="web"} => 10 @100`, query("job:http_requests:double", 100))
+
+	addSample(t, ims, 200, map[string]string{"job": "a", "path": "/"}, 3)
+	m.EvalGroup(context.Background(), groups[0], 200)
+
+	// The series of job b is marked stale, ending it rather than being
+	// looked back to.
+	assert.Equal(t, `job:http_requests:sum{job="a", team="web"} => 3 @200`, query("job:http_requests:sum", 200))
+	assert.Equal(t, `job:http_requests:sum{job="a", team="web"} => 3 @230`, query("job:http_requests:sum", 230))
+	assert.Equal(t, `{job="a", team="web"} => 2 @200
+{job="b", team="web"} => 1 @200`, query("count_over_time(job:http_requests:sum[5m])", 200))
+
+	buf := &bytes.Buffer{}
+	_, err = registry.WriteTo(buf)
+	require.NoError(t, err)
+	lines := strings.Split(buf.String(), "\n")
+	assert.Contains(t, lines, `koalemos_rule_group_evaluations_total{rule_group="http"} 2`)
+	// The broken rule only matched many series to one at 100.
+	assert.Contains(t, lines, `koalemos_rule_group_evaluation_failures_total{rule_group="http"} 1`)
+	assert.Contains(t, lines, `koalemos_rule_group_last_evaluation_timestamp_seconds{rule_group="http"} 200`)
+}
+
+func Test_Alerts(t *testing.T) {
+	var mu sync.Mutex
+	var sent [][]postableAlert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alerts []postableAlert
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alerts))
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, alerts)
+	}))
+	defer srv.Close()
+	notifier, err := NewNotifier(srv.URL+"/api/v2/alerts", srv.Client())
+	require.NoError(t, err)
+
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+
+	groups, err := Parse([]byte(`
+groups:
+  - name: http
+    rules:
+      - alert: ManyRequests
+        expr: http_requests > 2
+        for: 2m
+        labels:
+          severity: page
+        annotations:
+          summary: "{{ $labels.job }} at {{ $value }}"
+`))
+	require.NoError(t, err)
+	ng := promql.NewEngine(promql.Options{LookbackDelta: 60})
+	m := NewManager(log.NewLogger(), ims, ng, groups, notifier, nil)
+	query := func(q string, ts int64) string {
+		t.Helper()
+		v, err := ng.InstantQuery(context.Background(), ims, q, ts)
+		require.NoError(t, err)
+		return v.String()
+	}
+	eval := func(ts int64, a, b float64) {
+		t.Helper()
+		addSample(t, ims, ts, map[string]string{"job": "a"}, a)
+		addSample(t, ims, ts, map[string]string{"job": "b"}, b)
+		m.EvalGroup(context.Background(), groups[0], ts)
+	}
+	alert := postableAlert{
+		Labels:      map[string]string{"alertname": "ManyRequests", "job": "a", "severity": "page"},
+		Annotations: map[string]string{"summary": "a at 5"},
+		StartsAt:    time.Unix(100, 0).UTC(),
+	}
+
+	// The alert of job a is pending until it has been active for 2m.
+	eval(100, 5, 1)
+	eval(160, 5, 1)
+	assert.Equal(t, `ALERTS{alertname="ManyRequests", alertstate="pending", job="a", severity="page"} => 1 @160`, query("ALERTS", 160))
+	assert.Empty(t, sent)
+
+	// It fires, and is sent valid for four resends.
+	eval(220, 5, 1)
+	assert.Equal(t, `ALERTS{alertname="ManyRequests", alertstate="firing", job="a", severity="page"} => 1 @220`, query("ALERTS", 220))
+	firing := alert
+	firing.EndsAt = time.Unix(460, 0).UTC()
+	assert.Equal(t, [][]postableAlert{{firing}}, sent)
+
+	// It is not sent again until the resend delay has passed.
+	eval(250, 5, 1)
+	assert.Len(t, sent, 1)
+
+	// It resolves, is sent as resolved and its ALERTS series ends.
+	eval(280, 1, 1)
+	assert.Equal(t, "", query("ALERTS", 280))
+	resolved := alert
+	resolved.EndsAt = time.Unix(280, 0).UTC()
+	require.Len(t, sent, 2)
+	assert.Equal(t, []postableAlert{resolved}, sent[1])
+}
+
+// addSample adds a sample of the series http_requests with the given labels
+// to ims.
+func addSample(t *testing.T, ims store.IMS, ts int64, labelSet map[string]string, v float64) {
+	t.Helper()
+	mp := &metrics.MetricPoint{Name: "http_requests", LabelSet: labelSet, Time: ts, Value: v}
+	hash, err := metrics.HashMetric(mp)
+	require.NoError(t, err)
+	mp.Hash = hash
+	mf := metrics.NewMetricFamily(metrics.MetricDefinition{Name: "http_requests", Type: "counter"})
+	mf.HashedMetrics[mp.Hash] = []*metrics.MetricPoint{mp}
+	mfs := metrics.NewMetricFamiliesTimeGroup()
+	mfs.Time = ts
+	require.NoError(t, mfs.AddMetricFamily(&mf))
+	require.NoError(t, ims.AddMetricFamiliesTimeGroup(mfs))
+}
@@ -0,0 +1,79 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Notifier sends alerts to an Alertmanager, or any endpoint accepting the
+// alerts of its API, e.g. http://alertmanager:9093/api/v2/alerts.
+type Notifier struct {
+	client *http.Client
+	url    string
+}
+
+// NewNotifier returns a Notifier posting alerts to the endpoint at rawURL
+// with client, or http.DefaultClient if nil.
+func NewNotifier(rawURL string, client *http.Client) (*Notifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid Alertmanager URL %q", rawURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Notifier{client: client, url: u.String()}, nil
+}
+
+// postableAlert is an alert as the Alertmanager API accepts it.
+type postableAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// Send posts alerts to the Alertmanager. Alerts start when they became
+// active, and end when they resolved or, while firing, when they are valid
+// until.
+func (n *Notifier) Send(ctx context.Context, alerts []*Alert) error {
+	postable := make([]postableAlert, 0, len(alerts))
+	for _, a := range alerts {
+		pa := postableAlert{
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			StartsAt:    time.Unix(a.ActiveAt, 0).UTC(),
+			EndsAt:      time.Unix(a.ValidUntil, 0).UTC(),
+		}
+		if a.State == StateInactive {
+			pa.EndsAt = time.Unix(a.ResolvedAt, 0).UTC()
+		}
+		postable = append(postable, pa)
+	}
+	body, err := json.Marshal(postable)
+	if err != nil {
+		return fmt.Errorf("encoding alerts: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s: %s: %w", resp.Status, bytes.TrimSpace(msg), ErrAlertsRejected)
+	}
+	return nil
+}
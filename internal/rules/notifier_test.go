@@ -0,0 +1,27 @@
+package rules
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NotifierErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid alerts", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	n, err := NewNotifier(srv.URL, srv.Client())
+	require.NoError(t, err)
+	err = n.Send(context.Background(), []*Alert{{State: StateFiring}})
+	assert.ErrorIs(t, err, ErrAlertsRejected)
+	assert.Contains(t, err.Error(), "invalid alerts")
+
+	_, err = NewNotifier("alertmanager:9093", nil)
+	assert.Error(t, err, "URL without a scheme")
+}
@@ -0,0 +1,211 @@
+// Package rules evaluates recording and alerting rules: queries evaluated
+// periodically, whose results are written back to the store as series of
+// their own, or fire alerts sent on to an Alertmanager.
+package rules
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultInterval is how often the rules of a group are evaluated if the
+// group does not say.
+const DefaultInterval = time.Minute
+
+var (
+	metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegex  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Group is a group of rules evaluated in order at the same interval, so
+// that a rule may use the results of those before it.
+type Group struct {
+	name     string
+	interval time.Duration
+	rules    []Rule
+}
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Interval returns how often the rules of the group are evaluated.
+func (g *Group) Interval() time.Duration {
+	return g.interval
+}
+
+// Rules returns the rules of the group, in order of evaluation.
+func (g *Group) Rules() []Rule {
+	return g.rules
+}
+
+// Rule is a rule of a group: a *RecordingRule or an *AlertingRule.
+type Rule interface {
+	// Name returns the name of the series the rule records, or of the alerts
+	// it fires.
+	Name() string
+	// Query returns the query the rule evaluates.
+	Query() string
+}
+
+// RecordingRule is a rule recording the result of a query under the name
+// of the rule.
+type RecordingRule struct {
+	record string
+	query  string
+	labels map[string]string
+
+	// series are the label sets of the series written by the rule's last
+	// evaluation, keyed by their string form, which are marked stale should
+	// they be missing from the next.
+	series map[string]map[string]string
+}
+
+// Name returns the name the rule records its result under.
+func (r *RecordingRule) Name() string {
+	return r.record
+}
+
+// Query returns the query the rule evaluates.
+func (r *RecordingRule) Query() string {
+	return r.query
+}
+
+// groupsConfig is a rules file, e.g.
+//
+//	groups:
+//	  - name: http
+//	    interval: 30s
+//	    rules:
+//	      - record: job:http_requests:rate5m
+//	        expr: sum by (job) (rate(http_requests_total[5m]))
+//	        labels:
+//	          team: web
+//	      - alert: HighErrorRate
+//	        expr: job:http_errors:ratio5m > 0.05
+//	        for: 10m
+//	        annotations:
+//	          summary: "{{ $labels.job }} errors at {{ $value }}"
+type groupsConfig struct {
+	Groups []struct {
+		Name     string `yaml:"name"`
+		Interval string `yaml:"interval"`
+		Rules    []struct {
+			Record      string            `yaml:"record"`
+			Alert       string            `yaml:"alert"`
+			Expr        string            `yaml:"expr"`
+			For         string            `yaml:"for"`
+			Labels      map[string]string `yaml:"labels"`
+			Annotations map[string]string `yaml:"annotations"`
+		} `yaml:"rules"`
+	} `yaml:"groups"`
+}
+
+// LoadFile reads the rule groups of the rules file at path.
+func LoadFile(path string) ([]*Group, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return groups, nil
+}
+
+// Parse parses the rule groups of a rules file. Group names must be unique,
+// intervals at least a second, rules either recording or alerting rules,
+// and rule queries must parse and return a vector or scalar.
+func Parse(b []byte) ([]*Group, error) {
+	var config groupsConfig
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("parsing rules: %w", err)
+	}
+
+	names := map[string]struct{}{}
+	groups := make([]*Group, 0, len(config.Groups))
+	for i, gc := range config.Groups {
+		if gc.Name == "" {
+			return nil, fmt.Errorf("group %d has no name: %w", i, ErrInvalidGroup)
+		}
+		if _, ok := names[gc.Name]; ok {
+			return nil, fmt.Errorf("group %q is repeated: %w", gc.Name, ErrInvalidGroup)
+		}
+		names[gc.Name] = struct{}{}
+
+		g := &Group{name: gc.Name, interval: DefaultInterval}
+		if gc.Interval != "" {
+			d, err := parser.ParseDuration(gc.Interval)
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("group %q interval %q: %w", gc.Name, gc.Interval, ErrInvalidGroup)
+			}
+			g.interval = d
+		}
+		for j, rc := range gc.Rules {
+			var r Rule
+			var err error
+			switch {
+			case rc.Record != "" && rc.Alert != "":
+				err = fmt.Errorf("both record and alert given: %w", ErrInvalidRule)
+			case rc.Record != "":
+				if rc.For != "" || rc.Annotations != nil {
+					err = fmt.Errorf("for or annotations given to recording rule: %w", ErrInvalidRule)
+					break
+				}
+				r, err = newRecordingRule(rc.Record, rc.Expr, rc.Labels)
+			case rc.Alert != "":
+				r, err = newAlertingRule(rc.Alert, rc.Expr, rc.For, rc.Labels, rc.Annotations)
+			default:
+				err = fmt.Errorf("neither record nor alert given: %w", ErrInvalidRule)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("group %q rule %d: %w", gc.Name, j, err)
+			}
+			g.rules = append(g.rules, r)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func newRecordingRule(record, query string, labels map[string]string) (*RecordingRule, error) {
+	if !metricNameRegex.MatchString(record) {
+		return nil, fmt.Errorf("record %q is not a valid metric name: %w", record, ErrInvalidRule)
+	}
+	if err := validateQuery(query); err != nil {
+		return nil, err
+	}
+	if err := validateLabelNames(labels); err != nil {
+		return nil, err
+	}
+	return &RecordingRule{record: record, query: query, labels: labels}, nil
+}
+
+// validateQuery returns an error if query does not parse or return a vector
+// or scalar.
+func validateQuery(query string) error {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRule, err)
+	}
+	if t := expr.Type(); t != parser.ValueTypeVector && t != parser.ValueTypeScalar {
+		return fmt.Errorf("query of type %s, must be vector or scalar: %w", t, ErrInvalidRule)
+	}
+	return nil
+}
+
+func validateLabelNames(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRegex.MatchString(name) {
+			return fmt.Errorf("label %q is not a valid label name: %w", name, ErrInvalidRule)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Parse(t *testing.T) {
+	type Test struct {
+		desc        string
+		input       string
+		expectedErr error
+	}
+
+	tests := []Test{
+		{
+			desc: "[POSITIVE] groups of rules",
+			input: `
+groups:
+  - name: http
+    interval: 30s
+    rules:
+      - record: job:http_requests:rate5m
+        expr: sum by (job) (rate(http_requests_total[5m]))
+        labels:
+          team: web
+  - name: scalar
+    rules:
+      - record: answer
+        expr: 42
+      - alert: Down
+        expr: up == 0
+        for: 5m
+        labels:
+          severity: page
+        annotations:
+          summary: "{{ $labels.instance }} is down"
+`,
+		},
+		{
+			desc: "[NEGATIVE] repeated group name",
+			input: `
+groups:
+  - name: http
+  - name: http
+`,
+			expectedErr: ErrInvalidGroup,
+		},
+		{
+			desc: "[NEGATIVE] interval below a second",
+			input: `
+groups:
+  - name: http
+    interval: 500ms
+`,
+			expectedErr: ErrInvalidGroup,
+		},
+		{
+			desc: "[NEGATIVE] invalid record name",
+			input: `
+groups:
+  - name: http
+    rules:
+      - record: job-requests
+        expr: up
+`,
+			expectedErr: ErrInvalidRule,
+		},
+		{
+			desc: "[NEGATIVE] query which does not parse",
+			input: `
+groups:
+  - name: http
+    rules:
+      - record: requests
+        expr: sum(
+`,
+			expectedErr: ErrInvalidRule,
+		},
+		{
+			desc: "[NEGATIVE] range vector query",
+			input: `
+groups:
+  - name: http
+    rules:
+      - record: requests
+        expr: up[5m]
+`,
+			expectedErr: ErrInvalidRule,
+		},
+		{
+			desc: "[NEGATIVE] rule both recording and alerting",
+			input: `
+groups:
+  - name: http
+    rules:
+      - record: requests
+        alert: Requests
+        expr: up
+`,
+			expectedErr: ErrInvalidRule,
+		},
+		{
+			desc: "[NEGATIVE] recording rule with a hold duration",
+			input: `
+groups:
+  - name: http
+    rules:
+      - record: requests
+        expr: up
+        for: 5m
+`,
+			expectedErr: ErrInvalidRule,
+		},
+		{
+			desc: "[NEGATIVE] alert annotation which does not parse",
+			input: `
+groups:
+  - name: http
+    rules:
+      - alert: Down
+        expr: up == 0
+        annotations:
+          summary: "{{ $labels.job"
+`,
+			expectedErr: ErrInvalidRule,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			groups, err := Parse([]byte(tc.input))
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, groups, 2)
+			assert.Equal(t, "http", groups[0].Name())
+			assert.Equal(t, 30*time.Second, groups[0].Interval())
+			require.Len(t, groups[0].Rules(), 1)
+			assert.Equal(t, "job:http_requests:rate5m", groups[0].Rules()[0].Name())
+			require.IsType(t, &RecordingRule{}, groups[0].Rules()[0])
+			assert.Equal(t, map[string]string{"team": "web"}, groups[0].Rules()[0].(*RecordingRule).labels)
+			assert.Equal(t, DefaultInterval, groups[1].Interval())
+			require.Len(t, groups[1].Rules(), 2)
+			require.IsType(t, &AlertingRule{}, groups[1].Rules()[1])
+			assert.Equal(t, "Down", groups[1].Rules()[1].Name())
+			assert.Equal(t, 5*time.Minute, groups[1].Rules()[1].(*AlertingRule).HoldDuration())
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/log"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// fileTargets are the target groups read from a target file.
+type fileTargets struct {
+	// content is the content the file was last seen with, and groups the
+	// target groups of the last content which could be read.
+	content []byte
+	groups  []TargetGroup
+}
+
+// fileDiscoverer discovers target groups from the JSON and YAML files
+// matching a file service discovery config's patterns, polling them for
+// changes every refresh interval.
+type fileDiscoverer struct {
+	logger  log.Logger
+	job     string
+	config  FileSDConfig
+	metrics *scrapeMetrics
+
+	mtx sync.Mutex
+	// files are the target groups of each file read, by path.
+	files map[string]*fileTargets
+}
+
+func newFileDiscoverer(l log.Logger, job string, c FileSDConfig, metrics *scrapeMetrics) *fileDiscoverer {
+	return &fileDiscoverer{
+		logger:  l,
+		job:     job,
+		config:  c,
+		metrics: metrics,
+		files:   map[string]*fileTargets{},
+	}
+}
+
+// run refreshes the target groups every refresh interval until ctx is
+// done, sending on updates whenever they change.
+func (d *fileDiscoverer) run(ctx context.Context, updates chan<- struct{}) {
+	ticker := time.NewTicker(d.config.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if d.refresh() {
+				select {
+				case updates <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// refresh reads the files matching the discoverer's patterns which are new
+// or have changed since last read, and forgets the target groups of those
+// which no longer exist. A file which cannot be read, is empty or does not
+// parse, as it may be while it is being written, keeps the target groups
+// last read from it. It returns whether the target groups changed.
+func (d *fileDiscoverer) refresh() bool {
+	paths := map[string]struct{}{}
+	for _, pattern := range d.config.Files {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			paths[path] = struct{}{}
+		}
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	changed := false
+	for path := range d.files {
+		if _, ok := paths[path]; !ok {
+			delete(d.files, path)
+			changed = true
+		}
+	}
+	for path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			d.readFailed(path, err)
+			continue
+		}
+		ft, ok := d.files[path]
+		if !ok {
+			ft = &fileTargets{}
+			d.files[path] = ft
+		}
+		if ok && bytes.Equal(content, ft.content) {
+			continue
+		}
+		ft.content = content
+		groups, err := readTargetGroups(path, content)
+		if err != nil {
+			d.readFailed(path, err)
+			continue
+		}
+		ft.groups = groups
+		changed = true
+	}
+	return changed
+}
+
+func (d *fileDiscoverer) readFailed(path string, err error) {
+	d.metrics.fileSDReadFailures.With(d.job).Inc()
+	d.logger.Warn("failed to read target file, keeping its last targets", zap.String("job", d.job), zap.String("path", path), zap.Error(err))
+}
+
+// groups returns the target groups of every file, in the order of their
+// paths.
+func (d *fileDiscoverer) groups() []TargetGroup {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	paths := make([]string, 0, len(d.files))
+	for path := range d.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var groups []TargetGroup
+	for _, path := range paths {
+		groups = append(groups, d.files[path].groups...)
+	}
+	return groups
+}
+
+// readTargetGroups parses the target groups of the file at path, JSON or
+// YAML as its extension says, e.g.
+//
+//	[{"targets": ["node-1:9100"], "labels": {"env": "prod"}}]
+func readTargetGroups(path string, content []byte) ([]TargetGroup, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, fmt.Errorf("empty target file: %w", ErrInvalidTargetFile)
+	}
+	var docs []targetGroupDoc
+	var err error
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(content, &docs)
+	} else {
+		err = yaml.Unmarshal(content, &docs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTargetFile, err)
+	}
+	groups := make([]TargetGroup, 0, len(docs))
+	for _, doc := range docs {
+		tg, err := doc.targetGroup()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidTargetFile, err)
+		}
+		groups = append(groups, tg)
+	}
+	return groups, nil
+}
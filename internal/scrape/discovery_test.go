@@ -0,0 +1,100 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FileDiscoverer(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	d := newFileDiscoverer(log.NewLogger(), "node", FileSDConfig{
+		Files: []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yaml")},
+	}, newScrapeMetrics(instrument.NewRegistry()))
+
+	write("a.json", `[{"targets": ["node-1:9100"], "labels": {"env": "prod"}}]`)
+	write("b.yaml", `
+- targets: [node-2:9100, node-3:9100]
+`)
+	assert.True(t, d.refresh())
+	assert.Equal(t, []TargetGroup{
+		{Targets: []string{"node-1:9100"}, Labels: map[string]string{"env": "prod"}},
+		{Targets: []string{"node-2:9100", "node-3:9100"}},
+	}, d.groups())
+
+	// Files whose content is unchanged leave the targets unchanged.
+	assert.False(t, d.refresh())
+
+	// Partial and invalid writes keep the targets last read.
+	before := d.groups()
+	for _, content := range []string{
+		"",
+		`[{"targets": ["node-1:9100"]`,
+		`[{"targets": ["node-1"]}]`,
+	} {
+		write("a.json", content)
+		assert.False(t, d.refresh(), content)
+		assert.Equal(t, before, d.groups(), content)
+	}
+
+	// Changed files replace their targets, and removed files drop theirs.
+	write("a.json", `[{"targets": ["node-4:9100"]}]`)
+	require.NoError(t, os.Remove(filepath.Join(dir, "b.yaml")))
+	assert.True(t, d.refresh())
+	assert.Equal(t, []TargetGroup{{Targets: []string{"node-4:9100"}}}, d.groups())
+}
+
+func Test_RunDiscovery(t *testing.T) {
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+	tt := newTestTarget(t)
+	tt.serve("temperature 20\n", 0)
+
+	path := filepath.Join(t.TempDir(), "targets.json")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`[{"targets": [%q]}]`, tt.address())), 0o644))
+	c := &Config{
+		JobName:     "node",
+		Interval:    time.Minute,
+		Timeout:     time.Second,
+		MetricsPath: DefaultMetricsPath,
+		Scheme:      "http",
+		Format:      FormatPrometheus,
+		FileSD:      []FileSDConfig{{Files: []string{path}, RefreshInterval: 10 * time.Millisecond}},
+	}
+	m := NewManager(log.NewLogger(), ims, []*Config{c}, tt.srv.Client(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	loops := func() int {
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+		return len(m.loops["node"])
+	}
+
+	// Targets are scraped once discovered, and stopped once gone from
+	// their file.
+	require.Eventually(t, func() bool { return loops() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, tt.scraped, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, os.WriteFile(path, []byte(`[]`), 0o644))
+	require.Eventually(t, func() bool { return loops() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
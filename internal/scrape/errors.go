@@ -0,0 +1,11 @@
+package scrape
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidConfig     = errors.New("invalid scrape config")
+	ErrScrapeFailed      = errors.New("scrape failed")
+	ErrInvalidTargetFile = errors.New("invalid target file")
+)
@@ -0,0 +1,27 @@
+package scrape
+
+import "github.com/mikanmekan/koalemos/internal/instrument"
+
+// scrapeMetrics are the metrics the manager records about the targets it
+// scrapes, by job.
+type scrapeMetrics struct {
+	targets        *instrument.Gauge
+	scrapes        *instrument.Counter
+	scrapeFailures *instrument.Counter
+	// fileSDReadFailures counts reads of the target files of a job which
+	// failed.
+	fileSDReadFailures *instrument.Counter
+}
+
+func newScrapeMetrics(r *instrument.Registry) *scrapeMetrics {
+	return &scrapeMetrics{
+		targets: r.NewGauge("koalemos_scrape_targets",
+			"Number of targets of a scrape job being scraped.", "job"),
+		scrapes: r.NewCounter("koalemos_scrapes_total",
+			"Number of scrapes of the targets of a scrape job.", "job"),
+		scrapeFailures: r.NewCounter("koalemos_scrape_failures_total",
+			"Number of scrapes of the targets of a scrape job which failed.", "job"),
+		fileSDReadFailures: r.NewCounter("koalemos_file_sd_read_failures_total",
+			"Number of times a target file of a scrape job could not be read.", "job"),
+	}
+}
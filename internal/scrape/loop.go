@@ -0,0 +1,241 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"go.uber.org/zap"
+)
+
+// acceptHeader asks targets for the Prometheus text format.
+const acceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// seriesRef is a series written by a scrape.
+type seriesRef struct {
+	def      metrics.MetricDefinition
+	labelSet map[string]string
+}
+
+// scrapeLoop scrapes a target at the interval of its job.
+type scrapeLoop struct {
+	logger  log.Logger
+	config  *Config
+	target  *target
+	client  *http.Client
+	storage store.IMS
+	metrics *scrapeMetrics
+	url     string
+
+	// series are the series written by the last scrape, by hash, which are
+	// marked stale should they be missing from the next, and lastWrite the
+	// time of that scrape.
+	series    map[uint64]seriesRef
+	lastWrite int64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newScrapeLoop(l log.Logger, c *Config, t *target, client *http.Client, storage store.IMS, metrics *scrapeMetrics) *scrapeLoop {
+	u := url.URL{Scheme: c.Scheme, Host: t.address, Path: c.MetricsPath}
+	return &scrapeLoop{
+		logger:  l,
+		config:  c,
+		target:  t,
+		client:  client,
+		storage: storage,
+		metrics: metrics,
+		url:     u.String(),
+		done:    make(chan struct{}),
+	}
+}
+
+// run scrapes the target now, then at every interval until ctx is done.
+func (l *scrapeLoop) run(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.config.Interval)
+	defer ticker.Stop()
+
+	l.scrapeAndReport(ctx, time.Now().Unix())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			l.scrapeAndReport(ctx, t.Unix())
+		}
+	}
+}
+
+// stop stops the loop, marking the series of its last scrape stale, no
+// earlier than a second after it.
+func (l *scrapeLoop) stop() {
+	l.cancel()
+	<-l.done
+	ts := time.Now().Unix()
+	if ts <= l.lastWrite {
+		ts = l.lastWrite + 1
+	}
+	if err := l.write(metrics.NewMetricFamiliesTimeGroup(), map[uint64]seriesRef{}, ts); err != nil {
+		l.logger.Warn("failed to mark scraped series stale", zap.String("job", l.config.JobName), zap.String("target", l.target.address), zap.Error(err))
+	}
+}
+
+func (l *scrapeLoop) scrapeAndReport(ctx context.Context, ts int64) {
+	l.metrics.scrapes.With(l.config.JobName).Inc()
+	if err := l.scrape(ctx, ts); err != nil {
+		l.metrics.scrapeFailures.With(l.config.JobName).Inc()
+		l.logger.Warn("failed to scrape target", zap.String("job", l.config.JobName), zap.String("target", l.target.address), zap.Error(err))
+	}
+}
+
+// scrape scrapes the target at ts, writing the series scraped with the
+// target's labels, and the series up, 1 if the scrape succeeded and 0
+// otherwise, and scrape_duration_seconds. Series of the last scrape
+// missing from this one are marked stale, all of them if it failed.
+func (l *scrapeLoop) scrape(ctx context.Context, ts int64) error {
+	start := time.Now()
+	mfs, scrapeErr := l.fetch(ctx)
+	duration := time.Since(start)
+
+	out := metrics.NewMetricFamiliesTimeGroup()
+	series := map[uint64]seriesRef{}
+	if scrapeErr == nil {
+		if scrapeErr = l.relabel(mfs, out, series, ts); scrapeErr != nil {
+			out, series = metrics.NewMetricFamiliesTimeGroup(), map[uint64]seriesRef{}
+		}
+	}
+	up := 1.0
+	if scrapeErr != nil {
+		up = 0
+	}
+	report := []struct {
+		name  string
+		value float64
+	}{
+		{"up", up},
+		{"scrape_duration_seconds", duration.Seconds()},
+	}
+	for _, r := range report {
+		def := metrics.MetricDefinition{Name: r.name, Type: "gauge"}
+		mp := &metrics.MetricPoint{Name: r.name, LabelSet: l.target.labelSet(nil), Time: ts, Value: r.value}
+		if err := add(out, def, mp, series); err != nil {
+			return err
+		}
+	}
+
+	if err := l.write(out, series, ts); err != nil {
+		if scrapeErr != nil {
+			return fmt.Errorf("%w, and %w", scrapeErr, err)
+		}
+		return err
+	}
+	return scrapeErr
+}
+
+// fetch requests the metrics of the target.
+func (l *scrapeLoop) fetch(ctx context.Context) (*metrics.MetricFamiliesTimeGroup, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(l.config.Timeout.Seconds(), 'f', -1, 64))
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %w", resp.Status, ErrScrapeFailed)
+	}
+	mfs, err := l.config.reader().Read(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading metrics: %w", err)
+	}
+	return mfs, nil
+}
+
+// relabel adds the series of mfs, scraped at ts, to out with the target's
+// labels, recording in series those without timestamps of their own.
+func (l *scrapeLoop) relabel(mfs, out *metrics.MetricFamiliesTimeGroup, series map[uint64]seriesRef, ts int64) error {
+	payloadTime := mfs.Time
+	if payloadTime == 0 {
+		payloadTime = ts
+	}
+	for _, mf := range mfs.Families {
+		for _, mps := range mf.HashedMetrics {
+			for _, mp := range mps {
+				p := &metrics.MetricPoint{
+					Name:      mp.Name,
+					LabelSet:  l.target.labelSet(mp.LabelSet),
+					Time:      mp.Time,
+					Value:     mp.Value,
+					Histogram: mp.Histogram,
+				}
+				track := series
+				if p.Time != 0 {
+					track = nil
+				} else {
+					p.Time = payloadTime
+				}
+				if err := add(out, mf.Def, p, track); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// add adds mp, a sample of a series of the family def, to mfs, and the
+// series to series unless nil.
+func add(mfs *metrics.MetricFamiliesTimeGroup, def metrics.MetricDefinition, mp *metrics.MetricPoint, series map[uint64]seriesRef) error {
+	if _, err := mfs.GetMetricFamily(def.Name); err != nil {
+		mf := metrics.NewMetricFamily(def)
+		mfs.AddMetricFamily(&mf)
+	}
+	hash, err := metrics.HashMetric(mp)
+	if err != nil {
+		return fmt.Errorf("hashing metric: %w", err)
+	}
+	mp.Hash = hash
+	if err := mfs.AddMetricPoint(mp); err != nil {
+		return err
+	}
+	if series != nil {
+		series[hash] = seriesRef{def: def, labelSet: mp.LabelSet}
+	}
+	return nil
+}
+
+// write marks the series of the last scrape missing from series stale at
+// ts, and writes them and out to the store, taking series to be the series
+// of the last scrape.
+func (l *scrapeLoop) write(out *metrics.MetricFamiliesTimeGroup, series map[uint64]seriesRef, ts int64) error {
+	out.Time = ts
+	for hash, s := range l.series {
+		if _, ok := series[hash]; ok {
+			continue
+		}
+		mp := &metrics.MetricPoint{Name: s.def.Name, LabelSet: s.labelSet, Time: ts, Value: metrics.StaleNaN}
+		if err := add(out, s.def, mp, nil); err != nil {
+			return err
+		}
+	}
+	l.series, l.lastWrite = series, ts
+	if err := l.storage.AddMetricFamiliesTimeGroup(out); err != nil {
+		return fmt.Errorf("writing scraped metrics: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package scrape
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+)
+
+// Manager scrapes the targets of scrape jobs, each target in a scrape loop
+// of its own.
+type Manager struct {
+	logger  log.Logger
+	storage store.IMS
+	configs []*Config
+	client  *http.Client
+	metrics *scrapeMetrics
+
+	mtx sync.Mutex
+	// loops are the scrape loops of each job, by job name, keyed by their
+	// target's key.
+	loops map[string]map[string]*scrapeLoop
+	wg    sync.WaitGroup
+}
+
+// NewManager returns a Manager scraping the targets of configs with client,
+// or http.DefaultClient if nil, into storage. It records metrics about
+// itself in r, or a registry of its own if r is nil.
+func NewManager(l log.Logger, storage store.IMS, configs []*Config, client *http.Client, r *instrument.Registry) *Manager {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if r == nil {
+		r = instrument.NewRegistry()
+	}
+	return &Manager{
+		logger:  l,
+		storage: storage,
+		configs: configs,
+		client:  client,
+		metrics: newScrapeMetrics(r),
+		loops:   map[string]map[string]*scrapeLoop{},
+	}
+}
+
+// Run scrapes the targets of every job, static and discovered, until ctx
+// is done.
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range m.configs {
+		if len(c.FileSD) == 0 {
+			m.sync(ctx, c, c.StaticTargets)
+			continue
+		}
+		wg.Add(1)
+		go func(c *Config) {
+			defer wg.Done()
+			m.runDiscovery(ctx, c)
+		}(c)
+	}
+	<-ctx.Done()
+	// Discovery has stopped syncing before the scrape loops are waited for.
+	wg.Wait()
+	m.wg.Wait()
+}
+
+// runDiscovery scrapes the static targets of the job c and those discovered
+// from its target files, syncing the job's scrape loops as the files change,
+// until ctx is done.
+func (m *Manager) runDiscovery(ctx context.Context, c *Config) {
+	discoverers := make([]*fileDiscoverer, 0, len(c.FileSD))
+	for _, sd := range c.FileSD {
+		discoverers = append(discoverers, newFileDiscoverer(m.logger, c.JobName, sd, m.metrics))
+	}
+	groups := func() []TargetGroup {
+		groups := append([]TargetGroup{}, c.StaticTargets...)
+		for _, d := range discoverers {
+			groups = append(groups, d.groups()...)
+		}
+		return groups
+	}
+
+	for _, d := range discoverers {
+		d.refresh()
+	}
+	m.sync(ctx, c, groups())
+
+	updates := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for _, d := range discoverers {
+		wg.Add(1)
+		go func(d *fileDiscoverer) {
+			defer wg.Done()
+			d.run(ctx, updates)
+		}(d)
+	}
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates:
+			m.sync(ctx, c, groups())
+		}
+	}
+}
+
+// sync scrapes the targets of groups for the job c, starting scrape loops
+// for targets new to the job and stopping those of targets no longer among
+// them, whose series are marked stale.
+func (m *Manager) sync(ctx context.Context, c *Config, groups []TargetGroup) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	loops := m.loops[c.JobName]
+	if loops == nil {
+		loops = map[string]*scrapeLoop{}
+		m.loops[c.JobName] = loops
+	}
+	keep := map[string]struct{}{}
+	for _, t := range targets(c, groups) {
+		key := t.key()
+		keep[key] = struct{}{}
+		if _, ok := loops[key]; ok {
+			continue
+		}
+		l := newScrapeLoop(m.logger, c, t, m.client, m.storage, m.metrics)
+		var loopCtx context.Context
+		loopCtx, l.cancel = context.WithCancel(ctx)
+		loops[key] = l
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			l.run(loopCtx)
+		}()
+	}
+	for key, l := range loops {
+		if _, ok := keep[key]; !ok {
+			l.stop()
+			delete(loops, key)
+		}
+	}
+	m.metrics.targets.With(c.JobName).Set(float64(len(loops)))
+}
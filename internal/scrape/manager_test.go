@@ -0,0 +1,182 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics/store"
+	"github.com/mikanmekan/koalemos/internal/promql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTarget serves metrics to scrape, or an error status if set.
+type testTarget struct {
+	mtx      sync.Mutex
+	body     string
+	status   int
+	requests int
+	srv      *httptest.Server
+}
+
+func newTestTarget(t *testing.T) *testTarget {
+	tt := &testTarget{}
+	tt.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tt.mtx.Lock()
+		defer tt.mtx.Unlock()
+		tt.requests++
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		if tt.status != 0 {
+			w.WriteHeader(tt.status)
+			return
+		}
+		fmt.Fprint(w, tt.body)
+	}))
+	t.Cleanup(tt.srv.Close)
+	return tt
+}
+
+func (tt *testTarget) serve(body string, status int) {
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+	tt.body, tt.status = body, status
+}
+
+func (tt *testTarget) scraped() bool {
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+	return tt.requests > 0
+}
+
+func (tt *testTarget) address() string {
+	return tt.srv.Listener.Addr().String()
+}
+
+func Test_Scrape(t *testing.T) {
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+	tt := newTestTarget(t)
+
+	configs, err := Parse([]byte(fmt.Sprintf(`
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: [%s]
+        labels:
+          env: prod
+`, tt.address())))
+	require.NoError(t, err)
+	ts := targets(configs[0], configs[0].StaticTargets)
+	require.Len(t, ts, 1)
+	l := newScrapeLoop(log.NewLogger(), configs[0], ts[0], tt.srv.Client(), ims, newScrapeMetrics(instrument.NewRegistry()))
+
+	ng := promql.NewEngine(promql.Options{})
+	query := func(q string, ts int64) string {
+		t.Helper()
+		v, err := ng.InstantQuery(context.Background(), ims, q, ts)
+		require.NoError(t, err)
+		return v.String()
+	}
+	labels := fmt.Sprintf(`env="prod", instance=%q, job="node"`, tt.address())
+
+	// Series take the target's labels, keeping labels of the same names
+	// as exported_ labels.
+	tt.serve(`# TYPE requests_total counter
+requests_total{job="app",path="/"} 5
+temperature 20
+`, 0)
+	require.NoError(t, l.scrape(context.Background(), 100))
+	assert.Equal(t, fmt.Sprintf(`up{%s} => 1 @100`, labels), query("up", 100))
+	assert.Equal(t, fmt.Sprintf(`requests_total{env="prod", exported_job="app", instance=%q, job="node", path="/"} => 5 @100`, tt.address()), query("requests_total", 100))
+	assert.Equal(t, fmt.Sprintf(`temperature{%s} => 20 @100`, labels), query("temperature", 100))
+
+	// Series missing from a scrape are marked stale.
+	tt.serve(`requests_total{job="app",path="/"} 7
+`, 0)
+	require.NoError(t, l.scrape(context.Background(), 200))
+	assert.Equal(t, "", query("temperature", 200))
+
+	// A failed scrape sets up to 0 and marks every series stale.
+	tt.serve("", http.StatusInternalServerError)
+	assert.ErrorIs(t, l.scrape(context.Background(), 300), ErrScrapeFailed)
+	assert.Equal(t, fmt.Sprintf(`up{%s} => 0 @300`, labels), query("up", 300))
+	assert.Equal(t, "", query("requests_total", 300))
+}
+
+func Test_ScrapeMalformed(t *testing.T) {
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+	tt := newTestTarget(t)
+
+	configs, err := Parse([]byte(`
+scrape_configs:
+  - job_name: node
+    format: koalemos
+`))
+	require.NoError(t, err)
+	ts := targets(configs[0], []TargetGroup{{Targets: []string{tt.address()}}})
+	l := newScrapeLoop(log.NewLogger(), configs[0], ts[0], tt.srv.Client(), ims, newScrapeMetrics(instrument.NewRegistry()))
+	ng := promql.NewEngine(promql.Options{})
+
+	// A help line without text is read, but one without a metric family
+	// name fails the scrape rather than the ingestor.
+	tt.serve("100\n# HELP temperature\n# TYPE temperature gauge\ntemperature 20\n", 0)
+	require.NoError(t, l.scrape(context.Background(), 100))
+	tt.serve("200\n# HELP\ntemperature 21\n", 0)
+	assert.Error(t, l.scrape(context.Background(), 200))
+
+	v, err := ng.InstantQuery(context.Background(), ims, "up", 200)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`up{instance=%q, job="node"} => 0 @200`, tt.address()), v.String())
+}
+
+func Test_Sync(t *testing.T) {
+	ims, err := store.Open(log.NewLogger(), store.Options{Registry: instrument.NewRegistry()})
+	require.NoError(t, err)
+	defer ims.Close()
+	tt := newTestTarget(t)
+	tt.serve("temperature 20\n", 0)
+
+	configs, err := Parse([]byte(`
+scrape_configs:
+  - job_name: node
+`))
+	require.NoError(t, err)
+	m := NewManager(log.NewLogger(), ims, configs, tt.srv.Client(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group := TargetGroup{Targets: []string{tt.address()}}
+	m.sync(ctx, configs[0], []TargetGroup{group, group})
+	require.Len(t, m.loops["node"], 1)
+	l := m.loops["node"][targets(configs[0], []TargetGroup{group})[0].key()]
+	require.NotNil(t, l)
+
+	// Targets no longer among the job's are stopped, and the series of
+	// their last scrape marked stale.
+	require.Eventually(t, tt.scraped, 5*time.Second, 10*time.Millisecond)
+	m.sync(ctx, configs[0], nil)
+	assert.Empty(t, m.loops["node"])
+	assert.Empty(t, l.series)
+
+	ts := time.Now().Unix() + 2
+	ng := promql.NewEngine(promql.Options{})
+	v, err := ng.InstantQuery(ctx, ims, "temperature", ts)
+	require.NoError(t, err)
+	assert.Equal(t, "", v.String())
+	v, err = ng.InstantQuery(ctx, ims, "count_over_time(temperature[1h])", ts)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`{instance=%q, job="node"} => 1 @%d`, tt.address(), ts), v.String())
+}
@@ -0,0 +1,243 @@
+// Package scrape pulls metrics from the /metrics endpoints of targets over
+// HTTP, as Prometheus does, writing them to the store as series labelled
+// with the job and instance they were scraped from.
+package scrape
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/metrics/reader"
+	"github.com/mikanmekan/koalemos/internal/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultInterval is how often the targets of a job are scraped if the
+	// job does not say.
+	DefaultInterval = time.Minute
+	// DefaultTimeout is how long a scrape may take if the job does not say,
+	// or its interval if shorter.
+	DefaultTimeout = 10 * time.Second
+	// DefaultMetricsPath is the path metrics are scraped from if the job
+	// does not say.
+	DefaultMetricsPath = "/metrics"
+	// DefaultRefreshInterval is how often target files are checked for
+	// changes if their file service discovery config does not say.
+	DefaultRefreshInterval = 30 * time.Second
+)
+
+// Formats metrics may be scraped in.
+const (
+	FormatPrometheus = "prometheus"
+	FormatKoalemos   = "koalemos"
+)
+
+var (
+	jobNameRegex   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_:.-]*$`)
+	labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Config is a scrape job: targets scraped alike.
+type Config struct {
+	JobName     string
+	Interval    time.Duration
+	Timeout     time.Duration
+	MetricsPath string
+	// Scheme is http or https.
+	Scheme string
+	// Format is the format targets serve metrics in, FormatPrometheus or
+	// FormatKoalemos.
+	Format string
+	// StaticTargets are groups of targets, host:port addresses, and the
+	// labels added to the series scraped from them.
+	StaticTargets []TargetGroup
+	// FileSD discovers more target groups from files.
+	FileSD []FileSDConfig
+}
+
+// FileSDConfig discovers target groups from JSON or YAML files, each a list
+// of target groups as the static targets of a job are configured.
+type FileSDConfig struct {
+	// Files are the paths of the files, whose last elements may be glob
+	// patterns, e.g. /etc/koalemos/targets/*.json.
+	Files []string
+	// RefreshInterval is how often the files are checked for changes.
+	RefreshInterval time.Duration
+}
+
+// TargetGroup is a group of targets sharing labels.
+type TargetGroup struct {
+	Targets []string
+	Labels  map[string]string
+}
+
+// reader returns the reader of the format c's targets serve metrics in.
+func (c *Config) reader() reader.Reader {
+	if c.Format == FormatKoalemos {
+		return reader.NewReader()
+	}
+	return reader.NewPrometheusTextReader()
+}
+
+// scrapeConfigs is a scrape config file, e.g.
+//
+//	scrape_configs:
+//	  - job_name: node
+//	    scrape_interval: 15s
+//	    static_configs:
+//	      - targets: [node-1:9100, node-2:9100]
+//	        labels:
+//	          env: prod
+//	    file_sd_configs:
+//	      - files: [/etc/koalemos/targets/*.json]
+type scrapeConfigs struct {
+	ScrapeConfigs []struct {
+		JobName        string           `yaml:"job_name"`
+		ScrapeInterval string           `yaml:"scrape_interval"`
+		ScrapeTimeout  string           `yaml:"scrape_timeout"`
+		MetricsPath    string           `yaml:"metrics_path"`
+		Scheme         string           `yaml:"scheme"`
+		Format         string           `yaml:"format"`
+		StaticConfigs  []targetGroupDoc `yaml:"static_configs"`
+		FileSDConfigs  []struct {
+			Files           []string `yaml:"files"`
+			RefreshInterval string   `yaml:"refresh_interval"`
+		} `yaml:"file_sd_configs"`
+	} `yaml:"scrape_configs"`
+}
+
+// targetGroupDoc is a group of targets as configured, or as read from a
+// target file.
+type targetGroupDoc struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+// LoadFile reads the scrape jobs of the scrape config file at path.
+func LoadFile(path string) ([]*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configs, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return configs, nil
+}
+
+// Parse parses the scrape jobs of a scrape config file. Job names must be
+// unique, intervals at least a second, timeouts no longer than intervals,
+// targets host:port addresses, and target files .json, .yml or .yaml.
+func Parse(b []byte) ([]*Config, error) {
+	var doc scrapeConfigs
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("parsing scrape configs: %w", err)
+	}
+
+	names := map[string]struct{}{}
+	configs := make([]*Config, 0, len(doc.ScrapeConfigs))
+	for i, sc := range doc.ScrapeConfigs {
+		if !jobNameRegex.MatchString(sc.JobName) {
+			return nil, fmt.Errorf("job %d name %q: %w", i, sc.JobName, ErrInvalidConfig)
+		}
+		if _, ok := names[sc.JobName]; ok {
+			return nil, fmt.Errorf("job %q is repeated: %w", sc.JobName, ErrInvalidConfig)
+		}
+		names[sc.JobName] = struct{}{}
+
+		c := &Config{
+			JobName:     sc.JobName,
+			Interval:    DefaultInterval,
+			Timeout:     DefaultTimeout,
+			MetricsPath: DefaultMetricsPath,
+			Scheme:      "http",
+			Format:      FormatPrometheus,
+		}
+		if sc.ScrapeInterval != "" {
+			d, err := parser.ParseDuration(sc.ScrapeInterval)
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("job %q interval %q: %w", sc.JobName, sc.ScrapeInterval, ErrInvalidConfig)
+			}
+			c.Interval = d
+		}
+		if c.Timeout > c.Interval {
+			c.Timeout = c.Interval
+		}
+		if sc.ScrapeTimeout != "" {
+			d, err := parser.ParseDuration(sc.ScrapeTimeout)
+			if err != nil || d <= 0 || d > c.Interval {
+				return nil, fmt.Errorf("job %q timeout %q: %w", sc.JobName, sc.ScrapeTimeout, ErrInvalidConfig)
+			}
+			c.Timeout = d
+		}
+		if sc.MetricsPath != "" {
+			if sc.MetricsPath[0] != '/' {
+				return nil, fmt.Errorf("job %q metrics path %q: %w", sc.JobName, sc.MetricsPath, ErrInvalidConfig)
+			}
+			c.MetricsPath = sc.MetricsPath
+		}
+		switch sc.Scheme {
+		case "":
+		case "http", "https":
+			c.Scheme = sc.Scheme
+		default:
+			return nil, fmt.Errorf("job %q scheme %q: %w", sc.JobName, sc.Scheme, ErrInvalidConfig)
+		}
+		switch sc.Format {
+		case "":
+		case FormatPrometheus, FormatKoalemos:
+			c.Format = sc.Format
+		default:
+			return nil, fmt.Errorf("job %q format %q: %w", sc.JobName, sc.Format, ErrInvalidConfig)
+		}
+		for _, doc := range sc.StaticConfigs {
+			tg, err := doc.targetGroup()
+			if err != nil {
+				return nil, fmt.Errorf("job %q: %w", sc.JobName, err)
+			}
+			c.StaticTargets = append(c.StaticTargets, tg)
+		}
+		for _, fc := range sc.FileSDConfigs {
+			sd := FileSDConfig{Files: fc.Files, RefreshInterval: DefaultRefreshInterval}
+			for _, pattern := range fc.Files {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("job %q file %q: %w", sc.JobName, pattern, ErrInvalidConfig)
+				}
+				if ext := filepath.Ext(pattern); ext != ".json" && ext != ".yml" && ext != ".yaml" {
+					return nil, fmt.Errorf("job %q file %q is not .json, .yml or .yaml: %w", sc.JobName, pattern, ErrInvalidConfig)
+				}
+			}
+			if fc.RefreshInterval != "" {
+				d, err := parser.ParseDuration(fc.RefreshInterval)
+				if err != nil || d < time.Second {
+					return nil, fmt.Errorf("job %q refresh interval %q: %w", sc.JobName, fc.RefreshInterval, ErrInvalidConfig)
+				}
+				sd.RefreshInterval = d
+			}
+			c.FileSD = append(c.FileSD, sd)
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// targetGroup validates the targets and labels of doc.
+func (doc targetGroupDoc) targetGroup() (TargetGroup, error) {
+	for _, target := range doc.Targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return TargetGroup{}, fmt.Errorf("target %q is not host:port: %w", target, ErrInvalidConfig)
+		}
+	}
+	for name := range doc.Labels {
+		if !labelNameRegex.MatchString(name) {
+			return TargetGroup{}, fmt.Errorf("label %q is not a valid label name: %w", name, ErrInvalidConfig)
+		}
+	}
+	return TargetGroup{Targets: doc.Targets, Labels: doc.Labels}, nil
+}
@@ -0,0 +1,116 @@
+package scrape
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Parse(t *testing.T) {
+	type Test struct {
+		desc        string
+		input       string
+		expectedErr error
+	}
+
+	tests := []Test{
+		{
+			desc: "[POSITIVE] scrape jobs",
+			input: `
+scrape_configs:
+  - job_name: node
+    scrape_interval: 15s
+    static_configs:
+      - targets: [node-1:9100, node-2:9100]
+        labels:
+          env: prod
+  - job_name: koalemos
+    scrape_interval: 5s
+    metrics_path: /internal/metrics
+    format: koalemos
+    file_sd_configs:
+      - files: [/etc/koalemos/targets/*.json]
+        refresh_interval: 1m
+`,
+		},
+		{
+			desc: "[NEGATIVE] repeated job name",
+			input: `
+scrape_configs:
+  - job_name: node
+  - job_name: node
+`,
+			expectedErr: ErrInvalidConfig,
+		},
+		{
+			desc: "[NEGATIVE] timeout longer than interval",
+			input: `
+scrape_configs:
+  - job_name: node
+    scrape_interval: 15s
+    scrape_timeout: 20s
+`,
+			expectedErr: ErrInvalidConfig,
+		},
+		{
+			desc: "[NEGATIVE] target without a port",
+			input: `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: [node-1]
+`,
+			expectedErr: ErrInvalidConfig,
+		},
+		{
+			desc: "[NEGATIVE] target file neither JSON nor YAML",
+			input: `
+scrape_configs:
+  - job_name: node
+    file_sd_configs:
+      - files: [/etc/koalemos/targets/*]
+`,
+			expectedErr: ErrInvalidConfig,
+		},
+		{
+			desc: "[NEGATIVE] unknown format",
+			input: `
+scrape_configs:
+  - job_name: node
+    format: json
+`,
+			expectedErr: ErrInvalidConfig,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			configs, err := Parse([]byte(tc.input))
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, configs, 2)
+			assert.Equal(t, &Config{
+				JobName:     "node",
+				Interval:    15 * time.Second,
+				Timeout:     DefaultTimeout,
+				MetricsPath: DefaultMetricsPath,
+				Scheme:      "http",
+				Format:      FormatPrometheus,
+				StaticTargets: []TargetGroup{{
+					Targets: []string{"node-1:9100", "node-2:9100"},
+					Labels:  map[string]string{"env": "prod"},
+				}},
+			}, configs[0])
+			// Timeouts are no longer than intervals.
+			assert.Equal(t, 5*time.Second, configs[1].Timeout)
+			assert.Equal(t, "/internal/metrics", configs[1].MetricsPath)
+			assert.Equal(t, FormatKoalemos, configs[1].Format)
+			assert.Equal(t, []FileSDConfig{{Files: []string{"/etc/koalemos/targets/*.json"}, RefreshInterval: time.Minute}}, configs[1].FileSD)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package scrape
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	jobLabel      = "job"
+	instanceLabel = "instance"
+	// exportedLabelPrefix prefixes the names of labels of scraped series
+	// which the labels of their target take the place of.
+	exportedLabelPrefix = "exported_"
+)
+
+// target is a target of a job: the address scraped, and the labels added to
+// the series scraped from it.
+type target struct {
+	address string
+	// labels are the job and instance, the target's address, and the
+	// labels of its group, which may override them.
+	labels map[string]string
+}
+
+// targets returns the targets of groups for the job c. A target repeated
+// with the same labels is scraped once.
+func targets(c *Config, groups []TargetGroup) []*target {
+	var ts []*target
+	seen := map[string]struct{}{}
+	for _, g := range groups {
+		for _, address := range g.Targets {
+			t := &target{
+				address: address,
+				labels:  map[string]string{jobLabel: c.JobName, instanceLabel: address},
+			}
+			for k, v := range g.Labels {
+				t.labels[k] = v
+			}
+			if _, ok := seen[t.key()]; ok {
+				continue
+			}
+			seen[t.key()] = struct{}{}
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// key identifies the target within its job.
+func (t *target) key() string {
+	names := make([]string, 0, len(t.labels))
+	for name := range t.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(t.address)
+	for _, name := range names {
+		sb.WriteString(",")
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(t.labels[name]))
+	}
+	return sb.String()
+}
+
+// labelSet returns the labels of a series scraped from t with the labels
+// labelSet: the target's labels added, and the series' own labels of the
+// same names kept with exportedLabelPrefix.
+func (t *target) labelSet(labelSet map[string]string) map[string]string {
+	out := make(map[string]string, len(labelSet)+len(t.labels))
+	for k, v := range labelSet {
+		if _, ok := t.labels[k]; ok {
+			k = exportedLabelPrefix + k
+		}
+		out[k] = v
+	}
+	for k, v := range t.labels {
+		out[k] = v
+	}
+	return out
+}
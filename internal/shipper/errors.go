@@ -0,0 +1,7 @@
+package shipper
+
+import "errors"
+
+var (
+	ErrInvalidMarkerVersion = errors.New("unsupported shipper marker version")
+)
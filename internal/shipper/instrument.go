@@ -0,0 +1,18 @@
+package shipper
+
+import "github.com/mikanmekan/koalemos/internal/instrument"
+
+// shipperMetrics are the metrics the shipper records about itself.
+type shipperMetrics struct {
+	uploads        *instrument.Counter
+	uploadFailures *instrument.Counter
+}
+
+func newShipperMetrics(r *instrument.Registry) *shipperMetrics {
+	return &shipperMetrics{
+		uploads: r.NewCounter("koalemos_shipper_uploads_total",
+			"Number of blocks uploaded to object storage."),
+		uploadFailures: r.NewCounter("koalemos_shipper_upload_failures_total",
+			"Number of blocks which failed to upload to object storage."),
+	}
+}
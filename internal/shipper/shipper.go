@@ -0,0 +1,319 @@
+// Package shipper uploads the blocks a store persists to object storage.
+package shipper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// MarkerFilename is the file within the data directory recording which
+	// blocks have been shipped.
+	MarkerFilename = "shipper.json"
+	markerVersion  = 1
+
+	metaFilename = "meta.json"
+	tmpSuffix    = ".tmp"
+
+	defaultAttempts = 5
+	defaultBackoff  = time.Second
+	maxBackoff      = time.Minute
+)
+
+// marker is the contents of the marker file.
+type marker struct {
+	Version int `json:"version"`
+	// Uploaded are the blocks which have been shipped, and are still in the
+	// data directory.
+	Uploaded []ulid.ULID `json:"uploaded"`
+}
+
+// Shipper uploads every block persisted to a data directory to a bucket, each
+// block's files under its ULID, e.g. 01HGW2N7Z3Q5X0K9J8R6T4V2B1/index. A
+// block's meta.json is uploaded last, so a block in the bucket is complete
+// once its meta.json exists. Shipped blocks are recorded in a marker file in
+// the data directory so that they are uploaded only once; tombstones added to
+// a block after it was shipped are not uploaded.
+type Shipper struct {
+	logger  log.Logger
+	bucket  objstore.Bucket
+	dir     string
+	metrics *shipperMetrics
+
+	// attempts is how many times an upload is tried before giving up until
+	// the next sync, waiting backoff after the first failure and twice as
+	// long after each further one.
+	attempts int
+	backoff  time.Duration
+}
+
+// New returns a Shipper uploading the blocks in dir to bucket, recording
+// metrics about itself in r, or a registry of its own if r is nil.
+func New(l log.Logger, bucket objstore.Bucket, dir string, r *instrument.Registry) *Shipper {
+	if r == nil {
+		r = instrument.NewRegistry()
+	}
+	return &Shipper{
+		logger:   l,
+		bucket:   bucket,
+		dir:      dir,
+		metrics:  newShipperMetrics(r),
+		attempts: defaultAttempts,
+		backoff:  defaultBackoff,
+	}
+}
+
+// Run syncs every interval until ctx is done.
+func (s *Shipper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Sync(ctx); err != nil {
+				s.logger.Error("failed to ship blocks", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Sync uploads the blocks in the data directory which have not been shipped
+// yet, oldest first, returning how many were uploaded. Blocks which fail to
+// upload are tried again by the next sync.
+func (s *Shipper) Sync(ctx context.Context) (int, error) {
+	m, err := s.readMarker()
+	if err != nil {
+		return 0, err
+	}
+	shipped := map[ulid.ULID]struct{}{}
+	for _, id := range m.Uploaded {
+		shipped[id] = struct{}{}
+	}
+
+	blocks, err := s.blocks()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		uploaded []ulid.ULID
+		n        int
+		errs     []error
+	)
+	for _, id := range blocks {
+		if _, ok := shipped[id]; ok {
+			uploaded = append(uploaded, id)
+			continue
+		}
+		err := s.upload(ctx, id)
+		switch {
+		case err == nil:
+			uploaded = append(uploaded, id)
+			n++
+			s.metrics.uploads.Inc()
+			s.logger.Info("shipped block", zap.String("ulid", id.String()))
+		case errors.Is(err, fs.ErrNotExist):
+			// The store deleted the block, e.g. having compacted it,
+			// while it was being uploaded.
+			s.logger.Info("block deleted before it was shipped", zap.String("ulid", id.String()))
+			s.deleteUploaded(ctx, id)
+		default:
+			s.metrics.uploadFailures.Inc()
+			errs = append(errs, fmt.Errorf("shipping block %s: %w", id, err))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	// Blocks no longer in the data directory are dropped from the marker,
+	// which only has to keep them from being shipped twice.
+	if err := s.writeMarker(&marker{Uploaded: uploaded}); err != nil {
+		errs = append(errs, err)
+	}
+	return n, errors.Join(errs...)
+}
+
+// blocks returns the ULIDs of the complete blocks in the data directory in
+// ascending order, i.e. oldest first.
+func (s *Shipper) blocks() ([]ulid.ULID, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing blocks: %w", err)
+	}
+
+	var ids []ulid.ULID
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, err := ulid.ParseStrict(e.Name())
+		if err != nil {
+			continue
+		}
+		// Blocks are renamed into place once complete, so any block
+		// directory with a meta.json can be shipped.
+		if _, err := os.Stat(filepath.Join(s.dir, e.Name(), metaFilename)); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+	return ids, nil
+}
+
+// upload uploads the files of the block with retries, meta.json last.
+func (s *Shipper) upload(ctx context.Context, id ulid.ULID) error {
+	dir := filepath.Join(s.dir, id.String())
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(p, tmpSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel != metaFilename {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	files = append(files, metaFilename)
+
+	for _, f := range files {
+		name := path.Join(id.String(), f)
+		err := s.retry(ctx, func() error {
+			return s.uploadFile(ctx, filepath.Join(dir, filepath.FromSlash(f)), name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Shipper) uploadFile(ctx context.Context, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.bucket.Put(ctx, name, f)
+}
+
+// retry calls fn until it succeeds, fails attempts times, or fails because
+// the file it uploads no longer exists.
+func (s *Shipper) retry(ctx context.Context, fn func() error) error {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || errors.Is(err, fs.ErrNotExist) || attempt == s.attempts {
+			return err
+		}
+		s.logger.Warn("upload failed, retrying", zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// deleteUploaded removes the objects of a partially uploaded block from the
+// bucket.
+func (s *Shipper) deleteUploaded(ctx context.Context, id ulid.ULID) {
+	names, err := s.bucket.List(ctx, id.String()+"/")
+	if err != nil {
+		s.logger.Warn("failed to list partially uploaded block", zap.String("ulid", id.String()), zap.Error(err))
+		return
+	}
+	for _, name := range names {
+		if err := s.bucket.Delete(ctx, name); err != nil {
+			s.logger.Warn("failed to delete partially uploaded block", zap.String("ulid", id.String()), zap.Error(err))
+			return
+		}
+	}
+}
+
+func (s *Shipper) readMarker() (*marker, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, MarkerFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &marker{Version: markerVersion}, nil
+		}
+		return nil, fmt.Errorf("reading shipper marker: %w", err)
+	}
+
+	var m marker
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decoding shipper marker: %w", err)
+	}
+	if m.Version != markerVersion {
+		return nil, fmt.Errorf("shipper marker version %d: %w", m.Version, ErrInvalidMarkerVersion)
+	}
+	return &m, nil
+}
+
+// writeMarker replaces the marker file atomically.
+func (s *Shipper) writeMarker(m *marker) error {
+	m.Version = markerVersion
+	if m.Uploaded == nil {
+		m.Uploaded = []ulid.ULID{}
+	}
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding shipper marker: %w", err)
+	}
+
+	p := filepath.Join(s.dir, MarkerFilename)
+	if err := writeFileSync(p+tmpSuffix, b); err != nil {
+		return fmt.Errorf("writing shipper marker: %w", err)
+	}
+	if err := os.Rename(p+tmpSuffix, p); err != nil {
+		return fmt.Errorf("writing shipper marker: %w", err)
+	}
+	return nil
+}
+
+// writeFileSync writes b to a new file at path and fsyncs it.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
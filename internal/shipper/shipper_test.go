@@ -0,0 +1,142 @@
+package shipper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBlock persists a block of one sample at t to dir.
+func writeBlock(t *testing.T, dir string, ts int64) *block.Meta {
+	t.Helper()
+	meta, err := block.Write(dir, ts, ts+1, metrics.NewListSeriesSet([]metrics.Series{&metrics.ListSeries{
+		Def:     metrics.MetricDefinition{Name: "up"},
+		Labels:  map[string]string{"job": "a"},
+		Samples: []metrics.Sample{{Time: ts, Value: 1}},
+	}}))
+	require.NoError(t, err)
+	return meta
+}
+
+// flakyBucket fails the first failures puts.
+type flakyBucket struct {
+	objstore.Bucket
+	failures int
+	puts     []string
+}
+
+func (b *flakyBucket) Put(ctx context.Context, name string, r io.Reader) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("unavailable")
+	}
+	b.puts = append(b.puts, name)
+	return b.Bucket.Put(ctx, name, r)
+}
+
+func newTestShipper(t *testing.T, dir string, failures int) (*Shipper, *flakyBucket) {
+	fs, err := objstore.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+	bucket := &flakyBucket{Bucket: fs, failures: failures}
+
+	s := New(log.NewLogger(), bucket, dir, instrument.NewRegistry())
+	s.attempts, s.backoff = 2, 0
+	return s, bucket
+}
+
+func Test_Sync(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	first := writeBlock(t, dir, 100)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "wal"), 0o777))
+
+	s, bucket := newTestShipper(t, dir, 0)
+	n, err := s.Sync(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Every file of the block is uploaded, meta.json last.
+	local, err := filepath.Glob(filepath.Join(dir, first.ULID.String(), "*", "*"))
+	require.NoError(t, err)
+	names, err := bucket.List(ctx, first.ULID.String()+"/")
+	require.NoError(t, err)
+	assert.Len(t, names, len(local)+2, "chunk segments, index and meta.json")
+	assert.Equal(t, first.ULID.String()+"/meta.json", bucket.puts[len(bucket.puts)-1])
+
+	// Shipped blocks are not uploaded again, even by a new shipper.
+	second := writeBlock(t, dir, 200)
+	bucket.puts = nil
+	s, _ = newTestShipper(t, dir, 0)
+	s.bucket = bucket
+	n, err = s.Sync(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	for _, name := range bucket.puts {
+		assert.True(t, strings.HasPrefix(name, second.ULID.String()+"/"), name)
+	}
+
+	// Blocks deleted locally are dropped from the marker.
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, first.ULID.String())))
+	_, err = s.Sync(ctx)
+	require.NoError(t, err)
+	m, err := s.readMarker()
+	require.NoError(t, err)
+	assert.Equal(t, []string{second.ULID.String()}, ulidStrings(m))
+}
+
+func Test_SyncRetries(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	meta := writeBlock(t, dir, 100)
+
+	tcs := []struct {
+		desc             string
+		failures         int
+		expectedUploaded int
+		expectedErr      bool
+	}{
+		{desc: "[POSITIVE] a failed upload is retried", failures: 1, expectedUploaded: 1},
+		{desc: "[NEGATIVE] the block is left for the next sync once attempts run out", failures: 2, expectedErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.NoError(t, os.RemoveAll(filepath.Join(dir, MarkerFilename)))
+			s, bucket := newTestShipper(t, dir, tc.failures)
+
+			n, err := s.Sync(ctx)
+			if tc.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedUploaded, n)
+
+			// The next sync ships the block either way.
+			n, err = s.Sync(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 1-tc.expectedUploaded, n)
+			_, err = bucket.Get(ctx, meta.ULID.String()+"/meta.json")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func ulidStrings(m *marker) []string {
+	var res []string
+	for _, id := range m.Uploaded {
+		res = append(res, id.String())
+	}
+	return res
+}
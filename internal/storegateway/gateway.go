@@ -0,0 +1,281 @@
+// Package storegateway serves queries over the blocks shipped to object
+// storage, so that long-term data need not be kept on local disk.
+package storegateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+const metaFilename = "meta.json"
+
+// Gateway serves queries over the raw blocks in a bucket, reading them
+// through block.BucketReaders whose index headers are cached in a local
+// directory. The blocks served are refreshed by Sync: blocks compacted or
+// rewritten into another block in the bucket are replaced by it, and
+// downsampled blocks are not served.
+type Gateway struct {
+	logger   log.Logger
+	bucket   objstore.Bucket
+	cacheDir string
+	metrics  *gatewayMetrics
+
+	// syncMtx serialises syncs.
+	syncMtx sync.Mutex
+	// metas holds the metadata of every complete block in the bucket, so
+	// that it is read only once.
+	metas map[ulid.ULID]*block.Meta
+
+	mtx    sync.RWMutex
+	blocks map[ulid.ULID]*block.BucketReader
+}
+
+// New returns a Gateway over the blocks in bucket, caching index headers in
+// cacheDir and recording metrics about itself in r, or a registry of its own
+// if r is nil. No blocks are served until the first Sync.
+func New(l log.Logger, bucket objstore.Bucket, cacheDir string, r *instrument.Registry) *Gateway {
+	if r == nil {
+		r = instrument.NewRegistry()
+	}
+	return &Gateway{
+		logger:   l,
+		bucket:   bucket,
+		cacheDir: cacheDir,
+		metrics:  newGatewayMetrics(r),
+		blocks:   map[ulid.ULID]*block.BucketReader{},
+		metas:    map[ulid.ULID]*block.Meta{},
+	}
+}
+
+// Run syncs every interval until ctx is done.
+func (g *Gateway) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := g.Sync(ctx); err != nil {
+				g.logger.Error("failed to sync blocks from bucket", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Sync lists the blocks in the bucket, opening those which should be served
+// and closing those which should no longer be. Blocks which fail to open are
+// tried again by the next sync.
+func (g *Gateway) Sync(ctx context.Context) error {
+	g.syncMtx.Lock()
+	defer g.syncMtx.Unlock()
+
+	ids, err := g.listBlocks(ctx)
+	if err != nil {
+		g.metrics.syncFailures.Inc()
+		return err
+	}
+
+	var errs []error
+	present := make(map[ulid.ULID]struct{}, len(ids))
+	for _, id := range ids {
+		present[id] = struct{}{}
+		if _, ok := g.metas[id]; ok {
+			continue
+		}
+		meta, err := g.readMeta(ctx, id)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		g.metas[id] = meta
+	}
+	for id := range g.metas {
+		if _, ok := present[id]; !ok {
+			delete(g.metas, id)
+		}
+	}
+
+	wanted := servedBlocks(g.metas)
+	for id := range wanted {
+		g.mtx.RLock()
+		_, ok := g.blocks[id]
+		g.mtx.RUnlock()
+		if ok {
+			continue
+		}
+		r, err := block.OpenBucket(ctx, g.bucket, id, g.cacheDir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		g.mtx.Lock()
+		g.blocks[id] = r
+		g.mtx.Unlock()
+		g.logger.Info("loaded block from bucket", zap.String("ulid", id.String()))
+	}
+
+	g.mtx.Lock()
+	var unloaded []*block.BucketReader
+	for id, r := range g.blocks {
+		if _, ok := wanted[id]; !ok {
+			unloaded = append(unloaded, r)
+			delete(g.blocks, id)
+		}
+	}
+	g.metrics.blocksLoaded.Set(float64(len(g.blocks)))
+	g.mtx.Unlock()
+
+	for _, r := range unloaded {
+		errs = append(errs, r.Close())
+		g.logger.Info("unloaded block", zap.String("ulid", r.Meta().ULID.String()))
+	}
+	errs = append(errs, g.removeStaleIndexHeaders())
+	if err := errors.Join(errs...); err != nil {
+		g.metrics.syncFailures.Inc()
+		return err
+	}
+	return nil
+}
+
+// listBlocks returns the blocks in the bucket with a meta.json, i.e. those
+// uploaded completely.
+func (g *Gateway) listBlocks(ctx context.Context) ([]ulid.ULID, error) {
+	names, err := g.bucket.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing bucket: %w", err)
+	}
+	var ids []ulid.ULID
+	for _, name := range names {
+		dir, file, ok := strings.Cut(name, "/")
+		if !ok || file != metaFilename {
+			continue
+		}
+		if id, err := ulid.ParseStrict(dir); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (g *Gateway) readMeta(ctx context.Context, id ulid.ULID) (*block.Meta, error) {
+	// Opening the block reads its meta.json again, but only blocks which
+	// are served are opened.
+	r, err := g.bucket.Get(ctx, path.Join(id.String(), metaFilename))
+	if err != nil {
+		return nil, fmt.Errorf("reading meta of block %s: %w", id, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading meta of block %s: %w", id, err)
+	}
+	meta, err := block.DecodeMeta(b)
+	if err != nil {
+		return nil, fmt.Errorf("reading meta of block %s: %w", id, err)
+	}
+	return meta, nil
+}
+
+// servedBlocks returns the raw blocks which no other block was compacted or
+// rewritten from.
+func servedBlocks(metas map[ulid.ULID]*block.Meta) map[ulid.ULID]struct{} {
+	replaced := map[ulid.ULID]struct{}{}
+	for _, m := range metas {
+		for _, p := range m.Compaction.Parents {
+			replaced[p] = struct{}{}
+		}
+	}
+	served := map[ulid.ULID]struct{}{}
+	for id, m := range metas {
+		if _, ok := replaced[id]; !ok && m.Downsample == nil {
+			served[id] = struct{}{}
+		}
+	}
+	return served
+}
+
+// Querier returns a Querier over the raw samples of the blocks served. The
+// querier must be closed once the caller is done with its results.
+func (g *Gateway) Querier() (metrics.Querier, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	readers := make([]*block.BucketReader, 0, len(g.blocks))
+	for _, r := range g.blocks {
+		readers = append(readers, r)
+	}
+	sort.Slice(readers, func(i, j int) bool {
+		return readers[i].Meta().MinTime < readers[j].Meta().MinTime
+	})
+
+	queriers := make([]metrics.Querier, 0, len(readers))
+	for _, r := range readers {
+		q, err := r.Querier()
+		if err != nil {
+			metrics.NewMergeQuerier(queriers...).Close()
+			return nil, fmt.Errorf("opening block querier: %w", err)
+		}
+		queriers = append(queriers, q)
+	}
+	return metrics.NewMergeQuerier(queriers...), nil
+}
+
+// Close closes the blocks served, waiting for open queriers to finish. The
+// cached index headers are kept for the next run.
+func (g *Gateway) Close() error {
+	g.mtx.Lock()
+	blocks := g.blocks
+	g.blocks = map[ulid.ULID]*block.BucketReader{}
+	g.mtx.Unlock()
+
+	var errs []error
+	for _, r := range blocks {
+		errs = append(errs, r.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// removeStaleIndexHeaders removes the cached index headers of blocks which
+// are not served, including those of blocks deleted from the bucket while
+// the gateway was not running.
+func (g *Gateway) removeStaleIndexHeaders() error {
+	entries, err := os.ReadDir(g.cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("listing index header cache: %w", err)
+	}
+
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	var errs []error
+	for _, e := range entries {
+		id, err := ulid.ParseStrict(e.Name())
+		if err != nil {
+			continue
+		}
+		if _, ok := g.blocks[id]; !ok {
+			errs = append(errs, block.RemoveIndexHeader(g.cacheDir, id))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+package storegateway
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikanmekan/koalemos/internal/instrument"
+	"github.com/mikanmekan/koalemos/internal/log"
+	"github.com/mikanmekan/koalemos/internal/metrics"
+	"github.com/mikanmekan/koalemos/internal/metrics/block"
+	"github.com/mikanmekan/koalemos/internal/metrics/compact"
+	"github.com/mikanmekan/koalemos/internal/objstore"
+	"github.com/mikanmekan/koalemos/internal/shipper"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBlock persists a block of one sample at ts to dir.
+func writeBlock(t *testing.T, dir string, ts int64, v float64) *block.Meta {
+	t.Helper()
+	meta, err := block.Write(dir, ts, ts+100, metrics.NewListSeriesSet([]metrics.Series{&metrics.ListSeries{
+		Def:     metrics.MetricDefinition{Name: "up", Type: "gauge"},
+		Labels:  map[string]string{"job": "a"},
+		Samples: []metrics.Sample{{Time: ts, Value: v}},
+	}}))
+	require.NoError(t, err)
+	return meta
+}
+
+// loaded returns the blocks g serves.
+func loaded(g *Gateway) []ulid.ULID {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	var ids []ulid.ULID
+	for id := range g.blocks {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// querySamples returns the samples of the series up{job="a"} served by g.
+func querySamples(t *testing.T, g *Gateway) []metrics.Sample {
+	t.Helper()
+	q, err := g.Querier()
+	require.NoError(t, err)
+	defer q.Close()
+
+	set := q.Select(0, 1000, metrics.MustNewMatcher(metrics.MatchEqual, "job", "a"))
+	var samples []metrics.Sample
+	for set.Next() {
+		s, err := metrics.ExpandSamples(set.At().Iterator())
+		require.NoError(t, err)
+		samples = append(samples, s...)
+	}
+	require.NoError(t, set.Err())
+	return samples
+}
+
+func Test_Gateway(t *testing.T) {
+	ctx := context.Background()
+	dataDir, cacheDir := t.TempDir(), t.TempDir()
+	bucket, err := objstore.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	first := writeBlock(t, dataDir, 0, 1)
+	second := writeBlock(t, dataDir, 100, 2)
+	var readers []*block.Reader
+	for _, m := range []*block.Meta{first, second} {
+		r, err := block.Open(filepath.Join(dataDir, m.ULID.String()))
+		require.NoError(t, err)
+		readers = append(readers, r)
+	}
+	compacted, err := compact.NewCompactor(compact.DefaultRanges(100)).Compact(dataDir, readers)
+	require.NoError(t, err)
+	for _, r := range readers {
+		require.NoError(t, r.Close())
+	}
+	_, err = shipper.New(log.NewLogger(), bucket, dataDir, instrument.NewRegistry()).Sync(ctx)
+	require.NoError(t, err)
+
+	g := New(log.NewLogger(), bucket, cacheDir, instrument.NewRegistry())
+	defer g.Close()
+	require.NoError(t, g.Sync(ctx))
+
+	// The compacted block replaces its parents.
+	assert.Equal(t, []ulid.ULID{compacted.ULID}, loaded(g))
+	assert.Equal(t, []metrics.Sample{{Time: 0, Value: 1}, {Time: 100, Value: 2}}, querySamples(t, g))
+	assert.FileExists(t, filepath.Join(cacheDir, compacted.ULID.String(), block.IndexHeaderFilename))
+
+	// Once the compacted block is deleted from the bucket its parents are
+	// served again, and its cached index header is removed.
+	names, err := bucket.List(ctx, compacted.ULID.String()+"/")
+	require.NoError(t, err)
+	for _, name := range names {
+		require.NoError(t, bucket.Delete(ctx, name))
+	}
+	require.NoError(t, g.Sync(ctx))
+	assert.ElementsMatch(t, []ulid.ULID{first.ULID, second.ULID}, loaded(g))
+	assert.Equal(t, []metrics.Sample{{Time: 0, Value: 1}, {Time: 100, Value: 2}}, querySamples(t, g))
+	assert.NoDirExists(t, filepath.Join(cacheDir, compacted.ULID.String()))
+
+	// A block without a meta.json has not been uploaded completely.
+	partial := writeBlock(t, t.TempDir(), 200, 3)
+	require.NoError(t, bucket.Put(ctx, path.Join(partial.ULID.String(), "index"), strings.NewReader("")))
+	require.NoError(t, g.Sync(ctx))
+	assert.Len(t, loaded(g), 2)
+}
@@ -0,0 +1,18 @@
+package storegateway
+
+import "github.com/mikanmekan/koalemos/internal/instrument"
+
+// gatewayMetrics are the metrics the gateway records about itself.
+type gatewayMetrics struct {
+	blocksLoaded *instrument.Gauge
+	syncFailures *instrument.Counter
+}
+
+func newGatewayMetrics(r *instrument.Registry) *gatewayMetrics {
+	return &gatewayMetrics{
+		blocksLoaded: r.NewGauge("koalemos_storegateway_blocks_loaded",
+			"Number of blocks in object storage served by the store gateway."),
+		syncFailures: r.NewCounter("koalemos_storegateway_sync_failures_total",
+			"Number of syncs of the blocks in object storage which failed."),
+	}
+}